@@ -0,0 +1,578 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"pppoe-probe/auth"
+	"pppoe-probe/goroutine"
+	"pppoe-probe/handler"
+	"pppoe-probe/metrics"
+	"pppoe-probe/vault"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server 基于 handler.Handler 的 HTTP/JSON 控制接口，用于无界面远程控制探测。
+//
+//	GET    /api/adapters                    列出可用网卡
+//	GET    /api/handlers                    列出运行中的处理器
+//	POST   /api/handlers                    启动处理器，Content-Type: application/json，body: {"adapter": "eth0", "ac_name": "...", "vlans": [7, 35], "passive": false}
+//	DELETE /api/handlers/{adapter}          停止处理器
+//	GET    /api/handlers/{adapter}/sessions 当前各对端的会话状态，旁路监听模式下为监听到的会话
+//	GET    /api/handlers/{adapter}/acs      网段上发现的所有 AC
+//	GET    /api/credentials                 已捕获的凭据，最多保留 maxCaptures 条
+//	GET    /api/vault                       凭据库中的凭据，不含密码，需先调用 SetVault
+//	GET    /api/vault/export                以明文导出凭据库，?format=json（默认，每行一个）或 csv
+//	DELETE /api/vault/{id}                  从凭据库中删除一条凭据
+//	GET    /api/events                      以 Server-Sent Events 推送事件，可用 ?adapter= 过滤
+//	GET    /metrics                         Prometheus 指标，需先调用 SetMetrics
+//
+// 事件格式为 handler.JSONEvent 加上 handler 字段（启动时使用的网卡名）。
+//
+// 调用 SetToken 后所有接口都需要携带 Authorization: Bearer <token>，否则返回 401。
+// 不设置 token 时只接受来自本机回环地址、Host 为回环地址或 localhost、没有 Origin 或 Origin 为本机的请求，
+// 防止浏览器跨站请求和 DNS 重绑定，并且拒绝 /api/credentials、/api/vault 下的凭据接口和携带密码的 /api/events。
+type Server struct {
+	mux       *http.ServeMux
+	token     string
+	metrics   *metrics.Collector
+	vault     *vault.Vault
+	redaction handler.Redaction
+
+	mu       sync.Mutex
+	handlers map[string]*runningHandler
+	captures []Capture
+	subs     map[chan Event]struct{}
+}
+
+// maxCaptures /api/credentials 保留的凭据数，超出后丢弃最早的
+const maxCaptures = 1000
+
+// Capture 捕获到的一组凭据
+type Capture struct {
+	Time       time.Time `json:"time"`
+	Handler    string    `json:"handler"`
+	AdapterMac string    `json:"adapter_mac"`
+	PeerMac    string    `json:"peer_mac"`
+	PeerID     string    `json:"peer_id"`
+	Password   string    `json:"password"`
+	Method     string    `json:"method,omitempty"`
+	Vlan       string    `json:"vlan,omitempty"`
+}
+
+// Event 推送给 SSE 订阅者的事件
+type Event struct {
+	Handler string `json:"handler"`
+	handler.JSONEvent
+}
+
+// HandlerInfo 运行中的处理器
+type HandlerInfo struct {
+	Adapter    string    `json:"adapter"`
+	AdapterMac string    `json:"adapter_mac"`
+	AcName     string    `json:"ac_name"`
+	Vlans      []uint16  `json:"vlans,omitempty"`
+	Passive    bool      `json:"passive"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+type runningHandler struct {
+	info HandlerInfo
+	h    *handler.Handler
+	done chan struct{}
+}
+
+type startRequest struct {
+	Adapter string   `json:"adapter"`
+	AcName  string   `json:"ac_name"`
+	Vlans   []uint16 `json:"vlans"`
+	Passive bool     `json:"passive"`
+}
+
+func NewServer() *Server {
+	s := &Server{
+		mux:      http.NewServeMux(),
+		handlers: make(map[string]*runningHandler),
+		subs:     make(map[chan Event]struct{}),
+	}
+	s.mux.HandleFunc("GET /api/adapters", s.listAdapters)
+	s.mux.HandleFunc("GET /api/handlers", s.listHandlers)
+	s.mux.HandleFunc("POST /api/handlers", s.startHandler)
+	s.mux.HandleFunc("DELETE /api/handlers/{adapter}", s.stopHandler)
+	s.mux.HandleFunc("GET /api/handlers/{adapter}/sessions", s.listSessions)
+	s.mux.HandleFunc("GET /api/handlers/{adapter}/acs", s.listACs)
+	s.mux.HandleFunc("GET /api/credentials", s.listCredentials)
+	s.mux.HandleFunc("GET /api/events", s.streamEvents)
+	return s
+}
+
+// SetMetrics 开启统计，之后启动的处理器都会上报到 c，并通过 /metrics 输出。只能调用一次。
+func (s *Server) SetMetrics(c *metrics.Collector) {
+	s.metrics = c
+	s.mux.Handle("GET /metrics", c)
+}
+
+// SetVault 之后捕获到的凭据同时加密保存到 v，并开启 /api/vault 接口。只能调用一次。
+func (s *Server) SetVault(v *vault.Vault) {
+	s.vault = v
+	s.mux.HandleFunc("GET /api/vault", s.listVault)
+	s.mux.HandleFunc("GET /api/vault/export", s.exportVault)
+	s.mux.HandleFunc("DELETE /api/vault/{id}", s.deleteVault)
+}
+
+// SetRedaction 设置之后启动的处理器的密码脱敏策略，事件和 /api/captures 中的密码按该策略输出，
+// 凭据库中仍保存明文。需在 Start 之前调用。
+func (s *Server) SetRedaction(r handler.Redaction) {
+	s.redaction = r
+}
+
+// SetToken 设置 bearer token，之后所有接口都需要认证。需在开始服务之前调用。
+func (s *Server) SetToken(token string) {
+	s.token = token
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r) {
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorize 检查请求是否允许访问，不允许时写入 401 或 403 并返回 false
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if s.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pppoe-probe"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return false
+		}
+		return true
+	}
+	if !isLoopback(r.RemoteAddr) {
+		writeError(w, http.StatusForbidden, errors.New("remote access requires a bearer token"))
+		return false
+	}
+	if !isLoopbackHost(r.Host) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("host %s requires a bearer token", r.Host))
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !isLoopbackHost(u.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("origin %s requires a bearer token", origin))
+			return false
+		}
+	}
+	if r.URL.Path == "/api/credentials" || r.URL.Path == "/api/events" || r.URL.Path == "/api/vault" || strings.HasPrefix(r.URL.Path, "/api/vault/") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pppoe-probe"`)
+		writeError(w, http.StatusUnauthorized, errors.New("credential endpoints require a bearer token"))
+		return false
+	}
+	return true
+}
+
+// isLoopback remoteAddr 是否为本机回环地址
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isLoopbackHost Host 头或 Origin 中的主机（可带端口）是否为 localhost 或回环地址
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Start 启动指定网卡的处理器，acName 为空时使用默认值，vlans 为空时应答所有 VLAN，
+// passive 为 true 时以旁路监听模式启动。
+func (s *Server) Start(adapter string, acName string, vlans []uint16, passive bool) (info HandlerInfo, err error) {
+	s.mu.Lock()
+	_, ok := s.handlers[adapter]
+	s.mu.Unlock()
+	if ok {
+		err = fmt.Errorf("handler for %s already running", adapter)
+		return
+	}
+	if acName == "" {
+		acName = handler.NovaDefaultAcName
+	}
+
+	newHandler := handler.NewHandlerByName
+	if passive {
+		newHandler = handler.NewMonitorByName
+	}
+	h, err := newHandler(adapter, func(e handler.Event, args ...interface{}) {
+		s.onEvent(adapter, e, args...)
+	})
+	if err != nil {
+		return
+	}
+	h.SetAcName(acName)
+	h.SetMetrics(s.metrics)
+	if err = h.SetTrackACs(true); err != nil {
+		h.Close()
+		return
+	}
+	h.SetRedaction(s.redaction)
+	if len(vlans) > 0 {
+		h.SetVlans(vlans...)
+	}
+
+	rh := &runningHandler{
+		info: HandlerInfo{
+			Adapter:    adapter,
+			AdapterMac: net.HardwareAddr(h.AdapterMac()).String(),
+			AcName:     acName,
+			Vlans:      vlans,
+			Passive:    passive,
+			StartedAt:  time.Now(),
+		},
+		h:    h,
+		done: make(chan struct{}),
+	}
+	s.mu.Lock()
+	if _, ok = s.handlers[adapter]; ok {
+		s.mu.Unlock()
+		h.Close()
+		err = fmt.Errorf("handler for %s already running", adapter)
+		return
+	}
+	s.handlers[adapter] = rh
+	s.mu.Unlock()
+
+	goroutine.Go(func() {
+		defer close(rh.done)
+		h.Run()
+	})
+	info = rh.info
+	return
+}
+
+// Stop 停止指定网卡的处理器，会阻塞到处理器退出。
+func (s *Server) Stop(adapter string) error {
+	s.mu.Lock()
+	rh, ok := s.handlers[adapter]
+	delete(s.handlers, adapter)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("handler for %s not running", adapter)
+	}
+	rh.h.Close()
+	<-rh.done
+	return nil
+}
+
+// Close 停止所有处理器
+func (s *Server) Close() {
+	s.mu.Lock()
+	var adapters []string
+	for adapter := range s.handlers {
+		adapters = append(adapters, adapter)
+	}
+	s.mu.Unlock()
+	for _, adapter := range adapters {
+		_ = s.Stop(adapter)
+	}
+}
+
+// Captures 返回已捕获的凭据
+func (s *Server) Captures() []Capture {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Capture(nil), s.captures...)
+}
+
+func (s *Server) onEvent(adapter string, e handler.Event, args ...interface{}) {
+	ev := Event{
+		Handler:   adapter,
+		JSONEvent: handler.NewJSONEvent(e, args...),
+	}
+	// CHAP 没有明文密码，不保存到凭据库
+	if e == handler.EventSessionAuthCaptured && ev.Method != auth.MethodCHAP && s.vault != nil {
+		_, err := s.vault.Add(vault.Credential{
+			CapturedAt: ev.Time,
+			Adapter:    ev.Adapter,
+			PeerMac:    ev.Peer,
+			Vlan:       ev.Vlan,
+			Method:     ev.Method,
+			Username:   ev.PeerID,
+			Password:   ev.RevealPassword(),
+		})
+		if err != nil {
+			logrus.Errorln("failed to save credential to vault", err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e == handler.EventSessionAuthCaptured {
+		if len(s.captures) >= maxCaptures {
+			s.captures = append(s.captures[:0], s.captures[len(s.captures)-maxCaptures+1:]...)
+		}
+		s.captures = append(s.captures, Capture{
+			Time:       ev.Time,
+			Handler:    adapter,
+			AdapterMac: ev.Adapter,
+			PeerMac:    ev.Peer,
+			PeerID:     ev.PeerID,
+			Password:   ev.Password,
+			Method:     ev.Method,
+			Vlan:       ev.Vlan,
+		})
+	}
+	for ch := range s.subs {
+		select {
+		case ch <- ev:
+		default:
+			logrus.Warnln("api event subscriber too slow, drop event", ev.Event)
+		}
+	}
+}
+
+func (s *Server) subscribe() chan Event {
+	ch := make(chan Event, 64)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *Server) unsubscribe(ch chan Event) {
+	s.mu.Lock()
+	delete(s.subs, ch)
+	s.mu.Unlock()
+}
+
+func (s *Server) runningHandler(adapter string) (rh *runningHandler, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rh, ok = s.handlers[adapter]
+	return
+}
+
+func (s *Server) listAdapters(w http.ResponseWriter, r *http.Request) {
+	adapters, err := handler.ListAdapters()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	type adapterInfo struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Mac         string `json:"mac"`
+		MTU         int    `json:"mtu"`
+		Up          bool   `json:"up"`
+		Running     bool   `json:"running"`
+		PcapDevice  string `json:"pcap_device"`
+	}
+	infos := make([]adapterInfo, 0, len(adapters))
+	for _, a := range adapters {
+		infos = append(infos, adapterInfo{
+			Name:        a.Name,
+			Description: a.Description,
+			Mac:         net.HardwareAddr(a.Mac).String(),
+			MTU:         a.MTU,
+			Up:          a.Up,
+			Running:     a.Running,
+			PcapDevice:  a.PcapDevice,
+		})
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) listHandlers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	infos := make([]HandlerInfo, 0, len(s.handlers))
+	for _, rh := range s.handlers {
+		infos = append(infos, rh.info)
+	}
+	s.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Adapter < infos[j].Adapter
+	})
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) startHandler(w http.ResponseWriter, r *http.Request) {
+	// 浏览器跨站提交表单时无法设置该类型
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+		return
+	}
+	var req startRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Adapter == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing adapter"))
+		return
+	}
+	info, err := s.Start(req.Adapter, req.AcName, req.Vlans, req.Passive)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *Server) stopHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.Stop(r.PathValue("adapter")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	rh, ok := s.runningHandler(r.PathValue("adapter"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("handler for %s not running", r.PathValue("adapter")))
+		return
+	}
+	if rh.h.Passive() {
+		monitored := rh.h.MonitoredSessions()
+		sort.Slice(monitored, func(i, j int) bool {
+			return monitored[i].StartedAt.Before(monitored[j].StartedAt)
+		})
+		if monitored == nil {
+			monitored = []handler.MonitoredSession{}
+		}
+		writeJSON(w, http.StatusOK, monitored)
+		return
+	}
+	sessions := rh.h.Sessions()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+	if sessions == nil {
+		sessions = []handler.Session{}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) listACs(w http.ResponseWriter, r *http.Request) {
+	rh, ok := s.runningHandler(r.PathValue("adapter"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("handler for %s not running", r.PathValue("adapter")))
+		return
+	}
+	acs := rh.h.ACs()
+	sort.Slice(acs, func(i, j int) bool {
+		return acs[i].FirstSeen.Before(acs[j].FirstSeen)
+	})
+	if acs == nil {
+		acs = []handler.ACInfo{}
+	}
+	writeJSON(w, http.StatusOK, acs)
+}
+
+func (s *Server) listCredentials(w http.ResponseWriter, r *http.Request) {
+	captures := s.Captures()
+	if captures == nil {
+		captures = []Capture{}
+	}
+	writeJSON(w, http.StatusOK, captures)
+}
+
+func (s *Server) listVault(w http.ResponseWriter, r *http.Request) {
+	credentials := s.vault.List()
+	for i := range credentials {
+		credentials[i].Password = ""
+	}
+	if credentials == nil {
+		credentials = []vault.Credential{}
+	}
+	writeJSON(w, http.StatusOK, credentials)
+}
+
+func (s *Server) exportVault(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", vault.FormatJSON:
+		format = vault.FormatJSON
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case vault.FormatCSV:
+		w.Header().Set("Content-Type", "text/csv")
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %s", format))
+		return
+	}
+	if err := s.vault.Export(w, format); err != nil {
+		logrus.Errorln("export vault", err)
+	}
+}
+
+func (s *Server) deleteVault(w http.ResponseWriter, r *http.Request) {
+	err := s.vault.Delete(r.PathValue("id"))
+	switch {
+	case errors.Is(err, vault.ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+	filter := r.URL.Query().Get("adapter")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			if filter != "" && filter != ev.Handler {
+				continue
+			}
+			bs, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Event, bs)
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"pppoe-probe/handler"
+	"pppoe-probe/metrics"
+	"pppoe-probe/vault"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRequest 以 remoteAddr 为来源、Host 为本机的请求，token 不为空时携带 bearer token，有 body 时为 JSON
+func newRequest(method string, target string, remoteAddr string, token string, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	r.Host = "127.0.0.1:8080"
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+func serve(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func do(s *Server, method string, target string, remoteAddr string, token string, body string) *httptest.ResponseRecorder {
+	return serve(s, newRequest(method, target, remoteAddr, token, body))
+}
+
+const (
+	localAddr  = "127.0.0.1:52000"
+	remoteAddr = "192.0.2.10:52000"
+)
+
+func TestServer_Routes(t *testing.T) {
+	s := NewServer()
+	tests := []struct {
+		method string
+		target string
+		body   string
+		status int
+		want   string
+	}{
+		{"GET", "/api/handlers", "", http.StatusOK, "[]\n"},
+		{"GET", "/api/handlers/eth9/sessions", "", http.StatusNotFound, `{"error":"handler for eth9 not running"}` + "\n"},
+		{"GET", "/api/handlers/eth9/acs", "", http.StatusNotFound, `{"error":"handler for eth9 not running"}` + "\n"},
+		{"DELETE", "/api/handlers/eth9", "", http.StatusNotFound, `{"error":"handler for eth9 not running"}` + "\n"},
+		{"POST", "/api/handlers", "{", http.StatusBadRequest, ""},
+		{"POST", "/api/handlers", `{"ac_name": "bras"}`, http.StatusBadRequest, `{"error":"missing adapter"}` + "\n"},
+		{"PUT", "/api/handlers", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/api/unknown", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := do(s, tt.method, tt.target, localAddr, "", tt.body)
+		assert.Equal(t, tt.status, w.Code, tt.method+" "+tt.target)
+		if tt.want != "" {
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, tt.want, w.Body.String(), tt.method+" "+tt.target)
+		}
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	s := NewServer()
+	s.SetMetrics(metrics.NewCollector())
+
+	// 没有 token 时只接受本机的请求，凭据接口一律拒绝
+	assert.Equal(t, http.StatusOK, do(s, "GET", "/api/handlers", localAddr, "", "").Code)
+	assert.Equal(t, http.StatusOK, do(s, "GET", "/metrics", "[::1]:52000", "", "").Code)
+	assert.Equal(t, http.StatusForbidden, do(s, "GET", "/api/handlers", remoteAddr, "", "").Code)
+	assert.Equal(t, http.StatusForbidden, do(s, "POST", "/api/handlers", remoteAddr, "", `{"adapter": "eth0"}`).Code)
+	for _, target := range []string{"/api/credentials", "/api/events", "/api/vault", "/api/vault/export"} {
+		w := do(s, "GET", target, localAddr, "", "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code, target)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer")
+	}
+
+	// 没有 token 时拒绝非本机的 Host 和 Origin，防止 DNS 重绑定和浏览器跨站请求
+	r := newRequest("GET", "/api/handlers", localAddr, "", "")
+	r.Host = "attacker.example:8080"
+	assert.Equal(t, http.StatusForbidden, serve(s, r).Code)
+	for origin, status := range map[string]int{
+		"http://attacker.example": http.StatusForbidden,
+		"null":                    http.StatusForbidden,
+		"http://localhost:3000":   http.StatusOK,
+		"http://[::1]:8080":       http.StatusOK,
+	} {
+		r = newRequest("GET", "/api/handlers", localAddr, "", "")
+		r.Header.Set("Origin", origin)
+		assert.Equal(t, status, serve(s, r).Code, origin)
+	}
+	// 启动处理器只接受 JSON，浏览器跨站提交的表单被拒绝
+	r = newRequest("POST", "/api/handlers", localAddr, "", `{"adapter": "eth0"}`)
+	r.Header.Set("Content-Type", "text/plain")
+	assert.Equal(t, http.StatusUnsupportedMediaType, serve(s, r).Code)
+
+	s.SetToken("s3cret-token")
+	r = newRequest("GET", "/api/handlers", remoteAddr, "s3cret-token", "")
+	r.Host = "probe.example:8080"
+	assert.Equal(t, http.StatusOK, serve(s, r).Code)
+	for _, token := range []string{"", "wrong", "s3cret-token-"} {
+		assert.Equal(t, http.StatusUnauthorized, do(s, "GET", "/api/handlers", localAddr, token, "").Code, token)
+		assert.Equal(t, http.StatusUnauthorized, do(s, "GET", "/metrics", localAddr, token, "").Code, token)
+	}
+	assert.Equal(t, http.StatusOK, do(s, "GET", "/api/handlers", remoteAddr, "s3cret-token", "").Code)
+	assert.Equal(t, http.StatusOK, do(s, "GET", "/api/credentials", remoteAddr, "s3cret-token", "").Code)
+	assert.Equal(t, http.StatusOK, do(s, "GET", "/metrics", remoteAddr, "s3cret-token", "").Code)
+}
+
+func TestServer_Credentials(t *testing.T) {
+	s := NewServer()
+	s.SetToken("token")
+	v, err := vault.Open(filepath.Join(t.TempDir(), "captures.vault"), "passphrase")
+	assert.Nil(t, err)
+	s.SetVault(v)
+
+	s.onEvent("eth0", handler.EventSessionAuthCaptured, "00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5", "user@isp", handler.NewSecret("secret", handler.RedactMasked), "pap", "35")
+	// CHAP 没有明文密码，只出现在 /api/credentials 中
+	s.onEvent("eth0", handler.EventSessionAuthCaptured, "00:e0:4c:36:17:f8", "00:0c:29:8b:82:c6", "chap@isp", handler.NewSecret("", handler.RedactMasked), "chap", "")
+
+	w := do(s, "GET", "/api/credentials", localAddr, "token", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var captures []map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &captures))
+	assert.Len(t, captures, 2)
+	assert.NotEmpty(t, captures[0]["time"])
+	delete(captures[0], "time")
+	assert.Equal(t, map[string]interface{}{
+		"handler":     "eth0",
+		"adapter_mac": "00:e0:4c:36:17:f8",
+		"peer_mac":    "00:0c:29:8b:82:c5",
+		"peer_id":     "user@isp",
+		"password":    "s****t",
+		"method":      "pap",
+		"vlan":        "35",
+	}, captures[0])
+
+	// 凭据库列表不含密码，导出为明文
+	w = do(s, "GET", "/api/vault", localAddr, "token", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var credentials []vault.Credential
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &credentials))
+	assert.Len(t, credentials, 1)
+	assert.Equal(t, "user@isp", credentials[0].Username)
+	assert.Equal(t, "", credentials[0].Password)
+
+	w = do(s, "GET", "/api/vault/export?format=csv", localAddr, "token", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), ",user@isp,secret,")
+	assert.Equal(t, http.StatusUnauthorized, do(s, "GET", "/api/vault/export", localAddr, "", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(s, "GET", "/api/vault/export?format=xml", localAddr, "token", "").Code)
+
+	assert.Equal(t, http.StatusNotFound, do(s, "DELETE", "/api/vault/unknown", localAddr, "token", "").Code)
+	assert.Equal(t, http.StatusNoContent, do(s, "DELETE", "/api/vault/"+credentials[0].ID, localAddr, "token", "").Code)
+	assert.Empty(t, v.List())
+}
+
+func TestServer_CapturesLimit(t *testing.T) {
+	s := NewServer()
+	for i := 0; i < maxCaptures+10; i++ {
+		s.onEvent("eth0", handler.EventSessionAuthCaptured, "00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5", fmt.Sprint("user", i), handler.NewSecret("secret", handler.RedactFull), "pap", "")
+	}
+	// 超出上限后丢弃最早的
+	captures := s.Captures()
+	assert.Len(t, captures, maxCaptures)
+	assert.Equal(t, "user10", captures[0].PeerID)
+	assert.Equal(t, fmt.Sprint("user", maxCaptures+9), captures[len(captures)-1].PeerID)
+}
+
+func TestServer_Events(t *testing.T) {
+	s := NewServer()
+	s.SetToken("token")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	// 读取不到事件时由超时结束请求
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", ts.URL+"/api/events?adapter=eth0", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := client.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// 响应头发出之后才订阅
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		n := len(s.subs)
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.onEvent("eth1", handler.EventSessionAuthCaptured, "00:e0:4c:36:17:f9", "00:0c:29:8b:82:c6", "other", handler.NewSecret("secret", handler.RedactMasked), "pap", "")
+	s.onEvent("eth0", handler.EventSessionAuthCaptured, "00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5", "user@isp", handler.NewSecret("secret", handler.RedactMasked), "pap", "35")
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "event: session_auth_captured\n", line)
+	line, err = r.ReadString('\n')
+	assert.Nil(t, err)
+	if assert.True(t, strings.HasPrefix(line, "data: ")) {
+		var ev map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev))
+		assert.Equal(t, "eth0", ev["handler"])
+		assert.Equal(t, "user@isp", ev["peer_id"])
+		assert.Equal(t, "s****t", ev["password"])
+	}
+}
@@ -0,0 +1,47 @@
+package auth
+
+import "time"
+
+// 计费记录类型
+const (
+	AcctStart   = "start"
+	AcctStop    = "stop"
+	AcctInterim = "interim"
+)
+
+// 会话结束原因，与 RADIUS Acct-Terminate-Cause 对应
+const (
+	// TerminateUserRequest 对端发送 PADT 或 LCP Terminate-Request
+	TerminateUserRequest = "user-request"
+	// TerminateNASRequest 本端因地址池耗尽、认证失败等原因结束会话
+	TerminateNASRequest = "nas-request"
+	// TerminateAdminReset 处理器关闭
+	TerminateAdminReset = "admin-reset"
+)
+
+// AccountingRecord 一条计费记录，Rx 为从对端收到，Tx 为发给对端
+type AccountingRecord struct {
+	Status string
+	// SessionID 计费会话 ID，同一会话的 start、interim、stop 相同
+	SessionID      string
+	Adapter        string
+	PeerMac        string
+	Vlan           string
+	PPPoESessionID uint16
+	Username       string
+	IP             string
+	// Attributes 认证通过时 Authenticator 返回的属性，例如 AttrClass
+	Attributes     map[string]string
+	StartedAt      time.Time
+	Duration       time.Duration
+	RxPackets      uint64
+	RxBytes        uint64
+	TxPackets      uint64
+	TxBytes        uint64
+	TerminateCause string
+}
+
+// Accounter 记录会话计费，可能被多个会话并发调用。返回的 error 只记录日志，不影响会话。
+type Accounter interface {
+	Account(rec AccountingRecord) error
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"pppoe-probe/ppp"
+	"strings"
+	"sync"
+)
+
+// 认证方式
+const (
+	MethodPAP  = "pap"
+	MethodCHAP = "chap"
+)
+
+// Verdict 认证结果
+type Verdict int
+
+const (
+	// Ignore 不回复对端，对端重传认证请求直至超时，用于只捕获凭据
+	Ignore Verdict = 0
+	Accept Verdict = 1
+	Reject Verdict = 2
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Ignore:
+		return "ignore"
+	case Accept:
+		return "accept"
+	case Reject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// Request 一次认证请求。
+// PAP 时 Password 为明文密码；CHAP 时 Password 为空，ChapID、Challenge 为本端发出的 Challenge，
+// Response 为对端回复的 MD5(ChapID + secret + Challenge)。
+type Request struct {
+	// Adapter 收到请求的网卡名
+	Adapter   string
+	PeerMac   string
+	Vlan      string
+	SessionID uint16
+	Method    string
+	Username  string
+	Password  string
+	ChapID    byte
+	Challenge []byte
+	Response  []byte
+}
+
+// 常用的 Attributes 键，与 RADIUS 属性名一致
+const (
+	// AttrFramedIPAddress 分配给对端的 IPv4 地址，数据面在地址池内且未被占用时优先使用
+	AttrFramedIPAddress = "Framed-IP-Address"
+	// AttrAcctInterimInterval 计费中间记录的间隔，单位秒
+	AttrAcctInterimInterval = "Acct-Interim-Interval"
+	// AttrSessionTimeout 会话最长时间，单位秒，只记录不强制
+	AttrSessionTimeout = "Session-Timeout"
+	// AttrClass 认证服务器要求在计费请求中原样带回的数据
+	AttrClass = "Class"
+)
+
+// Decision 认证决定。Message 放在 PAP Ack/Nak 或 CHAP Success/Failure 中发给对端，
+// Attributes 为附加属性，例如 RADIUS 返回的 Framed-IP-Address，原样记录在会话中。
+type Decision struct {
+	Verdict    Verdict
+	Message    string
+	Attributes map[string]string
+}
+
+// Authenticator 对认证请求做出决定，可能被多个会话并发调用。
+// 返回 error 时视为拒绝，错误信息不会发给对端。
+type Authenticator interface {
+	Authenticate(req Request) (Decision, error)
+}
+
+// AuthenticatorFunc 将普通函数适配为 Authenticator
+type AuthenticatorFunc func(req Request) (Decision, error)
+
+func (f AuthenticatorFunc) Authenticate(req Request) (Decision, error) {
+	return f(req)
+}
+
+// CaptureOnly 只记录凭据，不回复对端
+var CaptureOnly Authenticator = AuthenticatorFunc(func(req Request) (Decision, error) {
+	return Decision{Verdict: Ignore}, nil
+})
+
+// AcceptAll 任何账号密码都认证通过
+var AcceptAll Authenticator = AuthenticatorFunc(func(req Request) (Decision, error) {
+	return Decision{Verdict: Accept, Message: "Login ok"}, nil
+})
+
+// User 本地用户文件中的一个账号
+type User struct {
+	Username   string
+	Password   string
+	Attributes map[string]string
+}
+
+// UserFile 基于本地用户文件的认证，文件每行一个账号：
+//
+//	# 注释
+//	username password [key=value ...]
+//
+// 字段以空白分隔，key=value 作为认证通过时的 Attributes。
+// PAP 比较明文密码，CHAP 用密码计算 CHAP-MD5 后比较。
+type UserFile struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// LoadUserFile 读取用户文件，之后可以调用 Reload 重新读取
+func LoadUserFile(path string) (f *UserFile, err error) {
+	f = &UserFile{path: path}
+	if err = f.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload 重新读取用户文件，读取失败时保留原有账号
+func (f *UserFile) Reload() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	users, err := ParseUsers(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.mu.Lock()
+	f.users = users
+	f.mu.Unlock()
+	return nil
+}
+
+// ParseUsers 按用户文件格式解析账号，同名账号以后出现的为准
+func ParseUsers(r io.Reader) (users map[string]User, err error) {
+	users = make(map[string]User)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: missing password", line)
+		}
+		u := User{Username: fields[0], Password: fields[1]}
+		for _, field := range fields[2:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("line %d: invalid attribute %q", line, field)
+			}
+			if u.Attributes == nil {
+				u.Attributes = make(map[string]string)
+			}
+			u.Attributes[kv[0]] = kv[1]
+		}
+		users[u.Username] = u
+	}
+	err = scanner.Err()
+	return
+}
+
+func (f *UserFile) Authenticate(req Request) (d Decision, err error) {
+	f.mu.RLock()
+	u, ok := f.users[req.Username]
+	f.mu.RUnlock()
+	d.Verdict = Reject
+	d.Message = "Authentication failed"
+	if !ok {
+		return
+	}
+	switch req.Method {
+	case MethodPAP:
+		ok = subtle.ConstantTimeCompare([]byte(req.Password), []byte(u.Password)) == 1
+	case MethodCHAP:
+		expected := ppp.ChapMD5Response(req.ChapID, u.Password, req.Challenge)
+		ok = subtle.ConstantTimeCompare(req.Response, expected) == 1
+	default:
+		return d, errors.New("unsupported auth method " + req.Method)
+	}
+	if ok {
+		d = Decision{Verdict: Accept, Message: "Login ok", Attributes: u.Attributes}
+	}
+	return
+}
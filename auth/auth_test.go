@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"pppoe-probe/ppp"
+	"strings"
+	"testing"
+)
+
+func TestParseUsers(t *testing.T) {
+	users, err := ParseUsers(strings.NewReader(`
+# comment
+alice  secret
+bob pass ip=10.64.0.9 rate=10M
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(users))
+	assert.Equal(t, "secret", users["alice"].Password)
+	assert.Equal(t, map[string]string{"ip": "10.64.0.9", "rate": "10M"}, users["bob"].Attributes)
+
+	_, err = ParseUsers(strings.NewReader("alice\n"))
+	assert.NotNil(t, err)
+	_, err = ParseUsers(strings.NewReader("alice secret =x\n"))
+	assert.NotNil(t, err)
+}
+
+func TestUserFile_Authenticate(t *testing.T) {
+	users, err := ParseUsers(strings.NewReader("alice secret ip=10.64.0.9\n"))
+	assert.Nil(t, err)
+	f := &UserFile{users: users}
+
+	d, err := f.Authenticate(Request{Method: MethodPAP, Username: "alice", Password: "secret"})
+	assert.Nil(t, err)
+	assert.Equal(t, Accept, d.Verdict)
+	assert.Equal(t, "10.64.0.9", d.Attributes["ip"])
+
+	d, err = f.Authenticate(Request{Method: MethodPAP, Username: "alice", Password: "wrong"})
+	assert.Nil(t, err)
+	assert.Equal(t, Reject, d.Verdict)
+
+	d, err = f.Authenticate(Request{Method: MethodPAP, Username: "mallory", Password: "secret"})
+	assert.Nil(t, err)
+	assert.Equal(t, Reject, d.Verdict)
+
+	challenge := []byte{0x01, 0x02, 0x03, 0x04}
+	d, err = f.Authenticate(Request{
+		Method:    MethodCHAP,
+		Username:  "alice",
+		ChapID:    7,
+		Challenge: challenge,
+		Response:  ppp.ChapMD5Response(7, "secret", challenge),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, Accept, d.Verdict)
+
+	d, err = f.Authenticate(Request{
+		Method:    MethodCHAP,
+		Username:  "alice",
+		ChapID:    8,
+		Challenge: challenge,
+		Response:  ppp.ChapMD5Response(7, "secret", challenge),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, Reject, d.Verdict)
+}
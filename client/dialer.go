@@ -0,0 +1,530 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"pppoe-probe/link"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"time"
+)
+
+const (
+	DefaultDialTimeout        = 30 * time.Second
+	DefaultRetransmitInterval = time.Second
+	DefaultMRU                = 1492
+)
+
+var (
+	ErrDialTimeout  = errors.New("dial timeout")
+	ErrAuthFailed   = errors.New("authentication failed")
+	ErrSessionEnded = errors.New("session terminated by access concentrator")
+)
+
+// 拨号阶段
+const (
+	PhaseDiscovery = "discovery"
+	PhaseLCP       = "lcp"
+	PhaseAuth      = "auth"
+	PhaseIPCP      = "ipcp"
+	PhaseDone      = "done"
+)
+
+// Transport 收发以太网帧，*pcap.Handle 满足此接口。
+// 没有数据时 ReadPacketData 应在短时间内返回非 io.EOF 的错误（如 pcap 的读超时），以便处理重传和超时。
+type Transport interface {
+	ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	WritePacketData(data []byte) error
+}
+
+// DialOptions 拨号参数
+type DialOptions struct {
+	Username    string
+	Password    string
+	ServiceName string
+	// AcName 只接受该 AC-Name 的 PADO，为空时接受第一个 PADO
+	AcName string
+	Vlans  link.VlanStack
+	// MRU 为 0 时使用 DefaultMRU
+	MRU uint16
+	// Timeout 整个拨号过程的超时时间，为 0 时使用 DefaultDialTimeout
+	Timeout time.Duration
+	// RetransmitInterval 请求报文的重传间隔，为 0 时使用 DefaultRetransmitInterval
+	RetransmitInterval time.Duration
+}
+
+// DialResult 拨号结果
+type DialResult struct {
+	AcMac        string        `json:"ac_mac"`
+	AcName       string        `json:"ac_name"`
+	SessionID    uint16        `json:"session_id"`
+	AuthProtocol string        `json:"auth_protocol"`
+	AuthMessage  string        `json:"auth_message,omitempty"`
+	LocalIP      net.IP        `json:"local_ip"`
+	PeerIP       net.IP        `json:"peer_ip,omitempty"`
+	PrimaryDNS   net.IP        `json:"primary_dns,omitempty"`
+	SecondaryDNS net.IP        `json:"secondary_dns,omitempty"`
+	PeerMRU      uint16        `json:"peer_mru,omitempty"`
+	Elapsed      time.Duration `json:"-"`
+}
+
+// DialError 拨号失败时所处的阶段
+type DialError struct {
+	Phase string
+	Err   error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Phase, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Dialer PPPoE 客户端：完成发现、LCP 协商、PAP/CHAP 认证和 IPCP，用于验证捕获到的账号。
+// 拨号成功后会立即挂断（LCP Terminate + PADT），不承载数据。
+// 可以在 veth pair 的两端分别运行本客户端和 pppoe-server 等 AC 进行测试。
+type Dialer struct {
+	transport  Transport
+	adapterMac net.HardwareAddr
+	handle     *pcap.Handle
+}
+
+func NewDialer(t Transport, adapterMac []byte) *Dialer {
+	return &Dialer{
+		transport:  t,
+		adapterMac: adapterMac,
+	}
+}
+
+// OpenDialer 打开网卡并创建客户端，使用完需调用 Close
+func OpenDialer(adapterName string, adapterMac []byte) (d *Dialer, err error) {
+	handle, err := pcap.OpenLive(adapterName, 1600, false, 100*time.Millisecond)
+	if err != nil {
+		return
+	}
+	d = NewDialer(handle, adapterMac)
+	d.handle = handle
+	return
+}
+
+func (d *Dialer) Close() {
+	if d.handle != nil {
+		d.handle.Close()
+	}
+}
+
+type dialSession struct {
+	d    *Dialer
+	opts DialOptions
+
+	phase     string
+	hostUniq  []byte
+	acMac     net.HardwareAddr
+	sessionID uint16
+	// ppp LCP 协商和认证，err 为其回调中产生的错误
+	ppp       *ppp.Engine
+	err       error
+	hangingUp bool
+
+	// 等待应答的请求，超过重传间隔未收到应答时重发
+	pending  func()
+	lastSend time.Time
+
+	ipcpID        byte
+	ipcpRequest   ppp.IPCtrlProtocol
+	ipcpLocalOpen bool
+	ipcpPeerOpen  bool
+
+	result DialResult
+}
+
+// Dial 阻塞函数，拨号直到拿到 IP 地址、失败或超时。失败时返回 *DialError。
+func (d *Dialer) Dial(opts DialOptions) (result DialResult, err error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultDialTimeout
+	}
+	if opts.RetransmitInterval <= 0 {
+		opts.RetransmitInterval = DefaultRetransmitInterval
+	}
+	if opts.MRU == 0 {
+		opts.MRU = DefaultMRU
+	}
+	s := &dialSession{
+		d:        d,
+		opts:     opts,
+		phase:    PhaseDiscovery,
+		hostUniq: make([]byte, 8),
+	}
+	_, _ = rand.Read(s.hostUniq)
+	var magic [4]byte
+	_, _ = rand.Read(magic[:])
+	s.ppp = ppp.NewEngine(ppp.Config{
+		Role:             ppp.RolePeer,
+		MRU:              opts.MRU,
+		MagicNumber:      binary.BigEndian.Uint32(magic[:]),
+		Username:         opts.Username,
+		Password:         opts.Password,
+		Send:             s.sendPPP,
+		OnPhase:          s.onPhase,
+		OnAuthResult:     s.onAuthResult,
+		OnProtocolReject: s.onProtocolReject,
+	})
+
+	start := time.Now()
+	err = s.run(start.Add(opts.Timeout))
+	if s.sessionID != 0 {
+		s.hangup()
+	}
+	if err != nil {
+		err = &DialError{Phase: s.phase, Err: err}
+		return
+	}
+	result = s.result
+	result.Elapsed = time.Since(start)
+	return
+}
+
+func (s *dialSession) run(deadline time.Time) error {
+	s.sendPADI()
+	for s.phase != PhaseDone {
+		if time.Now().After(deadline) {
+			return ErrDialTimeout
+		}
+		if s.pending != nil && time.Since(s.lastSend) >= s.opts.RetransmitInterval {
+			s.pending()
+		}
+		f, ok, err := s.read()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		switch f.EtherType {
+		case layers.EthernetTypePPPoEDiscovery:
+			err = s.handleDiscovery(f)
+		case layers.EthernetTypePPPoESession:
+			err = s.handleSession(f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read 读取一个发给本机的 PPPoE 帧，读超时时 ok 为 false
+func (s *dialSession) read() (f link.Frame, ok bool, err error) {
+	data, _, err := s.d.transport.ReadPacketData()
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		err = nil
+		return
+	}
+	f, ok = link.DecodeFrame(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+	if !ok || !bytes.Equal(f.DstMac, s.d.adapterMac) {
+		ok = false
+		return
+	}
+	if s.acMac != nil && !bytes.Equal(f.SrcMac, s.acMac) {
+		ok = false
+	}
+	return
+}
+
+func (s *dialSession) handleDiscovery(f link.Frame) error {
+	pppoed, err := pppoe.DecodePPPoED(f.Payload)
+	if err != nil {
+		logrus.Debugln("dial failed to decode pppoed", err)
+		return nil
+	}
+	switch pppoed.Code {
+	case pppoe.CodePADO:
+		if s.acMac != nil || !bytes.Equal(pppoed.HostUniq, s.hostUniq) {
+			return nil
+		}
+		if s.opts.AcName != "" && s.opts.AcName != pppoed.AcName {
+			logrus.Debugln("dial ignore PADO from", f.SrcMac, pppoed.AcName)
+			return nil
+		}
+		s.acMac = f.SrcMac
+		s.result.AcMac = f.SrcMac.String()
+		s.result.AcName = pppoed.AcName
+		s.sendPADR(pppoed.AcCookie)
+	case pppoe.CodePADS:
+		if s.phase != PhaseDiscovery || !bytes.Equal(pppoed.HostUniq, s.hostUniq) {
+			return nil
+		}
+		if pppoed.SessionID == 0 {
+			return errors.New("access concentrator refused the session")
+		}
+		s.sessionID = pppoed.SessionID
+		s.result.SessionID = pppoed.SessionID
+		s.phase = PhaseLCP
+		// LCP 和认证的请求由 ppp.Engine 记录，重传时交给它重发
+		s.lastSend = time.Now()
+		s.ppp.Open()
+		s.pending = func() {
+			s.lastSend = time.Now()
+			s.ppp.Retransmit()
+		}
+	case pppoe.CodePADT:
+		if s.sessionID != 0 && pppoed.SessionID == s.sessionID {
+			s.sessionID = 0
+			return ErrSessionEnded
+		}
+	}
+	return nil
+}
+
+func (s *dialSession) handleSession(f link.Frame) error {
+	if s.sessionID == 0 {
+		return nil
+	}
+	var pppoes pppoe.PPPoES
+	var frame ppp.Frame
+	if err := pppoe.DecodeSessionFrameInto(&pppoes, &frame, f.Payload); err != nil {
+		logrus.Debugln("dial failed to decode pppoes", err)
+		return nil
+	}
+	if pppoes.SessionID != s.sessionID || pppoes.Code != pppoe.SCodeSessionData {
+		return nil
+	}
+	switch frame.Protocol {
+	case ppp.ProtocolLCP:
+		logrus.Debugln("dial receive lcp", frame.LinkProtocol.GetShowCode())
+	case ppp.ProtocolPAP:
+		logrus.Debugln("dial receive pap", frame.PwdAuthProtocol.GetShowCode(), frame.PwdAuthProtocol.Message)
+	case ppp.ProtocolCHAP:
+		logrus.Debugln("dial receive chap", frame.ChapProtocol.GetShowCode())
+	}
+	if s.ppp.Input(&frame) {
+		return s.err
+	}
+	switch frame.Protocol {
+	case ppp.ProtocolIPCP:
+		return s.handleIPCP(frame.IPCtrlProtocol)
+	default:
+		// 对不支持的协议（如 IPv6CP、CCP）回复 LCP Protocol Reject
+		s.ppp.RejectProtocol(pppoes.Payload)
+	}
+	return nil
+}
+
+// onPhase 按 ppp.Engine 的阶段推进拨号：认证阶段记录协商结果，网络阶段开始 IPCP，对端结束链路时拨号失败
+func (s *dialSession) onPhase(phase ppp.Phase) {
+	switch phase {
+	case ppp.PhaseAuthenticate:
+		s.phase = PhaseAuth
+		s.result.PeerMRU = s.ppp.PeerMRU()
+		switch s.ppp.AuthProtocol() {
+		case ppp.AuthProtocolPassword:
+			s.result.AuthProtocol = "pap"
+		case ppp.AuthProtocolChap:
+			s.result.AuthProtocol = "chap"
+		default:
+			s.result.AuthProtocol = "none"
+		}
+	case ppp.PhaseNetwork:
+		s.startIPCP()
+	case ppp.PhaseDead:
+		if !s.hangingUp {
+			s.sessionID = 0
+			s.err = ErrSessionEnded
+		}
+	}
+}
+
+func (s *dialSession) onAuthResult(accepted bool, message string) {
+	s.result.AuthMessage = message
+	if !accepted {
+		s.err = fmt.Errorf("%w: %s", ErrAuthFailed, message)
+	}
+}
+
+func (s *dialSession) onProtocolReject(p ppp.Protocol) {
+	if p == ppp.ProtocolIPCP {
+		s.err = errors.New("access concentrator rejected ipcp")
+	}
+}
+
+func (s *dialSession) startIPCP() {
+	s.phase = PhaseIPCP
+	s.ipcpRequest = ppp.IPCtrlProtocol{
+		Code:         ppp.LinkCodeConfigRequest,
+		IPAddress:    net.IPv4zero.To4(),
+		PrimaryDNS:   net.IPv4zero.To4(),
+		SecondaryDNS: net.IPv4zero.To4(),
+	}
+	s.sendIPCPRequest()
+}
+
+func (s *dialSession) handleIPCP(ipcp ppp.IPCtrlProtocol) error {
+	if s.phase != PhaseIPCP {
+		// 认证完成前 AC 发来的 IPCP 请求直接丢弃，AC 会重传
+		return nil
+	}
+	logrus.Debugln("dial receive ipcp", ipcp.GetShowCode(), ipcp.IPAddress, ipcp.PrimaryDNS, ipcp.SecondaryDNS)
+	switch ipcp.Code {
+	case ppp.LinkCodeConfigRequest:
+		if len(ipcp.UnknownOptions) > 0 {
+			s.sendIPCP(ppp.IPCtrlProtocol{
+				Code:           ppp.LinkCodeConfigReject,
+				Identifier:     ipcp.Identifier,
+				UnknownOptions: ipcp.UnknownOptions,
+			})
+			return nil
+		}
+		s.result.PeerIP = ipcp.IPAddress
+		ack := ipcp
+		ack.Code = ppp.LinkCodeConfigAck
+		s.sendIPCP(ack)
+		s.ipcpPeerOpen = true
+	case ppp.LinkCodeConfigAck:
+		if ipcp.Identifier != s.ipcpRequest.Identifier {
+			return nil
+		}
+		s.ipcpLocalOpen = true
+		s.result.LocalIP = s.ipcpRequest.IPAddress
+		s.result.PrimaryDNS = s.ipcpRequest.PrimaryDNS
+		s.result.SecondaryDNS = s.ipcpRequest.SecondaryDNS
+	case ppp.LinkCodeConfigNak:
+		if ipcp.Identifier != s.ipcpRequest.Identifier {
+			return nil
+		}
+		if ipcp.IPAddress != nil {
+			s.ipcpRequest.IPAddress = ipcp.IPAddress
+		}
+		if ipcp.PrimaryDNS != nil {
+			s.ipcpRequest.PrimaryDNS = ipcp.PrimaryDNS
+		}
+		if ipcp.SecondaryDNS != nil {
+			s.ipcpRequest.SecondaryDNS = ipcp.SecondaryDNS
+		}
+		s.sendIPCPRequest()
+	case ppp.LinkCodeConfigReject:
+		if ipcp.Identifier != s.ipcpRequest.Identifier {
+			return nil
+		}
+		if ipcp.IPAddress != nil {
+			return errors.New("access concentrator rejected ip address option")
+		}
+		if ipcp.PrimaryDNS != nil {
+			s.ipcpRequest.PrimaryDNS = nil
+		}
+		if ipcp.SecondaryDNS != nil {
+			s.ipcpRequest.SecondaryDNS = nil
+		}
+		s.sendIPCPRequest()
+	}
+	if s.ipcpLocalOpen && s.ipcpPeerOpen {
+		s.pending = nil
+		s.phase = PhaseDone
+	}
+	return nil
+}
+
+// hangup 挂断会话：发送 LCP Terminate Request，短暂等待 Terminate Ack 后发送 PADT
+func (s *dialSession) hangup() {
+	s.hangingUp = true
+	s.ppp.Close()
+	deadline := time.Now().Add(s.opts.RetransmitInterval)
+	for time.Now().Before(deadline) && s.ppp.Phase() != ppp.PhaseDead {
+		f, ok, err := s.read()
+		if err != nil {
+			break
+		}
+		if !ok || f.EtherType != layers.EthernetTypePPPoESession {
+			continue
+		}
+		var pppoes pppoe.PPPoES
+		var frame ppp.Frame
+		if pppoe.DecodeSessionFrameInto(&pppoes, &frame, f.Payload) == nil && pppoes.SessionID == s.sessionID {
+			s.ppp.Input(&frame)
+		}
+	}
+	padt := pppoe.NewPPPoEDPacket(pppoe.CodePADT, s.sessionID, "", nil, nil)
+	s.writeFrame(layers.EthernetTypePPPoEDiscovery, s.acMac, padt.Encode())
+	s.sessionID = 0
+}
+
+// nextIdentifier IPCP 的 Identifier，LCP 和认证的由 ppp.Engine 分配
+func (s *dialSession) nextIdentifier() byte {
+	s.ipcpID++
+	return s.ipcpID
+}
+
+func (s *dialSession) sendPADI() {
+	padi := pppoe.NewPPPoEDPacket(pppoe.CodePADI, 0, "", s.hostUniq, nil)
+	if s.opts.ServiceName != "" {
+		padi.ServiceNames = []string{s.opts.ServiceName}
+	}
+	s.sendRequest(func() {
+		s.writeFrame(layers.EthernetTypePPPoEDiscovery, broadcastMac, padi.Encode())
+	})
+}
+
+func (s *dialSession) sendPADR(cookie []byte) {
+	padr := pppoe.NewPPPoEDPacket(pppoe.CodePADR, 0, "", s.hostUniq, cookie)
+	if s.opts.ServiceName != "" {
+		padr.ServiceNames = []string{s.opts.ServiceName}
+	}
+	s.sendRequest(func() {
+		s.writeFrame(layers.EthernetTypePPPoEDiscovery, s.acMac, padr.Encode())
+	})
+}
+
+func (s *dialSession) sendIPCPRequest() {
+	s.ipcpRequest.Identifier = s.nextIdentifier()
+	s.ipcpLocalOpen = false
+	request := s.ipcpRequest
+	s.sendRequest(func() {
+		s.sendIPCP(request)
+	})
+}
+
+// sendRequest 立即发送请求，并在收到应答前按重传间隔重发
+func (s *dialSession) sendRequest(send func()) {
+	s.pending = func() {
+		s.lastSend = time.Now()
+		send()
+	}
+	s.pending()
+}
+
+func (s *dialSession) sendIPCP(ipcp ppp.IPCtrlProtocol) {
+	s.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ipcp})
+}
+
+func (s *dialSession) sendPPP(f *ppp.Frame) {
+	s.writeFrame(layers.EthernetTypePPPoESession, s.acMac, pppoe.AppendSessionFrame(nil, s.sessionID, f))
+}
+
+func (s *dialSession) writeFrame(etherType layers.EthernetType, dst net.HardwareAddr, payload []byte) {
+	data, err := link.Frame{
+		SrcMac:    s.d.adapterMac,
+		DstMac:    dst,
+		Vlans:     s.opts.Vlans,
+		EtherType: etherType,
+		Payload:   payload,
+	}.Encode()
+	if err == nil {
+		err = s.d.transport.WritePacketData(data)
+	}
+	if err != nil {
+		logrus.Errorln("dial write packet data", err)
+	}
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"pppoe-probe/link"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"testing"
+	"time"
+)
+
+var (
+	testClientMac = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	testAcMac     = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+)
+
+// pipeTransport 内存中的一端，in 读取对端发来的帧，out 发给对端
+type pipeTransport struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (t *pipeTransport) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case data := <-t.in:
+		return data, gopacket.CaptureInfo{}, nil
+	case <-time.After(10 * time.Millisecond):
+		return nil, gopacket.CaptureInfo{}, errors.New("read timeout")
+	}
+}
+
+func (t *pipeTransport) WritePacketData(data []byte) error {
+	t.out <- append([]byte(nil), data...)
+	return nil
+}
+
+// fakeAC 脚本化的 AC，按 RFC 流程应答客户端
+type fakeAC struct {
+	t            *testing.T
+	transport    *pipeTransport
+	auth         ppp.AuthProtocol
+	username     string
+	password     string
+	sessionID    uint16
+	challenge    []byte
+	lcpPeerOpen  bool
+	lcpLocalOpen bool
+	authed       bool
+	terminated   bool
+	padt         bool
+}
+
+func (ac *fakeAC) run(done chan struct{}) {
+	for {
+		var data []byte
+		select {
+		case data = <-ac.transport.in:
+		case <-done:
+			return
+		}
+		f, ok := link.DecodeFrame(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+		if !ok {
+			continue
+		}
+		if f.EtherType == layers.EthernetTypePPPoEDiscovery {
+			ac.handleDiscovery(f)
+		} else {
+			ac.handleSession(f)
+		}
+	}
+}
+
+func (ac *fakeAC) handleDiscovery(f link.Frame) {
+	pppoed, err := pppoe.DecodePPPoED(f.Payload)
+	assert.Nil(ac.t, err)
+	switch pppoed.Code {
+	case pppoe.CodePADI:
+		pado := pppoe.NewPPPoEDPacket(pppoe.CodePADO, 0, "fake-ac", pppoed.HostUniq, []byte("cookie"))
+		ac.write(layers.EthernetTypePPPoEDiscovery, pado.Encode())
+	case pppoe.CodePADR:
+		assert.Equal(ac.t, []byte("cookie"), pppoed.AcCookie)
+		pads := pppoe.NewPPPoEDPacket(pppoe.CodePADS, ac.sessionID, "fake-ac", pppoed.HostUniq, nil)
+		ac.write(layers.EthernetTypePPPoEDiscovery, pads.Encode())
+		lcp := ppp.LinkCtrlProtocol{
+			Code:           ppp.LinkCodeConfigRequest,
+			Identifier:     1,
+			MaxReceiveUint: 1492,
+			AuthProtocol:   ac.auth,
+			MagicNumber:    0x11223344,
+		}
+		if ac.auth == ppp.AuthProtocolChap {
+			lcp.AuthAlgorithm = ppp.ChapAlgorithmMD5
+		}
+		ac.send(ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: lcp})
+	case pppoe.CodePADT:
+		ac.padt = true
+	}
+}
+
+func (ac *fakeAC) handleSession(f link.Frame) {
+	var pppoes pppoe.PPPoES
+	var frame ppp.Frame
+	assert.Nil(ac.t, pppoe.DecodeSessionFrameInto(&pppoes, &frame, f.Payload))
+	assert.Equal(ac.t, ac.sessionID, pppoes.SessionID)
+	switch frame.Protocol {
+	case ppp.ProtocolLCP:
+		lcp := frame.LinkProtocol
+		switch lcp.Code {
+		case ppp.LinkCodeConfigRequest:
+			ack := lcp
+			ack.Code = ppp.LinkCodeConfigAck
+			ac.send(ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ack})
+			ac.lcpLocalOpen = true
+		case ppp.LinkCodeConfigAck:
+			ac.lcpPeerOpen = true
+		case ppp.LinkCodeTerminateRequest:
+			ac.terminated = true
+			ac.send(ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{
+				Code:       ppp.LinkCodeTerminateAck,
+				Identifier: lcp.Identifier,
+			}})
+		}
+		if ac.lcpLocalOpen && ac.lcpPeerOpen && ac.auth == ppp.AuthProtocolChap && ac.challenge == nil {
+			ac.challenge = []byte("0123456789abcdef")
+			ac.send(ppp.Frame{Protocol: ppp.ProtocolCHAP, ChapProtocol: ppp.ChapProtocol{
+				Code:       ppp.ChapCodeChallenge,
+				Identifier: 7,
+				Value:      ac.challenge,
+				Name:       "fake-ac",
+			}})
+		}
+	case ppp.ProtocolPAP:
+		pap := frame.PwdAuthProtocol
+		reply := ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeNak, Identifier: pap.Identifier, Message: "bad password"}
+		if pap.PeerID == ac.username && pap.Password == ac.password {
+			reply = ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeAck, Identifier: pap.Identifier, Message: "welcome"}
+			ac.authed = true
+		}
+		ac.send(ppp.Frame{Protocol: ppp.ProtocolPAP, PwdAuthProtocol: reply})
+		if ac.authed {
+			ac.sendIPCPRequest()
+		}
+	case ppp.ProtocolCHAP:
+		chap := frame.ChapProtocol
+		reply := ppp.ChapProtocol{Code: ppp.ChapCodeFailure, Identifier: chap.Identifier, Message: "bad password"}
+		expected := ppp.ChapMD5Response(chap.Identifier, ac.password, ac.challenge)
+		if chap.Name == ac.username && bytes.Equal(chap.Value, expected) {
+			reply = ppp.ChapProtocol{Code: ppp.ChapCodeSuccess, Identifier: chap.Identifier, Message: "welcome"}
+			ac.authed = true
+		}
+		ac.send(ppp.Frame{Protocol: ppp.ProtocolCHAP, ChapProtocol: reply})
+		if ac.authed {
+			ac.sendIPCPRequest()
+		}
+	case ppp.ProtocolIPCP:
+		ipcp := frame.IPCtrlProtocol
+		if ipcp.Code != ppp.LinkCodeConfigRequest {
+			return
+		}
+		reply := ipcp
+		if ipcp.IPAddress.Equal(net.IPv4zero) {
+			reply = ppp.IPCtrlProtocol{
+				Code:         ppp.LinkCodeConfigNak,
+				Identifier:   ipcp.Identifier,
+				IPAddress:    net.IPv4(10, 0, 0, 2).To4(),
+				PrimaryDNS:   net.IPv4(8, 8, 8, 8).To4(),
+				SecondaryDNS: net.IPv4(8, 8, 4, 4).To4(),
+			}
+		} else {
+			reply.Code = ppp.LinkCodeConfigAck
+		}
+		ac.send(ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: reply})
+	}
+}
+
+func (ac *fakeAC) sendIPCPRequest() {
+	ac.send(ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{
+		Code:       ppp.LinkCodeConfigRequest,
+		Identifier: 1,
+		IPAddress:  net.IPv4(10, 0, 0, 1).To4(),
+	}})
+}
+
+func (ac *fakeAC) send(f ppp.Frame) {
+	ac.write(layers.EthernetTypePPPoESession, pppoe.AppendSessionFrame(nil, ac.sessionID, &f))
+}
+
+func (ac *fakeAC) write(etherType layers.EthernetType, payload []byte) {
+	data, err := link.Frame{SrcMac: testAcMac, DstMac: testClientMac, EtherType: etherType, Payload: payload}.Encode()
+	assert.Nil(ac.t, err)
+	_ = ac.transport.WritePacketData(data)
+}
+
+func dialFakeAC(t *testing.T, auth ppp.AuthProtocol, password string) (*fakeAC, DialResult, error) {
+	clientToAC := make(chan []byte, 64)
+	acToClient := make(chan []byte, 64)
+	ac := &fakeAC{
+		t:         t,
+		transport: &pipeTransport{in: clientToAC, out: acToClient},
+		auth:      auth,
+		username:  "user",
+		password:  "secret",
+		sessionID: 0x1234,
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		ac.run(done)
+		close(stopped)
+	}()
+	d := NewDialer(&pipeTransport{in: acToClient, out: clientToAC}, testClientMac)
+	result, err := d.Dial(DialOptions{
+		Username:           "user",
+		Password:           password,
+		Timeout:            2 * time.Second,
+		RetransmitInterval: 50 * time.Millisecond,
+	})
+	time.Sleep(20 * time.Millisecond)
+	close(done)
+	<-stopped
+	return ac, result, err
+}
+
+func TestDialer_PAP(t *testing.T) {
+	ac, result, err := dialFakeAC(t, ppp.AuthProtocolPassword, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, testAcMac.String(), result.AcMac)
+	assert.Equal(t, "fake-ac", result.AcName)
+	assert.Equal(t, uint16(0x1234), result.SessionID)
+	assert.Equal(t, "pap", result.AuthProtocol)
+	assert.Equal(t, "welcome", result.AuthMessage)
+	assert.Equal(t, "10.0.0.2", result.LocalIP.String())
+	assert.Equal(t, "10.0.0.1", result.PeerIP.String())
+	assert.Equal(t, "8.8.8.8", result.PrimaryDNS.String())
+	assert.Equal(t, "8.8.4.4", result.SecondaryDNS.String())
+	assert.True(t, ac.terminated)
+	assert.True(t, ac.padt)
+}
+
+func TestDialer_CHAP(t *testing.T) {
+	ac, result, err := dialFakeAC(t, ppp.AuthProtocolChap, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "chap", result.AuthProtocol)
+	assert.Equal(t, "10.0.0.2", result.LocalIP.String())
+	assert.True(t, ac.authed)
+	assert.True(t, ac.padt)
+}
+
+func TestDialer_AuthFailed(t *testing.T) {
+	ac, _, err := dialFakeAC(t, ppp.AuthProtocolChap, "wrong")
+	assert.True(t, errors.Is(err, ErrAuthFailed))
+	var dialErr *DialError
+	assert.True(t, errors.As(err, &dialErr))
+	assert.Equal(t, PhaseAuth, dialErr.Phase)
+	assert.True(t, ac.padt)
+}
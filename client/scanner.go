@@ -0,0 +1,173 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"pppoe-probe/link"
+	"pppoe-probe/pppoe"
+	"time"
+)
+
+const DefaultScanTimeout = 3 * time.Second
+
+var broadcastMac = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Vendor PADO 中的 Vendor-Specific 标签
+type Vendor struct {
+	VendorID uint32 `json:"vendor_id"`
+	Value    string `json:"value"`
+}
+
+// Offer 扫描到的一个 PADO
+type Offer struct {
+	AcMac        string        `json:"ac_mac"`
+	AcName       string        `json:"ac_name"`
+	ServiceNames []string      `json:"service_names,omitempty"`
+	Cookie       string        `json:"cookie,omitempty"`
+	Vendors      []Vendor      `json:"vendors,omitempty"`
+	Vlan         string        `json:"vlan,omitempty"`
+	Service      string        `json:"service"`
+	Latency      time.Duration `json:"-"`
+	LatencyMs    float64       `json:"latency_ms"`
+}
+
+// ScanOptions 扫描参数。Vlans 为空时只在未打标签的网段上扫描，
+// ServiceNames 为空时发送 Service-Name 为空（任意服务）的 PADI。
+// 每个 VLAN 与每个服务名的组合各发送一个 PADI。
+type ScanOptions struct {
+	Vlans        []link.VlanStack
+	ServiceNames []string
+	Timeout      time.Duration
+}
+
+// Scanner 客户端发现扫描器：广播 PADI 并收集所有 AC 回复的 PADO，不会继续发送 PADR 建立会话。
+type Scanner struct {
+	transport  Transport
+	adapterMac net.HardwareAddr
+	handle     *pcap.Handle
+}
+
+type scanProbe struct {
+	vlans   link.VlanStack
+	service string
+	sentAt  time.Time
+}
+
+func NewScanner(t Transport, adapterMac []byte) *Scanner {
+	return &Scanner{
+		transport:  t,
+		adapterMac: adapterMac,
+	}
+}
+
+// OpenScanner 打开网卡并创建扫描器，使用完需调用 Close
+func OpenScanner(adapterName string, adapterMac []byte) (s *Scanner, err error) {
+	handle, err := pcap.OpenLive(adapterName, 1600, false, 100*time.Millisecond)
+	if err != nil {
+		return
+	}
+	s = NewScanner(handle, adapterMac)
+	s.handle = handle
+	return
+}
+
+// Scan 阻塞函数，发送 PADI 后等待 opts.Timeout，返回期间收到的所有 PADO。
+func (s *Scanner) Scan(opts ScanOptions) (offers []Offer, err error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultScanTimeout
+	}
+	vlansList := opts.Vlans
+	if len(vlansList) == 0 {
+		vlansList = []link.VlanStack{nil}
+	}
+	services := opts.ServiceNames
+	if len(services) == 0 {
+		services = []string{""}
+	}
+
+	probes := make(map[string]scanProbe)
+	for _, vlans := range vlansList {
+		for _, service := range services {
+			hostUniq := make([]byte, 8)
+			_, _ = rand.Read(hostUniq)
+			padi := pppoe.NewPPPoEDPacket(pppoe.CodePADI, 0, "", hostUniq, nil)
+			if service != "" {
+				padi.ServiceNames = []string{service}
+			}
+			data, err := link.Frame{
+				SrcMac:    s.adapterMac,
+				DstMac:    broadcastMac,
+				Vlans:     vlans,
+				EtherType: layers.EthernetTypePPPoEDiscovery,
+				Payload:   padi.Encode(),
+			}.Encode()
+			if err != nil {
+				return nil, err
+			}
+			logrus.Debugln("scan send PADI vlan", vlans, "service", service)
+			probes[hex.EncodeToString(hostUniq)] = scanProbe{
+				vlans:   vlans,
+				service: service,
+				sentAt:  time.Now(),
+			}
+			if err = s.transport.WritePacketData(data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	deadline := time.Now().Add(opts.Timeout)
+	for time.Now().Before(deadline) {
+		data, _, err := s.transport.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		f, ok := link.DecodeFrame(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+		if !ok || f.EtherType != layers.EthernetTypePPPoEDiscovery || f.DstMac.String() != s.adapterMac.String() {
+			continue
+		}
+		pado, err := pppoe.DecodePPPoED(f.Payload)
+		if err != nil || pado.Code != pppoe.CodePADO {
+			continue
+		}
+		probe, ok := probes[hex.EncodeToString(pado.HostUniq)]
+		if !ok {
+			continue
+		}
+		latency := time.Since(probe.sentAt)
+		offer := Offer{
+			AcMac:        f.SrcMac.String(),
+			AcName:       pado.AcName,
+			ServiceNames: pado.ServiceNames,
+			Cookie:       hex.EncodeToString(pado.AcCookie),
+			Vlan:         probe.vlans.String(),
+			Service:      probe.service,
+			Latency:      latency,
+			LatencyMs:    float64(latency.Microseconds()) / 1000,
+		}
+		for _, vendor := range pado.VendorTags {
+			offer.Vendors = append(offer.Vendors, Vendor{
+				VendorID: vendor.VendorID,
+				Value:    hex.EncodeToString(vendor.Value),
+			})
+		}
+		logrus.Debugln("scan receive PADO from", offer.AcMac, offer.AcName, "latency", latency)
+		offers = append(offers, offer)
+	}
+	return
+}
+
+func (s *Scanner) Close() {
+	if s.handle != nil {
+		s.handle.Close()
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"pppoe-probe/link"
+	"pppoe-probe/pppoe"
+	"testing"
+	"time"
+)
+
+// cannedPADO 回复 PADI 的 PADO，带一个正常和一个不足 4 字节的 Vendor-Specific 标签
+func cannedPADO(hostUniq []byte, service string) []byte {
+	pado := pppoe.NewPPPoEDPacket(pppoe.CodePADO, 0, "bras", hostUniq, []byte{0xc0, 0x0c})
+	pado.ServiceNames = []string{service}
+	pado.VendorTags = []pppoe.VendorTag{{VendorID: 3561, Value: []byte{0x01, 0x02}}}
+	data := append(pado.Encode(), 0x01, 0x05, 0x00, 0x02, 0xab, 0xcd)
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(data)-pppoe.PPPoEDBasicLen))
+	return data
+}
+
+func TestScanner_Scan(t *testing.T) {
+	transport := &pipeTransport{in: make(chan []byte, 16), out: make(chan []byte, 16)}
+	s := NewScanner(transport, testClientMac)
+	defer s.Close()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			f, ok := link.DecodeFrame(gopacket.NewPacket(<-transport.out, layers.LayerTypeEthernet, gopacket.Default))
+			if !ok {
+				return
+			}
+			padi, err := pppoe.DecodePPPoED(f.Payload)
+			if err != nil || padi.Code != pppoe.CodePADI {
+				return
+			}
+			reply := func(dst []byte, payload []byte) {
+				data, _ := link.Frame{SrcMac: testAcMac, DstMac: dst, Vlans: f.Vlans, EtherType: layers.EthernetTypePPPoEDiscovery, Payload: payload}.Encode()
+				transport.in <- data
+			}
+			// 发给其他设备和 Host-Uniq 不匹配的 PADO 都应忽略
+			reply(testAcMac, cannedPADO(padi.HostUniq, "other"))
+			reply(testClientMac, cannedPADO([]byte{0xff}, "other"))
+			reply(testClientMac, cannedPADO(padi.HostUniq, padi.ServiceNames[0]))
+		}
+	}()
+
+	offers, err := s.Scan(ScanOptions{
+		Vlans:        []link.VlanStack{{{TPID: layers.EthernetTypeDot1Q, ID: 35}}},
+		ServiceNames: []string{"internet", "iptv"},
+		Timeout:      200 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	if !assert.Len(t, offers, 2) {
+		return
+	}
+	services := map[string]bool{}
+	for _, offer := range offers {
+		services[offer.Service] = true
+		assert.Equal(t, testAcMac.String(), offer.AcMac)
+		assert.Equal(t, "bras", offer.AcName)
+		assert.Equal(t, []string{offer.Service}, offer.ServiceNames)
+		assert.Equal(t, "c00c", offer.Cookie)
+		assert.Equal(t, []Vendor{{VendorID: 3561, Value: "0102"}}, offer.Vendors)
+		assert.Equal(t, "35", offer.Vlan)
+		assert.True(t, offer.LatencyMs >= 0)
+	}
+	assert.Equal(t, map[string]bool{"internet": true, "iptv": true}, services)
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"pppoe-probe/api"
+	"pppoe-probe/auth"
+	"pppoe-probe/client"
+	"pppoe-probe/handler"
+	"pppoe-probe/link"
+	"pppoe-probe/metrics"
+	"pppoe-probe/ppp"
+	"pppoe-probe/radius"
+	"pppoe-probe/vault"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 退出码：捕获到凭据（或 -list）返回 ExitOK，超时未捕获到凭据返回 ExitTimeout。
+// 扫描模式下扫描到 AC 返回 ExitOK，没有任何 AC 回复返回 ExitTimeout。
+// 拨号模式下拿到 IP 返回 ExitOK，认证失败返回 ExitAuthFailed，超时返回 ExitTimeout。
+const (
+	ExitOK          = 0
+	ExitError       = 1
+	ExitUsage       = 2
+	ExitTimeout     = 3
+	ExitAuthFailed  = 4
+	ExitInterrupted = 130
+)
+
+const (
+	AuthPolicyFirst = "first"
+	AuthPolicyAll   = "all"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// VaultPassphraseEnv 凭据库口令所在的环境变量，避免口令出现在命令行参数中
+const VaultPassphraseEnv = "PPPOE_VAULT_PASSPHRASE"
+
+// APITokenEnv HTTP 控制接口的 bearer token 所在的环境变量，未设置时 -http 只能监听本机回环地址
+const APITokenEnv = "PPPOE_API_TOKEN"
+
+// DialPasswordEnv 拨号模式下的密码所在的环境变量，避免密码出现在命令行参数中
+const DialPasswordEnv = "PPPOE_DIAL_PASSWORD"
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	var (
+		ifName     = flag.String("i", "", "监听的网卡名（系统网卡名或 pcap 设备名）")
+		list       = flag.Bool("list", false, "列出可用网卡后退出")
+		acName     = flag.String("ac-name", handler.NovaDefaultAcName, "PADO/PADS 中回复的 AC-Name")
+		authPolicy = flag.String("auth", AuthPolicyFirst, "凭据捕获策略：first 捕获到第一组凭据后退出，all 持续捕获直到超时或中断")
+		timeout    = flag.Duration("timeout", 0, "整体超时时间，0 表示不超时")
+		format     = flag.String("format", FormatText, "事件输出格式：text 或 json（每行一个 JSON 对象，格式见 handler.JSONEvent）")
+		passive    = flag.Bool("monitor", false, "旁路监听模式：不发送任何封包，只记录网段上已有的 PPPoE 会话和明文 PAP 凭据")
+		serialDev  = flag.String("serial", "", "串口模式：在该串口设备（例如 /dev/ttyUSB0）上以 RFC 1662 异步 HDLC 承载 PPP 并捕获凭据，写 pty 时创建 pty 并输出从设备路径，此时忽略 -i")
+		baud       = flag.Int("baud", 0, "串口模式下的波特率，0 表示不修改")
+		scan       = flag.Bool("scan", false, "客户端扫描模式：广播 PADI 并列出回复 PADO 的所有 AC，-timeout 为等待时间（默认 3s），-vlan 可写 100.35 形式的双层标签")
+		services   = flag.String("service", "", "扫描模式下请求的服务名，逗号分隔，为空时请求任意服务；拨号模式下只能写一个")
+		dial       = flag.Bool("dial", false, "客户端拨号模式：用 -user 和环境变量 "+DialPasswordEnv+" 中的密码完成 PPPoE 拨号，输出分配的 IP 和 DNS 后挂断，可用于验证捕获到的凭据")
+		user       = flag.String("user", "", "拨号模式下的用户名")
+		pool       = flag.String("pool", "", "开启数据面（简易 BRAS）并从该 IPv4 地址池分配地址，例如 10.64.0.0/24，未指定 -users 时认证一律通过")
+		users      = flag.String("users", "", "本地用户文件，每行一个 \"账号 密码\"，只有文件中的账号能认证通过，其余拒绝并结束会话；未指定时只捕获凭据不回复（数据面模式下一律通过）")
+		radiusAddr = flag.String("radius", "", "RADIUS 服务器地址，例如 10.0.0.2 或 10.0.0.2:1812，认证交给 RADIUS 并发送计费（端口 1813），与 -users 互斥")
+		radiusKey  = flag.String("radius-secret", "", "RADIUS 共享密钥")
+		nasID      = flag.String("nas-id", "", "RADIUS 请求中的 NAS-Identifier")
+		interim    = flag.Duration("acct-interim", 0, "计费中间记录间隔，0 表示不发送，RADIUS 返回 Acct-Interim-Interval 时以其为准")
+		chap       = flag.Bool("chap", false, "要求对端使用 CHAP-MD5 认证，对端不支持时退回 PAP；CHAP 捕获不到明文密码")
+		gateway    = flag.String("gateway", "", "数据面 BRAS 侧地址，默认为地址池的第一个地址")
+		dns        = flag.String("dns", "", "数据面通过 IPCP 下发的 DNS，逗号分隔，最多两个")
+		tunName    = flag.String("tun", "pppoe", "数据面共享 TUN 设备名，-tun-per-session 时为设备名前缀")
+		perSession = flag.Bool("tun-per-session", false, "数据面为每个会话创建一个点对点 TUN 设备")
+		kernel     = flag.Bool("kernel", false, "数据面使用 Linux 内核 PPPoE（AF_PPPOX）转发，每个会话创建一个 pppN 网卡，失败时退回为每个会话创建 TUN 设备")
+		lns        = flag.String("lns", "", "LAC 模式：认证通过的会话经 L2TPv2 隧道转交该 LNS，例如 10.0.0.3 或 10.0.0.3:1701，附带代理 LCP 和代理认证；未指定 -users/-radius 时一律转交，与 -pool 互斥")
+		lnsSecret  = flag.String("lns-secret", "", "L2TP 隧道认证的共享密钥，为空时不认证")
+		relayIf    = flag.String("relay", "", "中继模式：在 -i（面向 CPE）和该网卡（面向 AC）之间转发 PPPoE 发现和会话报文，插入 Relay-Session-Id 并改写 MAC，不再捕获凭据")
+		circuitID  = flag.String("circuit-id", "", "中继模式下插入的 TR-101 Agent-Circuit-ID，可用 {mac}、{vlan} 占位符，例如 \"eth 0/1:{vlan}\"")
+		remoteID   = flag.String("remote-id", "", "中继模式下插入的 TR-101 Agent-Remote-ID，可用 {mac}、{vlan} 占位符")
+		mru        = flag.Uint("mru", handler.DefaultMRU, "数据面本端 MRU，同时作为 TUN 设备的 MTU")
+		trackACs   = flag.Bool("acs", false, "退出时输出网段上发现的所有 AC，网卡以混杂模式打开")
+		vlans      = flag.String("vlan", "", "只应答这些 VLAN 上的请求，逗号分隔：35 匹配最内层 ID，100.35 匹配外层 100 内层 35，100.* 匹配外层 100 下的所有内层，0 表示未打标签，为空时应答全部")
+		vaultPath  = flag.String("vault", "", "把捕获到的凭据加密保存到该文件，口令从环境变量 "+VaultPassphraseEnv+" 读取")
+		vaultList  = flag.Bool("vault-list", false, "列出 -vault 中的凭据（不含密码）后退出")
+		vaultOut   = flag.String("vault-export", "", "以明文导出 -vault 中的凭据到标准输出后退出，格式 json 或 csv")
+		vaultDel   = flag.String("vault-delete", "", "从 -vault 中删除这些 ID 的凭据后退出，逗号分隔")
+		redact     = flag.String("redact", "full", "事件和日志中密码的脱敏方式：full 完全隐藏，masked 只保留首尾字符，hashed 输出未加盐的 SHA-256 摘要（可被穷举反查），none 输出明文；-vault 中始终保存明文")
+		verbose    = flag.Bool("v", false, "输出调试日志")
+		httpAddr   = flag.String("http", "", "以 HTTP 控制接口模式运行并监听该地址，例如 :8080，此时忽略 -i；未设置环境变量 "+APITokenEnv+" 时只监听 127.0.0.1 且不开放凭据接口")
+		metricAddr = flag.String("metrics", "", "在该地址的 /metrics 输出 Prometheus 指标，HTTP 控制接口模式下直接挂在 -http 上")
+	)
+	flag.Parse()
+
+	logrus.SetOutput(os.Stderr)
+	logrus.SetLevel(logrus.WarnLevel)
+	if *verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	if *list {
+		return listAdapters()
+	}
+	redaction, err := handler.ParseRedaction(*redact)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -redact:", err)
+		return ExitUsage
+	}
+	var v *vault.Vault
+	if *vaultPath != "" {
+		v, err = vault.Open(*vaultPath, os.Getenv(VaultPassphraseEnv))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "open -vault:", err)
+			return ExitError
+		}
+	} else if *vaultList || *vaultOut != "" || *vaultDel != "" {
+		fmt.Fprintln(os.Stderr, "missing -vault")
+		return ExitUsage
+	}
+	switch {
+	case *vaultList:
+		return listVault(v, *format)
+	case *vaultOut != "":
+		if err := v.Export(os.Stdout, *vaultOut); err != nil {
+			fmt.Fprintln(os.Stderr, "export vault:", err)
+			return ExitError
+		}
+		return ExitOK
+	case *vaultDel != "":
+		for _, id := range strings.Split(*vaultDel, ",") {
+			if err := v.Delete(strings.TrimSpace(id)); err != nil {
+				fmt.Fprintln(os.Stderr, "delete", id+":", err)
+				return ExitError
+			}
+		}
+		return ExitOK
+	}
+	var collector *metrics.Collector
+	if *metricAddr != "" || *httpAddr != "" {
+		collector = metrics.NewCollector()
+	}
+	if *httpAddr != "" {
+		return serveAPI(*httpAddr, os.Getenv(APITokenEnv), collector, v, redaction)
+	}
+	if *ifName == "" && *serialDev == "" {
+		fmt.Fprintln(os.Stderr, "missing -i, use -list to show available adapters")
+		flag.Usage()
+		return ExitUsage
+	}
+	if *authPolicy != AuthPolicyFirst && *authPolicy != AuthPolicyAll {
+		fmt.Fprintln(os.Stderr, "invalid -auth:", *authPolicy)
+		return ExitUsage
+	}
+	if *format != FormatText && *format != FormatJSON {
+		fmt.Fprintln(os.Stderr, "invalid -format:", *format)
+		return ExitUsage
+	}
+	if *scan {
+		return runScan(*ifName, *vlans, *services, *timeout, *format)
+	}
+	if *dial {
+		opts := client.DialOptions{
+			Username:    *user,
+			Password:    os.Getenv(DialPasswordEnv),
+			ServiceName: *services,
+			Timeout:     *timeout,
+		}
+		if *acName != handler.NovaDefaultAcName {
+			opts.AcName = *acName
+		}
+		return runDial(*ifName, *vlans, opts, *format)
+	}
+	vlanIDs, vlanStacks, err := parseVlans(*vlans)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -vlan:", err)
+		return ExitUsage
+	}
+
+	p := &probe{
+		format:     *format,
+		authPolicy: *authPolicy,
+		stop:       make(chan int, 1),
+		jsonl:      handler.NewJSONLinesListener(os.Stdout),
+		vault:      v,
+	}
+	if *serialDev != "" && (*passive || *pool != "" || *lns != "") {
+		fmt.Fprintln(os.Stderr, "-serial does not support -monitor, -pool or -lns")
+		return ExitUsage
+	}
+	if *lns != "" && (*passive || *pool != "") {
+		fmt.Fprintln(os.Stderr, "-lns cannot be used with -monitor or -pool")
+		return ExitUsage
+	}
+	if *relayIf != "" && (*serialDev != "" || *passive || *pool != "" || *lns != "") {
+		fmt.Fprintln(os.Stderr, "-relay cannot be used with -serial, -monitor, -pool or -lns")
+		return ExitUsage
+	}
+	var h *handler.Handler
+	switch {
+	case *serialDev != "":
+		h, err = handler.NewSerialHandler(handler.SerialConfig{Device: *serialDev, Baud: *baud}, p.onEvent)
+	case *passive:
+		h, err = handler.NewMonitorByName(*ifName, p.onEvent)
+	default:
+		h, err = handler.NewHandlerByName(*ifName, p.onEvent)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitError
+	}
+	h.SetAcName(*acName)
+	h.SetMetrics(collector)
+	if err = h.SetTrackACs(*trackACs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		h.Close()
+		return ExitError
+	}
+	h.SetRedaction(redaction)
+	if len(vlanIDs) > 0 {
+		h.SetVlans(vlanIDs...)
+	}
+	if len(vlanStacks) > 0 {
+		h.SetVlanStacks(vlanStacks...)
+	}
+	if *users != "" && *radiusAddr != "" {
+		fmt.Fprintln(os.Stderr, "-users and -radius are mutually exclusive")
+		h.Close()
+		return ExitUsage
+	}
+	if *radiusAddr != "" {
+		rc, err := radius.NewClient(radius.Config{Server: *radiusAddr, Secret: *radiusKey, NASIdentifier: *nasID})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "radius:", err)
+			h.Close()
+			return ExitUsage
+		}
+		h.SetAuthenticator(rc)
+		h.SetAccounter(rc, *interim)
+	}
+	if *users != "" {
+		userFile, err := auth.LoadUserFile(*users)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "load -users:", err)
+			h.Close()
+			return ExitError
+		}
+		h.SetAuthenticator(userFile)
+	}
+	if *chap {
+		h.SetAuthProtocol(ppp.AuthProtocolChap)
+	}
+	if *pool != "" {
+		cfg, err := dataPlaneConfig(*pool, *gateway, *dns, *tunName, *perSession, *mru)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			h.Close()
+			return ExitUsage
+		}
+		cfg.KernelOffload = *kernel
+		if err = h.SetDataPlane(cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "data plane:", err)
+			h.Close()
+			return ExitError
+		}
+		// BRAS 模式下持续服务，不在捕获到第一组凭据后退出
+		p.authPolicy = AuthPolicyAll
+	}
+	if *lns != "" {
+		if err = h.SetLAC(handler.LACConfig{LNS: *lns, Secret: *lnsSecret}); err != nil {
+			fmt.Fprintln(os.Stderr, "lac:", err)
+			h.Close()
+			return ExitUsage
+		}
+		p.authPolicy = AuthPolicyAll
+	}
+	var server *handler.Handler
+	if *relayIf != "" {
+		server, err = handler.NewHandlerByName(*relayIf, p.onEvent)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			h.Close()
+			return ExitError
+		}
+		server.SetMetrics(collector)
+		server.SetRedaction(redaction)
+		err = h.SetRelay(server, handler.RelayConfig{AgentCircuitID: *circuitID, AgentRemoteID: *remoteID})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "relay:", err)
+			server.Close()
+			h.Close()
+			return ExitUsage
+		}
+		// 中继模式下持续转发，直到超时或中断
+		p.authPolicy = AuthPolicyAll
+	}
+	if *metricAddr != "" {
+		go serveMetrics(*metricAddr, collector)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.Run()
+		close(done)
+	}()
+	serverDone := make(chan struct{})
+	go func() {
+		if server != nil {
+			server.Run()
+		}
+		close(serverDone)
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	var timer <-chan time.Time
+	if *timeout > 0 {
+		timer = time.After(*timeout)
+	}
+
+	var code int
+	select {
+	case code = <-p.stop:
+	case <-timer:
+		code = ExitTimeout
+	case <-sig:
+		code = ExitInterrupted
+	}
+	// all 策略下只要捕获过凭据即视为成功
+	if code != ExitError && p.capturedCount() > 0 {
+		code = ExitOK
+	}
+	if server != nil {
+		server.Close()
+	}
+	h.Close()
+	<-serverDone
+	<-done
+	if *trackACs {
+		p.printACs(h.ACs())
+	}
+	return code
+}
+
+type probe struct {
+	format     string
+	authPolicy string
+	stop       chan int
+	jsonl      handler.Listener
+	vault      *vault.Vault
+
+	mu       sync.Mutex
+	captured int
+}
+
+func (p *probe) onEvent(e handler.Event, args ...interface{}) {
+	p.print(e, args...)
+	switch e {
+	case handler.EventError:
+		p.finish(ExitError)
+	case handler.EventSessionAuthCaptured:
+		p.save(handler.NewJSONEvent(e, args...))
+		p.mu.Lock()
+		p.captured++
+		p.mu.Unlock()
+		if p.authPolicy == AuthPolicyFirst {
+			p.finish(ExitOK)
+		}
+	}
+}
+
+// save 把捕获到的凭据保存到凭据库，未指定 -vault 时不做处理。CHAP 没有明文密码，不保存
+func (p *probe) save(je handler.JSONEvent) {
+	if p.vault == nil || je.Method == auth.MethodCHAP {
+		return
+	}
+	_, err := p.vault.Add(vault.Credential{
+		CapturedAt: je.Time,
+		Adapter:    je.Adapter,
+		PeerMac:    je.Peer,
+		Vlan:       je.Vlan,
+		Method:     je.Method,
+		Username:   je.PeerID,
+		Password:   je.RevealPassword(),
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "save credential to vault:", err)
+	}
+}
+
+func (p *probe) capturedCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.captured
+}
+
+func (p *probe) finish(code int) {
+	select {
+	case p.stop <- code:
+	default:
+	}
+}
+
+func (p *probe) print(e handler.Event, args ...interface{}) {
+	if p.format == FormatJSON {
+		p.jsonl(e, args...)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var strArgs []string
+	for _, arg := range args {
+		strArgs = append(strArgs, fmt.Sprint(arg))
+	}
+	fmt.Printf("%s %-32s %s\n", time.Now().Format("15:04:05.000"), e, strings.Join(strArgs, " "))
+}
+
+func (p *probe) printACs(acs []handler.ACInfo) {
+	for _, ac := range acs {
+		if p.format == FormatJSON {
+			bs, _ := json.Marshal(ac)
+			fmt.Println(string(bs))
+			continue
+		}
+		fmt.Printf("ac %s %q vlan:%s services:%v offers:%d sessions:%d peers:%v\n",
+			ac.AcMac, ac.AcName, ac.Vlan, ac.ServiceNames, ac.Offers, ac.Sessions, ac.Peers)
+	}
+}
+
+func runScan(ifName string, vlans string, services string, timeout time.Duration, format string) int {
+	opts := client.ScanOptions{Timeout: timeout}
+	if vlans != "" {
+		for _, field := range strings.Split(vlans, ",") {
+			stack, err := link.ParseVlanStack(strings.TrimSpace(field))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "invalid -vlan:", err)
+				return ExitUsage
+			}
+			opts.Vlans = append(opts.Vlans, stack)
+		}
+	}
+	if services != "" {
+		opts.ServiceNames = strings.Split(services, ",")
+	}
+
+	a, err := handler.FindAdapter(ifName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitError
+	}
+	scanner, err := client.OpenScanner(a.PcapDevice, a.Mac)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "open adapter:", err)
+		return ExitError
+	}
+	defer scanner.Close()
+	offers, err := scanner.Scan(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "scan:", err)
+		return ExitError
+	}
+	for _, offer := range offers {
+		if format == FormatJSON {
+			bs, _ := json.Marshal(offer)
+			fmt.Println(string(bs))
+			continue
+		}
+		fmt.Printf("pado %s %q vlan:%s service:%q services:%v latency:%s cookie:%s vendors:%v\n",
+			offer.AcMac, offer.AcName, offer.Vlan, offer.Service, offer.ServiceNames, offer.Latency, offer.Cookie, offer.Vendors)
+	}
+	if len(offers) == 0 {
+		return ExitTimeout
+	}
+	return ExitOK
+}
+
+func runDial(ifName string, vlans string, opts client.DialOptions, format string) int {
+	stack, err := link.ParseVlanStack(vlans)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -vlan:", err)
+		return ExitUsage
+	}
+	opts.Vlans = stack
+
+	a, err := handler.FindAdapter(ifName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitError
+	}
+	dialer, err := client.OpenDialer(a.PcapDevice, a.Mac)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "open adapter:", err)
+		return ExitError
+	}
+	defer dialer.Close()
+	result, err := dialer.Dial(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dial:", err)
+		switch {
+		case errors.Is(err, client.ErrAuthFailed):
+			return ExitAuthFailed
+		case errors.Is(err, client.ErrDialTimeout):
+			return ExitTimeout
+		}
+		return ExitError
+	}
+	if format == FormatJSON {
+		bs, _ := json.Marshal(result)
+		fmt.Println(string(bs))
+		return ExitOK
+	}
+	fmt.Printf("session %d with %s %q auth:%s ip:%s peer:%s dns:%s,%s elapsed:%s\n",
+		result.SessionID, result.AcMac, result.AcName, result.AuthProtocol, result.LocalIP, result.PeerIP,
+		result.PrimaryDNS, result.SecondaryDNS, result.Elapsed)
+	return ExitOK
+}
+
+func serveAPI(addr string, token string, collector *metrics.Collector, v *vault.Vault, redaction handler.Redaction) int {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -http:", err)
+		return ExitUsage
+	}
+	if token == "" {
+		// 没有 token 时不对外开放
+		if host == "" {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			fmt.Fprintln(os.Stderr, "-http on a non-loopback address requires "+APITokenEnv)
+			return ExitUsage
+		}
+	}
+	s := api.NewServer()
+	s.SetToken(token)
+	s.SetMetrics(collector)
+	s.SetRedaction(redaction)
+	if v != nil {
+		s.SetVault(v)
+	}
+	srv := &http.Server{Addr: addr, Handler: s}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	code := ExitOK
+	select {
+	case err := <-errCh:
+		fmt.Fprintln(os.Stderr, "http server:", err)
+		code = ExitError
+	case <-sig:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = srv.Shutdown(ctx)
+	s.Close()
+	return code
+}
+
+func serveMetrics(addr string, collector *metrics.Collector) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collector)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorln("metrics server:", err)
+	}
+}
+
+func dataPlaneConfig(pool string, gateway string, dns string, tunName string, perSession bool, mru uint) (cfg handler.DataPlaneConfig, err error) {
+	_, cfg.Pool, err = net.ParseCIDR(pool)
+	if err != nil || cfg.Pool.IP.To4() == nil {
+		err = fmt.Errorf("invalid -pool: %s", pool)
+		return
+	}
+	if gateway == "" {
+		cfg.Gateway = make(net.IP, 4)
+		binary.BigEndian.PutUint32(cfg.Gateway, binary.BigEndian.Uint32(cfg.Pool.IP.To4())+1)
+	} else if cfg.Gateway = net.ParseIP(gateway).To4(); cfg.Gateway == nil {
+		err = fmt.Errorf("invalid -gateway: %s", gateway)
+		return
+	}
+	if dns != "" {
+		servers := strings.Split(dns, ",")
+		if len(servers) > 2 {
+			err = fmt.Errorf("invalid -dns: %s", dns)
+			return
+		}
+		for i, server := range servers {
+			ip := net.ParseIP(strings.TrimSpace(server)).To4()
+			if ip == nil {
+				err = fmt.Errorf("invalid -dns: %s", server)
+				return
+			}
+			if i == 0 {
+				cfg.PrimaryDNS = ip
+			} else {
+				cfg.SecondaryDNS = ip
+			}
+		}
+	}
+	if mru < 576 || mru > 65535 {
+		err = fmt.Errorf("invalid -mru: %d", mru)
+		return
+	}
+	cfg.MRU = uint16(mru)
+	cfg.TunName = tunName
+	cfg.PerSessionTun = perSession
+	return
+}
+
+// parseVlans 解析 -vlan，单个 ID 匹配最内层标签，带 . 的按外层到内层逐层匹配
+func parseVlans(s string) (ids []uint16, stacks []link.VlanStack, err error) {
+	if s == "" {
+		return
+	}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if strings.Contains(field, ".") {
+			filter, err := link.ParseVlanFilter(field)
+			if err != nil {
+				return nil, nil, err
+			}
+			stacks = append(stacks, filter)
+			continue
+		}
+		id, err := strconv.ParseUint(field, 10, 12)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, uint16(id))
+	}
+	return
+}
+
+func listVault(v *vault.Vault, format string) int {
+	for _, c := range v.List() {
+		c.Password = ""
+		if format == FormatJSON {
+			bs, _ := json.Marshal(c)
+			fmt.Println(string(bs))
+			continue
+		}
+		fmt.Println(c)
+	}
+	return ExitOK
+}
+
+func listAdapters() int {
+	adapters, err := handler.ListAdapters()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "list adapters:", err)
+		return ExitError
+	}
+	for _, a := range adapters {
+		fmt.Println(a)
+	}
+	return ExitOK
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"log/slog"
 	"runtime"
 	"sync"
 )
@@ -16,6 +17,11 @@ var GlobalWg = sync.WaitGroup{}
 var goroutineCount = make(chan struct{}, 50)
 
 func Go(f func()) {
+	GoWith(nil, f)
+}
+
+// GoWith 同 Go，f 中的 panic 通过 logger 输出，logger 为 nil 时输出到 logrus
+func GoWith(logger *slog.Logger, f func()) {
 	go func() {
 		GlobalWg.Add(1)
 		goroutineCount <- struct{}{}
@@ -24,7 +30,11 @@ func Go(f func()) {
 			GlobalWg.Done()
 			<-goroutineCount
 			if r := recover(); r != nil {
-				logrus.Errorln("recover", r, fmt.Sprintf("%+v", callers()))
+				if logger == nil {
+					logrus.Errorln("recover", r, fmt.Sprintf("%+v", callers()))
+					return
+				}
+				logger.Error("recover", "panic", r, "stack", fmt.Sprintf("%+v", callers()))
 			}
 		}()
 
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"pppoe-probe/link"
+	"pppoe-probe/pppoe"
+	"sync"
+	"time"
+)
+
+// ACOffer 其他 AC 发出的一个 PADO 或 PADS
+type ACOffer struct {
+	Code         string   `json:"code"`
+	AcMac        string   `json:"ac_mac"`
+	AcName       string   `json:"ac_name,omitempty"`
+	ServiceNames []string `json:"service_names,omitempty"`
+	Vlan         string   `json:"vlan,omitempty"`
+	PeerMac      string   `json:"peer_mac"`
+	SessionID    uint16   `json:"session_id,omitempty"`
+}
+
+// ACInfo 网段上发现的一个 AC 的汇总记录
+type ACInfo struct {
+	AcMac        string    `json:"ac_mac"`
+	AcName       string    `json:"ac_name,omitempty"`
+	ServiceNames []string  `json:"service_names,omitempty"`
+	Vlan         string    `json:"vlan,omitempty"`
+	Peers        []string  `json:"peers,omitempty"`
+	Offers       int       `json:"offers"`
+	Sessions     int       `json:"sessions"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+type acRegistry struct {
+	mu  sync.Mutex
+	acs map[string]*ACInfo
+}
+
+// SetTrackACs 开启后记录网段上出现过的所有 AC，通过 ACs 查询。
+// PADO/PADS 是发给其他设备的单播帧，网卡不是以混杂模式打开时以混杂模式重新打开，失败时返回错误。需在 Run 之前调用。
+func (h *Handler) SetTrackACs(track bool) (err error) {
+	if !track {
+		h.acs = nil
+		return
+	}
+	if h.handle != nil && !h.promisc {
+		if err = h.openPcap(true); err != nil {
+			return
+		}
+	}
+	h.acs = &acRegistry{acs: make(map[string]*ACInfo)}
+	return
+}
+
+// ACs 返回记录到的 AC，未开启 SetTrackACs 时返回空。
+func (h *Handler) ACs() (acs []ACInfo) {
+	if h.acs == nil {
+		return
+	}
+	h.acs.mu.Lock()
+	defer h.acs.mu.Unlock()
+	for _, ac := range h.acs.acs {
+		info := *ac
+		info.ServiceNames = append([]string(nil), ac.ServiceNames...)
+		info.Peers = append([]string(nil), ac.Peers...)
+		acs = append(acs, info)
+	}
+	return
+}
+
+// detectAC 处理其他 MAC 发出的 PADO/PADS。
+// 探测模式下说明网段上有其他 AC 在和本程序竞争，路由器可能选择对方导致探测失败，上报 EventCompetingAC。
+// 注意：PADO/PADS 是单播帧，只有在集线器、镜像端口或旁路监听（混杂模式）下才能看到发给其他设备的帧。
+func (h *Handler) detectAC(f link.Frame, pppoed pppoe.PPPoED) {
+	if pppoed.Code != pppoe.CodePADO && pppoed.Code != pppoe.CodePADS {
+		return
+	}
+	if mac(f.SrcMac) == mac(h.adapterMac) {
+		return
+	}
+	offer := ACOffer{
+		Code:         pppoed.Code.String(),
+		AcMac:        mac(f.SrcMac),
+		AcName:       pppoed.AcName,
+		ServiceNames: pppoed.ServiceNames,
+		Vlan:         f.Vlans.String(),
+		PeerMac:      mac(f.DstMac),
+		SessionID:    pppoed.SessionID,
+	}
+	h.acs.record(offer)
+	if h.monitor != nil {
+		return
+	}
+	h.log(StageDiscovery).Warn("competing access concentrator", "ac_name", offer.AcName, "ac_mac", offer.AcMac, "code", offer.Code, "peer_mac", offer.PeerMac)
+	h.callback(EventCompetingAC, mac(h.adapterMac), offer)
+}
+
+func (r *acRegistry) record(offer ACOffer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := offer.AcMac + "/" + offer.Vlan
+	now := time.Now()
+	ac, ok := r.acs[key]
+	if !ok {
+		ac = &ACInfo{
+			AcMac:     offer.AcMac,
+			Vlan:      offer.Vlan,
+			FirstSeen: now,
+		}
+		r.acs[key] = ac
+	}
+	ac.LastSeen = now
+	if offer.AcName != "" {
+		ac.AcName = offer.AcName
+	}
+	for _, serviceName := range offer.ServiceNames {
+		if !containsString(ac.ServiceNames, serviceName) {
+			ac.ServiceNames = append(ac.ServiceNames, serviceName)
+		}
+	}
+	if !containsString(ac.Peers, offer.PeerMac) {
+		ac.Peers = append(ac.Peers, offer.PeerMac)
+	}
+	if offer.Code == pppoe.CodePADS.String() {
+		ac.Sessions++
+	} else {
+		ac.Offers++
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, item := range ss {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"testing"
+)
+
+func TestHandler_DetectAC(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestHandler(rec)
+	assert.Nil(t, h.SetTrackACs(true))
+	cpe, ac := mac(testPeerMac), mac(testAcMac)
+
+	// 混杂模式下看到其他 AC 与 CPE 之间的单播 PADO/PADS
+	pado := pppoe.NewPPPoEDPacket(pppoe.CodePADO, 0, "bras", nil, []byte{0x01})
+	pado.ServiceNames = []string{"internet"}
+	inject(h, discoveryFrame(testAcMac, testPeerMac, pado))
+	inject(h, discoveryFrame(testAcMac, testPeerMac, pppoe.NewPPPoEDPacket(pppoe.CodePADS, 5, "bras", nil, nil)))
+	// 本网卡发出的帧不算竞争
+	inject(h, discoveryFrame(testAdapterMac, testPeerMac, pppoe.NewPPPoEDPacket(pppoe.CodePADO, 0, "self", nil, nil)))
+
+	events := rec.all(EventCompetingAC)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "00:e0:4c:36:17:f8", events[0][0])
+	assert.Equal(t, ACOffer{Code: "PADO", AcMac: ac, AcName: "bras", ServiceNames: []string{"internet"}, PeerMac: cpe}, events[0][1])
+	assert.Equal(t, ACOffer{Code: "PADS", AcMac: ac, AcName: "bras", PeerMac: cpe, SessionID: 5}, events[1][1])
+
+	acs := h.ACs()
+	if assert.Len(t, acs, 1) {
+		assert.Equal(t, ac, acs[0].AcMac)
+		assert.Equal(t, "bras", acs[0].AcName)
+		assert.Equal(t, []string{"internet"}, acs[0].ServiceNames)
+		assert.Equal(t, []string{cpe}, acs[0].Peers)
+		assert.Equal(t, 1, acs[0].Offers)
+		assert.Equal(t, 1, acs[0].Sessions)
+	}
+	assert.True(t, w.empty())
+}
+
+func TestHandler_IgnoreOtherUnicast(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestHandler(rec)
+	assert.Nil(t, h.SetTrackACs(true))
+
+	// CPE 选择了其他 AC 后发给对方的 PADR 和会话报文不能由本程序应答
+	inject(h, discoveryFrame(testPeerMac, testAcMac, pppoe.NewPPPoEDPacket(pppoe.CodePADR, 0, "bras", nil, []byte{0x01})))
+	inject(h, sessionFrame(testPeerMac, testAcMac, 5, ppp.Frame{Protocol: ppp.ProtocolPAP, PwdAuthProtocol: ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeRequest, Identifier: 1, PeerID: "user", Password: "secret"}}))
+	assert.Empty(t, rec.all(EventDiscoverySessionConfirmation))
+	assert.Empty(t, rec.all(EventSessionAuthRequest))
+	assert.True(t, w.empty())
+
+	// 广播的 PADI 照常应答
+	inject(h, discoveryFrame(testPeerMac, broadcastMac, pppoe.NewPPPoEDPacket(pppoe.CodePADI, 0, "", nil, nil)))
+	assert.Len(t, rec.all(EventDiscoveryBroadcast), 1)
+	assert.Equal(t, pppoe.CodePADO, pppoe.DCode(w.next(t).Payload[1]))
+}
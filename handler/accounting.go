@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"fmt"
+	"pppoe-probe/auth"
+	"pppoe-probe/goroutine"
+	"strconv"
+	"time"
+)
+
+// accounting 会话的计费状态，由 Worker.mu 保护
+type accounting struct {
+	id        string
+	startedAt time.Time
+	stop      chan struct{}
+}
+
+// SetAccounter 开启计费，需在 Run 之前调用。认证通过的会话（开启数据面时为 IPCP 完成后，LAC 模式为转交 LNS 后）发送 start，
+// 结束时发送 stop；interim 大于 0 时按该间隔发送中间记录，认证返回的 auth.AttrAcctInterimInterval 优先。
+func (h *Handler) SetAccounter(a auth.Accounter, interim time.Duration) {
+	h.accounter = a
+	h.acctInterim = interim
+}
+
+// startAccounting 发送 start 并按需启动中间记录的定时器，只执行一次
+func (w *Worker) startAccounting() {
+	if w.h.accounter == nil {
+		return
+	}
+	now := time.Now()
+	w.mu.Lock()
+	if w.acct != nil {
+		w.mu.Unlock()
+		return
+	}
+	acct := &accounting{
+		id:        fmt.Sprintf("%x-%04x", now.UnixNano(), w.session.SessionID),
+		startedAt: now,
+		stop:      make(chan struct{}),
+	}
+	w.acct = acct
+	interim := w.h.acctInterim
+	if seconds, err := strconv.Atoi(w.session.Attributes[auth.AttrAcctInterimInterval]); err == nil && seconds > 0 {
+		interim = time.Duration(seconds) * time.Second
+	}
+	w.mu.Unlock()
+
+	rec := w.accountingRecord(acct, auth.AcctStart, "")
+	goroutine.GoWith(w.h.logger, func() {
+		w.account(rec)
+	})
+	if interim <= 0 {
+		return
+	}
+	// 每个会话一个定时协程，数量不固定，不使用 goroutine.Go 以免占满其并发上限
+	go func() {
+		ticker := time.NewTicker(interim)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.account(w.accountingRecord(acct, auth.AcctInterim, ""))
+			case <-acct.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopAccounting 会话结束时发送 stop，wait 为 true 时等待发送完成，用于处理器关闭
+func (w *Worker) stopAccounting(cause string, wait bool) {
+	w.mu.Lock()
+	acct := w.acct
+	w.acct = nil
+	w.mu.Unlock()
+	if acct == nil {
+		return
+	}
+	close(acct.stop)
+	rec := w.accountingRecord(acct, auth.AcctStop, cause)
+	if wait {
+		w.account(rec)
+		return
+	}
+	goroutine.GoWith(w.h.logger, func() {
+		w.account(rec)
+	})
+}
+
+func (w *Worker) accountingRecord(acct *accounting, status string, cause string) auth.AccountingRecord {
+	s := w.Session()
+	return auth.AccountingRecord{
+		Status:         status,
+		SessionID:      acct.id,
+		Adapter:        w.h.adapterName,
+		PeerMac:        s.PeerMac,
+		Vlan:           s.Vlan,
+		PPPoESessionID: s.SessionID,
+		Username:       s.PeerID,
+		IP:             s.IP,
+		Attributes:     s.Attributes,
+		StartedAt:      acct.startedAt,
+		Duration:       time.Since(acct.startedAt),
+		RxPackets:      s.RxPackets,
+		RxBytes:        s.RxBytes,
+		TxPackets:      s.TxPackets,
+		TxBytes:        s.TxBytes,
+		TerminateCause: cause,
+	}
+}
+
+func (w *Worker) account(rec auth.AccountingRecord) {
+	if err := w.h.accounter.Account(rec); err != nil {
+		w.log().Error("accounting failed", "status", rec.Status, "acct_session_id", rec.SessionID, "err", err)
+	}
+}
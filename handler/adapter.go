@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	"net"
+	"strings"
+)
+
+// Adapter 可用于监听的以太网网卡。
+// Name 为系统网卡名，PcapDevice 为 pcap 打开该网卡时使用的设备名。
+// Linux 下两者一般相同，Windows 下 PcapDevice 形如 \Device\NPF_{GUID}。
+type Adapter struct {
+	Name        string
+	Description string
+	Mac         []byte
+	MTU         int
+	Up          bool
+	Running     bool
+	PcapDevice  string
+}
+
+func (a Adapter) String() string {
+	state := "down"
+	if a.Up && a.Running {
+		state = "up"
+	} else if a.Up {
+		state = "no-carrier"
+	}
+	return fmt.Sprintf("%s(%s) mtu %d %s pcap:%s", a.Name, mac(a.Mac), a.MTU, state, a.PcapDevice)
+}
+
+// ListAdapters 列出系统中所有带 MAC 地址的以太网网卡，并关联对应的 pcap 设备。
+// 找不到 pcap 设备的网卡也会返回，此时 PcapDevice 为空，不能用于创建 Handler。
+func ListAdapters() (adapters []Adapter, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return
+	}
+	guids := adapterGUIDs()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) != 6 {
+			continue
+		}
+		adapters = append(adapters, Adapter{
+			Name:        iface.Name,
+			Description: iface.Name,
+			Mac:         iface.HardwareAddr,
+			MTU:         iface.MTU,
+			Up:          iface.Flags&net.FlagUp != 0,
+			Running:     iface.Flags&net.FlagRunning != 0,
+		})
+		a := &adapters[len(adapters)-1]
+		if dev, ok := matchPcapDevice(iface, guids[iface.HardwareAddr.String()], devs); ok {
+			a.PcapDevice = dev.Name
+			if dev.Description != "" {
+				a.Description = dev.Description
+			}
+		}
+	}
+	return
+}
+
+// FindAdapter 根据系统网卡名或 pcap 设备名查找网卡。
+func FindAdapter(name string) (a Adapter, err error) {
+	adapters, err := ListAdapters()
+	if err != nil {
+		return
+	}
+	for _, adapter := range adapters {
+		if adapter.Name == name || adapter.PcapDevice == name {
+			if adapter.PcapDevice == "" {
+				err = fmt.Errorf("adapter %s has no pcap device", name)
+				return
+			}
+			a = adapter
+			return
+		}
+	}
+	err = errors.New("adapter not found: " + name)
+	return
+}
+
+// NewHandlerByName 根据网卡名创建处理器，网卡的 MAC 地址和 pcap 设备名自动获取。
+// 与 NewHandler 不同，打开网卡失败时返回错误，不再回调 EventError。
+func NewHandlerByName(name string, cb Listener) (h *Handler, err error) {
+	a, err := FindAdapter(name)
+	if err != nil {
+		return
+	}
+	return newHandler(a.PcapDevice, a.Mac, cb, false)
+}
+
+// matchPcapDevice 优先按名称匹配 pcap 设备，名称不一致（Windows）时按网卡 GUID 匹配 \Device\NPF_{GUID}。
+// guid 由网卡 MAC 查得，PPPoE 拨号用的网卡一般没有 IP 地址，不能按 IP 匹配。
+func matchPcapDevice(iface net.Interface, guid string, devs []pcap.Interface) (pcap.Interface, bool) {
+	for _, dev := range devs {
+		if dev.Name == iface.Name {
+			return dev, true
+		}
+	}
+	if guid == "" {
+		return pcap.Interface{}, false
+	}
+	guid = strings.ToUpper(strings.Trim(guid, "{}"))
+	for _, dev := range devs {
+		if strings.HasSuffix(strings.ToUpper(dev.Name), "{"+guid+"}") {
+			return dev, true
+		}
+	}
+	return pcap.Interface{}, false
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package handler
+
+// adapterGUIDs 只有 Windows 下 pcap 设备名与系统网卡名不同，需要按 GUID 关联
+func adapterGUIDs() map[string]string {
+	return nil
+}
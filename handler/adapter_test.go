@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"github.com/google/gopacket/pcap"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestMatchPcapDevice(t *testing.T) {
+	devs := []pcap.Interface{
+		{Name: `\Device\NPF_Loopback`},
+		{Name: `\Device\NPF_{6A2B1C3D-0000-4E5F-8A9B-0C1D2E3F4A5B}`, Description: "Realtek PCIe GbE"},
+		{Name: "eth0"},
+	}
+	tests := []struct {
+		name  string
+		iface string
+		guid  string
+		want  string
+		ok    bool
+	}{
+		{"same name", "eth0", "", "eth0", true},
+		{"guid", "以太网", "{6A2B1C3D-0000-4E5F-8A9B-0C1D2E3F4A5B}", devs[1].Name, true},
+		{"guid lower case", "以太网", "{6a2b1c3d-0000-4e5f-8a9b-0c1d2e3f4a5b}", devs[1].Name, true},
+		{"unknown guid", "以太网 2", "{00000000-0000-0000-0000-000000000000}", "", false},
+		{"no guid", "以太网 2", "", "", false},
+	}
+	for _, tt := range tests {
+		dev, ok := matchPcapDevice(net.Interface{Name: tt.iface}, tt.guid, devs)
+		assert.Equal(t, tt.ok, ok, tt.name)
+		assert.Equal(t, tt.want, dev.Name, tt.name)
+	}
+}
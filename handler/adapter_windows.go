@@ -0,0 +1,40 @@
+//go:build windows
+
+package handler
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// adapterGUIDs 返回网卡 MAC 到网卡 GUID（{...}）的映射，用于关联 \Device\NPF_{GUID}
+func adapterGUIDs() map[string]string {
+	size := uint32(15 * 1024)
+	var buf []byte
+	for {
+		buf = make([]byte, size)
+		err := syscall.GetAdaptersInfo((*syscall.IpAdapterInfo)(unsafe.Pointer(&buf[0])), &size)
+		if err == nil {
+			break
+		}
+		if err != syscall.ERROR_BUFFER_OVERFLOW {
+			return nil
+		}
+	}
+	guids := make(map[string]string)
+	for ai := (*syscall.IpAdapterInfo)(unsafe.Pointer(&buf[0])); ai != nil; ai = ai.Next {
+		if ai.AddressLength != 6 {
+			continue
+		}
+		name := ai.AdapterName[:]
+		for i, c := range name {
+			if c == 0 {
+				name = name[:i]
+				break
+			}
+		}
+		guids[net.HardwareAddr(ai.Address[:6]).String()] = string(name)
+	}
+	return guids
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"pppoe-probe/auth"
+	"pppoe-probe/goroutine"
+	"pppoe-probe/link"
+	"pppoe-probe/ppp"
+	"time"
+)
+
+// SetAuthenticator 设置认证决定方式，需在 Run 之前调用。
+// 为 nil 时开启数据面或 LAC 模式则 auth.AcceptAll，否则 auth.CaptureOnly。
+// 无论哪种方式，收到的凭据都会通过 EventSessionAuthCaptured 上报。
+func (h *Handler) SetAuthenticator(a auth.Authenticator) {
+	h.authenticator = a
+}
+
+// SetAuthProtocol 设置 LCP 中要求对端使用的认证协议，只支持 ppp.AuthProtocolPassword（默认）
+// 和 ppp.AuthProtocolChap（CHAP-MD5），对端拒绝 CHAP 时退回 PAP。需在 Run 之前调用。
+// CHAP 只能捕获到账号和 Response，捕获明文密码应使用 PAP。
+func (h *Handler) SetAuthProtocol(p ppp.AuthProtocol) {
+	h.authProtocol = p
+}
+
+func (h *Handler) getAuthenticator() auth.Authenticator {
+	switch {
+	case h.authenticator != nil:
+		return h.authenticator
+	case h.dp != nil, h.lac != nil:
+		return auth.AcceptAll
+	}
+	return auth.CaptureOnly
+}
+
+// newAuthRequest 把 ppp.Engine 的认证请求转换为 Authenticator 的请求，链路相关的字段由调用方填写
+func newAuthRequest(r ppp.AuthRequest) auth.Request {
+	if r.Protocol == ppp.AuthProtocolChap {
+		return auth.Request{
+			Method:    auth.MethodCHAP,
+			Username:  r.Username,
+			ChapID:    r.Identifier,
+			Challenge: r.Challenge,
+			Response:  r.Response,
+		}
+	}
+	return auth.Request{
+		Method:   auth.MethodPAP,
+		Username: r.Username,
+		Password: r.Password,
+	}
+}
+
+// onAuthenticate ppp.Engine 收到 PAP Request 或 CHAP Response 时上报凭据并交给 Authenticator 决定。
+// Authenticator 可能较慢（例如 RADIUS），在协程中调用；决定之前对端重传的请求由 Engine 忽略，之后重发同样的回复。
+func (w *Worker) onAuthenticate(r ppp.AuthRequest) {
+	req := newAuthRequest(r)
+
+	var startedAt time.Time
+	w.updateSession(func(s *Session) {
+		s.Stage = StageAuth
+		s.PeerID = req.Username
+		s.AuthMethod = req.Method
+		startedAt = s.StartedAt
+		req.Adapter = w.h.adapterName
+		req.PeerMac = s.PeerMac
+		req.Vlan = s.Vlan
+		req.SessionID = s.SessionID
+	})
+	w.h.metrics.ObservePADIToAuth(w.h.adapterID(), time.Since(startedAt))
+	w.h.report(&Auth{
+		PeerMac:  w.srcMac,
+		Vlan:     req.Vlan,
+		Method:   req.Method,
+		PeerID:   req.Username,
+		Password: req.Password,
+	})
+	authenticator := w.h.getAuthenticator()
+	goroutine.GoWith(w.h.logger, func() {
+		decision, err := authenticator.Authenticate(req)
+		if err != nil {
+			w.log().Error("failed to authenticate", "method", req.Method, "user", req.Username, "err", err)
+			decision = auth.Decision{Verdict: auth.Reject, Message: "Authentication failed"}
+		}
+		w.decide(r, req, decision)
+	})
+}
+
+// decide 执行认证决定：通过后开启数据面或转交 LNS，拒绝后结束会话，Ignore 时不回复。r 为代理认证的原始请求
+func (w *Worker) decide(r ppp.AuthRequest, req auth.Request, d auth.Decision) {
+	// 等待决定期间会话可能已经结束
+	if cur, ok := w.h.worker(frameKey(link.Frame{SrcMac: w.srcMac, Vlans: w.vlans})); !ok || cur != w {
+		return
+	}
+	w.log().Info("auth decision", "method", req.Method, "verdict", d.Verdict, "user", req.Username)
+	w.h.metrics.IncAuthResult(w.h.adapterID(), req.Method, d.Verdict.String())
+	switch d.Verdict {
+	case auth.Accept:
+		w.updateSession(func(s *Session) {
+			s.Attributes = d.Attributes
+		})
+		if w.h.lac != nil {
+			// 建立隧道较慢，forward 只在访问 Engine 时持有 inMu，转交之前的帧由 Engine 处理
+			w.forward(r)
+			return
+		}
+		w.inMu.Lock()
+		defer w.inMu.Unlock()
+		w.engine.AuthDone(true, d.Message)
+		if w.h.dp != nil {
+			w.startNetwork()
+		} else {
+			w.startAccounting()
+		}
+	case auth.Reject:
+		w.h.callback(EventSessionAuthRejected, mac(w.h.adapterMac), mac(w.srcMac))
+		w.inMu.Lock()
+		defer w.inMu.Unlock()
+		w.engine.AuthDone(false, d.Message)
+		w.terminate()
+	}
+}
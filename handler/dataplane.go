@@ -0,0 +1,598 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"net"
+	"pppoe-probe/auth"
+	"pppoe-probe/goroutine"
+	"pppoe-probe/link"
+	"pppoe-probe/metrics"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"pppoe-probe/pppox"
+	"pppoe-probe/tun"
+	"strconv"
+	"sync"
+)
+
+// DefaultMRU 数据面本端的默认 MRU，以太网 MTU 1500 减去 PPPoE 头 6 字节和 PPP 协议字段 2 字节
+const DefaultMRU = 1492
+
+// DataPlaneConfig 数据面配置。
+// 开启后处理器作为一个简易 BRAS：PAP 认证通过后完成 IPCP/IPv6CP 协商，
+// 并在 PPPoE 会话和 TUN 设备之间转发 IPv4（0x0021）和 IPv6（0x0057）报文。
+type DataPlaneConfig struct {
+	// Gateway BRAS 侧的 IPv4 地址，在 IPCP 中告知对端
+	Gateway net.IP
+	// Pool 分配给对端的 IPv4 地址池，不分配网络地址、广播地址和 Gateway
+	Pool         *net.IPNet
+	PrimaryDNS   net.IP
+	SecondaryDNS net.IP
+	// MRU 本端的 MRU，为 0 时使用 DefaultMRU，同时作为 TUN 设备的 MTU
+	MRU uint16
+	// TunName 共享 TUN 设备的名称；PerSessionTun 时作为前缀，设备名为前缀加会话 ID
+	TunName string
+	// PerSessionTun 为每个会话创建一个点对点 TUN 设备（Gateway 到对端地址），
+	// 否则所有会话共用一个 TUN 设备，需要自行为设备配置地址并把地址池路由到该设备。
+	// 共享设备上的 IPv6 报文按目的地址的低 64 位（IPv6CP 协商的接口标识）找到会话。
+	PerSessionTun bool
+	// OpenTun 创建 TUN 设备，为 nil 时使用 tun.Open
+	OpenTun func(name string, mtu int) (tun.Device, error)
+	// KernelOffload 发现阶段完成后把会话交给 Linux 内核 PPPoE（AF_PPPOX），
+	// 控制报文经 /dev/ppp 通道仍由本程序处理，IPCP 完成后创建 pppN 网卡，IP 报文在内核中转发。
+	// 需要 pppoe 内核模块和 CAP_NET_ADMIN；带 VLAN 标签的会话或连接失败时退回为每个会话创建 TUN 设备。
+	KernelOffload bool
+}
+
+type dataPlane struct {
+	h      *Handler
+	cfg    DataPlaneConfig
+	shared tun.Device
+
+	mu     sync.Mutex
+	leases map[string]*Worker
+	iids   map[string]*Worker
+}
+
+// SetDataPlane 开启数据面，需在 Run 之前调用。共享 TUN 设备在这里创建。
+func (h *Handler) SetDataPlane(cfg DataPlaneConfig) (err error) {
+	if cfg.Pool == nil || cfg.Pool.IP.To4() == nil {
+		err = errors.New("invalid ipv4 address pool")
+		return
+	}
+	if cfg.Gateway.To4() == nil {
+		err = errors.New("invalid gateway address")
+		return
+	}
+	if h.lac != nil {
+		err = errors.New("data plane conflicts with lac mode")
+		return
+	}
+	if h.relay != nil {
+		err = errors.New("data plane conflicts with relay mode")
+		return
+	}
+	if cfg.MRU == 0 {
+		cfg.MRU = DefaultMRU
+	}
+	if cfg.OpenTun == nil {
+		cfg.OpenTun = func(name string, mtu int) (tun.Device, error) {
+			return tun.Open(name, mtu)
+		}
+	}
+	dp := &dataPlane{
+		h:      h,
+		cfg:    cfg,
+		leases: make(map[string]*Worker),
+		iids:   make(map[string]*Worker),
+	}
+	if !cfg.PerSessionTun && !cfg.KernelOffload {
+		dp.shared, err = cfg.OpenTun(cfg.TunName, int(cfg.MRU))
+		if err != nil {
+			return
+		}
+		h.log(StageNetwork).Info("data plane uses shared tun", "tun", dp.shared.Name())
+	}
+	h.dp = dp
+	return
+}
+
+func (dp *dataPlane) start() {
+	if dp.shared == nil {
+		return
+	}
+	goroutine.GoWith(dp.h.logger, func() {
+		dp.readTun(dp.shared, nil)
+	})
+}
+
+func (dp *dataPlane) close() {
+	if dp.shared != nil {
+		_ = dp.shared.Close()
+	}
+}
+
+// readTun 从 TUN 设备读取报文并发给对应的会话，设备关闭后返回。
+// w 为 nil 时表示共享设备，按目的地址查找会话。
+func (dp *dataPlane) readTun(dev tun.Device, w *Worker) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			dp.h.log(StageNetwork).Debug("stop reading tun", "tun", dev.Name(), "err", err)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		target := w
+		if target == nil {
+			target = dp.route(buf[:n])
+		}
+		if target == nil {
+			dp.h.metrics.IncDataDropped(dp.h.adapterID(), metrics.DropNoRoute)
+			continue
+		}
+		target.sendData(buf[:n])
+	}
+}
+
+// route 按目的地址查找会话
+func (dp *dataPlane) route(packet []byte) *Worker {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		return dp.leases[net.IP(packet[16:20]).String()]
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		return dp.iids[string(packet[32:40])]
+	}
+	return nil
+}
+
+// allocate 从地址池中分配一个未使用的地址，地址池耗尽时返回 nil。
+// preferred 在地址池内且未被占用时优先分配，例如认证返回的 Framed-IP-Address。
+func (dp *dataPlane) allocate(w *Worker, preferred net.IP) net.IP {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if ip := preferred.To4(); ip != nil && dp.cfg.Pool.Contains(ip) && !ip.Equal(dp.cfg.Gateway) {
+		if _, ok := dp.leases[ip.String()]; !ok {
+			dp.leases[ip.String()] = w
+			return ip
+		}
+		dp.h.log(StageNetwork).Warn("preferred address is in use, allocate from pool", "ip", ip, "peer_mac", mac(w.srcMac))
+	}
+	base := binary.BigEndian.Uint32(dp.cfg.Pool.IP.To4().Mask(dp.cfg.Pool.Mask))
+	ones, bits := dp.cfg.Pool.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	for offset := uint32(1); offset+1 < size; offset++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+offset)
+		if ip.Equal(dp.cfg.Gateway) {
+			continue
+		}
+		if _, ok := dp.leases[ip.String()]; ok {
+			continue
+		}
+		dp.leases[ip.String()] = w
+		return ip
+	}
+	return nil
+}
+
+func (dp *dataPlane) bindInterfaceID(w *Worker, iid []byte) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.iids[string(iid)] = w
+}
+
+func (dp *dataPlane) release(ip net.IP, iid []byte) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if ip != nil {
+		delete(dp.leases, ip.String())
+	}
+	if iid != nil {
+		delete(dp.iids, string(iid))
+	}
+}
+
+// network 会话认证之后的网络层状态，由 Worker.mu 保护
+type network struct {
+	ip            net.IP
+	ipcpID        byte
+	ipcpLocalOpen bool
+	ipcpPeerOpen  bool
+
+	localIID        []byte
+	peerIID         []byte
+	ipv6cpID        byte
+	ipv6cpLocalOpen bool
+	ipv6cpPeerOpen  bool
+
+	tun tun.Device
+	up  bool
+}
+
+// offload 把刚完成发现阶段的会话交给内核，失败时继续在用户态处理
+func (w *Worker) offload(sessionID uint16) {
+	if len(w.vlans) > 0 {
+		w.log().Warn("kernel offload does not support vlan, use user space data plane", "vlan", w.vlans)
+		return
+	}
+	s, err := pppox.Connect(w.h.adapterName, sessionID, w.srcMac)
+	if err != nil {
+		w.log().Warn("kernel offload failed, use user space data plane", "err", err)
+		return
+	}
+	w.mu.Lock()
+	w.kernel = s
+	w.mu.Unlock()
+	w.log().Info("session is carried by kernel pppoe")
+	go w.readKernel(s, sessionID)
+}
+
+// readKernel 读取内核通道中的 PPP 控制报文，补上 PPPoE 头后按普通会话帧处理
+func (w *Worker) readKernel(s *pppox.Session, sessionID uint16) {
+	for {
+		frame, err := s.ReadFrame()
+		if err != nil {
+			return
+		}
+		w.handleFrame(link.Frame{
+			SrcMac:    w.srcMac,
+			DstMac:    w.h.adapterMac,
+			EtherType: layers.EthernetTypePPPoESession,
+			Payload:   pppoe.PPPoES{VersionAndType: pppoe.VersionAndType, SessionID: sessionID, Payload: frame}.Encode(),
+		})
+	}
+}
+
+// kernelSession 会话由内核承载时返回内核会话
+func (w *Worker) kernelSession() *pppox.Session {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.kernel
+}
+
+// startNetwork 认证通过后分配地址并发起 IPCP 和 IPv6CP 协商
+func (w *Worker) startNetwork() {
+	dp := w.h.dp
+	ip := dp.allocate(w, net.ParseIP(w.Session().Attributes[auth.AttrFramedIPAddress]))
+	if ip == nil {
+		w.log().Error("address pool exhausted, terminate session")
+		w.terminate()
+		return
+	}
+	localIID := make([]byte, 8)
+	_, _ = rand.Read(localIID)
+	localIID[0] &^= 0x02
+	w.mu.Lock()
+	w.network.ip = ip
+	w.network.localIID = localIID
+	w.network.ipcpID = 1
+	w.network.ipv6cpID = 1
+	w.session.Stage = StageNetwork
+	w.session.IP = ip.String()
+	w.mu.Unlock()
+	w.log().Info("assign address", "ip", ip)
+	w.sendIPCPRequest()
+	w.sendIPv6CPRequest()
+}
+
+func (w *Worker) sendIPCPRequest() {
+	w.mu.Lock()
+	id := w.network.ipcpID
+	w.mu.Unlock()
+	w.sendPPP(&ppp.Frame{
+		Protocol: ppp.ProtocolIPCP,
+		IPCtrlProtocol: ppp.IPCtrlProtocol{
+			Code:       ppp.LinkCodeConfigRequest,
+			Identifier: id,
+			IPAddress:  w.h.dp.cfg.Gateway.To4(),
+		},
+	})
+}
+
+func (w *Worker) sendIPv6CPRequest() {
+	w.mu.Lock()
+	id := w.network.ipv6cpID
+	iid := w.network.localIID
+	w.mu.Unlock()
+	w.sendPPP(&ppp.Frame{
+		Protocol: ppp.ProtocolIPv6CP,
+		IPv6CtrlProtocol: ppp.IPv6CtrlProtocol{
+			Code:        ppp.LinkCodeConfigRequest,
+			Identifier:  id,
+			InterfaceID: iid,
+		},
+	})
+}
+
+func (w *Worker) handleIPCtrlProtocol(ipcp ppp.IPCtrlProtocol) {
+	w.log().Debug("handle pppoe session ipcp", "code", ipcp.GetShowCode(), "ip", ipcp.IPAddress)
+	w.mu.Lock()
+	ip := w.network.ip
+	localOpen := w.network.ipcpLocalOpen
+	w.mu.Unlock()
+	if ip == nil {
+		return
+	}
+	switch ipcp.Code {
+	case ppp.LinkCodeConfigRequest:
+		// 对端会重传请求，借此重传本端还没被确认的请求
+		if !localOpen {
+			w.sendIPCPRequest()
+		}
+		reply := w.ipcpReply(ipcp, ip)
+		if reply.Code == ppp.LinkCodeConfigAck {
+			w.mu.Lock()
+			w.network.ipcpPeerOpen = true
+			w.mu.Unlock()
+		}
+		w.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: reply})
+	case ppp.LinkCodeConfigAck:
+		w.mu.Lock()
+		if ipcp.Identifier == w.network.ipcpID {
+			w.network.ipcpLocalOpen = true
+		}
+		w.mu.Unlock()
+	case ppp.LinkCodeConfigNak, ppp.LinkCodeConfigReject:
+		// 本端只请求了网关地址，不接受修改
+		w.log().Warn("peer refused gateway address in ipcp")
+	}
+	w.checkNetworkUp()
+}
+
+// ipcpReply 对端请求的地址必须是分配的地址且必须请求地址，DNS 必须是配置的 DNS，未配置 DNS 时拒绝 DNS 配置项
+func (w *Worker) ipcpReply(ipcp ppp.IPCtrlProtocol, ip net.IP) (reply ppp.IPCtrlProtocol) {
+	cfg := w.h.dp.cfg
+	reply.Identifier = ipcp.Identifier
+	reply.UnknownOptions = ipcp.UnknownOptions
+	if ipcp.PrimaryDNS != nil && cfg.PrimaryDNS == nil {
+		reply.PrimaryDNS = ipcp.PrimaryDNS
+	}
+	if ipcp.SecondaryDNS != nil && cfg.SecondaryDNS == nil {
+		reply.SecondaryDNS = ipcp.SecondaryDNS
+	}
+	if len(reply.UnknownOptions) > 0 || reply.PrimaryDNS != nil || reply.SecondaryDNS != nil {
+		reply.Code = ppp.LinkCodeConfigReject
+		return
+	}
+	// 没有带 IP-Address 的请求也 Nak，告知对端分配的地址（RFC 1332 3.3）
+	if ipcp.IPAddress == nil || !ipcp.IPAddress.Equal(ip) {
+		reply.IPAddress = ip
+	}
+	if ipcp.PrimaryDNS != nil && !ipcp.PrimaryDNS.Equal(cfg.PrimaryDNS) {
+		reply.PrimaryDNS = cfg.PrimaryDNS.To4()
+	}
+	if ipcp.SecondaryDNS != nil && !ipcp.SecondaryDNS.Equal(cfg.SecondaryDNS) {
+		reply.SecondaryDNS = cfg.SecondaryDNS.To4()
+	}
+	if reply.IPAddress != nil || reply.PrimaryDNS != nil || reply.SecondaryDNS != nil {
+		reply.Code = ppp.LinkCodeConfigNak
+		return
+	}
+	reply = ipcp
+	reply.Code = ppp.LinkCodeConfigAck
+	return
+}
+
+func (w *Worker) handleIPv6CtrlProtocol(ipv6cp ppp.IPv6CtrlProtocol) {
+	w.log().Debug("handle pppoe session ipv6cp", "code", ipv6cp.GetShowCode())
+	w.mu.Lock()
+	localIID := w.network.localIID
+	localOpen := w.network.ipv6cpLocalOpen
+	w.mu.Unlock()
+	if localIID == nil {
+		return
+	}
+	switch ipv6cp.Code {
+	case ppp.LinkCodeConfigRequest:
+		if !localOpen {
+			w.sendIPv6CPRequest()
+		}
+		reply := ppp.IPv6CtrlProtocol{Identifier: ipv6cp.Identifier}
+		switch {
+		case len(ipv6cp.UnknownOptions) > 0:
+			reply.Code = ppp.LinkCodeConfigReject
+			reply.UnknownOptions = ipv6cp.UnknownOptions
+		case ipv6cp.InterfaceID == nil || binary.BigEndian.Uint64(ipv6cp.InterfaceID) == 0 || string(ipv6cp.InterfaceID) == string(localIID):
+			// RFC 5072 4.1：对端没有或与本端冲突的接口标识，建议一个新的
+			suggest := make([]byte, 8)
+			_, _ = rand.Read(suggest)
+			suggest[0] &^= 0x02
+			reply.Code = ppp.LinkCodeConfigNak
+			reply.InterfaceID = suggest
+		default:
+			reply = ipv6cp
+			reply.Code = ppp.LinkCodeConfigAck
+			peerIID := append([]byte(nil), ipv6cp.InterfaceID...)
+			w.mu.Lock()
+			w.network.peerIID = peerIID
+			w.network.ipv6cpPeerOpen = true
+			w.mu.Unlock()
+			w.h.dp.bindInterfaceID(w, peerIID)
+		}
+		w.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv6CP, IPv6CtrlProtocol: reply})
+	case ppp.LinkCodeConfigAck:
+		w.mu.Lock()
+		if ipv6cp.Identifier == w.network.ipv6cpID {
+			w.network.ipv6cpLocalOpen = true
+		}
+		w.mu.Unlock()
+	case ppp.LinkCodeConfigNak:
+		if len(ipv6cp.InterfaceID) == 8 {
+			w.mu.Lock()
+			w.network.localIID = append([]byte(nil), ipv6cp.InterfaceID...)
+			w.network.ipv6cpID++
+			w.mu.Unlock()
+			w.sendIPv6CPRequest()
+		}
+	case ppp.LinkCodeConfigReject:
+		w.log().Warn("peer rejected ipv6cp interface identifier")
+	}
+}
+
+// checkNetworkUp IPCP 双向确认后会话开始转发数据
+func (w *Worker) checkNetworkUp() {
+	w.mu.Lock()
+	n := &w.network
+	if n.up || !n.ipcpLocalOpen || !n.ipcpPeerOpen {
+		w.mu.Unlock()
+		return
+	}
+	n.up = true
+	w.session.Up = true
+	ip := n.ip
+	sessionID := w.session.SessionID
+	w.mu.Unlock()
+
+	dp := w.h.dp
+	if kernel := w.kernelSession(); kernel != nil {
+		name, err := kernel.ConnectUnit(int(dp.cfg.MRU))
+		if err == nil {
+			err = tun.ConfigurePointToPoint(name, dp.cfg.Gateway, ip)
+		}
+		if err != nil {
+			w.log().Error("failed to set up kernel ppp unit", "err", err)
+			w.terminate()
+			return
+		}
+		w.updateSession(func(s *Session) {
+			s.Interface = name
+		})
+	} else if dp.cfg.PerSessionTun || dp.cfg.KernelOffload {
+		dev, err := dp.cfg.OpenTun(dp.cfg.TunName+strconv.Itoa(int(sessionID)), int(dp.cfg.MRU))
+		if err != nil {
+			w.log().Error("failed to open tun", "err", err)
+			w.terminate()
+			return
+		}
+		if p2p, ok := dev.(tun.PointToPoint); ok {
+			if err = p2p.SetPointToPoint(dp.cfg.Gateway, ip); err != nil {
+				w.log().Error("failed to set tun address", "tun", dev.Name(), "err", err)
+			}
+		}
+		w.mu.Lock()
+		w.network.tun = dev
+		w.session.Interface = dev.Name()
+		w.mu.Unlock()
+		// 每个会话一个读协程，数量不固定，不使用 goroutine.Go 以免占满其并发上限
+		go dp.readTun(dev, w)
+	}
+	w.log().Info("session is up", "ip", ip)
+	w.startAccounting()
+	w.h.callback(EventSessionUp, mac(w.h.adapterMac), w.Session())
+}
+
+// handleData 转发对端发来的 IPv4/IPv6 报文
+func (w *Worker) handleData(protocol ppp.Protocol, data []byte) {
+	adapter := w.h.adapterID()
+	w.mu.Lock()
+	ready := w.network.up
+	if protocol == ppp.ProtocolIPv6 {
+		ready = ready && w.network.ipv6cpPeerOpen
+	}
+	ip, peerIID := w.network.ip, w.network.peerIID
+	dev := w.network.tun
+	w.mu.Unlock()
+	if dev == nil {
+		dev = w.h.dp.shared
+	}
+	if !ready || dev == nil {
+		w.h.metrics.IncDataDropped(adapter, metrics.DropNotReady)
+		return
+	}
+	if !sourceAllowed(protocol, data, ip, peerIID) {
+		w.h.metrics.IncDataDropped(adapter, metrics.DropSpoofed)
+		return
+	}
+	if len(data) > int(w.h.dp.cfg.MRU) {
+		w.h.metrics.IncDataDropped(adapter, metrics.DropTooBig)
+		return
+	}
+	if _, err := dev.Write(data); err != nil {
+		w.log().Debug("write tun", "tun", dev.Name(), "err", err)
+		return
+	}
+	w.h.metrics.AddData(adapter, metrics.DirectionRx, len(data))
+	w.updateSession(func(s *Session) {
+		s.RxPackets++
+		s.RxBytes += uint64(len(data))
+	})
+}
+
+// sourceAllowed 对端只能以分配的 IPv4 地址，或以 IPv6CP 协商的接口标识结尾的 IPv6 地址发出报文
+func sourceAllowed(protocol ppp.Protocol, data []byte, ip net.IP, peerIID []byte) bool {
+	switch protocol {
+	case ppp.ProtocolIPv4:
+		return len(data) >= 20 && data[0]>>4 == 4 && ip.Equal(net.IP(data[12:16]))
+	case ppp.ProtocolIPv6:
+		return len(data) >= 40 && data[0]>>4 == 6 && len(peerIID) == 8 && bytes.Equal(data[16:24], peerIID)
+	}
+	return false
+}
+
+// sendData 将 TUN 设备读到的报文封装后发给对端，超过对端 MRU 的报文直接丢弃
+func (w *Worker) sendData(packet []byte) {
+	adapter := w.h.adapterID()
+	protocol := ppp.ProtocolIPv4
+	if packet[0]>>4 == 6 {
+		protocol = ppp.ProtocolIPv6
+	}
+	w.mu.Lock()
+	ready := w.network.up
+	if protocol == ppp.ProtocolIPv6 {
+		ready = ready && w.network.ipv6cpPeerOpen
+	}
+	sessionID := w.session.SessionID
+	w.mu.Unlock()
+	peerMRU := w.engine.PeerMRU()
+	if !ready {
+		w.h.metrics.IncDataDropped(adapter, metrics.DropNotReady)
+		return
+	}
+	if peerMRU == 0 {
+		peerMRU = DefaultMRU
+	}
+	if len(packet) > int(peerMRU) {
+		w.h.metrics.IncDataDropped(adapter, metrics.DropTooBig)
+		return
+	}
+	f := ppp.Frame{Protocol: protocol, Data: packet}
+	w.sendMu.Lock()
+	w.payloadBuf = pppoe.AppendSessionFrame(w.payloadBuf[:0], sessionID, &f)
+	w.writeFrame(layers.EthernetTypePPPoESession, w.payloadBuf)
+	w.sendMu.Unlock()
+	w.h.metrics.AddData(adapter, metrics.DirectionTx, len(packet))
+	w.updateSession(func(s *Session) {
+		s.TxPackets++
+		s.TxBytes += uint64(len(packet))
+	})
+}
+
+// stopNetwork 释放地址和 TUN 设备，返回会话之前是否已经建立
+func (w *Worker) stopNetwork() (wasUp bool) {
+	w.mu.Lock()
+	n := w.network
+	kernel := w.kernel
+	w.network = network{}
+	w.kernel = nil
+	w.session.Up = false
+	w.mu.Unlock()
+	if kernel != nil {
+		kernel.Close()
+	}
+	if w.h.dp != nil {
+		w.h.dp.release(n.ip, n.peerIID)
+	}
+	if n.tun != nil {
+		_ = n.tun.Close()
+	}
+	return n.up
+}
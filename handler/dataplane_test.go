@@ -0,0 +1,322 @@
+package handler
+
+import (
+	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"pppoe-probe/auth"
+	"pppoe-probe/link"
+	"pppoe-probe/metrics"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"pppoe-probe/tun"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTun 内存中的 TUN 设备，in 中的报文由 Read 返回，Write 写入的报文发到 out
+type fakeTun struct {
+	name   string
+	in     chan []byte
+	out    chan []byte
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newFakeTun(name string) *fakeTun {
+	return &fakeTun{name: name, in: make(chan []byte, 16), out: make(chan []byte, 16), closed: make(chan struct{})}
+}
+
+func (d *fakeTun) Name() string {
+	return d.name
+}
+
+func (d *fakeTun) Read(p []byte) (int, error) {
+	select {
+	case packet := <-d.in:
+		return copy(p, packet), nil
+	case <-d.closed:
+		return 0, errors.New("tun closed")
+	}
+}
+
+func (d *fakeTun) Write(p []byte) (int, error) {
+	d.out <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (d *fakeTun) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
+
+func (d *fakeTun) empty() bool {
+	return len(d.out) == 0
+}
+
+// ipv4Packet 只有首部的 IPv4 报文
+func ipv4Packet(src net.IP, dst net.IP) []byte {
+	packet := make([]byte, 20)
+	packet[0] = 0x45
+	packet[3] = 20
+	packet[8] = 64
+	copy(packet[12:16], src.To4())
+	copy(packet[16:20], dst.To4())
+	return packet
+}
+
+// ipv6Packet 只有首部的 IPv6 报文
+func ipv6Packet(src net.IP, dst net.IP) []byte {
+	packet := make([]byte, 40)
+	packet[0] = 0x60
+	packet[6] = 59
+	packet[7] = 64
+	copy(packet[8:24], src.To16())
+	copy(packet[24:40], dst.To16())
+	return packet
+}
+
+// expect 读取 Handler 发出的帧直到收到 protocol 的 code 报文，LCP 和认证报文交给 Engine，其余忽略
+func (p *testPeer) expect(protocol ppp.Protocol, code ppp.LinkCode) (frame ppp.Frame) {
+	t := p.t
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		f := p.w.next(t)
+		var pppoes pppoe.PPPoES
+		frame = ppp.Frame{}
+		if !assert.Nil(t, pppoe.DecodeSessionFrameInto(&pppoes, &frame, f.Payload)) {
+			continue
+		}
+		switch frame.Protocol {
+		case protocol:
+			if frame.IPCtrlProtocol.Code == code && protocol == ppp.ProtocolIPCP || frame.IPv6CtrlProtocol.Code == code && protocol == ppp.ProtocolIPv6CP {
+				return
+			}
+		case ppp.ProtocolLCP, ppp.ProtocolPAP, ppp.ProtocolCHAP:
+			p.engine.Input(&frame)
+		}
+	}
+	t.Fatalf("%v %v not received", protocol, code)
+	return
+}
+
+func newTestDataPlane(t *testing.T, rec *eventRecorder) (h *Handler, w *fakeWriter, dev *fakeTun, c *metrics.Collector) {
+	h, w = newTestHandler(rec)
+	c = metrics.NewCollector()
+	h.SetMetrics(c)
+	h.SetAuthenticator(auth.AcceptAll)
+	dev = newFakeTun("pppoe0")
+	_, pool, _ := net.ParseCIDR("10.64.0.0/24")
+	err := h.SetDataPlane(DataPlaneConfig{
+		Gateway:    net.ParseIP("10.64.0.1"),
+		Pool:       pool,
+		PrimaryDNS: net.ParseIP("10.64.0.53"),
+		OpenTun: func(name string, mtu int) (tun.Device, error) {
+			return dev, nil
+		},
+	})
+	assert.Nil(t, err)
+	run(t, h)
+	return
+}
+
+func TestHandler_DataPlaneIPCP(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w, _, _ := newTestDataPlane(t, rec)
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	peer.discover()
+	peer.authenticate()
+
+	req := peer.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigRequest)
+	assert.Equal(t, net.ParseIP("10.64.0.1").To4(), req.IPCtrlProtocol.IPAddress)
+	assert.Equal(t, ppp.PhaseNetwork, peer.engine.Phase())
+
+	// 没有 IP-Address 的请求也 Nak，带上分配的地址
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1}})
+	nak := peer.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigNak)
+	assert.Equal(t, ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigNak, Identifier: 1, IPAddress: net.ParseIP("10.64.0.2").To4()}, nak.IPCtrlProtocol)
+
+	// 请求的地址不是分配的地址、DNS 不是配置的 DNS
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 2, IPAddress: net.IPv4zero.To4(), PrimaryDNS: net.IPv4zero.To4()}})
+	nak = peer.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigNak)
+	assert.Equal(t, ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigNak, Identifier: 2, IPAddress: net.ParseIP("10.64.0.2").To4(), PrimaryDNS: net.ParseIP("10.64.0.53").To4()}, nak.IPCtrlProtocol)
+
+	// 未配置辅 DNS 时拒绝该配置项
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 3, IPAddress: net.IPv4zero.To4(), SecondaryDNS: net.IPv4zero.To4()}})
+	rej := peer.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigReject)
+	assert.Equal(t, ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigReject, Identifier: 3, SecondaryDNS: net.IPv4zero.To4()}, rej.IPCtrlProtocol)
+
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 4, IPAddress: net.ParseIP("10.64.0.2").To4()}})
+	ack := peer.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigAck)
+	assert.Equal(t, byte(4), ack.IPCtrlProtocol.Identifier)
+	assert.Empty(t, rec.all(EventSessionUp))
+
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigAck, Identifier: req.IPCtrlProtocol.Identifier, IPAddress: req.IPCtrlProtocol.IPAddress}})
+	args := rec.wait(t, EventSessionUp)
+	assert.Equal(t, "10.64.0.2", args[1].(Session).IP)
+}
+
+// up 完成认证和 IPCP，返回分配的地址
+func (p *testPeer) up(rec *eventRecorder) net.IP {
+	p.t.Helper()
+	p.discover()
+	p.authenticate()
+	req := p.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigRequest)
+	p.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1}})
+	ip := p.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigNak).IPCtrlProtocol.IPAddress
+	p.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 2, IPAddress: ip}})
+	p.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigAck)
+	p.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigAck, Identifier: req.IPCtrlProtocol.Identifier, IPAddress: req.IPCtrlProtocol.IPAddress}})
+	rec.wait(p.t, EventSessionUp)
+	return ip
+}
+
+// 网络阶段对端重新协商 LCP 时关闭网络层，重新认证后再次建立
+func TestHandler_DataPlaneRenegotiate(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w, dev, _ := newTestDataPlane(t, rec)
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	ip := peer.up(rec)
+
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 0x40, MagicNumber: 0x11223344}})
+	assert.Len(t, rec.all(EventSessionDown), 1)
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv4, Data: ipv4Packet(ip, net.ParseIP("198.51.100.1"))})
+	assert.True(t, dev.empty())
+
+	peer.exchange()
+	req := peer.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigRequest)
+	assert.Equal(t, ppp.PhaseNetwork, peer.engine.Phase())
+	assert.Equal(t, []bool{true, true}, peer.results)
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1, IPAddress: ip}})
+	peer.expect(ppp.ProtocolIPCP, ppp.LinkCodeConfigAck)
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigAck, Identifier: req.IPCtrlProtocol.Identifier, IPAddress: req.IPCtrlProtocol.IPAddress}})
+	deadline := time.Now().Add(testTimeout)
+	for len(rec.all(EventSessionUp)) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Len(t, rec.all(EventSessionUp), 2)
+	assert.Len(t, h.Sessions(), 1)
+}
+
+func TestHandler_DataPlaneSource(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w, dev, c := newTestDataPlane(t, rec)
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	ip := peer.up(rec)
+	internet := net.ParseIP("198.51.100.1")
+
+	// IPv4 只转发源地址为分配地址的报文
+	packet := ipv4Packet(ip, internet)
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv4, Data: packet})
+	assert.Equal(t, packet, <-dev.out)
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv4, Data: ipv4Packet(net.ParseIP("10.64.0.3"), internet)})
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv4, Data: ipv6Packet(net.ParseIP("fe80::1"), net.ParseIP("2001:db8::1"))})
+	assert.True(t, dev.empty())
+
+	// IPv6CP 完成之前不转发 IPv6
+	iid := []byte{0x02, 0x11, 0x22, 0xff, 0xfe, 0x33, 0x44, 0x55}
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv6, Data: ipv6Packet(net.ParseIP("fe80::211:22ff:fe33:4455"), net.ParseIP("2001:db8::1"))})
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv6CP, IPv6CtrlProtocol: ppp.IPv6CtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1, InterfaceID: iid}})
+	peer.expect(ppp.ProtocolIPv6CP, ppp.LinkCodeConfigAck)
+
+	// IPv6 只转发接口标识为协商结果的报文，前缀不限
+	for _, src := range []string{"fe80::211:22ff:fe33:4455", "2001:db8:1::211:22ff:fe33:4455"} {
+		packet = ipv6Packet(net.ParseIP(src), net.ParseIP("2001:db8::1"))
+		peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv6, Data: packet})
+		assert.Equal(t, packet, <-dev.out, src)
+	}
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv6, Data: ipv6Packet(net.ParseIP("2001:db8:1::1"), net.ParseIP("2001:db8::1"))})
+	assert.True(t, dev.empty())
+
+	sessions := h.Sessions()
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, uint64(3), sessions[0].RxPackets)
+	}
+	var sb strings.Builder
+	_, err := c.WriteTo(&sb)
+	assert.Nil(t, err)
+	assert.Contains(t, sb.String(), `pppoe_data_dropped_total{adapter="00:e0:4c:36:17:f8",reason="spoofed"} 3`+"\n")
+	assert.Contains(t, sb.String(), `pppoe_data_dropped_total{adapter="00:e0:4c:36:17:f8",reason="not_ready"} 1`+"\n")
+
+	// TUN 上发往分配地址的报文转发给对端
+	packet = ipv4Packet(internet, ip)
+	dev.in <- packet
+	frame := peer.expectData()
+	assert.Equal(t, ppp.ProtocolIPv4, frame.Protocol)
+	assert.Equal(t, packet, frame.Data)
+}
+
+// expectData 读取 Handler 发出的帧直到收到 IP 报文
+func (p *testPeer) expectData() (frame ppp.Frame) {
+	t := p.t
+	t.Helper()
+	for i := 0; i < 16; i++ {
+		f := p.w.next(t)
+		var pppoes pppoe.PPPoES
+		frame = ppp.Frame{}
+		assert.Nil(t, pppoe.DecodeSessionFrameInto(&pppoes, &frame, f.Payload))
+		if frame.Protocol == ppp.ProtocolIPv4 || frame.Protocol == ppp.ProtocolIPv6 {
+			return
+		}
+	}
+	t.Fatal("data not received")
+	return
+}
+
+// 内核承载的会话从 /dev/ppp 通道读到的控制报文与抓包协程收到的帧同时交给 Worker，需要 -race 检查
+func TestWorker_ConcurrentInput(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w, dev, _ := newTestDataPlane(t, rec)
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	ip := peer.up(rec)
+	worker, ok := h.worker(frameKey(link.Frame{SrcMac: testPeerMac}))
+	if !assert.True(t, ok) {
+		return
+	}
+
+	const n = 50
+	forwarded := make(chan int)
+	go func() {
+		count := 0
+		for count < n {
+			<-dev.out
+			count++
+		}
+		forwarded <- count
+	}()
+	iid := []byte{0x02, 0x11, 0x22, 0xff, 0xfe, 0x33, 0x44, 0x55}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolIPv4, Data: ipv4Packet(ip, net.ParseIP("198.51.100.1"))})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// 同 readKernel，补上 PPPoE 头后直接交给 Worker
+		for i := 0; i < n; i++ {
+			f := ppp.Frame{Protocol: ppp.ProtocolIPv6CP, IPv6CtrlProtocol: ppp.IPv6CtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: byte(i), InterfaceID: iid}}
+			worker.handleFrame(link.Frame{SrcMac: testPeerMac, DstMac: testAdapterMac, EtherType: layers.EthernetTypePPPoESession, Payload: pppoe.AppendSessionFrame(nil, peer.sessionID, &f)})
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, n, <-forwarded)
+
+	acks := 0
+	for !w.empty() {
+		var pppoes pppoe.PPPoES
+		var frame ppp.Frame
+		assert.Nil(t, pppoe.DecodeSessionFrameInto(&pppoes, &frame, w.next(t).Payload))
+		if frame.Protocol == ppp.ProtocolIPv6CP && frame.IPv6CtrlProtocol.Code == ppp.LinkCodeConfigAck {
+			acks++
+		}
+	}
+	assert.Equal(t, n, acks)
+	assert.Equal(t, uint64(n), worker.Session().RxPackets)
+}
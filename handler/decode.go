@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"encoding/hex"
+	"errors"
+	"pppoe-probe/link"
+	"pppoe-probe/ppp"
+)
+
+// FrameSnippetLen DecodeFailure.Frame 最多包含的字节数
+const FrameSnippetLen = 64
+
+// DecodeFailure 无法解码的 PPPoE 帧，EventDecodeError 的参数。
+// Layer、Field、Offset、Expected、Actual 和 Reason 取自 ppp.DecodeError，不是该类型的错误时只有 Layer 和 Message。
+type DecodeFailure struct {
+	PeerMac  string `json:"peer_mac"`
+	Vlan     string `json:"vlan,omitempty"`
+	Layer    string `json:"layer"`
+	Field    string `json:"field,omitempty"`
+	Offset   int    `json:"offset"`
+	Expected int    `json:"expected,omitempty"`
+	Actual   int    `json:"actual,omitempty"`
+	// Reason truncated、invalid length、bad version 或 unknown code
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message"`
+	// Frame 从 PPPoE 头开始的前 FrameSnippetLen 字节的十六进制，Offset 以 PPPoE 头为起点。
+	// 串口链路上从 PPP 协议字段开始，FCS 错误时为空
+	Frame string `json:"frame"`
+	// Err 原始错误，可以用 errors.Is、errors.As 判断
+	Err error `json:"-"`
+}
+
+func newDecodeFailure(f link.Frame, layer string, err error) DecodeFailure {
+	snippet := f.Payload
+	if len(snippet) > FrameSnippetLen {
+		snippet = snippet[:FrameSnippetLen]
+	}
+	d := DecodeFailure{
+		PeerMac: mac(f.SrcMac),
+		Vlan:    f.Vlans.String(),
+		Layer:   layer,
+		Message: err.Error(),
+		Frame:   hex.EncodeToString(snippet),
+		Err:     err,
+	}
+	var de *ppp.DecodeError
+	if errors.As(err, &de) {
+		d.Layer, d.Field, d.Offset = de.Layer, de.Field, de.Offset
+		d.Expected, d.Actual = de.Expected, de.Actual
+		d.Reason = de.Err.Error()
+	}
+	return d
+}
+
+// decodeError 统计并上报无法解码的帧，layer 为外层协议 metrics.LayerPPPoED、metrics.LayerPPPoES 或 metrics.LayerHDLC
+func (h *Handler) decodeError(f link.Frame, layer string, err error) {
+	h.metrics.IncDecodeErrors(h.adapterID(), layer)
+	d := newDecodeFailure(f, layer, err)
+	h.log(StageHandler).Debug("failed to decode frame", "peer_mac", d.PeerMac, "vlan", d.Vlan, "err", err, "frame", d.Frame)
+	h.callback(EventDecodeError, h.adapterID(), d)
+}
@@ -1,129 +1,424 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"github.com/sirupsen/logrus"
+	"log/slog"
+	"pppoe-probe/auth"
 	"pppoe-probe/goroutine"
+	"pppoe-probe/link"
+	"pppoe-probe/metrics"
+	"pppoe-probe/ppp"
 	"pppoe-probe/pppoe"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const NovaDefaultAcName = "nova-tools"
 
 type Auth struct {
+	PeerMac  []byte
+	Vlan     string
+	Method   string
 	PeerID   string
 	Password string
 }
 
+// packetWriter 发送以太网帧，一般为 pcap handle，测试中替换为记录发送内容的实现
+type packetWriter interface {
+	WritePacketData(data []byte) error
+}
+
 // Handler 网络封包处理器。
 // 一个处理器仅绑定一个网卡，启动后处理该网卡的所有封包。并通过 handler.Listener 函数回传事件。
 // 各个方法都不支持并发调用。GUI 界面的并发在 GUI 那边用弹窗等待的方式处理掉了。
 type Handler struct {
-	adapterName string
-	adapterMac  []byte
-	handle      *pcap.Handle
-	mac2Worker  map[string]*Worker
-	workerDone  chan *Auth
-	cb          Listener
-	running     bool
+	adapterName   string
+	adapterMac    []byte
+	handle        *pcap.Handle
+	promisc       bool
+	writer        packetWriter
+	mu            sync.Mutex
+	mac2Worker    map[string]*Worker
+	workerDone    chan *Auth
+	done          chan struct{}
+	cb            Listener
+	running       bool
+	acName        string
+	metrics       *metrics.Collector
+	vlans         map[uint16]bool
+	vlanStacks    []link.VlanStack
+	monitor       *monitor
+	acs           *acRegistry
+	dp            *dataPlane
+	lac           *lac
+	relay         *relay
+	serial        *serialLink
+	sessionSeq    uint32
+	authenticator auth.Authenticator
+	authProtocol  ppp.AuthProtocol
+	accounter     auth.Accounter
+	acctInterim   time.Duration
+	redaction     Redaction
+	logger        *slog.Logger
 }
 
+// NewHandler 创建处理器，打开网卡失败时回调 EventError，返回的处理器不会收到任何封包。
 func NewHandler(AdapterName string, adapterMac []byte, cb Listener) (h *Handler) {
+	h, err := newHandler(AdapterName, adapterMac, cb, false)
+	if err != nil {
+		h.callback(EventError, fmt.Sprintf("初始化适配器(%s)监听器失败：%s", mac(h.adapterMac), err.Error()))
+	}
+	return
+}
+
+func newHandler(AdapterName string, adapterMac []byte, cb Listener, passive bool) (h *Handler, err error) {
+	h = newBaseHandler(AdapterName, adapterMac, cb)
+	h.SetLogger(nil)
+	if passive {
+		h.monitor = newMonitor()
+	}
+
+	// 旁路监听时需要混杂模式才能收到镜像过来的单播帧
+	err = h.openPcap(passive)
+	return
+}
+
+// openPcap 打开网卡，已经打开时关闭原来的 handle
+func (h *Handler) openPcap(promisc bool) (err error) {
+	handle, err := pcap.OpenLive(h.adapterName, 1024, promisc, time.Second*10)
+	if err != nil {
+		return
+	}
+	if h.handle != nil {
+		h.handle.Close()
+	}
+	h.handle, h.writer, h.promisc = handle, handle, promisc
+	return
+}
+
+// newBaseHandler 与链路无关的初始化，调用方设置好链路后再调用 SetLogger
+func newBaseHandler(adapterName string, adapterMac []byte, cb Listener) (h *Handler) {
 	h = &Handler{}
-	h.adapterName = AdapterName
+	h.adapterName = adapterName
 	h.mac2Worker = make(map[string]*Worker)
 	h.adapterMac = adapterMac
-	h.workerDone = make(chan *Auth, 1)
+	// 缓冲几组凭据，监听方较慢时不阻塞抓包
+	h.workerDone = make(chan *Auth, 16)
+	h.done = make(chan struct{})
 	h.cb = cb
+	h.acName = NovaDefaultAcName
+	h.authProtocol = ppp.AuthProtocolPassword
+	return
+}
 
-	var err error
-	h.handle, err = pcap.OpenLive(h.adapterName, 1024, false, time.Second*10)
-	if err != nil {
-		h.callback(EventError, fmt.Sprintf("初始化适配器(%s)监听器失败：%s", mac(h.adapterMac), err.Error()))
-		return
+// SetAcName 设置 PADO/PADS 中回复的 AC-Name，需在 Run 之前调用。
+func (h *Handler) SetAcName(acName string) {
+	h.acName = acName
+}
+
+// SetMetrics 设置统计收集器，为 nil 时不统计，需在 Run 之前调用。
+func (h *Handler) SetMetrics(c *metrics.Collector) {
+	h.metrics = c
+}
+
+// SetVlans 只应答最内层 VLAN ID 在 ids 中的帧，0 表示未打标签的帧。
+// 不调用 SetVlans 和 SetVlanStacks 时应答所有 VLAN 和未打标签的帧。需在 Run 之前调用。
+func (h *Handler) SetVlans(ids ...uint16) {
+	h.vlans = make(map[uint16]bool)
+	for _, id := range ids {
+		h.vlans[id] = true
+	}
+}
+
+// SetVlanStacks 只应答 VLAN 标签与 filters 之一匹配的帧，匹配规则见 link.VlanStack.Match，
+// 例如 100.35 只应答外层 100 内层 35 的帧，100.* 应答外层 100 下的所有帧。
+// 与 SetVlans 同时调用时满足任一条件即应答。需在 Run 之前调用。
+func (h *Handler) SetVlanStacks(filters ...link.VlanStack) {
+	h.vlanStacks = append([]link.VlanStack{}, filters...)
+}
+
+func (h *Handler) AdapterName() string {
+	return h.adapterName
+}
+
+func (h *Handler) AdapterMac() []byte {
+	return h.adapterMac
+}
+
+// adapterID 事件、日志和统计中标识本端的字符串：网卡 MAC，串口为设备路径
+func (h *Handler) adapterID() string {
+	if h.serial != nil {
+		return h.adapterName
+	}
+	return mac(h.adapterMac)
+}
+
+// Sessions 返回所有对端的会话状态快照，可与 Run 并发调用。
+func (h *Handler) Sessions() (sessions []Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, w := range h.mac2Worker {
+		sessions = append(sessions, w.Session())
 	}
 	return
 }
 
 // Run 阻塞函数。会一直等待 worker 回传认证数据。
 func (h *Handler) Run() {
-	logrus.Infoln("start watching network adapter:", mac(h.adapterMac))
-	h.callback(EventStart, mac(h.adapterMac))
-	defer h.callback(EventStop, mac(h.adapterMac))
+	h.log(StageHandler).Info("start watching network adapter")
+	h.callback(EventStart, h.adapterID())
+	defer h.callback(EventStop, h.adapterID())
 
-	goroutine.Go(func() {
+	if h.dp != nil {
+		h.dp.start()
+	}
+	if h.serial != nil {
+		h.serial.start()
+	}
+	goroutine.GoWith(h.logger, func() {
 		if h.handle == nil {
 			return
 		}
 		packetSource := gopacket.NewPacketSource(h.handle, h.handle.LinkType())
 		for packet := range packetSource.Packets() {
-			h.Handle(packet)
+			h.handleSafely(packet)
 		}
 	})
-	for d := range h.workerDone {
-		h.callback(EventSessionAuthRequest, d.PeerID, d.Password)
+	for {
+		select {
+		case d := <-h.workerDone:
+			h.captured(d)
+		case <-h.done:
+			// 上报关闭之前已经收到的凭据
+			for {
+				select {
+				case d := <-h.workerDone:
+					h.captured(d)
+				default:
+					h.log(StageHandler).Info("handler closed")
+					return
+				}
+			}
+		}
+	}
+}
+
+func (h *Handler) captured(d *Auth) {
+	h.metrics.IncCredentials(h.adapterID())
+	password := h.secret(d.Password)
+	h.callback(EventSessionAuthRequest, d.PeerID, password)
+	h.callback(EventSessionAuthCaptured, h.adapterID(), mac(d.PeerMac), d.PeerID, password, d.Method, d.Vlan)
+}
+
+// report 把捕获到的凭据交给 Run 上报，可在抓包协程中调用。Handler 已关闭时丢弃
+func (h *Handler) report(d *Auth) {
+	select {
+	case h.workerDone <- d:
+	case <-h.done:
 	}
-	logrus.Infoln("handler for", mac(h.adapterMac), "closed")
 }
 
 // Close 阻塞函数。pcap handle 启动后调用 Close 会阻塞几秒钟。
 func (h *Handler) Close() {
 	start := time.Now()
-	h.handle.Close()
-	h.handle = nil
-	close(h.workerDone)
-	logrus.Infoln("close handler for", mac(h.adapterMac), "use time:", time.Now().Sub(start).Milliseconds())
+	h.mu.Lock()
+	workers := make([]*Worker, 0, len(h.mac2Worker))
+	for _, w := range h.mac2Worker {
+		workers = append(workers, w)
+	}
+	h.mu.Unlock()
+	for _, w := range workers {
+		w.stopAccounting(auth.TerminateAdminReset, true)
+	}
+	if h.lac != nil {
+		// 隧道中的会话结束时向对端发送 PADT，需在 pcap handle 关闭之前
+		h.lac.close()
+	}
+	if h.handle != nil {
+		h.handle.Close()
+		h.handle = nil
+	}
+	if h.serial != nil {
+		h.serial.close()
+	}
+	if h.dp != nil {
+		for _, w := range workers {
+			w.stopNetwork()
+		}
+		h.dp.close()
+	}
+	close(h.done)
+	h.log(StageHandler).Info("close handler", "elapsed", time.Since(start))
+}
+
+// handleSafely 处理单个帧时的 panic 只丢弃该帧，不中断抓包
+func (h *Handler) handleSafely(packet gopacket.Packet) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.log(StageHandler).Error("recover from handling packet", "panic", r, "frame", hex.EncodeToString(packet.Data()), "stack", string(debug.Stack()))
+		}
+	}()
+	h.Handle(packet)
 }
 
 func (h *Handler) Handle(packet gopacket.Packet) {
-	ethPack, _ := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
-	key := hex.EncodeToString(ethPack.SrcMAC)
-	switch ethPack.EthernetType {
+	f, ok := link.DecodeFrame(packet)
+	if !ok || !h.answerVlan(f.Vlans) {
+		return
+	}
+	if h.monitor != nil {
+		h.handleMonitor(f)
+		return
+	}
+	if h.relay != nil {
+		h.relay.handle(h, f)
+		return
+	}
+	// 混杂模式下会收到发给其他设备的单播帧，只有 PADO/PADS 用于发现竞争的 AC
+	if !h.addressed(f) && !isOffer(f) {
+		return
+	}
+	key := frameKey(f)
+	switch f.EtherType {
 	case layers.EthernetTypePPPoEDiscovery:
-		pppoePack, _ := packet.Layer(layers.LayerTypePPPoE).(*layers.PPPoE)
-		switch pppoePack.Code {
-		case layers.PPPoECodePADI:
-			if _, ok := h.mac2Worker[key]; ok {
+		// 不依赖 gopacket 的 PPPoE 层，截断的帧解码失败时该层为 nil
+		if len(f.Payload) < pppoe.PPPoEDBasicLen {
+			_, err := pppoe.DecodePPPoED(f.Payload)
+			h.decodeError(f, metrics.LayerPPPoED, err)
+			return
+		}
+		switch pppoe.DCode(f.Payload[1]) {
+		case pppoe.CodePADI:
+			h.metrics.IncPADI(h.adapterID())
+			if !h.addWorker(key, f) {
+				return
+			}
+			h.callback(EventDiscoveryBroadcast, mac(h.adapterMac), mac(f.SrcMac))
+		case pppoe.CodePADR:
+			h.metrics.IncPADR(h.adapterID())
+			h.callback(EventDiscoverySessionConfirmation, mac(h.adapterMac), mac(f.SrcMac))
+		case pppoe.CodePADO, pppoe.CodePADS:
+			pppoed, err := pppoe.DecodePPPoED(f.Payload)
+			if err != nil {
+				h.decodeError(f, metrics.LayerPPPoED, err)
 				return
 			}
-			h.mac2Worker[key] = NewWorker(h, ethPack.SrcMAC)
-			h.callback(EventDiscoveryBroadcast, mac(h.adapterMac), mac(ethPack.SrcMAC))
-		case layers.PPPoECodePADR:
-			h.callback(EventDiscoverySessionConfirmation, mac(h.adapterMac), mac(ethPack.SrcMAC))
+			h.detectAC(f, pppoed)
+			return
 		}
 	case layers.EthernetTypePPPoESession:
-		if _, ok := h.mac2Worker[key]; !ok {
+		if _, ok := h.worker(key); !ok {
 			return
 		}
 
-		pppoes, err := pppoe.DecodePPPoES(ethPack.Payload)
-		if err != nil {
+		var pppoes pppoe.PPPoES
+		var frame ppp.Frame
+		if err := pppoe.DecodeSessionFrameInto(&pppoes, &frame, f.Payload); err != nil {
+			h.decodeError(f, metrics.LayerPPPoES, err)
 			return
 		}
-		switch pppoes.P2PProtocol {
-		case pppoe.P2PLinkCtrlProtocol:
-			switch pppoes.LinkProtocol.Code {
-			case pppoe.LinkCodeConfigRequest:
-				h.callback(EventSessionRequest, mac(h.adapterMac), mac(ethPack.SrcMAC))
-			case pppoe.LinkCodeConfigAck:
-				h.callback(EventSessionACK, mac(h.adapterMac), mac(ethPack.SrcMAC))
-			case pppoe.LinkCodeConfigNak:
-				h.callback(EventSessionNak, mac(h.adapterMac), mac(ethPack.SrcMAC))
+		switch frame.Protocol {
+		case ppp.ProtocolLCP:
+			switch frame.LinkProtocol.Code {
+			case ppp.LinkCodeConfigRequest:
+				h.callback(EventSessionRequest, mac(h.adapterMac), mac(f.SrcMac))
+			case ppp.LinkCodeConfigAck:
+				h.callback(EventSessionACK, mac(h.adapterMac), mac(f.SrcMac))
+			case ppp.LinkCodeConfigNak:
+				h.callback(EventSessionNak, mac(h.adapterMac), mac(f.SrcMac))
+			}
+		case ppp.ProtocolPAP:
+			h.callback(EventSessionAuthRequest, mac(h.adapterMac), mac(f.SrcMac))
+		case ppp.ProtocolCHAP:
+			if frame.ChapProtocol.Code == ppp.ChapCodeResponse {
+				h.callback(EventSessionAuthRequest, mac(h.adapterMac), mac(f.SrcMac))
 			}
-		case pppoe.P2PAuthProtocol:
-			h.callback(EventSessionAuthRequest, mac(h.adapterMac), mac(ethPack.SrcMAC))
 		}
 	}
-	if c, ok := h.mac2Worker[key]; ok {
-		c.handlePacket(packet)
+	if c, ok := h.worker(key); ok {
+		// 内核承载的会话帧由内核处理，控制报文从 /dev/ppp 通道读取
+		if f.EtherType == layers.EthernetTypePPPoESession && c.kernelSession() != nil {
+			return
+		}
+		c.handleFrame(f)
 		return
 	}
 }
 
+// frameKey 区分对端的键，同一 MAC 在不同 VLAN 上视为不同对端
+func frameKey(f link.Frame) string {
+	return mac(f.SrcMac) + "/" + f.Vlans.String()
+}
+
+// addressed 判断帧是否发给本网卡，组播和广播帧也视为发给本网卡
+func (h *Handler) addressed(f link.Frame) bool {
+	return len(f.DstMac) > 0 && f.DstMac[0]&0x01 != 0 || bytes.Equal(f.DstMac, h.adapterMac)
+}
+
+// isOffer 判断是否为 PADO/PADS
+func isOffer(f link.Frame) bool {
+	if f.EtherType != layers.EthernetTypePPPoEDiscovery || len(f.Payload) < pppoe.PPPoEDBasicLen {
+		return false
+	}
+	code := pppoe.DCode(f.Payload[1])
+	return code == pppoe.CodePADO || code == pppoe.CodePADS
+}
+
+// answerVlan 判断是否应答该 VLAN 上的帧
+func (h *Handler) answerVlan(vlans link.VlanStack) bool {
+	if h.vlans == nil && h.vlanStacks == nil {
+		return true
+	}
+	if h.vlans[vlans.ID()] {
+		return true
+	}
+	for _, filter := range h.vlanStacks {
+		if vlans.Match(filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) worker(key string) (w *Worker, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w, ok = h.mac2Worker[key]
+	return
+}
+
+// addWorker 为新的对端创建 Worker，已存在时返回 false
+func (h *Handler) addWorker(key string, f link.Frame) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.mac2Worker[key]; ok {
+		return false
+	}
+	h.mac2Worker[key] = NewWorker(h, f.SrcMac, f.Vlans)
+	return true
+}
+
+// removeWorker 移除会话已结束的 Worker，key 已被新的 Worker 占用时不做处理
+func (h *Handler) removeWorker(key string, w *Worker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.mac2Worker[key] == w {
+		delete(h.mac2Worker, key)
+	}
+}
+
+// nextSessionID 分配 1~0xfffe 之间的会话 ID，0 和 0xffff 为保留值
+func (h *Handler) nextSessionID() uint16 {
+	return uint16((atomic.AddUint32(&h.sessionSeq, 1)-1)%0xfffe) + 1
+}
+
 func (h *Handler) callback(e Event, args ...interface{}) {
 	if h.cb != nil {
 		h.cb(e, args...)
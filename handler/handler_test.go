@@ -0,0 +1,450 @@
+package handler
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"net"
+	"pppoe-probe/auth"
+	"pppoe-probe/link"
+	"pppoe-probe/metrics"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testAdapterMac = net.HardwareAddr{0x00, 0xe0, 0x4c, 0x36, 0x17, 0xf8}
+	testPeerMac    = net.HardwareAddr{0x00, 0x0c, 0x29, 0x8b, 0x82, 0xc5}
+	broadcastMac   = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+// testTimeout 等待异步事件或帧的最长时间
+const testTimeout = 2 * time.Second
+
+// fakeWriter 代替 pcap handle，记录 Handler 发出的帧
+type fakeWriter struct {
+	frames chan []byte
+}
+
+func newFakeWriter() *fakeWriter {
+	return &fakeWriter{frames: make(chan []byte, 256)}
+}
+
+func (w *fakeWriter) WritePacketData(data []byte) error {
+	w.frames <- append([]byte(nil), data...)
+	return nil
+}
+
+// next 等待下一个发出的帧
+func (w *fakeWriter) next(t *testing.T) (f link.Frame) {
+	t.Helper()
+	select {
+	case data := <-w.frames:
+		f, ok := link.DecodeFrame(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+		assert.True(t, ok)
+		return f
+	case <-time.After(testTimeout):
+		t.Fatal("no frame sent")
+	}
+	return
+}
+
+// empty 没有尚未取出的帧
+func (w *fakeWriter) empty() bool {
+	return len(w.frames) == 0
+}
+
+type recordedEvent struct {
+	e    Event
+	args []interface{}
+}
+
+// eventRecorder 记录 Listener 收到的事件，可被多个协程调用
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []recordedEvent
+}
+
+func (r *eventRecorder) listener(e Event, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, recordedEvent{e: e, args: args})
+}
+
+// all 返回类型为 e 的所有事件的参数
+func (r *eventRecorder) all(e Event) (args [][]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ev := range r.events {
+		if ev.e == e {
+			args = append(args, ev.args)
+		}
+	}
+	return
+}
+
+// wait 等待第一个类型为 e 的事件
+func (r *eventRecorder) wait(t *testing.T, e Event) []interface{} {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		if args := r.all(e); len(args) > 0 {
+			return args[0]
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("event %s not received", e)
+	return nil
+}
+
+// newTestHandler 不打开网卡的处理器，发出的帧写入返回的 fakeWriter，帧通过 inject 注入
+func newTestHandler(rec *eventRecorder) (h *Handler, w *fakeWriter) {
+	h = newBaseHandler("eth0", testAdapterMac, rec.listener)
+	h.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	w = newFakeWriter()
+	h.writer = w
+	return
+}
+
+// run 在协程中运行 h，测试结束时关闭
+func run(t *testing.T, h *Handler) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Run()
+	}()
+	t.Cleanup(func() {
+		h.Close()
+		<-done
+	})
+}
+
+// inject 把一帧交给 h.Handle，如同从网卡收到
+func inject(h *Handler, f link.Frame) {
+	data, err := f.Encode()
+	if err != nil {
+		panic(err)
+	}
+	h.Handle(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+}
+
+// testPeer 模拟一个 PPPoE 客户端：发现阶段由测试构造报文，PPP 交给被认证方的 ppp.Engine
+type testPeer struct {
+	t         *testing.T
+	h         *Handler
+	w         *fakeWriter
+	mac       net.HardwareAddr
+	vlans     link.VlanStack
+	sessionID uint16
+	engine    *ppp.Engine
+	out       []ppp.Frame
+	results   []bool
+}
+
+func newTestPeer(t *testing.T, h *Handler, w *fakeWriter, username string, password string) *testPeer {
+	p := &testPeer{t: t, h: h, w: w, mac: testPeerMac}
+	p.engine = ppp.NewEngine(ppp.Config{
+		Role:        ppp.RolePeer,
+		MagicNumber: 0x11223344,
+		Username:    username,
+		Password:    password,
+		Send: func(f *ppp.Frame) {
+			decoded, _ := ppp.DecodeFrame(f.Encode())
+			p.out = append(p.out, decoded)
+		},
+		OnAuthResult: func(accepted bool, message string) {
+			p.results = append(p.results, accepted)
+		},
+	})
+	return p
+}
+
+// sendDiscovery 发送 discovery 报文，PADI 为广播
+func (p *testPeer) sendDiscovery(pppoed pppoe.PPPoED) {
+	dst := testAdapterMac
+	if pppoed.Code == pppoe.CodePADI {
+		dst = broadcastMac
+	}
+	inject(p.h, link.Frame{SrcMac: p.mac, DstMac: dst, Vlans: p.vlans, EtherType: layers.EthernetTypePPPoEDiscovery, Payload: pppoed.Encode()})
+}
+
+// sendPPP 以当前会话 ID 发送 PPP 帧
+func (p *testPeer) sendPPP(f *ppp.Frame) {
+	inject(p.h, link.Frame{SrcMac: p.mac, DstMac: testAdapterMac, Vlans: p.vlans, EtherType: layers.EthernetTypePPPoESession, Payload: pppoe.AppendSessionFrame(nil, p.sessionID, f)})
+}
+
+// discover 完成 PADI/PADO/PADR/PADS，记录分配的会话 ID
+func (p *testPeer) discover() {
+	t := p.t
+	t.Helper()
+	p.sendDiscovery(pppoe.NewPPPoEDPacket(pppoe.CodePADI, 0, "", []byte{0x01}, nil))
+	pado := p.nextDiscovery(pppoe.CodePADO)
+	p.sendDiscovery(pppoe.NewPPPoEDPacket(pppoe.CodePADR, 0, pado.AcName, pado.HostUniq, pado.AcCookie))
+	pads := p.nextDiscovery(pppoe.CodePADS)
+	assert.NotEqual(t, uint16(0), pads.SessionID)
+	p.sessionID = pads.SessionID
+}
+
+// nextDiscovery 等待发给本端的 discovery 报文
+func (p *testPeer) nextDiscovery(code pppoe.DCode) (pppoed pppoe.PPPoED) {
+	t := p.t
+	t.Helper()
+	f := p.w.next(t)
+	assert.Equal(t, layers.EthernetTypePPPoEDiscovery, f.EtherType)
+	assert.Equal(t, p.mac, f.DstMac)
+	pppoed, err := pppoe.DecodePPPoED(f.Payload)
+	assert.Nil(t, err)
+	assert.Equal(t, code, pppoed.Code)
+	return
+}
+
+// flush 把 Engine 待发送的帧注入 Handler
+func (p *testPeer) flush() {
+	for len(p.out) > 0 {
+		f := p.out[0]
+		p.out = p.out[1:]
+		p.sendPPP(&f)
+	}
+}
+
+// receive 把 Handler 发出的一个会话帧交给 Engine，返回该帧
+func (p *testPeer) receive() (frame ppp.Frame) {
+	t := p.t
+	t.Helper()
+	f := p.w.next(t)
+	assert.Equal(t, layers.EthernetTypePPPoESession, f.EtherType)
+	var pppoes pppoe.PPPoES
+	assert.Nil(t, pppoe.DecodeSessionFrameInto(&pppoes, &frame, f.Payload))
+	assert.Equal(t, p.sessionID, pppoes.SessionID)
+	p.engine.Input(&frame)
+	return
+}
+
+// exchange 来回交换 PPP 帧，直到 Handler 不再立即回复
+func (p *testPeer) exchange() {
+	p.t.Helper()
+	p.flush()
+	for !p.w.empty() {
+		p.receive()
+		p.flush()
+	}
+}
+
+// authenticate 完成 LCP 协商并发送认证请求
+func (p *testPeer) authenticate() {
+	p.t.Helper()
+	p.engine.Open()
+	p.exchange()
+	assert.Equal(p.t, ppp.PhaseAuthenticate, p.engine.Phase())
+}
+
+func TestHandler_PAPCapture(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestHandler(rec)
+	run(t, h)
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	peer.discover()
+	assert.Equal(t, [][]interface{}{{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"}}, rec.all(EventDiscoveryBroadcast))
+	assert.Equal(t, [][]interface{}{{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"}}, rec.all(EventDiscoverySessionConfirmation))
+	peer.authenticate()
+
+	// 认证帧触发的 EventSessionAuthRequest 带网卡和对端 MAC，捕获到凭据时再带账号和密码触发一次
+	args := rec.wait(t, EventSessionAuthCaptured)
+	requests := rec.all(EventSessionAuthRequest)
+	if assert.Len(t, requests, 2) {
+		assert.Equal(t, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"}, requests[0])
+		assert.Equal(t, "user@isp", requests[1][0])
+		assert.Equal(t, "secret", requests[1][1].(Secret).Reveal())
+	}
+	assert.Len(t, args, 6)
+	assert.Equal(t, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5", "user@isp"}, args[:3])
+	assert.Equal(t, "secret", args[3].(Secret).Reveal())
+	assert.Equal(t, "[redacted]", args[3].(Secret).String())
+	assert.Equal(t, []interface{}{auth.MethodPAP, ""}, args[4:])
+
+	// 只捕获凭据时不回复认证请求
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, w.empty())
+	sessions := h.Sessions()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, StageAuth, sessions[0].Stage)
+	assert.Equal(t, "user@isp", sessions[0].PeerID)
+	assert.Equal(t, peer.sessionID, sessions[0].SessionID)
+}
+
+func TestHandler_CHAPAccept(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestHandler(rec)
+	h.SetAuthProtocol(ppp.AuthProtocolChap)
+	h.SetAuthenticator(auth.AcceptAll)
+	run(t, h)
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	peer.vlans, _ = link.ParseVlanStack("100.35")
+	peer.discover()
+	peer.authenticate()
+
+	args := rec.wait(t, EventSessionAuthCaptured)
+	assert.Equal(t, []interface{}{auth.MethodCHAP, "100.35"}, args[4:])
+	assert.Equal(t, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"}, rec.all(EventSessionAuthRequest)[0])
+
+	// 认证结果在 Authenticator 的协程中发出
+	frame := peer.receive()
+	assert.Equal(t, ppp.ProtocolCHAP, frame.Protocol)
+	assert.Equal(t, ppp.ChapCodeSuccess, frame.ChapProtocol.Code)
+	assert.Equal(t, []bool{true}, peer.results)
+	assert.Equal(t, ppp.PhaseNetwork, peer.engine.Phase())
+}
+
+func TestHandler_AuthReject(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestHandler(rec)
+	requests := make(chan auth.Request, 1)
+	h.SetAuthenticator(auth.AuthenticatorFunc(func(req auth.Request) (auth.Decision, error) {
+		requests <- req
+		return auth.Decision{Verdict: auth.Reject, Message: "bad password"}, nil
+	}))
+	run(t, h)
+	peer := newTestPeer(t, h, w, "user@isp", "wrong")
+	peer.discover()
+	peer.authenticate()
+
+	req := <-requests
+	assert.Equal(t, auth.Request{Adapter: "eth0", PeerMac: "00:0c:29:8b:82:c5", SessionID: peer.sessionID, Method: auth.MethodPAP, Username: "user@isp", Password: "wrong"}, req)
+	// 拒绝后回复 PAP Nak 并结束会话
+	frame := peer.receive()
+	assert.Equal(t, ppp.PwdAuthCodeNak, frame.PwdAuthProtocol.Code)
+	assert.Equal(t, "bad password", frame.PwdAuthProtocol.Message)
+	assert.Equal(t, []bool{false}, peer.results)
+	assert.Equal(t, [][]interface{}{{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"}}, rec.all(EventSessionAuthRejected))
+	var padt bool
+	for !padt {
+		f := w.next(t)
+		padt = f.EtherType == layers.EthernetTypePPPoEDiscovery && pppoe.DCode(f.Payload[1]) == pppoe.CodePADT
+	}
+	assert.Empty(t, h.Sessions())
+}
+
+func TestHandler_IgnoreUnknownPeer(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestHandler(rec)
+	peer := newTestPeer(t, h, w, "user", "secret")
+	peer.sessionID = 1
+	peer.sendPPP(&ppp.Frame{Protocol: ppp.ProtocolPAP, PwdAuthProtocol: ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeRequest, PeerID: "user", Password: "secret"}})
+	assert.Empty(t, rec.all(EventSessionAuthRequest))
+	assert.True(t, w.empty())
+}
+
+func TestHandler_Metrics(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestHandler(rec)
+	c := metrics.NewCollector()
+	h.SetMetrics(c)
+	run(t, h)
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	peer.discover()
+	peer.authenticate()
+	rec.wait(t, EventSessionAuthCaptured)
+
+	var sb strings.Builder
+	_, err := c.WriteTo(&sb)
+	assert.Nil(t, err)
+	out := sb.String()
+	assert.Contains(t, out, `pppoe_padi_total{adapter="00:e0:4c:36:17:f8"} 1`+"\n")
+	assert.Contains(t, out, `pppoe_padr_total{adapter="00:e0:4c:36:17:f8"} 1`+"\n")
+	// 双方各发送一次 Configure-Ack，按会话只统计一次
+	assert.Contains(t, out, `pppoe_lcp_ack_total{adapter="00:e0:4c:36:17:f8"} 1`+"\n")
+	assert.Contains(t, out, `pppoe_credentials_total{adapter="00:e0:4c:36:17:f8"} 1`+"\n")
+	assert.Contains(t, out, `pppoe_padi_to_auth_seconds_count{adapter="00:e0:4c:36:17:f8"} 1`+"\n")
+}
+
+func TestHandler_AnswerVlan(t *testing.T) {
+	parse := func(s string) link.VlanStack {
+		vlans, err := link.ParseVlanStack(s)
+		assert.Nil(t, err)
+		return vlans
+	}
+	filter := func(s string) link.VlanStack {
+		f, err := link.ParseVlanFilter(s)
+		assert.Nil(t, err)
+		return f
+	}
+	h := newBaseHandler("eth0", testAdapterMac, nil)
+	assert.True(t, h.answerVlan(nil))
+	assert.True(t, h.answerVlan(parse("100.35")))
+
+	h.SetVlans(0, 7)
+	h.SetVlanStacks(filter("100.35"), filter("200.*"))
+	tests := []struct {
+		vlans string
+		want  bool
+	}{
+		{"", true},
+		{"7", true},
+		{"300.7", true},
+		{"100.35", true},
+		{"100.36", false},
+		{"200.36", true},
+		{"200", false},
+		{"35", false},
+		{"300.35", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, h.answerVlan(parse(tt.vlans)), tt.vlans)
+	}
+}
+
+func TestHandler_VlanStackFilter(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestHandler(rec)
+	outer, _ := link.ParseVlanFilter("100.*")
+	h.SetVlanStacks(outer)
+	peer := newTestPeer(t, h, w, "user", "secret")
+
+	peer.vlans, _ = link.ParseVlanStack("200.35")
+	peer.sendDiscovery(pppoe.NewPPPoEDPacket(pppoe.CodePADI, 0, "", nil, nil))
+	assert.True(t, w.empty())
+
+	// 回复时保留对端标签中的优先级和 DEI
+	peer.vlans, _ = link.ParseVlanStack("100.35")
+	peer.vlans[1].Priority = 3
+	peer.vlans[1].DropEligible = true
+	peer.sendDiscovery(pppoe.NewPPPoEDPacket(pppoe.CodePADI, 0, "", nil, nil))
+	f := w.next(t)
+	assert.Equal(t, peer.vlans, f.Vlans)
+	assert.Len(t, rec.all(EventDiscoveryBroadcast), 1)
+}
+
+// Run 已经退出、缓冲已满时，收到认证请求不能阻塞抓包协程
+func TestHandler_AuthAfterClose(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestHandler(rec)
+	for i := 0; i < cap(h.workerDone); i++ {
+		h.workerDone <- &Auth{}
+	}
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	peer.discover()
+	h.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		peer.engine.Open()
+		peer.flush()
+		for !w.empty() {
+			peer.receive()
+			peer.flush()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("auth request blocked after Close")
+	}
+	assert.Len(t, rec.all(EventSessionAuthRequest), 1)
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONLinesSchemaVersion JSON 行事件格式的版本号，写入每一行的 "v" 字段。
+// 只新增字段时版本号不变，删除或修改已有字段或事件参数的含义时递增。
+//
+//	v2  新增 session_auth_captured；session_auth_request 收到认证帧时带 adapter 和 peer，捕获到凭据时带 peer_id 和 password
+//	v3  adapter 在串口处理器上为设备路径，不一定是 MAC
+const JSONLinesSchemaVersion = 3
+
+// 事件所属阶段
+const (
+	StageHandler   = "handler"
+	StageDiscovery = "discovery"
+	StageLCP       = "lcp"
+	StageAuth      = "auth"
+	StageMonitor   = "monitor"
+	StageNetwork   = "network"
+	StageRelay     = "relay"
+)
+
+// JSONEvent JSON 行格式中的一行，字段说明（v3）：
+//
+//	v         格式版本号，见 JSONLinesSchemaVersion
+//	time      事件时间，RFC 3339，纳秒精度
+//	event     事件名，见 Event.String，例如 discovery_broadcast、session_ack
+//	stage     事件所属阶段：handler、discovery、lcp、auth、monitor、network、relay
+//	adapter   本端标识：以太网为本地网卡 MAC，形如 00:11:22:33:44:55；串口为设备路径，例如 /dev/ttyUSB0
+//	peer      对端 MAC，串口上为空
+//	peer_id   PAP/CHAP 账号，仅 session_auth_captured 和捕获到凭据时的 session_auth_request
+//	password  PAP 密码，按 Handler 的 Redaction 脱敏，同 peer_id
+//	method    认证方式 pap 或 chap，仅 session_auth_captured
+//	vlan      对端所在的 VLAN，形如 35 或 100.35，仅 session_auth_captured
+//	message   错误信息，仅 error
+//	session   旁路监听到的会话，仅 monitor_session，格式见 MonitoredSession
+//	ac        其他 AC 发出的 PADO/PADS，仅 competing_ac，格式见 ACOffer
+//	link      数据面会话，仅 session_up、session_down，格式见 Session
+//	decode    无法解码的帧，仅 decode_error，格式见 DecodeFailure
+//	relay     中继的会话，仅 relay_session，格式见 RelayedSession
+//	args      无法识别的事件参数原样输出
+//
+// 没有值的字段不输出。
+type JSONEvent struct {
+	Version  int               `json:"v"`
+	Time     time.Time         `json:"time"`
+	Event    string            `json:"event"`
+	Stage    string            `json:"stage"`
+	Adapter  string            `json:"adapter,omitempty"`
+	Peer     string            `json:"peer,omitempty"`
+	PeerID   string            `json:"peer_id,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Method   string            `json:"method,omitempty"`
+	Vlan     string            `json:"vlan,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Session  *MonitoredSession `json:"session,omitempty"`
+	AC       *ACOffer          `json:"ac,omitempty"`
+	Link     *Session          `json:"link,omitempty"`
+	Decode   *DecodeFailure    `json:"decode,omitempty"`
+	Relay    *RelayedSession   `json:"relay,omitempty"`
+	Args     []interface{}     `json:"args,omitempty"`
+
+	secret Secret
+}
+
+// now 事件时间，测试中替换为固定值
+var now = time.Now
+
+// NewJSONEvent 将 Listener 收到的事件参数转换为 JSONEvent。
+func NewJSONEvent(e Event, args ...interface{}) JSONEvent {
+	je := JSONEvent{
+		Version: JSONLinesSchemaVersion,
+		Time:    now(),
+		Event:   e.String(),
+		Stage:   e.Stage(),
+	}
+	str := func(i int) string {
+		return fmt.Sprint(args[i])
+	}
+	switch {
+	case (e == EventStart || e == EventStop) && len(args) == 1:
+		je.Adapter = str(0)
+	case e == EventError && len(args) == 1:
+		je.Message = str(0)
+	case e == EventSessionAuthCaptured && len(args) >= 4:
+		je.Adapter, je.Peer, je.PeerID, je.Password = str(0), str(1), str(2), str(3)
+		if len(args) >= 6 {
+			je.Method, je.Vlan = str(4), str(5)
+		}
+		if s, ok := args[3].(Secret); ok {
+			je.secret = s
+		}
+	case e == EventSessionAuthRequest && len(args) == 2:
+		if s, ok := args[1].(Secret); ok {
+			je.PeerID, je.Password = str(0), s.String()
+			je.secret = s
+		} else {
+			je.Adapter, je.Peer = str(0), str(1)
+		}
+	case e == EventMonitorSession && len(args) == 2:
+		je.Adapter = str(0)
+		if s, ok := args[1].(MonitoredSession); ok {
+			je.Session = &s
+		}
+	case e == EventCompetingAC && len(args) == 2:
+		je.Adapter = str(0)
+		if offer, ok := args[1].(ACOffer); ok {
+			je.AC = &offer
+			je.Peer = offer.PeerMac
+		}
+	case (e == EventSessionUp || e == EventSessionDown) && len(args) == 2:
+		je.Adapter = str(0)
+		if s, ok := args[1].(Session); ok {
+			je.Link = &s
+			je.Peer = s.PeerMac
+			je.PeerID = s.PeerID
+		}
+	case e == EventDecodeError && len(args) == 2:
+		je.Adapter = str(0)
+		if d, ok := args[1].(DecodeFailure); ok {
+			je.Decode = &d
+			je.Peer = d.PeerMac
+			je.Message = d.Message
+		}
+	case e == EventRelaySession && len(args) == 2:
+		je.Adapter = str(0)
+		if s, ok := args[1].(RelayedSession); ok {
+			je.Relay = &s
+			je.Peer = s.CpeMac
+		}
+	case e.Stage() != StageHandler && e != EventSessionAuthCaptured && len(args) == 2:
+		je.Adapter, je.Peer = str(0), str(1)
+	default:
+		je.Args = args
+	}
+	return je
+}
+
+// RevealPassword 返回 session_auth_captured 和 session_auth_request 中的明文密码，用于保存到凭据库，不要写入日志
+func (je JSONEvent) RevealPassword() string {
+	return je.secret.Reveal()
+}
+
+// NewJSONLinesListener 返回一个将每个事件序列化为一行 JSON 写入 w 的 Listener，格式见 JSONEvent。
+// 可以被多个 Handler 并发调用。写入失败时丢弃该事件。
+func NewJSONLinesListener(w io.Writer) Listener {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(e Event, args ...interface{}) {
+		je := NewJSONEvent(e, args...)
+		mu.Lock()
+		defer mu.Unlock()
+		_ = enc.Encode(je)
+	}
+}
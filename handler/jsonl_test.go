@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2024, 5, 6, 7, 8, 9, 10, time.UTC)
+
+// jsonlGolden 每种事件的参数和对应的 JSON 行，time 固定为 testTime
+var jsonlGolden = []struct {
+	e    Event
+	args []interface{}
+	line string
+}{
+	{EventStart, []interface{}{"00:e0:4c:36:17:f8"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"start","stage":"handler","adapter":"00:e0:4c:36:17:f8"}`},
+	{EventStop, []interface{}{"/dev/ttyUSB0"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"stop","stage":"handler","adapter":"/dev/ttyUSB0"}`},
+	{EventDiscoveryBroadcast, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"discovery_broadcast","stage":"discovery","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5"}`},
+	{EventDiscoverySessionConfirmation, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"discovery_session_confirmation","stage":"discovery","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5"}`},
+	{EventSessionRequest, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_request","stage":"lcp","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5"}`},
+	{EventSessionACK, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_ack","stage":"lcp","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5"}`},
+	{EventSessionNak, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_nak","stage":"lcp","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5"}`},
+	{EventSessionAuthRequest, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_auth_request","stage":"auth","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5"}`},
+	{EventSessionAuthRequest, []interface{}{"/dev/ttyUSB0", ""},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_auth_request","stage":"auth","adapter":"/dev/ttyUSB0"}`},
+	{EventSessionAuthRequest, []interface{}{"user@isp", NewSecret("secret", RedactMasked)},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_auth_request","stage":"auth","peer_id":"user@isp","password":"s****t"}`},
+	{EventError, []interface{}{"open eth0: permission denied"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"error","stage":"handler","message":"open eth0: permission denied"}`},
+	{EventSessionAuthCaptured, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5", "user@isp", NewSecret("secret", RedactMasked), "pap", "100.35"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_auth_captured","stage":"auth","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5","peer_id":"user@isp","password":"s****t","method":"pap","vlan":"100.35"}`},
+	{EventMonitorSession, []interface{}{"00:e0:4c:36:17:f8", MonitoredSession{CpeMac: "00:0c:29:8b:82:c5", AcMac: "00:00:5e:00:53:01", SessionID: 7, Stage: MonitorStageLCP, StartedAt: testTime, UpdatedAt: testTime}},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"monitor_session","stage":"monitor","adapter":"00:e0:4c:36:17:f8","session":{"cpe_mac":"00:0c:29:8b:82:c5","ac_mac":"00:00:5e:00:53:01","session_id":7,"stage":"lcp","started_at":"2024-05-06T07:08:09.00000001Z","updated_at":"2024-05-06T07:08:09.00000001Z"}}`},
+	{EventCompetingAC, []interface{}{"00:e0:4c:36:17:f8", ACOffer{Code: "PADO", AcMac: "00:00:5e:00:53:01", AcName: "bras", PeerMac: "00:0c:29:8b:82:c5"}},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"competing_ac","stage":"discovery","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5","ac":{"code":"PADO","ac_mac":"00:00:5e:00:53:01","ac_name":"bras","peer_mac":"00:0c:29:8b:82:c5"}}`},
+	{EventSessionUp, []interface{}{"00:e0:4c:36:17:f8", Session{PeerMac: "00:0c:29:8b:82:c5", SessionID: 1, Stage: StageNetwork, PeerID: "user@isp", IP: "10.64.0.2", StartedAt: testTime, UpdatedAt: testTime}},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_up","stage":"network","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5","peer_id":"user@isp","link":{"peer_mac":"00:0c:29:8b:82:c5","session_id":1,"stage":"network","peer_id":"user@isp","started_at":"2024-05-06T07:08:09.00000001Z","updated_at":"2024-05-06T07:08:09.00000001Z","ip":"10.64.0.2"}}`},
+	{EventSessionDown, []interface{}{"00:e0:4c:36:17:f8", Session{PeerMac: "00:0c:29:8b:82:c5", SessionID: 1, Stage: StageNetwork, RxPackets: 3, StartedAt: testTime, UpdatedAt: testTime}},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_down","stage":"network","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5","link":{"peer_mac":"00:0c:29:8b:82:c5","session_id":1,"stage":"network","started_at":"2024-05-06T07:08:09.00000001Z","updated_at":"2024-05-06T07:08:09.00000001Z","rx_packets":3}}`},
+	{EventSessionAuthRejected, []interface{}{"00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5"},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"session_auth_rejected","stage":"auth","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5"}`},
+	{EventDecodeError, []interface{}{"00:e0:4c:36:17:f8", DecodeFailure{PeerMac: "00:0c:29:8b:82:c5", Layer: "pppoed", Field: "header", Offset: 0, Expected: 6, Actual: 2, Reason: "truncated", Message: "pppoed: truncated header", Frame: "1109", Err: errors.New("truncated")}},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"decode_error","stage":"handler","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5","message":"pppoed: truncated header","decode":{"peer_mac":"00:0c:29:8b:82:c5","layer":"pppoed","field":"header","offset":0,"expected":6,"actual":2,"reason":"truncated","message":"pppoed: truncated header","frame":"1109"}}`},
+	{EventRelaySession, []interface{}{"00:e0:4c:36:17:f8", RelayedSession{CpeMac: "00:0c:29:8b:82:c5", AcMac: "00:00:5e:00:53:01", SessionID: 9, RelaySessionID: "00000001", Stage: "up", StartedAt: testTime, UpdatedAt: testTime}},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"relay_session","stage":"relay","adapter":"00:e0:4c:36:17:f8","peer":"00:0c:29:8b:82:c5","relay":{"cpe_mac":"00:0c:29:8b:82:c5","ac_mac":"00:00:5e:00:53:01","session_id":9,"relay_session_id":"00000001","stage":"up","started_at":"2024-05-06T07:08:09.00000001Z","updated_at":"2024-05-06T07:08:09.00000001Z"}}`},
+	{Event(99), []interface{}{"a", 1},
+		`{"v":3,"time":"2024-05-06T07:08:09.00000001Z","event":"unknown","stage":"handler","args":["a",1]}`},
+}
+
+// fixTime 测试期间把事件时间固定为 testTime
+func fixTime(t *testing.T) {
+	now = func() time.Time { return testTime }
+	t.Cleanup(func() { now = time.Now })
+}
+
+func TestNewJSONEvent_Golden(t *testing.T) {
+	fixTime(t)
+	for _, g := range jsonlGolden {
+		bs, err := json.Marshal(NewJSONEvent(g.e, g.args...))
+		assert.Nil(t, err)
+		assert.Equal(t, g.line, string(bs), g.e.String())
+	}
+}
+
+func TestNewJSONLinesListener_Golden(t *testing.T) {
+	fixTime(t)
+	var buf bytes.Buffer
+	l := NewJSONLinesListener(&buf)
+	var want []string
+	for _, g := range jsonlGolden {
+		l(g.e, g.args...)
+		want = append(want, g.line)
+	}
+	assert.Equal(t, strings.Join(want, "\n")+"\n", buf.String())
+}
+
+func TestJSONEvent_RevealPassword(t *testing.T) {
+	je := NewJSONEvent(EventSessionAuthCaptured, "00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5", "user@isp", NewSecret("secret", RedactFull), "pap", "")
+	assert.Equal(t, "[redacted]", je.Password)
+	assert.Equal(t, "secret", je.RevealPassword())
+	assert.Equal(t, "", NewJSONEvent(EventSessionAuthRequest, "00:e0:4c:36:17:f8", "00:0c:29:8b:82:c5").RevealPassword())
+}
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"errors"
+	"github.com/google/gopacket/layers"
+	"pppoe-probe/l2tp"
+	"pppoe-probe/link"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"sync"
+)
+
+// LACConfig LAC 模式配置。
+// 开启后认证通过的会话不在本地结束，而是经 L2TPv2 隧道（RFC 2661）转交给 LNS：本端完成 LCP 和认证后，
+// 用代理 LCP 和代理认证发起入向呼叫，由 LNS 回复认证结果并继续 IPCP 等协商，此后 PPPoE 会话和 L2TP 会话之间原样转发 PPP 帧。
+type LACConfig struct {
+	// LNS 地址，没有端口时使用 l2tp.DefaultPort
+	LNS string
+	// Secret 隧道认证的共享密钥，为空时不认证
+	Secret string
+	// HostName SCCRQ 中的 Host Name，为空时使用 AC-Name
+	HostName string
+}
+
+type lac struct {
+	h   *Handler
+	cfg LACConfig
+
+	// mu 建立隧道期间一直持有，同时认证通过的会话等待同一个隧道
+	mu     sync.Mutex
+	tunnel *l2tp.Tunnel
+	closed bool
+}
+
+// SetLAC 开启 LAC 模式，需在 Run 之前调用，不能与数据面同时开启。
+// 隧道在第一个会话认证通过时建立，隧道断开后其中的会话随之结束，下一个会话重新建立隧道。
+func (h *Handler) SetLAC(cfg LACConfig) (err error) {
+	if cfg.LNS == "" {
+		err = errors.New("missing lns address")
+		return
+	}
+	if h.dp != nil {
+		err = errors.New("lac mode conflicts with data plane")
+		return
+	}
+	if h.relay != nil {
+		err = errors.New("lac mode conflicts with relay mode")
+		return
+	}
+	h.lac = &lac{h: h, cfg: cfg}
+	return
+}
+
+// dial 返回已建立的隧道，没有或已断开时建立新的隧道
+func (l *lac) dial() (t *l2tp.Tunnel, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, l2tp.ErrClosed
+	}
+	if l.tunnel != nil {
+		select {
+		case <-l.tunnel.Done():
+		default:
+			return l.tunnel, nil
+		}
+	}
+	hostName := l.cfg.HostName
+	if hostName == "" {
+		hostName = l.h.acName
+	}
+	t, err = l2tp.Dial(l2tp.Config{
+		Server:   l.cfg.LNS,
+		Secret:   l.cfg.Secret,
+		HostName: hostName,
+		OnClose: func(err error) {
+			if !errors.Is(err, l2tp.ErrClosed) {
+				l.h.log(StageNetwork).Warn("l2tp tunnel closed", "lns", l.cfg.LNS, "err", err)
+			}
+		},
+	})
+	if err != nil {
+		return
+	}
+	l.h.log(StageNetwork).Info("l2tp tunnel established", "lns", t.RemoteAddr(), "tunnel_id", t.LocalID())
+	l.tunnel = t
+	return
+}
+
+// close 关闭隧道，其中的会话向对端发送 PADT 后结束
+func (l *lac) close() {
+	l.mu.Lock()
+	l.closed = true
+	t := l.tunnel
+	l.mu.Unlock()
+	if t != nil {
+		t.Close()
+	}
+}
+
+// forward 认证通过后把会话转交 LNS，认证结果由 LNS 回复。转交失败时拒绝对端的认证并结束会话。
+// 在 Authenticator 的协程中调用，访问 Engine 时持有 inMu，建立隧道和会话期间不持有
+func (w *Worker) forward(r ppp.AuthRequest) {
+	tunnel, err := w.h.lac.dial()
+	var s *l2tp.Session
+	if err == nil {
+		w.inMu.Lock()
+		initial, sent, received := w.engine.ConfigRequests()
+		w.inMu.Unlock()
+		s, err = tunnel.OpenSession(l2tp.SessionConfig{
+			CallingNumber:      mac(w.srcMac),
+			InitialReceivedLCP: initial,
+			LastSentLCP:        sent,
+			LastReceivedLCP:    received,
+			ProxyAuth:          &r,
+			OnFrame:            w.sendFrame,
+			OnClose:            w.onL2TPClose,
+		})
+	}
+	if err != nil {
+		w.log().Error("failed to forward session to lns", "lns", w.h.lac.cfg.LNS, "err", err)
+		w.inMu.Lock()
+		defer w.inMu.Unlock()
+		w.engine.AuthDone(false, "Service unavailable")
+		w.terminate()
+		return
+	}
+	// 建立 L2TP 会话期间 PPPoE 会话可能已经结束
+	if cur, ok := w.h.worker(frameKey(link.Frame{SrcMac: w.srcMac, Vlans: w.vlans})); !ok || cur != w {
+		s.Close()
+		return
+	}
+	w.mu.Lock()
+	w.l2tp = s
+	w.session.Stage = StageNetwork
+	w.session.Up = true
+	w.session.L2TPTunnelID = tunnel.LocalID()
+	w.session.L2TPSessionID = s.LocalID()
+	w.mu.Unlock()
+	w.log().Info("session forwarded to lns", "lns", tunnel.RemoteAddr(), "tunnel_id", tunnel.LocalID(), "l2tp_session_id", s.LocalID())
+	w.startAccounting()
+	w.h.callback(EventSessionUp, mac(w.h.adapterMac), w.Session())
+}
+
+// l2tpSession 会话已转交 LNS 时返回 L2TP 会话
+func (w *Worker) l2tpSession() *l2tp.Session {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.l2tp
+}
+
+// forwardFrame 把对端的 PPP 帧（从协议字段开始）原样发给 LNS
+func (w *Worker) forwardFrame(s *l2tp.Session, frame []byte) {
+	if err := s.WriteFrame(frame); err != nil {
+		w.log().Debug("write l2tp session", "err", err)
+		return
+	}
+	w.updateSession(func(s *Session) {
+		s.RxPackets++
+		s.RxBytes += uint64(len(frame))
+	})
+}
+
+// sendFrame 把 LNS 发来的 PPP 帧（从协议字段开始）原样发给对端
+func (w *Worker) sendFrame(frame []byte) {
+	sessionID := w.sessionID()
+	w.sendMu.Lock()
+	w.payloadBuf = pppoe.PPPoES{VersionAndType: pppoe.VersionAndType, SessionID: sessionID, Payload: frame}.AppendEncode(w.payloadBuf[:0])
+	w.writeFrame(layers.EthernetTypePPPoESession, w.payloadBuf)
+	w.sendMu.Unlock()
+	w.updateSession(func(s *Session) {
+		s.TxPackets++
+		s.TxBytes += uint64(len(frame))
+	})
+}
+
+// onL2TPClose LNS 结束了会话或隧道断开，向对端发送 PADT
+func (w *Worker) onL2TPClose(err error) {
+	w.log().Info("l2tp session closed", "err", err)
+	w.terminate()
+}
+
+// stopForwarding 向 LNS 发送 CDN，返回会话之前是否已经转交
+func (w *Worker) stopForwarding() (wasUp bool) {
+	w.mu.Lock()
+	s := w.l2tp
+	w.l2tp = nil
+	w.mu.Unlock()
+	if s == nil {
+		return false
+	}
+	s.Close()
+	return true
+}
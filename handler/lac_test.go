@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"pppoe-probe/l2tp"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeLNSTunnelID  = 0x2345
+	fakeLNSSessionID = 0x5432
+)
+
+// fakeLNS 进程内的 LNS，不认证隧道，应答隧道和会话的建立，记录收到的控制报文和数据报文
+type fakeLNS struct {
+	t    *testing.T
+	conn *net.UDPConn
+	// refuse 为 true 时用 CDN 拒绝入向呼叫，serve 开始后不再修改
+	refuse bool
+
+	mu         sync.Mutex
+	peer       *net.UDPAddr
+	peerTunnel uint16
+	ns         uint16
+	nr         uint16
+
+	controls chan *l2tp.Message
+	frames   chan []byte
+}
+
+// newFakeLNS refuse 为 true 时拒绝所有入向呼叫
+func newFakeLNS(t *testing.T, refuse bool) *fakeLNS {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	s := &fakeLNS{t: t, conn: conn, refuse: refuse, controls: make(chan *l2tp.Message, 16), frames: make(chan []byte, 16)}
+	go s.serve()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return s
+}
+
+func (s *fakeLNS) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeLNS) serve() {
+	buf := make([]byte, 0xffff)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// 解码结果引用 buf，复制后再交给测试
+		m, err := l2tp.Decode(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			continue
+		}
+		if !m.Control {
+			s.frames <- m.Payload
+			continue
+		}
+		if len(m.AVPs) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		s.peer = addr
+		s.nr = m.Ns + 1
+		s.mu.Unlock()
+		switch m.Type() {
+		case l2tp.MessageSCCRQ:
+			s.mu.Lock()
+			s.peerTunnel, _ = m.GetUint16(l2tp.AVPAssignedTunnelID)
+			s.mu.Unlock()
+			reply := l2tp.NewControl(l2tp.MessageSCCRP, 0, 0)
+			reply.AddUint16(l2tp.AVPAssignedTunnelID, fakeLNSTunnelID)
+			s.send(reply)
+		case l2tp.MessageICRQ:
+			peerSession, _ := m.GetUint16(l2tp.AVPAssignedSessionID)
+			if s.refuse {
+				reply := l2tp.NewControl(l2tp.MessageCDN, 0, peerSession)
+				reply.Add(l2tp.AVPResultCode, []byte{0x00, 0x04})
+				s.send(reply)
+				break
+			}
+			reply := l2tp.NewControl(l2tp.MessageICRP, 0, peerSession)
+			reply.AddUint16(l2tp.AVPAssignedSessionID, fakeLNSSessionID)
+			s.send(reply)
+		default:
+			s.ack()
+		}
+		s.controls <- &m
+	}
+}
+
+// send 调用方已设置 SessionID，其余头部字段在这里填写
+func (s *fakeLNS) send(m *l2tp.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.TunnelID = s.peerTunnel
+	m.Ns = s.ns
+	m.Nr = s.nr
+	s.ns++
+	bs, err := m.AppendEncode(nil)
+	assert.Nil(s.t, err)
+	_, _ = s.conn.WriteToUDP(bs, s.peer)
+}
+
+func (s *fakeLNS) ack() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bs, _ := (&l2tp.Message{Control: true, TunnelID: s.peerTunnel, Ns: s.ns, Nr: s.nr}).AppendEncode(nil)
+	_, _ = s.conn.WriteToUDP(bs, s.peer)
+}
+
+func (s *fakeLNS) sendData(sessionID uint16, frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = s.conn.WriteToUDP(l2tp.AppendData(nil, s.peerTunnel, sessionID, frame), s.peer)
+}
+
+// expect 等待下一个类型为 mt 的控制报文
+func (s *fakeLNS) expect(mt l2tp.MessageType) *l2tp.Message {
+	for {
+		select {
+		case m := <-s.controls:
+			if m.Type() == mt {
+				return m
+			}
+		case <-time.After(testTimeout):
+			s.t.Fatalf("no %s received", mt)
+			return nil
+		}
+	}
+}
+
+func TestHandler_LAC(t *testing.T) {
+	rec := &eventRecorder{}
+	lns := newFakeLNS(t, false)
+	h, w := newTestHandler(rec)
+	assert.Nil(t, h.SetLAC(LACConfig{LNS: lns.addr(), HostName: "lac"}))
+	run(t, h)
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	peer.discover()
+	peer.authenticate()
+
+	// 认证通过后用代理 LCP 和代理认证转交 LNS，认证结果由 LNS 回复
+	sccrq := lns.expect(l2tp.MessageSCCRQ)
+	assert.Equal(t, "lac", sccrq.GetString(l2tp.AVPHostName))
+	icrq := lns.expect(l2tp.MessageICRQ)
+	assert.Equal(t, mac(testPeerMac), icrq.GetString(l2tp.AVPCallingNumber))
+	iccn := lns.expect(l2tp.MessageICCN)
+	authType, _ := iccn.GetUint16(l2tp.AVPProxyAuthenType)
+	assert.Equal(t, l2tp.ProxyAuthenPAP, authType)
+	assert.Equal(t, "user@isp", iccn.GetString(l2tp.AVPProxyAuthenName))
+	assert.Equal(t, "secret", iccn.GetString(l2tp.AVPProxyAuthenResponse))
+	_, sent, received := peer.engine.ConfigRequests()
+	lastSent, _ := iccn.Get(l2tp.AVPLastSentLCPConfReq)
+	lastReceived, _ := iccn.Get(l2tp.AVPLastReceivedLCPConfReq)
+	// 对端发出的请求即为 LAC 收到的请求
+	assert.Equal(t, sent, lastReceived)
+	assert.Equal(t, received, lastSent)
+
+	args := rec.wait(t, EventSessionUp)
+	session := args[1].(Session)
+	assert.NotEqual(t, uint16(0), session.L2TPTunnelID)
+	assert.NotEqual(t, uint16(0), session.L2TPSessionID)
+	assert.True(t, w.empty())
+
+	// 之后 PPP 帧在 PPPoE 会话和 L2TP 会话之间原样转发
+	ipcp := ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1, IPAddress: net.IPv4zero.To4()}}
+	peer.sendPPP(&ipcp)
+	select {
+	case frame := <-lns.frames:
+		assert.Equal(t, pppoe.AppendSessionFrame(nil, peer.sessionID, &ipcp)[pppoe.PPPoESBasicLen:], frame)
+	case <-time.After(testTimeout):
+		t.Fatal("no data received by lns")
+	}
+	pap := ppp.Frame{Protocol: ppp.ProtocolPAP, PwdAuthProtocol: ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeAck, Identifier: 1, Message: "welcome"}}
+	lns.sendData(session.L2TPSessionID, pppoe.AppendSessionFrame(nil, peer.sessionID, &pap)[pppoe.PPPoESBasicLen:])
+	assert.Equal(t, ppp.PwdAuthCodeAck, peer.receive().PwdAuthProtocol.Code)
+	assert.Equal(t, ppp.PhaseNetwork, peer.engine.Phase())
+
+	// LNS 结束会话后向对端发送 PADT
+	cdn := l2tp.NewControl(l2tp.MessageCDN, 0, session.L2TPSessionID)
+	cdn.Add(l2tp.AVPResultCode, []byte{0x00, 0x03})
+	lns.send(cdn)
+	f := w.next(t)
+	assert.Equal(t, layers.EthernetTypePPPoEDiscovery, f.EtherType)
+	assert.Equal(t, pppoe.CodePADT, pppoe.DCode(f.Payload[1]))
+	rec.wait(t, EventSessionDown)
+	assert.Empty(t, h.Sessions())
+}
+
+func TestHandler_LACRefused(t *testing.T) {
+	rec := &eventRecorder{}
+	// LNS 拒绝入向呼叫，转交失败时拒绝对端的认证并结束会话
+	lns := newFakeLNS(t, true)
+	h, w := newTestHandler(rec)
+	assert.Nil(t, h.SetLAC(LACConfig{LNS: lns.addr()}))
+	run(t, h)
+	peer := newTestPeer(t, h, w, "user@isp", "secret")
+	peer.discover()
+	peer.authenticate()
+
+	deadline := time.Now().Add(testTimeout)
+	for len(peer.results) == 0 && time.Now().Before(deadline) {
+		if !w.empty() {
+			peer.receive()
+			continue
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []bool{false}, peer.results)
+	f := peer.w.next(t)
+	assert.Equal(t, layers.EthernetTypePPPoEDiscovery, f.EtherType)
+	assert.Equal(t, pppoe.CodePADT, pppoe.DCode(f.Payload[1]))
+	assert.Empty(t, rec.all(EventSessionUp))
+	assert.Empty(t, h.Sessions())
+}
@@ -10,8 +10,88 @@ const (
 	EventSessionRequest               Event = 4
 	EventSessionACK                   Event = 5
 	EventSessionNak                   Event = 6
-	EventSessionAuthRequest           Event = 7
-	EventError                        Event = 8
+	// EventSessionAuthRequest 有两种参数：收到对端的 PAP 请求或 CHAP 响应帧时为（网卡 MAC，对端 MAC），
+	// 捕获到凭据时为（账号，密码），密码为 Secret，紧接着触发 EventSessionAuthCaptured
+	EventSessionAuthRequest Event = 7
+	EventError              Event = 8
+	// EventSessionAuthCaptured 参数：网卡 MAC，对端 MAC，账号，密码，认证方式（pap 或 chap），VLAN。
+	// 密码为 Secret，打印和序列化时按 Handler 的 Redaction 脱敏，需要明文时调用 Reveal
+	EventSessionAuthCaptured Event = 9
+	// EventMonitorSession 旁路监听模式下会话状态变化，参数：网卡 MAC，MonitoredSession
+	EventMonitorSession Event = 10
+	// EventCompetingAC 网段上有其他 AC 应答了 PADI/PADR，参数：网卡 MAC，ACOffer
+	EventCompetingAC Event = 11
+	// EventSessionUp 数据面模式下会话完成 IPCP 开始转发，或 LAC 模式下会话转交 LNS，参数：网卡 MAC，Session
+	EventSessionUp Event = 12
+	// EventSessionDown 数据面或 LAC 模式下已建立的会话结束，参数：网卡 MAC，Session
+	EventSessionDown Event = 13
+	// EventSessionAuthRejected Authenticator 拒绝了对端的认证，会话随后结束，参数：网卡 MAC，对端 MAC
+	EventSessionAuthRejected Event = 14
+	// EventDecodeError 收到无法解码的 PPPoE 帧，参数：网卡 MAC，DecodeFailure
+	EventDecodeError Event = 15
+	// EventRelaySession 中继模式下会话建立或结束，参数：面向 CPE 的网卡 MAC，RelayedSession
+	EventRelaySession Event = 16
 )
 
+func (e Event) String() string {
+	switch e {
+	case EventStart:
+		return "start"
+	case EventStop:
+		return "stop"
+	case EventDiscoveryBroadcast:
+		return "discovery_broadcast"
+	case EventDiscoverySessionConfirmation:
+		return "discovery_session_confirmation"
+	case EventSessionRequest:
+		return "session_request"
+	case EventSessionACK:
+		return "session_ack"
+	case EventSessionNak:
+		return "session_nak"
+	case EventSessionAuthRequest:
+		return "session_auth_request"
+	case EventError:
+		return "error"
+	case EventSessionAuthCaptured:
+		return "session_auth_captured"
+	case EventMonitorSession:
+		return "monitor_session"
+	case EventCompetingAC:
+		return "competing_ac"
+	case EventSessionUp:
+		return "session_up"
+	case EventSessionDown:
+		return "session_down"
+	case EventSessionAuthRejected:
+		return "session_auth_rejected"
+	case EventDecodeError:
+		return "decode_error"
+	case EventRelaySession:
+		return "relay_session"
+	}
+	return "unknown"
+}
+
+// Stage 事件所属的阶段
+func (e Event) Stage() string {
+	switch e {
+	case EventDiscoveryBroadcast, EventDiscoverySessionConfirmation, EventCompetingAC:
+		return StageDiscovery
+	case EventSessionRequest, EventSessionACK, EventSessionNak:
+		return StageLCP
+	case EventSessionAuthRequest, EventSessionAuthCaptured, EventSessionAuthRejected:
+		return StageAuth
+	case EventMonitorSession:
+		return StageMonitor
+	case EventSessionUp, EventSessionDown:
+		return StageNetwork
+	case EventRelaySession:
+		return StageRelay
+	}
+	return StageHandler
+}
+
+// Listener 事件回调，各事件的参数见事件常量的说明，参数的含义变化时递增 JSONLinesSchemaVersion。
+// 串口处理器上参数中的网卡 MAC 为设备路径，对端 MAC 为空
 type Listener func(e Event, args ...interface{})
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"log/slog"
+)
+
+// SetLogger 设置处理器的日志输出，需在 Run 之前调用。不调用或 l 为 nil 时转发给 logrus 的全局 logger。
+// 每行日志都带 adapter（本地网卡 MAC，串口为设备路径）和 stage 字段，会话相关的日志另带 peer_mac 和 session_id。
+func (h *Handler) SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(logrusHandler{})
+	}
+	h.logger = l.With("adapter", h.adapterID())
+}
+
+// log 处理器级别的日志
+func (h *Handler) log(stage string) *slog.Logger {
+	return h.logger.With("stage", stage)
+}
+
+// log 会话日志，不能在持有 w.mu 时调用
+func (w *Worker) log() *slog.Logger {
+	s := w.Session()
+	return w.h.logger.With("peer_mac", s.PeerMac, "session_id", s.SessionID, "stage", s.Stage)
+}
+
+// debugEnabled 发送路径上先判断再构造调试日志的字段，未开启调试日志时不分配内存
+func (h *Handler) debugEnabled() bool {
+	return h.logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// logrusHandler 把 slog 日志转发给 logrus 的全局 logger，字段转为 logrus.Fields
+type logrusHandler struct {
+	attrs []slog.Attr
+	group string
+}
+
+func logrusLevel(level slog.Level) logrus.Level {
+	switch {
+	case level >= slog.LevelError:
+		return logrus.ErrorLevel
+	case level >= slog.LevelWarn:
+		return logrus.WarnLevel
+	case level >= slog.LevelInfo:
+		return logrus.InfoLevel
+	}
+	return logrus.DebugLevel
+}
+
+func (l logrusHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return logrus.IsLevelEnabled(logrusLevel(level))
+}
+
+func (l logrusHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := make(logrus.Fields, len(l.attrs)+r.NumAttrs())
+	for _, a := range l.attrs {
+		l.addField(fields, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		l.addField(fields, l.group, a)
+		return true
+	})
+	logrus.WithFields(fields).Log(logrusLevel(r.Level), r.Message)
+	return nil
+}
+
+func (l logrusHandler) addField(fields logrus.Fields, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	key := a.Key
+	if prefix != "" {
+		key = prefix + "." + key
+	}
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			l.addField(fields, key, ga)
+		}
+		return
+	}
+	fields[key] = v.Any()
+}
+
+func (l logrusHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for i := range attrs {
+		if l.group != "" {
+			attrs[i] = slog.Group(l.group, attrs[i])
+		}
+	}
+	l.attrs = append(l.attrs[:len(l.attrs):len(l.attrs)], attrs...)
+	return l
+}
+
+func (l logrusHandler) WithGroup(name string) slog.Handler {
+	if l.group != "" {
+		name = l.group + "." + name
+	}
+	l.group = name
+	return l
+}
@@ -0,0 +1,366 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"pppoe-probe/auth"
+	"pppoe-probe/link"
+	"pppoe-probe/metrics"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"sync"
+	"time"
+)
+
+// 旁路监听模式下的会话阶段
+const (
+	MonitorStageDiscovery  = "discovery"
+	MonitorStageLCP        = "lcp"
+	MonitorStageAuth       = "auth"
+	MonitorStageAuthAck    = "auth_ack"
+	MonitorStageAuthNak    = "auth_nak"
+	MonitorStageTerminated = "terminated"
+)
+
+// 旁路监听的会话默认保留的时间，超时后从 MonitoredSessions 中移除
+const (
+	DefaultMonitorDiscoveryTimeout = 30 * time.Second
+	DefaultMonitorIdleTimeout      = 10 * time.Minute
+)
+
+// monitorSweepInterval 检查超时会话的最小间隔
+const monitorSweepInterval = time.Second
+
+// LCPOptions 一方已被对端确认（Configure-Ack）的 LCP 配置项
+type LCPOptions struct {
+	MaxReceiveUint              uint16 `json:"mru,omitempty"`
+	AuthProtocol                uint16 `json:"auth_protocol,omitempty"`
+	MagicNumber                 uint32 `json:"magic_number,omitempty"`
+	ProtocolFieldCompression    bool   `json:"pfc,omitempty"`
+	AddressCtrlFieldCompression bool   `json:"acfc,omitempty"`
+	CallbackOperation           byte   `json:"callback,omitempty"`
+}
+
+// MonitoredSession 旁路监听到的一个 CPE 与 AC 之间的会话
+type MonitoredSession struct {
+	CpeMac     string      `json:"cpe_mac,omitempty"`
+	AcMac      string      `json:"ac_mac,omitempty"`
+	Vlan       string      `json:"vlan,omitempty"`
+	SessionID  uint16      `json:"session_id"`
+	AcName     string      `json:"ac_name,omitempty"`
+	Stage      string      `json:"stage"`
+	CpeOptions *LCPOptions `json:"cpe_options,omitempty"`
+	AcOptions  *LCPOptions `json:"ac_options,omitempty"`
+	PeerID     string      `json:"peer_id,omitempty"`
+	// Password 按 Handler 的 Redaction 脱敏后的密码
+	Password  string    `json:"password,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// monitor 旁路监听模式的会话跟踪。
+// 发现阶段以 CPE 为键，收到 PADS 后以会话 ID 为键；中途才开始监听的会话，
+// 通过 PAP 请求的方向或 Configure-Request 中是否带认证协议（只有 AC 会带）判断双方角色。
+type monitor struct {
+	mu       sync.Mutex
+	pending  map[string]*MonitoredSession
+	sessions map[string]*MonitoredSession
+	// 超过该时间没有新报文的会话被丢弃，见 SetMonitorTimeouts
+	discoveryTimeout time.Duration
+	idleTimeout      time.Duration
+	lastSweep        time.Time
+}
+
+func newMonitor() *monitor {
+	return &monitor{
+		pending:          make(map[string]*MonitoredSession),
+		sessions:         make(map[string]*MonitoredSession),
+		discoveryTimeout: DefaultMonitorDiscoveryTimeout,
+		idleTimeout:      DefaultMonitorIdleTimeout,
+	}
+}
+
+// SetMonitorTimeouts 设置旁路监听模式下会话的保留时间：discovery 为发现阶段未完成的会话，
+// idle 为已建立但没有新报文的会话，为 0 时使用默认值。非旁路监听模式时不做处理，需在 Run 之前调用。
+func (h *Handler) SetMonitorTimeouts(discovery time.Duration, idle time.Duration) {
+	if h.monitor == nil {
+		return
+	}
+	if discovery == 0 {
+		discovery = DefaultMonitorDiscoveryTimeout
+	}
+	if idle == 0 {
+		idle = DefaultMonitorIdleTimeout
+	}
+	h.monitor.discoveryTimeout = discovery
+	h.monitor.idleTimeout = idle
+}
+
+// NewMonitor 创建旁路监听模式的处理器：网卡以混杂模式打开，从不发送任何封包，
+// 只跟踪网段上任意 CPE 与任意 AC 之间的发现和会话过程，并通过 EventMonitorSession 上报。
+// 适用于网段上已有真实 BRAS，或在镜像端口上监听的场景。
+// 打开网卡失败时回调 EventError。
+func NewMonitor(adapterName string, adapterMac []byte, cb Listener) *Handler {
+	h, err := newHandler(adapterName, adapterMac, cb, true)
+	if err != nil {
+		h.callback(EventError, fmt.Sprintf("初始化适配器(%s)监听器失败：%s", mac(h.adapterMac), err.Error()))
+	}
+	return h
+}
+
+// NewMonitorByName 同 NewMonitor，网卡 MAC 和 pcap 设备名根据网卡名自动获取，打开网卡失败时返回错误
+func NewMonitorByName(name string, cb Listener) (h *Handler, err error) {
+	a, err := FindAdapter(name)
+	if err != nil {
+		return
+	}
+	return newHandler(a.PcapDevice, a.Mac, cb, true)
+}
+
+// Passive 是否为旁路监听模式
+func (h *Handler) Passive() bool {
+	return h.monitor != nil
+}
+
+// MonitoredSessions 返回旁路监听到的会话快照，非旁路监听模式时返回空。
+func (h *Handler) MonitoredSessions() (sessions []MonitoredSession) {
+	if h.monitor == nil {
+		return
+	}
+	h.monitor.mu.Lock()
+	defer h.monitor.mu.Unlock()
+	for _, s := range h.monitor.pending {
+		sessions = append(sessions, *s)
+	}
+	for _, s := range h.monitor.sessions {
+		sessions = append(sessions, *s)
+	}
+	return
+}
+
+func (h *Handler) handleMonitor(f link.Frame) {
+	switch f.EtherType {
+	case layers.EthernetTypePPPoEDiscovery:
+		pppoed, err := pppoe.DecodePPPoED(f.Payload)
+		if err != nil {
+			h.decodeError(f, metrics.LayerPPPoED, err)
+			return
+		}
+		h.monitorDiscovery(f, pppoed)
+	case layers.EthernetTypePPPoESession:
+		pppoes, err := pppoe.DecodePPPoES(f.Payload)
+		if err != nil {
+			h.decodeError(f, metrics.LayerPPPoES, err)
+			return
+		}
+		if pppoes.Code != pppoe.SCodeSessionData {
+			return
+		}
+		frame, err := ppp.DecodeFrame(pppoes.Payload)
+		if err != nil {
+			h.decodeError(f, metrics.LayerPPPoES, ppp.ShiftOffset(err, pppoe.PPPoESBasicLen))
+			return
+		}
+		h.monitorSession(f, pppoes, frame)
+	}
+}
+
+func (h *Handler) monitorDiscovery(f link.Frame, pppoed pppoe.PPPoED) {
+	m := h.monitor
+	src, dst := mac(f.SrcMac), mac(f.DstMac)
+	h.log(StageMonitor).Debug("monitor pppoe discovery", "code", pppoed.Code, "src", src, "dst", dst, "vlan", f.Vlans, "session_id", pppoed.SessionID)
+	h.detectAC(f, pppoed)
+
+	m.mu.Lock()
+	m.sweep(time.Now())
+	var s *MonitoredSession
+	switch pppoed.Code {
+	case pppoe.CodePADI:
+		h.metrics.IncPADI(h.adapterID())
+		s = m.pendingSession(src, f.Vlans)
+	case pppoe.CodePADO:
+		s = m.pendingSession(dst, f.Vlans)
+		if pppoed.AcName != "" {
+			s.AcName = pppoed.AcName
+		}
+	case pppoe.CodePADR:
+		h.metrics.IncPADR(h.adapterID())
+		s = m.pendingSession(src, f.Vlans)
+		s.AcMac = dst
+	case pppoe.CodePADS:
+		s = m.pendingSession(dst, f.Vlans)
+		delete(m.pending, pendingKey(dst, f.Vlans))
+		s.AcMac = src
+		s.SessionID = pppoed.SessionID
+		if pppoed.AcName != "" {
+			s.AcName = pppoed.AcName
+		}
+		m.sessions[sessionKey(src, dst, f.Vlans, pppoed.SessionID)] = s
+	case pppoe.CodePADT:
+		key := sessionKey(src, dst, f.Vlans, pppoed.SessionID)
+		if s = m.sessions[key]; s == nil {
+			m.mu.Unlock()
+			return
+		}
+		delete(m.sessions, key)
+		s.Stage = MonitorStageTerminated
+	default:
+		m.mu.Unlock()
+		return
+	}
+	s.UpdatedAt = time.Now()
+	snapshot := *s
+	m.mu.Unlock()
+
+	if pppoed.Code == pppoe.CodePADS || pppoed.Code == pppoe.CodePADT {
+		h.callback(EventMonitorSession, mac(h.adapterMac), snapshot)
+	}
+}
+
+func (h *Handler) monitorSession(f link.Frame, pppoes pppoe.PPPoES, frame ppp.Frame) {
+	m := h.monitor
+	src, dst := mac(f.SrcMac), mac(f.DstMac)
+
+	m.mu.Lock()
+	m.sweep(time.Now())
+	key := sessionKey(src, dst, f.Vlans, pppoes.SessionID)
+	s, ok := m.sessions[key]
+	if !ok {
+		now := time.Now()
+		s = &MonitoredSession{
+			Vlan:      f.Vlans.String(),
+			SessionID: pppoes.SessionID,
+			Stage:     MonitorStageLCP,
+			StartedAt: now,
+			UpdatedAt: now,
+		}
+		m.sessions[key] = s
+	}
+
+	changed := false
+	var captured *Auth
+	switch frame.Protocol {
+	case ppp.ProtocolLCP:
+		lcp := frame.LinkProtocol
+		h.log(StageMonitor).Debug("monitor pppoe session lcp", "code", lcp.GetShowCode(), "src", src, "dst", dst, "session_id", pppoes.SessionID)
+		switch lcp.Code {
+		case ppp.LinkCodeConfigRequest:
+			if s.CpeMac == "" && lcp.AuthProtocol != 0 {
+				s.setRoles(dst, src)
+			}
+		case ppp.LinkCodeConfigAck:
+			// Configure-Ack 原样带回对端请求的配置项
+			options := newLCPOptions(lcp)
+			if s.AcMac == src {
+				s.CpeOptions = &options
+			} else if s.CpeMac == src {
+				s.AcOptions = &options
+			} else if lcp.AuthProtocol != 0 {
+				s.setRoles(src, dst)
+				s.AcOptions = &options
+			}
+			if s.Stage == MonitorStageDiscovery {
+				s.Stage = MonitorStageLCP
+			}
+			changed = true
+		}
+	case ppp.ProtocolPAP:
+		pap := frame.PwdAuthProtocol
+		h.log(StageMonitor).Debug("monitor pppoe session pap", "code", pap.GetShowCode(), "src", src, "dst", dst, "session_id", pppoes.SessionID)
+		switch pap.Code {
+		case ppp.PwdAuthCodeRequest:
+			s.setRoles(src, dst)
+			s.Stage = MonitorStageAuth
+			s.PeerID = pap.PeerID
+			s.Password = h.redaction.Apply(pap.Password)
+			captured = &Auth{
+				PeerMac:  f.SrcMac,
+				Vlan:     f.Vlans.String(),
+				Method:   auth.MethodPAP,
+				PeerID:   pap.PeerID,
+				Password: pap.Password,
+			}
+			changed = true
+		case ppp.PwdAuthCodeAck:
+			s.setRoles(dst, src)
+			s.Stage = MonitorStageAuthAck
+			changed = true
+		case ppp.PwdAuthCodeNak:
+			s.setRoles(dst, src)
+			s.Stage = MonitorStageAuthNak
+			changed = true
+		}
+	}
+	s.UpdatedAt = time.Now()
+	snapshot := *s
+	m.mu.Unlock()
+
+	if changed {
+		h.callback(EventMonitorSession, mac(h.adapterMac), snapshot)
+	}
+	if captured != nil {
+		h.report(captured)
+	}
+}
+
+// sweep 丢弃超时的会话，距上次检查不到 monitorSweepInterval 时不做处理。调用方需持有 m.mu
+func (m *monitor) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < monitorSweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, s := range m.pending {
+		if now.Sub(s.UpdatedAt) > m.discoveryTimeout {
+			delete(m.pending, key)
+		}
+	}
+	for key, s := range m.sessions {
+		if now.Sub(s.UpdatedAt) > m.idleTimeout {
+			delete(m.sessions, key)
+		}
+	}
+}
+
+func (m *monitor) pendingSession(cpe string, vlans link.VlanStack) *MonitoredSession {
+	key := pendingKey(cpe, vlans)
+	s, ok := m.pending[key]
+	if !ok {
+		now := time.Now()
+		s = &MonitoredSession{
+			CpeMac:    cpe,
+			Vlan:      vlans.String(),
+			Stage:     MonitorStageDiscovery,
+			StartedAt: now,
+		}
+		m.pending[key] = s
+	}
+	return s
+}
+
+func (s *MonitoredSession) setRoles(cpe string, ac string) {
+	s.CpeMac = cpe
+	s.AcMac = ac
+}
+
+func newLCPOptions(lcp ppp.LinkCtrlProtocol) LCPOptions {
+	return LCPOptions{
+		MaxReceiveUint:              lcp.MaxReceiveUint,
+		AuthProtocol:                uint16(lcp.AuthProtocol),
+		MagicNumber:                 lcp.MagicNumber,
+		ProtocolFieldCompression:    lcp.ProtocolFieldCompression,
+		AddressCtrlFieldCompression: lcp.AddressCtrlFieldCompression,
+		CallbackOperation:           byte(lcp.CallbackOperation),
+	}
+}
+
+func pendingKey(cpe string, vlans link.VlanStack) string {
+	return cpe + "/" + vlans.String()
+}
+
+// sessionKey 与方向无关的会话键
+func sessionKey(a string, b string, vlans link.VlanStack, sessionID uint16) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%s/%s/%s/%d", a, b, vlans, sessionID)
+}
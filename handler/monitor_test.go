@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"pppoe-probe/link"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"testing"
+	"time"
+)
+
+var testAcMac = net.HardwareAddr{0x00, 0x00, 0x5e, 0x00, 0x53, 0x01}
+
+func newTestMonitor(rec *eventRecorder) (h *Handler, w *fakeWriter) {
+	h, w = newTestHandler(rec)
+	h.monitor = newMonitor()
+	return
+}
+
+func discoveryFrame(src net.HardwareAddr, dst net.HardwareAddr, pppoed pppoe.PPPoED) link.Frame {
+	return link.Frame{SrcMac: src, DstMac: dst, EtherType: layers.EthernetTypePPPoEDiscovery, Payload: pppoed.Encode()}
+}
+
+func sessionFrame(src net.HardwareAddr, dst net.HardwareAddr, sessionID uint16, f ppp.Frame) link.Frame {
+	return link.Frame{SrcMac: src, DstMac: dst, EtherType: layers.EthernetTypePPPoESession, Payload: pppoe.AppendSessionFrame(nil, sessionID, &f)}
+}
+
+func TestHandler_Monitor(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w := newTestMonitor(rec)
+	run(t, h)
+	cpe, ac := mac(testPeerMac), mac(testAcMac)
+	lcpAuth := ppp.LinkCtrlProtocol{Identifier: 1, MaxReceiveUint: 1492, AuthProtocol: ppp.AuthProtocolPassword, MagicNumber: 0x0a0b0c0d}
+	confReq, confAck := lcpAuth, lcpAuth
+	confReq.Code, confAck.Code = ppp.LinkCodeConfigRequest, ppp.LinkCodeConfigAck
+
+	steps := []struct {
+		name  string
+		frame link.Frame
+		// 之后的会话快照，events 为累计的 EventMonitorSession 数量
+		want   MonitoredSession
+		events int
+	}{
+		{"padi", discoveryFrame(testPeerMac, broadcastMac, pppoe.NewPPPoEDPacket(pppoe.CodePADI, 0, "", nil, nil)),
+			MonitoredSession{CpeMac: cpe, Stage: MonitorStageDiscovery}, 0},
+		{"pado", discoveryFrame(testAcMac, testPeerMac, pppoe.NewPPPoEDPacket(pppoe.CodePADO, 0, "bras", nil, []byte{0x01})),
+			MonitoredSession{CpeMac: cpe, AcName: "bras", Stage: MonitorStageDiscovery}, 0},
+		{"padr", discoveryFrame(testPeerMac, testAcMac, pppoe.NewPPPoEDPacket(pppoe.CodePADR, 0, "bras", nil, []byte{0x01})),
+			MonitoredSession{CpeMac: cpe, AcMac: ac, AcName: "bras", Stage: MonitorStageDiscovery}, 0},
+		{"pads", discoveryFrame(testAcMac, testPeerMac, pppoe.NewPPPoEDPacket(pppoe.CodePADS, 7, "bras", nil, nil)),
+			MonitoredSession{CpeMac: cpe, AcMac: ac, AcName: "bras", SessionID: 7, Stage: MonitorStageDiscovery}, 1},
+		{"ac config request", sessionFrame(testAcMac, testPeerMac, 7, ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: confReq}),
+			MonitoredSession{CpeMac: cpe, AcMac: ac, AcName: "bras", SessionID: 7, Stage: MonitorStageDiscovery}, 1},
+		{"cpe config ack", sessionFrame(testPeerMac, testAcMac, 7, ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: confAck}),
+			MonitoredSession{CpeMac: cpe, AcMac: ac, AcName: "bras", SessionID: 7, Stage: MonitorStageLCP,
+				AcOptions: &LCPOptions{MaxReceiveUint: 1492, AuthProtocol: uint16(ppp.AuthProtocolPassword), MagicNumber: 0x0a0b0c0d}}, 2},
+		{"pap request", sessionFrame(testPeerMac, testAcMac, 7, ppp.Frame{Protocol: ppp.ProtocolPAP, PwdAuthProtocol: ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeRequest, Identifier: 1, PeerID: "user@isp", Password: "secret"}}),
+			MonitoredSession{CpeMac: cpe, AcMac: ac, AcName: "bras", SessionID: 7, Stage: MonitorStageAuth, PeerID: "user@isp", Password: "[redacted]",
+				AcOptions: &LCPOptions{MaxReceiveUint: 1492, AuthProtocol: uint16(ppp.AuthProtocolPassword), MagicNumber: 0x0a0b0c0d}}, 3},
+		{"pap ack", sessionFrame(testAcMac, testPeerMac, 7, ppp.Frame{Protocol: ppp.ProtocolPAP, PwdAuthProtocol: ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeAck, Identifier: 1}}),
+			MonitoredSession{CpeMac: cpe, AcMac: ac, AcName: "bras", SessionID: 7, Stage: MonitorStageAuthAck, PeerID: "user@isp", Password: "[redacted]",
+				AcOptions: &LCPOptions{MaxReceiveUint: 1492, AuthProtocol: uint16(ppp.AuthProtocolPassword), MagicNumber: 0x0a0b0c0d}}, 4},
+	}
+	for _, step := range steps {
+		inject(h, step.frame)
+		sessions := h.MonitoredSessions()
+		if !assert.Len(t, sessions, 1, step.name) {
+			continue
+		}
+		got := sessions[0]
+		assert.False(t, got.UpdatedAt.IsZero(), step.name)
+		got.StartedAt, got.UpdatedAt = time.Time{}, time.Time{}
+		assert.Equal(t, step.want, got, step.name)
+		assert.Len(t, rec.all(EventMonitorSession), step.events, step.name)
+	}
+
+	args := rec.wait(t, EventSessionAuthCaptured)
+	assert.Equal(t, []interface{}{"00:e0:4c:36:17:f8", cpe, "user@isp"}, args[:3])
+	assert.Equal(t, "secret", args[3].(Secret).Reveal())
+
+	inject(h, discoveryFrame(testPeerMac, testAcMac, pppoe.NewPPPoEDPacket(pppoe.CodePADT, 7, "", nil, nil)))
+	assert.Empty(t, h.MonitoredSessions())
+	events := rec.all(EventMonitorSession)
+	assert.Len(t, events, 5)
+	assert.Equal(t, MonitorStageTerminated, events[4][1].(MonitoredSession).Stage)
+	// 旁路监听从不发送
+	assert.True(t, w.empty())
+}
+
+func TestHandler_MonitorMidSession(t *testing.T) {
+	rec := &eventRecorder{}
+	h, _ := newTestMonitor(rec)
+	// 中途开始监听，由 Configure-Request 中的认证协议判断 AC
+	inject(h, sessionFrame(testAcMac, testPeerMac, 9, ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1, AuthProtocol: ppp.AuthProtocolPassword}}))
+	sessions := h.MonitoredSessions()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, mac(testPeerMac), sessions[0].CpeMac)
+	assert.Equal(t, mac(testAcMac), sessions[0].AcMac)
+	assert.Equal(t, MonitorStageLCP, sessions[0].Stage)
+
+	// 长度字段超出载荷的帧只上报解码错误
+	inject(h, link.Frame{SrcMac: testPeerMac, DstMac: broadcastMac, EtherType: layers.EthernetTypePPPoEDiscovery, Payload: []byte{0x11, 0x09, 0x00, 0x00, 0x01, 0x00}})
+	assert.Len(t, rec.all(EventDecodeError), 1)
+	assert.Len(t, h.MonitoredSessions(), 1)
+}
+
+func TestMonitor_Sweep(t *testing.T) {
+	rec := &eventRecorder{}
+	h, _ := newTestMonitor(rec)
+	h.SetMonitorTimeouts(time.Minute, time.Hour)
+	inject(h, discoveryFrame(testPeerMac, broadcastMac, pppoe.NewPPPoEDPacket(pppoe.CodePADI, 0, "", nil, nil)))
+	inject(h, sessionFrame(testAcMac, testAcMac, 3, ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeEchoRequest, Identifier: 1}}))
+	assert.Len(t, h.MonitoredSessions(), 2)
+
+	m := h.monitor
+	now := time.Now()
+	m.mu.Lock()
+	m.sweep(now.Add(30 * time.Second))
+	m.mu.Unlock()
+	assert.Len(t, h.MonitoredSessions(), 2)
+
+	// 发现阶段未完成的会话先超时
+	m.mu.Lock()
+	m.sweep(now.Add(2 * time.Minute))
+	m.mu.Unlock()
+	sessions := h.MonitoredSessions()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, uint16(3), sessions[0].SessionID)
+
+	// 距上次检查不到 monitorSweepInterval 时不检查
+	m.mu.Lock()
+	m.sweep(now.Add(2*time.Minute + monitorSweepInterval/2))
+	m.mu.Unlock()
+	m.mu.Lock()
+	m.sweep(now.Add(2 * time.Hour))
+	m.mu.Unlock()
+	assert.Empty(t, h.MonitoredSessions())
+}
+
+func TestHandler_MonitorAfterClose(t *testing.T) {
+	rec := &eventRecorder{}
+	h, _ := newTestMonitor(rec)
+	h.Close()
+	// 关闭后抓包协程中还可能有帧在处理，上报凭据不能阻塞或 panic
+	for i := 0; i < 32; i++ {
+		assert.NotPanics(t, func() {
+			inject(h, sessionFrame(testPeerMac, testAcMac, 7, ppp.Frame{Protocol: ppp.ProtocolPAP, PwdAuthProtocol: ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeRequest, Identifier: byte(i), PeerID: "user", Password: "secret"}}))
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Redaction 事件和日志中密码的脱敏策略
+type Redaction int
+
+const (
+	// RedactFull 默认策略，替换为 [redacted]
+	RedactFull Redaction = iota
+	// RedactMasked 只保留首尾各一个字符，例如 s****t，短于 6 个字符时全部替换为 ****
+	RedactMasked
+	// RedactHashed 替换为未加盐的 SHA-256 截断到前 6 字节，形如 sha256:1a2b3c4d5e6f，可以在不暴露密码的情况下比较是否相同。
+	// 没有盐且计算很快，拿到摘要的人可以用字典或穷举反查出较短或常见的密码，不能当作加密使用
+	RedactHashed
+	// RedactNone 输出明文，只在显式开启时使用
+	RedactNone
+)
+
+func (r Redaction) String() string {
+	switch r {
+	case RedactFull:
+		return "full"
+	case RedactMasked:
+		return "masked"
+	case RedactHashed:
+		return "hashed"
+	case RedactNone:
+		return "none"
+	}
+	return "unknown"
+}
+
+// ParseRedaction 解析 full、masked、hashed、none，空字符串为 RedactFull
+func ParseRedaction(s string) (r Redaction, err error) {
+	switch strings.ToLower(s) {
+	case "", "full":
+		return RedactFull, nil
+	case "masked":
+		return RedactMasked, nil
+	case "hashed":
+		return RedactHashed, nil
+	case "none":
+		return RedactNone, nil
+	}
+	err = errors.New("unknown redaction " + s + ", expected full, masked, hashed or none")
+	return
+}
+
+// Apply 按策略处理 s，空字符串原样返回
+func (r Redaction) Apply(s string) string {
+	if s == "" {
+		return s
+	}
+	switch r {
+	case RedactNone:
+		return s
+	case RedactHashed:
+		sum := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(sum[:6])
+	case RedactMasked:
+		runes := []rune(s)
+		if len(runes) < 6 {
+			return "****"
+		}
+		return string(runes[0]) + "****" + string(runes[len(runes)-1])
+	}
+	return "[redacted]"
+}
+
+// Secret 事件中携带的密码。打印和序列化时按 Redaction 处理，需要明文时（例如保存到凭据库）调用 Reveal
+type Secret struct {
+	value  string
+	policy Redaction
+}
+
+func NewSecret(value string, policy Redaction) Secret {
+	return Secret{value: value, policy: policy}
+}
+
+// Reveal 返回明文
+func (s Secret) Reveal() string {
+	return s.value
+}
+
+func (s Secret) String() string {
+	return s.policy.Apply(s.value)
+}
+
+// Format 保证 %v、%+v、%#v、%q 等格式化都不输出明文
+func (s Secret) Format(f fmt.State, verb rune) {
+	_, _ = fmt.Fprintf(f, fmt.FormatString(f, verb), s.String())
+}
+
+// LogValue 实现 slog.LogValuer，结构化日志中同样按策略输出
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// SetRedaction 设置事件和日志中密码的脱敏策略，默认为 RedactFull，需在 Run 之前调用
+func (h *Handler) SetRedaction(r Redaction) {
+	h.redaction = r
+}
+
+func (h *Handler) secret(value string) Secret {
+	return NewSecret(value, h.redaction)
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer 可被多个协程写入的日志缓冲区
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestHandler_Redaction(t *testing.T) {
+	const password = "hunter2pass"
+	for _, r := range []Redaction{RedactFull, RedactMasked, RedactHashed, RedactNone} {
+		t.Run(r.String(), func(t *testing.T) {
+			rec := &eventRecorder{}
+			h, w := newTestHandler(rec)
+			logs := &syncBuffer{}
+			h.SetLogger(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+			h.SetRedaction(r)
+			run(t, h)
+			peer := newTestPeer(t, h, w, "user@isp", password)
+			peer.discover()
+			peer.authenticate()
+
+			args := rec.wait(t, EventSessionAuthCaptured)
+			secret := args[3].(Secret)
+			assert.Equal(t, password, secret.Reveal())
+			assert.Equal(t, r.Apply(password), secret.String())
+			data, err := json.Marshal(NewJSONEvent(EventSessionAuthCaptured, args...))
+			assert.Nil(t, err)
+
+			// 只有 RedactNone 时事件的格式化输出、JSON 和调试日志中出现明文
+			for name, s := range map[string]string{
+				"format": fmt.Sprintf("%+v %#v", args, args),
+				"json":   string(data),
+				"log":    logs.String(),
+			} {
+				assert.Equal(t, r == RedactNone, strings.Contains(s, password), name)
+			}
+			assert.Contains(t, logs.String(), "handle pppoe session pap")
+			assert.Contains(t, string(data), r.Apply(password))
+		})
+	}
+}
+
+func TestParseRedaction(t *testing.T) {
+	// 未指定时完全隐藏
+	var zero Redaction
+	assert.Equal(t, RedactFull, zero)
+	for s, want := range map[string]Redaction{"": RedactFull, "full": RedactFull, "Masked": RedactMasked, "hashed": RedactHashed, "none": RedactNone} {
+		r, err := ParseRedaction(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, r, s)
+	}
+	_, err := ParseRedaction("plain")
+	assert.NotNil(t, err)
+	assert.Equal(t, "[redacted]", RedactFull.Apply("secret"))
+}
@@ -0,0 +1,409 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"net"
+	"pppoe-probe/link"
+	"pppoe-probe/metrics"
+	"pppoe-probe/pppoe"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRelayDiscoveryTimeout 发现阶段未完成的中继会话默认保留的时间
+const DefaultRelayDiscoveryTimeout = 30 * time.Second
+
+// 中继会话的阶段
+const (
+	RelayStageDiscovery  = "discovery"
+	RelayStageSession    = "session"
+	RelayStageTerminated = "terminated"
+)
+
+// RelayConfig PPPoE 中继（中间代理）配置
+type RelayConfig struct {
+	// AgentCircuitID、AgentRemoteID 非空时在转发给 AC 的 PADI/PADR 中插入 TR-101 线路标识，并去掉对端自带的线路标识。
+	// 可以包含 {mac} 和 {vlan}，分别替换为对端 MAC 和 VLAN
+	AgentCircuitID string
+	AgentRemoteID  string
+	// DiscoveryTimeout 发现阶段未完成的中继会话保留的时间，为 0 时使用 DefaultRelayDiscoveryTimeout
+	DiscoveryTimeout time.Duration
+}
+
+// RelayedSession 中继的一个 CPE 与 AC 之间的会话
+type RelayedSession struct {
+	CpeMac    string `json:"cpe_mac"`
+	AcMac     string `json:"ac_mac,omitempty"`
+	AcName    string `json:"ac_name,omitempty"`
+	Vlan      string `json:"vlan,omitempty"`
+	SessionID uint16 `json:"session_id"`
+	// RelaySessionID Relay-Session-Id 标签的十六进制
+	RelaySessionID string `json:"relay_session_id"`
+	Stage          string `json:"stage"`
+	// Rx 为从 CPE 收到转发给 AC，Tx 为从 AC 收到转发给 CPE，只统计会话报文
+	RxPackets uint64    `json:"rx_packets,omitempty"`
+	RxBytes   uint64    `json:"rx_bytes,omitempty"`
+	TxPackets uint64    `json:"tx_packets,omitempty"`
+	TxBytes   uint64    `json:"tx_bytes,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// relay 在面向 CPE 和面向 AC 的两个 Handler 之间转发发现和会话报文。
+// 两侧都以本端网卡 MAC 收发，AC 看到的所有 CPE 都是面向 AC 的网卡：
+// 发现阶段靠插入的 Relay-Session-Id（RFC 2516 4.5）区分 CPE，会话阶段靠 AC MAC、VLAN 和会话 ID 区分。
+type relay struct {
+	client *Handler
+	server *Handler
+	cfg    RelayConfig
+
+	mu  sync.Mutex
+	seq uint32
+	// relayIDs 以 Relay-Session-Id 为键，pending 以 CPE 的 frameKey 为键，
+	// cpeSessions、acSessions 分别以 CPE、AC 的 frameKey 加会话 ID 为键
+	relayIDs    map[string]*relayEntry
+	pending     map[string]*relayEntry
+	cpeSessions map[string]*relayEntry
+	acSessions  map[string]*relayEntry
+
+	// sendMu 保护发送时复用的缓冲区
+	sendMu   sync.Mutex
+	frameBuf []byte
+}
+
+type relayEntry struct {
+	cpeMac net.HardwareAddr
+	acMac  net.HardwareAddr
+	vlans  link.VlanStack
+	// relayID 为 CPE 自带的 Relay-Session-Id 时 inserted 为 false，转发给 CPE 时不去掉
+	relayID  []byte
+	inserted bool
+	session  RelayedSession
+}
+
+// SetRelay 开启中继模式：h 面向 CPE，server 面向 AC，两者都需在 Run 之前调用本方法，之后分别调用 Run。
+// h 上 CPE 发来的 PADI/PADR 插入 Relay-Session-Id 后从 server 发给 AC，AC 的应答去掉该标签后从 h 发回 CPE，
+// 会话报文原样转发，只改写源和目的 MAC。中继模式下两个 Handler 都不再应答 PPPoE，不能与旁路监听、数据面或 LAC 模式同时开启。
+func (h *Handler) SetRelay(server *Handler, cfg RelayConfig) (err error) {
+	if server == nil || server == h || server.adapterName == h.adapterName {
+		err = errors.New("relay needs two different adapters")
+		return
+	}
+	for _, x := range []*Handler{h, server} {
+		if x.monitor != nil || x.serial != nil || x.dp != nil || x.lac != nil {
+			err = errors.New("relay mode conflicts with monitor, serial, data plane or lac mode")
+			return
+		}
+	}
+	if cfg.DiscoveryTimeout == 0 {
+		cfg.DiscoveryTimeout = DefaultRelayDiscoveryTimeout
+	}
+	r := &relay{
+		client:      h,
+		server:      server,
+		cfg:         cfg,
+		relayIDs:    make(map[string]*relayEntry),
+		pending:     make(map[string]*relayEntry),
+		cpeSessions: make(map[string]*relayEntry),
+		acSessions:  make(map[string]*relayEntry),
+	}
+	h.relay = r
+	server.relay = r
+	return
+}
+
+// RelaySessions 返回中继的会话快照，非中继模式时返回空。可与 Run 并发调用。
+func (h *Handler) RelaySessions() (sessions []RelayedSession) {
+	r := h.relay
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.relayIDs {
+		sessions = append(sessions, e.session)
+	}
+	return
+}
+
+// handle 处理 h 收到的帧，h 为 r.client 或 r.server
+func (r *relay) handle(h *Handler, f link.Frame) {
+	// 抓包时能看到本端发出的帧
+	if bytes.Equal(f.SrcMac, h.adapterMac) {
+		return
+	}
+	switch f.EtherType {
+	case layers.EthernetTypePPPoEDiscovery:
+		pppoed, err := pppoe.DecodeRawPPPoED(f.Payload)
+		if err != nil {
+			h.decodeError(f, metrics.LayerPPPoED, err)
+			return
+		}
+		if h == r.client {
+			r.fromCPE(f, pppoed)
+		} else {
+			r.fromAC(f, pppoed)
+		}
+	case layers.EthernetTypePPPoESession:
+		pppoes, err := pppoe.DecodePPPoES(f.Payload)
+		if err != nil {
+			h.decodeError(f, metrics.LayerPPPoES, err)
+			return
+		}
+		r.forwardSession(h, f, pppoes.SessionID, f.Payload[:pppoe.PPPoESBasicLen+len(pppoes.Payload)])
+	}
+}
+
+// fromCPE 处理 CPE 发来的 PADI、PADR、PADT
+func (r *relay) fromCPE(f link.Frame, pppoed pppoe.RawPPPoED) {
+	h := r.client
+	key := frameKey(f)
+	switch pppoed.Code {
+	case pppoe.CodePADI, pppoe.CodePADR:
+		if pppoed.Code == pppoe.CodePADI {
+			h.metrics.IncPADI(h.adapterID())
+		} else {
+			h.metrics.IncPADR(h.adapterID())
+		}
+		e, ok := r.discover(f, pppoed)
+		if !ok {
+			return
+		}
+		dst := f.DstMac
+		if pppoed.Code == pppoe.CodePADR {
+			// CPE 只见过本端的 MAC，PADR 发给回复 PADO 的 AC
+			if e.acMac == nil {
+				h.log(StageRelay).Debug("drop padr before any offer", "cpe_mac", mac(f.SrcMac))
+				return
+			}
+			dst = e.acMac
+		}
+		pppoed.Tags = r.upstreamTags(e, pppoed.Tags)
+		r.write(r.server, dst, f.Vlans, layers.EthernetTypePPPoEDiscovery, pppoed.AppendEncode(nil))
+	case pppoe.CodePADT:
+		r.mu.Lock()
+		e, ok := r.cpeSessions[relayKey(key, pppoed.SessionID)]
+		r.mu.Unlock()
+		if !ok {
+			return
+		}
+		r.write(r.server, e.acMac, e.vlans, layers.EthernetTypePPPoEDiscovery, f.Payload)
+		r.terminate(e)
+	}
+}
+
+// discover 返回 CPE 发现阶段的中继会话，没有时新建。带 Relay-Session-Id 的报文沿用该标签，不再插入
+func (r *relay) discover(f link.Frame, pppoed pppoe.RawPPPoED) (e *relayEntry, ok bool) {
+	key := frameKey(f)
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, pending := range r.pending {
+		if now.Sub(pending.session.UpdatedAt) > r.cfg.DiscoveryTimeout {
+			delete(r.pending, k)
+			delete(r.relayIDs, string(pending.relayID))
+		}
+	}
+	if e, ok = r.pending[key]; ok {
+		e.session.UpdatedAt = now
+		return
+	}
+	if pppoed.Code != pppoe.CodePADI {
+		return
+	}
+	e = &relayEntry{
+		cpeMac: append(net.HardwareAddr(nil), f.SrcMac...),
+		vlans:  append(link.VlanStack(nil), f.Vlans...),
+		session: RelayedSession{
+			CpeMac:    mac(f.SrcMac),
+			Vlan:      f.Vlans.String(),
+			Stage:     RelayStageDiscovery,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+	}
+	if relayID, found := pppoed.Tag(pppoe.TagTypeRelaySessionID); found {
+		e.relayID = append([]byte(nil), relayID...)
+	} else {
+		for {
+			r.seq++
+			e.relayID = binary.BigEndian.AppendUint32(nil, r.seq)
+			if _, used := r.relayIDs[string(e.relayID)]; !used {
+				break
+			}
+		}
+		e.inserted = true
+	}
+	if _, used := r.relayIDs[string(e.relayID)]; used {
+		r.client.log(StageRelay).Warn("duplicate relay session id from cpe", "cpe_mac", e.session.CpeMac, "relay_session_id", hex.EncodeToString(e.relayID))
+		return nil, false
+	}
+	e.session.RelaySessionID = hex.EncodeToString(e.relayID)
+	r.relayIDs[string(e.relayID)] = e
+	r.pending[key] = e
+	return e, true
+}
+
+// upstreamTags 转发给 AC 的标签：按配置替换 TR-101 线路标识，需要时追加 Relay-Session-Id
+func (r *relay) upstreamTags(e *relayEntry, tags []pppoe.Tag) []pppoe.Tag {
+	if r.cfg.AgentCircuitID != "" || r.cfg.AgentRemoteID != "" {
+		// CPE 不可信，去掉其自带的线路标识
+		kept := tags[:0]
+		for _, tag := range tags {
+			if id, ok := tag.VendorID(); !ok || id != pppoe.BroadbandForumVendorID {
+				kept = append(kept, tag)
+			}
+		}
+		replacer := strings.NewReplacer("{mac}", e.session.CpeMac, "{vlan}", e.session.Vlan)
+		tags = append(kept, pppoe.NewAgentTag(replacer.Replace(r.cfg.AgentCircuitID), replacer.Replace(r.cfg.AgentRemoteID)))
+	}
+	if e.inserted {
+		tags = append(tags, pppoe.Tag{Type: pppoe.TagTypeRelaySessionID, Value: e.relayID})
+	}
+	return tags
+}
+
+// fromAC 处理 AC 发来的 PADO、PADS、PADT
+func (r *relay) fromAC(f link.Frame, pppoed pppoe.RawPPPoED) {
+	h := r.server
+	switch pppoed.Code {
+	case pppoe.CodePADO, pppoe.CodePADS:
+		relayID, ok := pppoed.Tag(pppoe.TagTypeRelaySessionID)
+		if !ok {
+			h.log(StageRelay).Debug("drop offer without relay session id", "ac_mac", mac(f.SrcMac), "code", pppoed.Code)
+			return
+		}
+		r.mu.Lock()
+		e, ok := r.relayIDs[string(relayID)]
+		if !ok || e.session.Stage != RelayStageDiscovery {
+			r.mu.Unlock()
+			return
+		}
+		// CPE 看到的 PADO 都来自本端 MAC，无法区分多个 AC，只中继最先应答的 AC
+		if e.acMac != nil && !bytes.Equal(e.acMac, f.SrcMac) {
+			r.mu.Unlock()
+			h.log(StageRelay).Debug("ignore offer from another ac", "ac_mac", mac(f.SrcMac), "cpe_mac", e.session.CpeMac)
+			return
+		}
+		e.acMac = append(net.HardwareAddr(nil), f.SrcMac...)
+		e.session.AcMac = mac(f.SrcMac)
+		if acName, ok := pppoed.Tag(pppoe.TagTypeAcName); ok {
+			e.session.AcName = string(acName)
+		}
+		e.session.UpdatedAt = time.Now()
+		established := pppoed.Code == pppoe.CodePADS && pppoed.SessionID != 0
+		if established {
+			e.session.SessionID = pppoed.SessionID
+			e.session.Stage = RelayStageSession
+			delete(r.pending, frameKey(link.Frame{SrcMac: e.cpeMac, Vlans: e.vlans}))
+			r.cpeSessions[relayKey(frameKey(link.Frame{SrcMac: e.cpeMac, Vlans: e.vlans}), pppoed.SessionID)] = e
+			r.acSessions[relayKey(frameKey(f), pppoed.SessionID)] = e
+		}
+		session := e.session
+		r.mu.Unlock()
+
+		if e.inserted {
+			kept := pppoed.Tags[:0]
+			for _, tag := range pppoed.Tags {
+				if tag.Type != pppoe.TagTypeRelaySessionID {
+					kept = append(kept, tag)
+				}
+			}
+			pppoed.Tags = kept
+		}
+		r.write(r.client, e.cpeMac, e.vlans, layers.EthernetTypePPPoEDiscovery, pppoed.AppendEncode(nil))
+		if established {
+			r.client.log(StageRelay).Info("relay session established", "cpe_mac", session.CpeMac, "ac_mac", session.AcMac, "session_id", session.SessionID)
+			r.client.callback(EventRelaySession, mac(r.client.adapterMac), session)
+		}
+	case pppoe.CodePADT:
+		r.mu.Lock()
+		e, ok := r.acSessions[relayKey(frameKey(f), pppoed.SessionID)]
+		r.mu.Unlock()
+		if !ok {
+			return
+		}
+		r.write(r.client, e.cpeMac, e.vlans, layers.EthernetTypePPPoEDiscovery, f.Payload)
+		r.terminate(e)
+	}
+}
+
+// forwardSession 原样转发会话报文，payload 从 PPPoE 头开始
+func (r *relay) forwardSession(h *Handler, f link.Frame, sessionID uint16, payload []byte) {
+	key := relayKey(frameKey(f), sessionID)
+	r.mu.Lock()
+	var e *relayEntry
+	var ok bool
+	if h == r.client {
+		if e, ok = r.cpeSessions[key]; ok {
+			e.session.RxPackets++
+			e.session.RxBytes += uint64(len(payload) - pppoe.PPPoESBasicLen)
+		}
+	} else {
+		if e, ok = r.acSessions[key]; ok {
+			e.session.TxPackets++
+			e.session.TxBytes += uint64(len(payload) - pppoe.PPPoESBasicLen)
+		}
+	}
+	if ok {
+		e.session.UpdatedAt = time.Now()
+	}
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	if h == r.client {
+		r.write(r.server, e.acMac, e.vlans, layers.EthernetTypePPPoESession, payload)
+	} else {
+		r.write(r.client, e.cpeMac, e.vlans, layers.EthernetTypePPPoESession, payload)
+	}
+}
+
+// terminate 任一方发送 PADT 后移除中继会话
+func (r *relay) terminate(e *relayEntry) {
+	r.mu.Lock()
+	if r.relayIDs[string(e.relayID)] != e {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.relayIDs, string(e.relayID))
+	delete(r.cpeSessions, relayKey(frameKey(link.Frame{SrcMac: e.cpeMac, Vlans: e.vlans}), e.session.SessionID))
+	delete(r.acSessions, relayKey(frameKey(link.Frame{SrcMac: e.acMac, Vlans: e.vlans}), e.session.SessionID))
+	e.session.Stage = RelayStageTerminated
+	e.session.UpdatedAt = time.Now()
+	session := e.session
+	r.mu.Unlock()
+	r.client.log(StageRelay).Info("relay session terminated", "cpe_mac", session.CpeMac, "ac_mac", session.AcMac, "session_id", session.SessionID)
+	r.client.callback(EventRelaySession, mac(r.client.adapterMac), session)
+}
+
+// write 以 h 的网卡 MAC 为源地址发送
+func (r *relay) write(h *Handler, dst net.HardwareAddr, vlans link.VlanStack, etherType layers.EthernetType, payload []byte) {
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+	var err error
+	r.frameBuf, err = link.Frame{
+		SrcMac:    h.adapterMac,
+		DstMac:    dst,
+		Vlans:     vlans,
+		EtherType: etherType,
+		Payload:   payload,
+	}.AppendEncode(r.frameBuf[:0])
+	if err == nil && h.writer != nil {
+		err = h.writer.WritePacketData(r.frameBuf)
+	}
+	if err != nil {
+		h.log(StageRelay).Error("write packet data", "err", err)
+	}
+}
+
+// relayKey 会话阶段的键：对端的 frameKey 加会话 ID
+func relayKey(key string, sessionID uint16) string {
+	return key + "/" + strconv.Itoa(int(sessionID))
+}
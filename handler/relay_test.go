@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"net"
+	"pppoe-probe/link"
+	"pppoe-probe/ppp"
+	"pppoe-probe/pppoe"
+	"testing"
+)
+
+var testServerMac = net.HardwareAddr{0x00, 0xe0, 0x4c, 0x36, 0x17, 0xf9}
+
+// newTestRelay h 面向 CPE，server 面向 AC，发出的帧分别写入 w 和 sw
+func newTestRelay(t *testing.T, rec *eventRecorder, cfg RelayConfig) (h *Handler, w *fakeWriter, server *Handler, sw *fakeWriter) {
+	h, w = newTestHandler(rec)
+	server = newBaseHandler("eth1", testServerMac, rec.listener)
+	server.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	sw = newFakeWriter()
+	server.writer = sw
+	assert.Nil(t, h.SetRelay(server, cfg))
+	return
+}
+
+func rawDiscovery(code pppoe.DCode, sessionID uint16, tags ...pppoe.Tag) []byte {
+	return pppoe.RawPPPoED{Code: code, SessionID: sessionID, Tags: tags}.AppendEncode(nil)
+}
+
+// nextRaw 读取一个 discovery 帧，检查源和目的 MAC
+func nextRaw(t *testing.T, w *fakeWriter, src net.HardwareAddr, dst net.HardwareAddr, code pppoe.DCode) (f link.Frame, pppoed pppoe.RawPPPoED) {
+	t.Helper()
+	f = w.next(t)
+	assert.Equal(t, layers.EthernetTypePPPoEDiscovery, f.EtherType)
+	assert.Equal(t, src, f.SrcMac)
+	assert.Equal(t, dst, f.DstMac)
+	pppoed, err := pppoe.DecodeRawPPPoED(f.Payload)
+	assert.Nil(t, err)
+	assert.Equal(t, code, pppoed.Code)
+	return
+}
+
+// expectSession 读取一个会话帧，检查 MAC、VLAN 和以太网填充之前的载荷
+func expectSession(t *testing.T, w *fakeWriter, src net.HardwareAddr, dst net.HardwareAddr, vlans link.VlanStack, payload []byte) {
+	t.Helper()
+	f := w.next(t)
+	assert.Equal(t, layers.EthernetTypePPPoESession, f.EtherType)
+	assert.Equal(t, src, f.SrcMac)
+	assert.Equal(t, dst, f.DstMac)
+	assert.Equal(t, vlans, f.Vlans)
+	if assert.True(t, len(f.Payload) >= len(payload)) {
+		assert.Equal(t, payload, f.Payload[:len(payload)])
+	}
+}
+
+func TestHandler_Relay(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w, server, sw := newTestRelay(t, rec, RelayConfig{AgentCircuitID: "{mac}/{vlan}", AgentRemoteID: "lab"})
+	vlans := link.VlanStack{{TPID: layers.EthernetTypeDot1Q, ID: 35}}
+	otherAc := net.HardwareAddr{0x00, 0x00, 0x5e, 0x00, 0x53, 0x02}
+	service := pppoe.Tag{Type: pppoe.TagTypeServiceName, Value: []byte("internet")}
+	acName := pppoe.Tag{Type: pppoe.TagTypeAcName, Value: []byte("bras")}
+	cookie := pppoe.Tag{Type: pppoe.TagTypeAcCookie, Value: []byte{0xc0, 0x0c}}
+	fromCPE := func(dst net.HardwareAddr, etherType layers.EthernetType, payload []byte) {
+		inject(h, link.Frame{SrcMac: testPeerMac, DstMac: dst, Vlans: vlans, EtherType: etherType, Payload: payload})
+	}
+	fromAC := func(src net.HardwareAddr, etherType layers.EthernetType, payload []byte) {
+		inject(server, link.Frame{SrcMac: src, DstMac: testServerMac, Vlans: vlans, EtherType: etherType, Payload: payload})
+	}
+
+	// PADI 去掉 CPE 自带的线路标识，插入配置的线路标识和 Relay-Session-Id 后广播给 AC
+	fromCPE(broadcastMac, layers.EthernetTypePPPoEDiscovery, rawDiscovery(pppoe.CodePADI, 0, service, pppoe.NewAgentTag("forged", "")))
+	f, padi := nextRaw(t, sw, testServerMac, broadcastMac, pppoe.CodePADI)
+	assert.Equal(t, vlans, f.Vlans)
+	relayID, ok := padi.Tag(pppoe.TagTypeRelaySessionID)
+	assert.True(t, ok)
+	assert.Equal(t, []pppoe.Tag{service, pppoe.NewAgentTag("00:0c:29:8b:82:c5/35", "lab"), {Type: pppoe.TagTypeRelaySessionID, Value: relayID}}, padi.Tags)
+	relayTag := pppoe.Tag{Type: pppoe.TagTypeRelaySessionID, Value: relayID}
+
+	// AC 的 PADO 去掉 Relay-Session-Id 后以本端 MAC 发给 CPE，其他 AC 的应答和没有该标签的应答都忽略
+	fromAC(testAcMac, layers.EthernetTypePPPoEDiscovery, rawDiscovery(pppoe.CodePADO, 0, service, acName, cookie, relayTag))
+	_, pado := nextRaw(t, w, testAdapterMac, testPeerMac, pppoe.CodePADO)
+	assert.Equal(t, []pppoe.Tag{service, acName, cookie}, pado.Tags)
+	fromAC(otherAc, layers.EthernetTypePPPoEDiscovery, rawDiscovery(pppoe.CodePADO, 0, service, relayTag))
+	fromAC(testAcMac, layers.EthernetTypePPPoEDiscovery, rawDiscovery(pppoe.CodePADO, 0, service))
+	assert.True(t, w.empty())
+
+	// PADR 发给回复 PADO 的 AC
+	fromCPE(testAdapterMac, layers.EthernetTypePPPoEDiscovery, rawDiscovery(pppoe.CodePADR, 0, service, cookie))
+	_, padr := nextRaw(t, sw, testServerMac, testAcMac, pppoe.CodePADR)
+	assert.Equal(t, []pppoe.Tag{service, cookie, pppoe.NewAgentTag("00:0c:29:8b:82:c5/35", "lab"), relayTag}, padr.Tags)
+
+	fromAC(testAcMac, layers.EthernetTypePPPoEDiscovery, rawDiscovery(pppoe.CodePADS, 9, service, relayTag))
+	_, pads := nextRaw(t, w, testAdapterMac, testPeerMac, pppoe.CodePADS)
+	assert.Equal(t, uint16(9), pads.SessionID)
+	events := rec.all(EventRelaySession)
+	if assert.Len(t, events, 1) {
+		session := events[0][1].(RelayedSession)
+		assert.Equal(t, RelayStageSession, session.Stage)
+		assert.Equal(t, mac(testAcMac), session.AcMac)
+		assert.Equal(t, "bras", session.AcName)
+		assert.Equal(t, "35", session.Vlan)
+	}
+
+	// 会话报文原样转发，只改写 MAC
+	lcp := pppoe.AppendSessionFrame(nil, 9, &ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1, MaxReceiveUint: 1492}})
+	fromCPE(testAdapterMac, layers.EthernetTypePPPoESession, lcp)
+	expectSession(t, sw, testServerMac, testAcMac, vlans, lcp)
+	fromAC(testAcMac, layers.EthernetTypePPPoESession, lcp)
+	expectSession(t, w, testAdapterMac, testPeerMac, vlans, lcp)
+	// 其他会话 ID 不转发
+	fromCPE(testAdapterMac, layers.EthernetTypePPPoESession, pppoe.AppendSessionFrame(nil, 10, &ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeEchoRequest, Identifier: 2}}))
+	assert.True(t, sw.empty())
+
+	sessions := h.RelaySessions()
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, uint64(1), sessions[0].RxPackets)
+		assert.Equal(t, uint64(1), sessions[0].TxPackets)
+		assert.Equal(t, uint64(len(lcp)-pppoe.PPPoESBasicLen), sessions[0].RxBytes)
+	}
+
+	fromCPE(testAdapterMac, layers.EthernetTypePPPoEDiscovery, rawDiscovery(pppoe.CodePADT, 9))
+	nextRaw(t, sw, testServerMac, testAcMac, pppoe.CodePADT)
+	assert.Empty(t, h.RelaySessions())
+	events = rec.all(EventRelaySession)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, RelayStageTerminated, events[1][1].(RelayedSession).Stage)
+	}
+	// 中继模式下本身不应答
+	assert.Empty(t, rec.all(EventDiscoveryBroadcast))
+	assert.True(t, w.empty())
+	assert.True(t, sw.empty())
+}
+
+func TestHandler_RelayOwnSessionID(t *testing.T) {
+	rec := &eventRecorder{}
+	h, w, server, sw := newTestRelay(t, rec, RelayConfig{})
+	// CPE 自带 Relay-Session-Id 时沿用，转发给 CPE 时保留
+	relayTag := pppoe.Tag{Type: pppoe.TagTypeRelaySessionID, Value: []byte{0xaa, 0xbb}}
+	inject(h, link.Frame{SrcMac: testPeerMac, DstMac: broadcastMac, EtherType: layers.EthernetTypePPPoEDiscovery, Payload: rawDiscovery(pppoe.CodePADI, 0, relayTag)})
+	_, padi := nextRaw(t, sw, testServerMac, broadcastMac, pppoe.CodePADI)
+	assert.Equal(t, []pppoe.Tag{relayTag}, padi.Tags)
+	inject(server, link.Frame{SrcMac: testAcMac, DstMac: testServerMac, EtherType: layers.EthernetTypePPPoEDiscovery, Payload: rawDiscovery(pppoe.CodePADO, 0, relayTag)})
+	_, pado := nextRaw(t, w, testAdapterMac, testPeerMac, pppoe.CodePADO)
+	assert.Equal(t, []pppoe.Tag{relayTag}, pado.Tags)
+
+	// 另一个 CPE 使用相同的标签时丢弃
+	inject(h, link.Frame{SrcMac: testAcMac, DstMac: broadcastMac, EtherType: layers.EthernetTypePPPoEDiscovery, Payload: rawDiscovery(pppoe.CodePADI, 0, relayTag)})
+	assert.True(t, sw.empty())
+
+	// 本端发出又被抓到的帧忽略
+	inject(server, link.Frame{SrcMac: testServerMac, DstMac: broadcastMac, EtherType: layers.EthernetTypePPPoEDiscovery, Payload: rawDiscovery(pppoe.CodePADI, 0, relayTag)})
+	assert.True(t, w.empty())
+}
+
+func TestHandler_SetRelay(t *testing.T) {
+	rec := &eventRecorder{}
+	h, _ := newTestHandler(rec)
+	assert.NotNil(t, h.SetRelay(h, RelayConfig{}))
+	assert.NotNil(t, h.SetRelay(nil, RelayConfig{}))
+	server := newBaseHandler("eth1", testServerMac, rec.listener)
+	server.monitor = newMonitor()
+	assert.NotNil(t, h.SetRelay(server, RelayConfig{}))
+}
@@ -0,0 +1,286 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand"
+	"pppoe-probe/auth"
+	"pppoe-probe/goroutine"
+	"pppoe-probe/link"
+	"pppoe-probe/metrics"
+	"pppoe-probe/ppp"
+	"pppoe-probe/serial"
+	"sync"
+	"time"
+)
+
+// SerialPty SerialConfig.Device 为该值时创建新的 pty，对端（例如 pppd）打开 EventStart 中的从设备路径
+const SerialPty = "pty"
+
+// serialRetransmitInterval 对端没有应答时重发 LCP 配置请求的间隔
+const serialRetransmitInterval = 3 * time.Second
+
+// SerialConfig 串口或 pty 上的 PPP 链路，帧格式为 RFC 1662 异步 HDLC
+type SerialConfig struct {
+	// Device 串口设备路径，例如 /dev/ttyUSB0，或者 SerialPty
+	Device string
+	// Baud 波特率，为 0 时不修改，pty 忽略此项
+	Baud int
+	// FCS32 使用 32 位 FCS，需要对端同样配置，默认 16 位
+	FCS32 bool
+}
+
+// NewSerialHandler 在串口或 pty 上作为 PPP 认证方运行，没有以太网和 PPPoE 发现阶段。
+// 认证和凭据上报与以太网上相同，事件中的网卡为设备路径，对端 MAC 为空；对端结束链路后等待下一次协商。
+// 不支持数据面和旁路监听
+func NewSerialHandler(cfg SerialConfig, cb Listener) (h *Handler, err error) {
+	var port *serial.Port
+	if cfg.Device == SerialPty {
+		port, err = serial.OpenPty()
+	} else {
+		port, err = serial.Open(cfg.Device, cfg.Baud)
+	}
+	if err != nil {
+		return
+	}
+	h = newBaseHandler(port.Name(), nil, cb)
+	h.serial = &serialLink{h: h, dev: port, fcs32: cfg.FCS32, done: make(chan struct{})}
+	h.SetLogger(nil)
+	return
+}
+
+// serialLink 串口上的 PPP 链路，同一时间只有一个会话
+type serialLink struct {
+	h     *Handler
+	dev   serial.Device
+	fcs32 bool
+	done  chan struct{}
+
+	mu      sync.Mutex
+	engine  *ppp.Engine
+	started bool
+	closed  bool
+	// opened 已经统计过 LCP 完成的 Engine，对端重新协商时不再统计
+	opened *ppp.Engine
+
+	// sendMu 保护发送路径上复用的缓冲区
+	sendMu   sync.Mutex
+	frameBuf []byte
+	hdlcBuf  []byte
+}
+
+func (s *serialLink) start() {
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+	goroutine.GoWith(s.h.logger, s.run)
+}
+
+// run 读取并处理对端的帧，直到设备关闭
+func (s *serialLink) run() {
+	defer close(s.done)
+	s.reset()
+	stop := make(chan struct{})
+	defer close(stop)
+	goroutine.GoWith(s.h.logger, func() {
+		s.retransmit(stop)
+	})
+
+	r := ppp.NewHDLCReader(s.dev, s.fcs32)
+	var frame ppp.Frame
+	for {
+		raw, err := r.ReadFrame()
+		var de *ppp.DecodeError
+		if errors.As(err, &de) {
+			s.h.decodeError(link.Frame{}, metrics.LayerHDLC, err)
+			continue
+		}
+		if err != nil {
+			if !s.isClosed() {
+				s.h.log(StageHandler).Error("failed to read serial device", "err", err)
+				s.h.callback(EventError, err.Error())
+			}
+			return
+		}
+		if err = ppp.DecodeFrameInto(&frame, raw); err != nil {
+			s.h.decodeError(link.Frame{Payload: raw}, metrics.LayerHDLC, err)
+			continue
+		}
+		s.input(&frame, raw)
+	}
+}
+
+// input raw 为 frame 解码前的数据（从协议字段开始），用于回复 Protocol Reject
+func (s *serialLink) input(frame *ppp.Frame, raw []byte) {
+	engine := s.current()
+	switch frame.Protocol {
+	case ppp.ProtocolLCP:
+		s.log().Debug("handle serial lcp", "code", frame.LinkProtocol.GetShowCode(), "packet", frame.LinkProtocol)
+		if frame.LinkProtocol.Code == ppp.LinkCodeConfigRequest {
+			s.h.callback(EventSessionRequest, s.h.adapterID(), "")
+		}
+	case ppp.ProtocolPAP:
+		pap := frame.PwdAuthProtocol
+		s.log().Debug("handle serial pap", "code", pap.GetShowCode(), "user", pap.PeerID, "password", s.h.secret(pap.Password))
+		s.h.callback(EventSessionAuthRequest, s.h.adapterID(), "")
+	case ppp.ProtocolCHAP:
+		s.log().Debug("handle serial chap", "code", frame.ChapProtocol.GetShowCode(), "user", frame.ChapProtocol.Name)
+	}
+	if engine.Input(frame) {
+		return
+	}
+	// 不承载数据，IPCP 等网络层协议一律拒绝
+	engine.RejectProtocol(raw)
+}
+
+// retransmit 对端没有应答时重发 LCP 配置请求，对端处于被动模式时也能完成协商
+func (s *serialLink) retransmit(stop chan struct{}) {
+	ticker := time.NewTicker(serialRetransmitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if engine := s.current(); engine.Phase() == ppp.PhaseEstablish {
+				engine.Retransmit()
+			}
+		}
+	}
+}
+
+// reset 为下一个会话创建新的 ppp.Engine 并主动发起协商
+func (s *serialLink) reset() {
+	var engine *ppp.Engine
+	engine = ppp.NewEngine(ppp.Config{
+		Role:         ppp.RoleAuthenticator,
+		MagicNumber:  rand.Uint32(),
+		Async:        true,
+		AuthProtocol: s.h.authProtocol,
+		Name:         s.h.acName,
+		Send: func(f *ppp.Frame) {
+			s.send(engine, f)
+		},
+		OnPhase: func(p ppp.Phase) {
+			s.onPhase(engine, p)
+		},
+		OnAuthenticate: func(req ppp.AuthRequest) {
+			s.onAuthenticate(engine, req)
+		},
+	})
+	s.mu.Lock()
+	closed := s.closed
+	s.engine = engine
+	s.mu.Unlock()
+	if !closed {
+		engine.Open()
+	}
+}
+
+func (s *serialLink) current() *ppp.Engine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.engine
+}
+
+func (s *serialLink) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *serialLink) onPhase(engine *ppp.Engine, p ppp.Phase) {
+	s.log().Debug("serial link phase", "phase", p)
+	switch p {
+	case ppp.PhaseAuthenticate:
+		// 每次拨入使用新的 Engine，对端重新协商时同一 Engine 会再次进入认证阶段
+		s.mu.Lock()
+		first := s.opened != engine
+		s.opened = engine
+		s.mu.Unlock()
+		if first {
+			s.h.metrics.IncLCPAck(s.h.adapterID())
+		}
+		if s.h.authProtocol == ppp.AuthProtocolChap && engine.AuthProtocol() != ppp.AuthProtocolChap {
+			s.log().Info("peer refused chap, fall back to pap")
+		}
+	case ppp.PhaseDead:
+		if engine == s.current() {
+			s.reset()
+		}
+	}
+}
+
+// onAuthenticate 上报凭据并交给 Authenticator 决定，拒绝后结束链路，同 Worker.onAuthenticate
+func (s *serialLink) onAuthenticate(engine *ppp.Engine, r ppp.AuthRequest) {
+	req := newAuthRequest(r)
+	req.Adapter = s.h.adapterName
+	s.h.report(&Auth{
+		Method:   req.Method,
+		PeerID:   req.Username,
+		Password: req.Password,
+	})
+	authenticator := s.h.getAuthenticator()
+	goroutine.GoWith(s.h.logger, func() {
+		decision, err := authenticator.Authenticate(req)
+		if err != nil {
+			s.log().Error("failed to authenticate", "method", req.Method, "user", req.Username, "err", err)
+			decision = auth.Decision{Verdict: auth.Reject, Message: "Authentication failed"}
+		}
+		// 等待决定期间链路可能已经结束
+		if engine != s.current() || s.isClosed() {
+			return
+		}
+		s.log().Info("auth decision", "method", req.Method, "verdict", decision.Verdict, "user", req.Username)
+		s.h.metrics.IncAuthResult(s.h.adapterID(), req.Method, decision.Verdict.String())
+		switch decision.Verdict {
+		case auth.Accept:
+			engine.AuthDone(true, decision.Message)
+		case auth.Reject:
+			s.h.callback(EventSessionAuthRejected, s.h.adapterID(), "")
+			engine.AuthDone(false, decision.Message)
+			engine.Close()
+		}
+	})
+}
+
+// send 按 RFC 1662 成帧后写入设备。LCP 始终转义全部控制字符，其余协议按对端协商的 ACCM 转义
+func (s *serialLink) send(engine *ppp.Engine, f *ppp.Frame) {
+	if f.Protocol == ppp.ProtocolLCP && s.h.debugEnabled() {
+		s.log().Debug("send serial lcp", "code", f.LinkProtocol.GetShowCode(), "packet", f.LinkProtocol)
+	}
+	accm := ppp.DefaultACCM
+	if f.Protocol != ppp.ProtocolLCP {
+		accm = engine.PeerACCM()
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.frameBuf = f.AppendEncode(s.frameBuf[:0])
+	s.hdlcBuf = ppp.AppendHDLC(s.hdlcBuf[:0], s.frameBuf, accm, s.fcs32)
+	if _, err := s.dev.Write(s.hdlcBuf); err != nil && !s.isClosed() {
+		s.log().Error("failed to write serial device", "err", err)
+	}
+}
+
+// close 关闭设备并等待 run 退出，之后不会再上报凭据
+func (s *serialLink) close() {
+	s.mu.Lock()
+	s.closed = true
+	started := s.started
+	s.mu.Unlock()
+	_ = s.dev.Close()
+	if started {
+		<-s.done
+	}
+}
+
+// log 链路日志，stage 取 ppp.Engine 当前的阶段
+func (s *serialLink) log() *slog.Logger {
+	switch s.current().Phase() {
+	case ppp.PhaseAuthenticate:
+		return s.h.log(StageAuth)
+	case ppp.PhaseNetwork:
+		return s.h.log(StageNetwork)
+	}
+	return s.h.log(StageLCP)
+}
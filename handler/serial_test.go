@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"pppoe-probe/auth"
+	"pppoe-probe/metrics"
+	"pppoe-probe/ppp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSerialDevice = "/dev/pts/9"
+
+// fakeSerial 用两个管道代替串口，Handler 从 r 读取对端发来的字节，写入 w 的字节由对端读取
+type fakeSerial struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (d *fakeSerial) Name() string {
+	return testSerialDevice
+}
+
+func (d *fakeSerial) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
+
+func (d *fakeSerial) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+func (d *fakeSerial) Close() error {
+	_ = d.r.Close()
+	return d.w.Close()
+}
+
+// serialPeer 串口另一端的被认证方，PPP 交给 ppp.Engine
+type serialPeer struct {
+	t      *testing.T
+	fcs32  bool
+	out    *io.PipeWriter
+	engine *ppp.Engine
+	// frames Handler 发出的帧，由读取协程解码
+	frames  chan ppp.Frame
+	results []bool
+}
+
+func newTestSerial(t *testing.T, rec *eventRecorder, fcs32 bool) (h *Handler, c *metrics.Collector, p *serialPeer) {
+	toHandler, fromPeer := io.Pipe()
+	toPeer, fromHandler := io.Pipe()
+	h = newBaseHandler(testSerialDevice, nil, rec.listener)
+	h.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.serial = &serialLink{h: h, dev: &fakeSerial{r: toHandler, w: fromHandler}, fcs32: fcs32, done: make(chan struct{})}
+	c = metrics.NewCollector()
+	h.SetMetrics(c)
+	h.SetAuthenticator(auth.AcceptAll)
+
+	p = &serialPeer{t: t, fcs32: fcs32, out: fromPeer, frames: make(chan ppp.Frame, 64)}
+	p.engine = ppp.NewEngine(ppp.Config{
+		Role:        ppp.RolePeer,
+		MagicNumber: 0x11223344,
+		Async:       true,
+		Username:    "user",
+		Password:    "secret",
+		Send:        p.send,
+		OnAuthResult: func(accepted bool, message string) {
+			p.results = append(p.results, accepted)
+		},
+	})
+	go func() {
+		r := ppp.NewHDLCReader(toPeer, fcs32)
+		for {
+			raw, err := r.ReadFrame()
+			if err != nil {
+				close(p.frames)
+				return
+			}
+			frame, err := ppp.DecodeFrame(raw)
+			if assert.Nil(t, err) {
+				p.frames <- frame
+			}
+		}
+	}()
+	run(t, h)
+	return
+}
+
+// send 按 RFC 1662 成帧后写给 Handler，始终转义全部控制字符
+func (p *serialPeer) send(f *ppp.Frame) {
+	_, _ = p.out.Write(ppp.AppendHDLC(nil, f.Encode(), ppp.DefaultACCM, p.fcs32))
+}
+
+// pump 把 Handler 发出的帧交给 Engine，直到 done 返回 true。done 在每收到一个帧后检查，参数为该帧
+func (p *serialPeer) pump(done func(frame ppp.Frame) bool) {
+	p.t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case frame, ok := <-p.frames:
+			if !ok {
+				p.t.Fatal("serial device closed")
+			}
+			p.engine.Input(&frame)
+			if done(frame) {
+				return
+			}
+		case <-deadline:
+			p.t.Fatal("timeout")
+		}
+	}
+}
+
+func TestHandler_Serial(t *testing.T) {
+	for _, fcs32 := range []bool{false, true} {
+		name := "fcs16"
+		if fcs32 {
+			name = "fcs32"
+		}
+		t.Run(name, func(t *testing.T) {
+			rec := &eventRecorder{}
+			_, c, peer := newTestSerial(t, rec, fcs32)
+			authenticated := func(n int) func(ppp.Frame) bool {
+				return func(ppp.Frame) bool {
+					return len(peer.results) == n
+				}
+			}
+			peer.engine.Open()
+			peer.pump(authenticated(1))
+			assert.Equal(t, []bool{true}, peer.results)
+			assert.Equal(t, ppp.PhaseNetwork, peer.engine.Phase())
+			args := rec.wait(t, EventSessionAuthCaptured)
+			assert.Equal(t, []interface{}{testSerialDevice, "", "user"}, args[:3])
+			assert.Equal(t, "secret", args[3].(Secret).Reveal())
+
+			// 不承载数据，网络层协议回复 Protocol Reject
+			ipcp := ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1}}
+			peer.send(&ipcp)
+			peer.pump(func(frame ppp.Frame) bool {
+				if frame.Protocol != ppp.ProtocolLCP || frame.LinkProtocol.Code != ppp.LinkCodeProtocolReject {
+					return false
+				}
+				assert.Equal(t, ipcp.Encode(), frame.LinkProtocol.Data)
+				return true
+			})
+
+			// 对端重新协商后重新认证，LCP 完成只统计一次
+			peer.send(&ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 0x40, MagicNumber: 0x11223344}})
+			peer.pump(authenticated(2))
+			assert.Equal(t, ppp.PhaseNetwork, peer.engine.Phase())
+			deadline := time.Now().Add(testTimeout)
+			for len(rec.all(EventSessionAuthCaptured)) < 2 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			var sb strings.Builder
+			_, err := c.WriteTo(&sb)
+			assert.Nil(t, err)
+			assert.Contains(t, sb.String(), `pppoe_lcp_ack_total{adapter="/dev/pts/9"} 1`+"\n")
+			assert.Contains(t, sb.String(), `pppoe_credentials_total{adapter="/dev/pts/9"} 2`+"\n")
+		})
+	}
+}
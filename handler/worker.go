@@ -2,116 +2,234 @@ package handler
 
 import (
 	"encoding/hex"
-	"fmt"
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/sirupsen/logrus"
 	"math/rand"
+	"pppoe-probe/auth"
+	"pppoe-probe/l2tp"
+	"pppoe-probe/link"
+	"pppoe-probe/metrics"
+	"pppoe-probe/ppp"
 	"pppoe-probe/pppoe"
+	"pppoe-probe/pppox"
 	"strings"
 	"sync"
+	"time"
 )
 
+// Session 对端会话状态快照
+type Session struct {
+	PeerMac   string    `json:"peer_mac"`
+	Vlan      string    `json:"vlan,omitempty"`
+	SessionID uint16    `json:"session_id"`
+	Stage     string    `json:"stage"`
+	PeerID    string    `json:"peer_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// AuthMethod 对端使用的认证方式 pap 或 chap，Attributes 为认证通过时 Authenticator 返回的属性
+	AuthMethod string            `json:"auth_method,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// 以下字段仅在开启数据面时有值
+	IP        string `json:"ip,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	// L2TPTunnelID、L2TPSessionID 仅在 LAC 模式下会话转交 LNS 后有值，为本端分配的 ID
+	L2TPTunnelID  uint16 `json:"l2tp_tunnel_id,omitempty"`
+	L2TPSessionID uint16 `json:"l2tp_session_id,omitempty"`
+	// 以下字段仅在开启数据面或 LAC 模式时有值，Rx 为从对端收到，Tx 为发给对端
+	Up        bool   `json:"up,omitempty"`
+	RxPackets uint64 `json:"rx_packets,omitempty"`
+	RxBytes   uint64 `json:"rx_bytes,omitempty"`
+	TxPackets uint64 `json:"tx_packets,omitempty"`
+	TxBytes   uint64 `json:"tx_bytes,omitempty"`
+}
+
 type Worker struct {
-	h             *Handler
-	srcMac        []byte
-	pppoesReqOnce sync.Once
-	magicNumber   uint32
+	h       *Handler
+	srcMac  []byte
+	vlans   link.VlanStack
+	mu      sync.Mutex
+	session Session
+	engine  *ppp.Engine
+	acct    *accounting
+	network network
+	kernel  *pppox.Session
+	l2tp    *l2tp.Session
+	// lcpOpened LCP 协商已完成过，重新协商时不再统计
+	lcpOpened bool
+	// inMu 串行化会话的输入：抓包协程、内核通道的读协程和 Authenticator 的决定，
+	// 网络层协商是先读状态再回复，交错执行会回复过期的状态
+	inMu sync.Mutex
+	// sendMu 保护发送路径上复用的缓冲区
+	sendMu     sync.Mutex
+	payloadBuf []byte
+	frameBuf   []byte
 }
 
-func NewWorker(h *Handler, srcMac []byte) *Worker {
-	return &Worker{
-		h:           h,
-		srcMac:      srcMac,
-		magicNumber: rand.Uint32(),
+func NewWorker(h *Handler, srcMac []byte, vlans link.VlanStack) *Worker {
+	now := time.Now()
+	w := &Worker{
+		h:      h,
+		srcMac: srcMac,
+		vlans:  vlans,
+		session: Session{
+			PeerMac:   mac(srcMac),
+			Vlan:      vlans.String(),
+			Stage:     StageDiscovery,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
 	}
+	// 不开启数据面时 MRU 使用对端的值
+	var mru uint16
+	if h.dp != nil {
+		mru = h.dp.cfg.MRU
+	}
+	w.engine = ppp.NewEngine(ppp.Config{
+		Role:           ppp.RoleAuthenticator,
+		MRU:            mru,
+		MagicNumber:    rand.Uint32(),
+		AuthProtocol:   h.authProtocol,
+		Name:           h.acName,
+		Send:           w.sendPPP,
+		OnPhase:        w.onPhase,
+		OnAuthenticate: w.onAuthenticate,
+	})
+	return w
 }
 
-func (w *Worker) handlePacket(packet gopacket.Packet) {
-	ethPack, _ := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+// Session 返回会话状态快照
+func (w *Worker) Session() Session {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.session
+}
 
-	switch ethPack.EthernetType {
+func (w *Worker) updateSession(f func(s *Session)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f(&w.session)
+	w.session.UpdatedAt = time.Now()
+}
+
+func (w *Worker) handleFrame(f link.Frame) {
+	w.inMu.Lock()
+	defer w.inMu.Unlock()
+	switch f.EtherType {
 	case layers.EthernetTypePPPoEDiscovery:
-		pppoed, err := pppoe.DecodePPPoED(ethPack.Payload)
+		pppoed, err := pppoe.DecodePPPoED(f.Payload)
 		if err != nil {
-			logrus.Errorln("failed to decode eth pppoed payload", err)
+			w.h.decodeError(f, metrics.LayerPPPoED, err)
 			return
 		}
-		logrus.Debugln("handle pppoe discovery", pppoed.Code, "from", ethPack.SrcMAC, fmt.Sprintf("%+v", pppoed))
+		w.log().Debug("handle pppoe discovery", "code", pppoed.Code, "vlan", f.Vlans, "packet", pppoed)
 		switch pppoed.Code {
 		case pppoe.CodePADI:
-			w.sendPPPoEDPacket(pppoe.NewPPPoEDPacket(pppoe.CodePADO, pppoed.SessionID, NovaDefaultAcName, pppoed.HostUniq, getRandCookie()))
+			w.sendPPPoEDPacket(pppoe.NewPPPoEDPacket(pppoe.CodePADO, pppoed.SessionID, w.h.acName, pppoed.HostUniq, getRandCookie()))
 		case pppoe.CodePADR:
-			w.sendPPPoEDPacket(pppoe.NewPPPoEDPacket(pppoe.CodePADS, pppoed.SessionID+1, NovaDefaultAcName, pppoed.HostUniq, pppoed.AcCookie))
+			sessionID := w.h.nextSessionID()
+			w.updateSession(func(s *Session) {
+				s.SessionID = sessionID
+			})
+			w.sendPPPoEDPacket(pppoe.NewPPPoEDPacket(pppoe.CodePADS, sessionID, w.h.acName, pppoed.HostUniq, pppoed.AcCookie))
+			if w.h.dp != nil && w.h.dp.cfg.KernelOffload {
+				w.offload(sessionID)
+			}
+		case pppoe.CodePADT:
+			if pppoed.SessionID == w.sessionID() {
+				w.log().Info("peer terminated session")
+				w.close(auth.TerminateUserRequest)
+			}
 		}
 	case layers.EthernetTypePPPoESession:
-		pppoes, err := pppoe.DecodePPPoES(ethPack.Payload)
-		if err != nil {
-			logrus.Errorln("failed to decode eth pppoes payload", err)
+		var pppoes pppoe.PPPoES
+		var frame ppp.Frame
+		if err := pppoe.DecodeSessionFrameInto(&pppoes, &frame, f.Payload); err != nil {
+			w.h.decodeError(f, metrics.LayerPPPoES, err)
 			return
 		}
 		if pppoes.Code != pppoe.SCodeSessionData {
-			logrus.Warnln("unknown session code", pppoes.Code)
+			w.log().Warn("unknown session code", "code", pppoes.Code)
 			return
 		}
-		if pppoes.P2PProtocol == pppoe.P2PLinkCtrlProtocol {
-			w.handleLinkCtrlProtocol(ethPack.SrcMAC, pppoes)
-		} else if pppoes.P2PProtocol == pppoe.P2PAuthProtocol {
-			w.handleAuthProtocol(ethPack.SrcMAC, pppoes)
-		} else {
-			logrus.Warnln("unknown p2p link protocol")
+		if s := w.l2tpSession(); s != nil {
+			w.forwardFrame(s, pppoes.Payload)
 			return
 		}
+		w.handlePPP(&frame)
 	}
 }
 
-func (w *Worker) handleLinkCtrlProtocol(srcMac []byte, pppoes pppoe.PPPoES) {
-	logrus.Debugln("handle pppoe session", pppoes.LinkProtocol.GetShowCode(), "from", srcMac, fmt.Sprintf("%+v", pppoes))
-	if pppoes.Code != pppoe.SCodeSessionData {
-		logrus.Warnln("unknown session code", pppoes.Code)
+// handlePPP LCP 和认证交给 ppp.Engine，开启数据面时处理 IPCP、IPv6CP 和数据
+func (w *Worker) handlePPP(frame *ppp.Frame) {
+	switch frame.Protocol {
+	case ppp.ProtocolLCP:
+		w.log().Debug("handle pppoe session lcp", "code", frame.LinkProtocol.GetShowCode(), "packet", frame.LinkProtocol)
+	case ppp.ProtocolPAP:
+		pap := frame.PwdAuthProtocol
+		w.log().Debug("handle pppoe session pap", "code", pap.GetShowCode(), "user", pap.PeerID, "password", w.h.secret(pap.Password))
+	case ppp.ProtocolCHAP:
+		w.log().Debug("handle pppoe session chap", "code", frame.ChapProtocol.GetShowCode(), "user", frame.ChapProtocol.Name)
+	}
+	if w.engine.Input(frame) {
 		return
 	}
-	// 发送不带任何配置项的Request
-	w.pppoesReqOnce.Do(func() {
-		w.sendPPPoESPacket(pppoe.NewPPPoESLinkProtocolPacket(0x01,
-			pppoe.AuthProtocolPassword,
-			pppoe.LinkCodeConfigRequest,
-			pppoes.LinkProtocol.Identifier+1,
-			pppoes.LinkProtocol.MaxReceiveUint,
-			w.magicNumber,
-			false,
-			false,
-			0))
-	})
-	switch pppoes.LinkProtocol.Code {
-	case pppoe.LinkCodeConfigRequest:
-		if pppoes.LinkProtocol.AddressCtrlFieldCompression || pppoes.LinkProtocol.ProtocolFieldCompression || pppoes.LinkProtocol.CallbackOperation != 0 {
-			// Reject所有的配置项
-			w.sendPPPoESPacket(pppoe.NewPPPoESLinkProtocolPacket(pppoes.SessionID,
-				0,
-				pppoe.LinkCodeConfigReject,
-				pppoes.LinkProtocol.Identifier,
-				0,
-				0,
-				pppoes.LinkProtocol.ProtocolFieldCompression,
-				pppoes.LinkProtocol.AddressCtrlFieldCompression,
-				pppoes.LinkProtocol.CallbackOperation))
-			return
-		}
-		// Accept不带配置项的请求
-		w.sendPPPoESPacket(pppoe.NewPPPoESLinkProtocolPacket(0x01,
-			pppoes.LinkProtocol.AuthProtocol,
-			pppoe.LinkCodeConfigAck,
-			pppoes.LinkProtocol.Identifier,
-			pppoes.LinkProtocol.MaxReceiveUint,
-			pppoes.LinkProtocol.MagicNumber,
-			pppoes.LinkProtocol.ProtocolFieldCompression,
-			pppoes.LinkProtocol.AddressCtrlFieldCompression,
-			pppoes.LinkProtocol.CallbackOperation))
+	if w.h.dp == nil {
+		w.log().Warn("unknown p2p link protocol", "protocol", frame.Protocol)
+		return
+	}
+	switch frame.Protocol {
+	case ppp.ProtocolIPCP:
+		w.handleIPCtrlProtocol(frame.IPCtrlProtocol)
+	case ppp.ProtocolIPv6CP:
+		w.handleIPv6CtrlProtocol(frame.IPv6CtrlProtocol)
+	case ppp.ProtocolIPv4, ppp.ProtocolIPv6:
+		w.handleData(frame.Protocol, frame.Data)
+	default:
+		w.log().Warn("unknown p2p link protocol", "protocol", frame.Protocol)
+	}
+}
 
-	case pppoe.LinkCodeConfigReject:
-	case pppoe.LinkCodeConfigAck:
+// onPhase 按 PPP 阶段更新会话状态，对端发送 Terminate Request 后结束会话
+func (w *Worker) onPhase(phase ppp.Phase) {
+	switch phase {
+	case ppp.PhaseEstablish:
+		w.updateSession(func(s *Session) {
+			s.Stage = StageLCP
+		})
+		w.renegotiate()
+	case ppp.PhaseAuthenticate:
+		w.mu.Lock()
+		first := !w.lcpOpened
+		w.lcpOpened = true
+		w.mu.Unlock()
+		if first {
+			w.h.metrics.IncLCPAck(w.h.adapterID())
+		}
+		if w.h.authProtocol == ppp.AuthProtocolChap && w.engine.AuthProtocol() != ppp.AuthProtocolChap {
+			w.log().Info("peer refused chap, fall back to pap")
+		}
+	case ppp.PhaseDead:
+		w.close(auth.TerminateUserRequest)
+	}
+}
 
+// renegotiate 对端在链路打开后重新协商 LCP，已经建立的网络层随之关闭，重新认证通过后再建立。
+// 内核承载的会话无法重建 ppp 网卡，直接结束
+func (w *Worker) renegotiate() {
+	w.mu.Lock()
+	started := w.network.ip != nil
+	kernel := w.kernel
+	w.mu.Unlock()
+	if !started {
+		return
+	}
+	w.log().Info("peer renegotiates lcp, stop network until authenticated again")
+	if kernel != nil {
+		w.terminate()
+		return
+	}
+	w.stopAccounting(auth.TerminateUserRequest, false)
+	if w.stopNetwork() {
+		w.h.callback(EventSessionDown, mac(w.h.adapterMac), w.Session())
 	}
 }
 
@@ -122,54 +240,77 @@ func getRandCookie() (bs []byte) {
 	return
 }
 
-func (w *Worker) sendPPPoESPacket(pppoes pppoe.PPPoES) {
-	if pppoes.P2PProtocol == pppoe.P2PLinkCtrlProtocol {
-		logrus.Debugln("send pppoe session link ctrl", pppoes.LinkProtocol.GetShowCode(), "to", w.srcMac, fmt.Sprintf("%+v", pppoes))
-	}
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{}
-	payload := pppoes.Encode()
-	_ = gopacket.SerializeLayers(buffer, options,
-		&layers.Ethernet{
-			SrcMAC:       w.h.adapterMac,
-			DstMAC:       w.srcMac,
-			EthernetType: layers.EthernetTypePPPoESession,
-		},
-		gopacket.Payload(payload),
-	)
-	data := buffer.Bytes()
-	err := w.h.handle.WritePacketData(data)
-	if err != nil {
-		fmt.Println("write packet data", err)
+// sendPPP 将 PPP 帧封装为会话报文发送，PPP 帧直接编码到复用的缓冲区中
+func (w *Worker) sendPPP(f *ppp.Frame) {
+	if f.Protocol == ppp.ProtocolLCP && w.h.debugEnabled() {
+		w.log().Debug("send pppoe session lcp", "code", f.LinkProtocol.GetShowCode(), "packet", f.LinkProtocol)
 	}
+	sessionID := w.sessionID()
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	w.payloadBuf = pppoe.AppendSessionFrame(w.payloadBuf[:0], sessionID, f)
+	w.writeFrame(layers.EthernetTypePPPoESession, w.payloadBuf)
 }
 
 func (w *Worker) sendPPPoEDPacket(pppoed pppoe.PPPoED) {
-	logrus.Debugln("send pppoe discovery", pppoed.Code, "to", mac(w.srcMac), fmt.Sprintf("%+v", pppoed))
-	buffer := gopacket.NewSerializeBuffer()
-	options := gopacket.SerializeOptions{}
-	payload := pppoed.Encode()
-	_ = gopacket.SerializeLayers(buffer, options,
-		&layers.Ethernet{
-			SrcMAC:       w.h.adapterMac,
-			DstMAC:       w.srcMac,
-			EthernetType: layers.EthernetTypePPPoEDiscovery,
-		},
-		gopacket.Payload(payload),
-	)
-	data := buffer.Bytes()
-	err := w.h.handle.WritePacketData(data)
+	if w.h.debugEnabled() {
+		w.log().Debug("send pppoe discovery", "code", pppoed.Code, "packet", pppoed)
+	}
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	w.payloadBuf = pppoed.AppendEncode(w.payloadBuf[:0])
+	w.writeFrame(layers.EthernetTypePPPoEDiscovery, w.payloadBuf)
+}
+
+// writeFrame 按对端所在的 VLAN 封装并发送，由内核承载的会话帧去掉 PPPoE 头后写入内核通道。
+// 调用方需持有 sendMu，payload 可以是 payloadBuf
+func (w *Worker) writeFrame(etherType layers.EthernetType, payload []byte) {
+	if kernel := w.kernelSession(); kernel != nil && etherType == layers.EthernetTypePPPoESession {
+		if err := kernel.WriteFrame(payload[pppoe.PPPoESBasicLen:]); err != nil {
+			w.log().Error("write kernel pppoe channel", "err", err)
+		}
+		return
+	}
+	w.frameBuf, _ = link.Frame{
+		SrcMac:    w.h.adapterMac,
+		DstMac:    w.srcMac,
+		Vlans:     w.vlans,
+		EtherType: etherType,
+		Payload:   payload,
+	}.AppendEncode(w.frameBuf[:0])
+	if w.h.writer == nil {
+		return
+	}
+	err := w.h.writer.WritePacketData(w.frameBuf)
 	if err != nil {
-		logrus.Errorln("write packet data", err)
+		w.log().Error("write packet data", "err", err)
 	}
 }
 
-func (w *Worker) handleAuthProtocol(srcMac []byte, pppoes pppoe.PPPoES) {
-	logrus.Debugln("handle pppoe session", pppoes.PwdAuthProtocol.GetShowCode(), "from", srcMac, "user:", pppoes.PwdAuthProtocol.PeerID)
-	w.h.workerDone <- &Auth{
-		PeerID:   pppoes.PwdAuthProtocol.PeerID,
-		Password: pppoes.PwdAuthProtocol.Password,
+func (w *Worker) sessionID() uint16 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.session.SessionID
+}
+
+// terminate 由本端结束会话：发送 PADT 后释放资源
+func (w *Worker) terminate() {
+	padt := pppoe.NewPPPoEDPacket(pppoe.CodePADT, w.sessionID(), w.h.acName, nil, nil)
+	w.sendPPPoEDPacket(padt)
+	w.close(auth.TerminateNASRequest)
+}
+
+// close 释放会话资源并移除 Worker，对端之后的 PADI 会重新建立会话。cause 为计费中的结束原因
+func (w *Worker) close(cause string) {
+	w.stopAccounting(cause, false)
+	wasUp := w.stopNetwork()
+	if w.stopForwarding() {
+		wasUp = true
+	}
+	if wasUp {
+		w.h.callback(EventSessionDown, mac(w.h.adapterMac), w.Session())
 	}
+	w.h.removeWorker(frameKey(link.Frame{SrcMac: w.srcMac, Vlans: w.vlans}), w)
 }
 
 func mac(bs []byte) string {
@@ -0,0 +1,62 @@
+package l2tp
+
+import (
+	"errors"
+	"fmt"
+
+	"pppoe-probe/ppp"
+)
+
+// DecodeError.Layer 的取值
+const (
+	LayerL2TP = "l2tp"
+	LayerAVP  = "l2tp_avp"
+)
+
+// DecodeError 与 ppp.DecodeError 相同
+type DecodeError = ppp.DecodeError
+
+// 解码错误的类别，DecodeError 可以用 errors.Is 与之比较
+var (
+	// ErrTruncated 同 ppp.ErrTruncated
+	ErrTruncated = ppp.ErrTruncated
+	// ErrBadLength 同 ppp.ErrBadLength
+	ErrBadLength = ppp.ErrBadLength
+	// ErrBadVersion 报文头中的版本不是 2
+	ErrBadVersion = errors.New("bad version")
+	// ErrBadFlags 控制报文没有设置长度和序号标志
+	ErrBadFlags = errors.New("bad flags")
+)
+
+var (
+	// ErrTimeout 重传之后对端仍然没有确认控制报文，或者没有回复
+	ErrTimeout = errors.New("l2tp control message timeout")
+	// ErrClosed 隧道或会话已经关闭
+	ErrClosed = errors.New("l2tp tunnel closed")
+	// ErrAuthFailed 对端的 Challenge Response 与共享密钥不符
+	ErrAuthFailed = errors.New("l2tp tunnel authentication failed")
+)
+
+// ResultError 对端用 StopCCN 或 CDN 结束了隧道或会话，RFC 2661 4.4.2
+type ResultError struct {
+	Type      MessageType
+	Result    uint16
+	ErrorCode uint16
+	Message   string
+}
+
+func (e *ResultError) Error() string {
+	s := fmt.Sprintf("l2tp peer sent %s: result %d, error %d", e.Type, e.Result, e.ErrorCode)
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+func truncated(layer string, field string, offset int, expected int, actual int) error {
+	return &DecodeError{Layer: layer, Field: field, Offset: offset, Expected: expected, Actual: actual, Err: ErrTruncated}
+}
+
+func badLength(layer string, field string, offset int, expected int, actual int) error {
+	return &DecodeError{Layer: layer, Field: field, Offset: offset, Expected: expected, Actual: actual, Err: ErrBadLength}
+}
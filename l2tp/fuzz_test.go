@@ -0,0 +1,37 @@
+package l2tp
+
+import (
+	"errors"
+	"testing"
+)
+
+// 运行：go test ./l2tp -fuzz FuzzDecode
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{0xc8, 0x02, 0x00, 0x14, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})
+	f.Add([]byte{0x00, 0x02, 0x12, 0x34, 0x56, 0x78, 0xff, 0x03, 0xc0, 0x21})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := Decode(data)
+		if err != nil {
+			var de *DecodeError
+			if !errors.As(err, &de) {
+				t.Fatalf("error is not a DecodeError: %v", err)
+			}
+			if de.Offset < 0 || de.Offset > len(data) {
+				t.Fatalf("offset %d out of range [0, %d]: %v", de.Offset, len(data), err)
+			}
+			return
+		}
+		if !m.Control {
+			return
+		}
+		// 解码成功的控制报文重新编码后不会比原报文长
+		bs, err := m.AppendEncode(nil)
+		if err != nil {
+			t.Fatalf("encode decoded message: %v", err)
+		}
+		if len(bs) > len(data) {
+			t.Fatalf("encoded %d bytes from %d bytes", len(bs), len(data))
+		}
+	})
+}
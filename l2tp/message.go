@@ -0,0 +1,399 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MessageType 控制报文类型，RFC 2661 3.2
+type MessageType uint16
+
+const (
+	MessageSCCRQ   MessageType = 1
+	MessageSCCRP   MessageType = 2
+	MessageSCCCN   MessageType = 3
+	MessageStopCCN MessageType = 4
+	MessageHello   MessageType = 6
+	MessageOCRQ    MessageType = 7
+	MessageOCRP    MessageType = 8
+	MessageOCCN    MessageType = 9
+	MessageICRQ    MessageType = 10
+	MessageICRP    MessageType = 11
+	MessageICCN    MessageType = 12
+	MessageCDN     MessageType = 14
+	MessageWEN     MessageType = 15
+	MessageSLI     MessageType = 16
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case 0:
+		return "ZLB"
+	case MessageSCCRQ:
+		return "SCCRQ"
+	case MessageSCCRP:
+		return "SCCRP"
+	case MessageSCCCN:
+		return "SCCCN"
+	case MessageStopCCN:
+		return "StopCCN"
+	case MessageHello:
+		return "HELLO"
+	case MessageOCRQ:
+		return "OCRQ"
+	case MessageOCRP:
+		return "OCRP"
+	case MessageOCCN:
+		return "OCCN"
+	case MessageICRQ:
+		return "ICRQ"
+	case MessageICRP:
+		return "ICRP"
+	case MessageICCN:
+		return "ICCN"
+	case MessageCDN:
+		return "CDN"
+	case MessageWEN:
+		return "WEN"
+	case MessageSLI:
+		return "SLI"
+	}
+	return fmt.Sprintf("unknown(%d)", uint16(t))
+}
+
+// AVPType IETF 定义的 AVP 类型（Vendor ID 为 0），RFC 2661 4.4
+type AVPType uint16
+
+const (
+	AVPMessageType               AVPType = 0
+	AVPResultCode                AVPType = 1
+	AVPProtocolVersion           AVPType = 2
+	AVPFramingCapabilities       AVPType = 3
+	AVPBearerCapabilities        AVPType = 4
+	AVPTieBreaker                AVPType = 5
+	AVPFirmwareRevision          AVPType = 6
+	AVPHostName                  AVPType = 7
+	AVPVendorName                AVPType = 8
+	AVPAssignedTunnelID          AVPType = 9
+	AVPReceiveWindowSize         AVPType = 10
+	AVPChallenge                 AVPType = 11
+	AVPQ931CauseCode             AVPType = 12
+	AVPChallengeResponse         AVPType = 13
+	AVPAssignedSessionID         AVPType = 14
+	AVPCallSerialNumber          AVPType = 15
+	AVPMinimumBPS                AVPType = 16
+	AVPMaximumBPS                AVPType = 17
+	AVPBearerType                AVPType = 18
+	AVPFramingType               AVPType = 19
+	AVPCalledNumber              AVPType = 21
+	AVPCallingNumber             AVPType = 22
+	AVPSubAddress                AVPType = 23
+	AVPTxConnectSpeed            AVPType = 24
+	AVPPhysicalChannelID         AVPType = 25
+	AVPInitialReceivedLCPConfReq AVPType = 26
+	AVPLastSentLCPConfReq        AVPType = 27
+	AVPLastReceivedLCPConfReq    AVPType = 28
+	AVPProxyAuthenType           AVPType = 29
+	AVPProxyAuthenName           AVPType = 30
+	AVPProxyAuthenChallenge      AVPType = 31
+	AVPProxyAuthenID             AVPType = 32
+	AVPProxyAuthenResponse       AVPType = 33
+	AVPCallErrors                AVPType = 34
+	AVPACCM                      AVPType = 35
+	AVPRandomVector              AVPType = 36
+	AVPPrivateGroupID            AVPType = 37
+	AVPRxConnectSpeed            AVPType = 38
+	AVPSequencingRequired        AVPType = 39
+)
+
+// mandatory 本端发送该 AVP 时是否设置 M 标志。代理 LCP 和代理认证等对端可以忽略的 AVP 不设置
+func (t AVPType) mandatory() bool {
+	switch t {
+	case AVPFirmwareRevision, AVPVendorName,
+		AVPInitialReceivedLCPConfReq, AVPLastSentLCPConfReq, AVPLastReceivedLCPConfReq,
+		AVPProxyAuthenType, AVPProxyAuthenName, AVPProxyAuthenChallenge, AVPProxyAuthenID, AVPProxyAuthenResponse,
+		AVPRxConnectSpeed:
+		return false
+	}
+	return true
+}
+
+// 报文头中的标志，RFC 2661 3.1
+const (
+	flagType     = 0x8000
+	flagLength   = 0x4000
+	flagSequence = 0x0800
+	flagOffset   = 0x0200
+	flagVersion  = 0x000f
+	version      = 2
+
+	avpMandatory = 0x8000
+	avpHidden    = 0x4000
+	avpLength    = 0x03ff
+)
+
+const (
+	// DataHeaderLen 不带长度和序号的数据报文头：标志、隧道 ID 和会话 ID
+	DataHeaderLen = 6
+	// ControlHeaderLen 控制报文头：标志、长度、隧道 ID、会话 ID、Ns 和 Nr
+	ControlHeaderLen = 12
+	// AVPHeaderLen AVP 头：标志和长度、Vendor ID、类型
+	AVPHeaderLen = 6
+)
+
+// pppAddressControl 数据报文中 PPP 帧前的 HDLC 地址和控制字段
+var pppAddressControl = []byte{0xff, 0x03}
+
+// AVP 属性值对。Hidden 的 AVP 不会解开，Value 为隐藏后的数据
+type AVP struct {
+	Mandatory bool
+	Hidden    bool
+	VendorID  uint16
+	Type      AVPType
+	Value     []byte
+}
+
+// Message L2TP 报文。控制报文的第一个 AVP 为 Message Type，没有 AVP 的控制报文为 ZLB，只用于确认；
+// 数据报文的 Payload 为承载的 PPP 帧，从协议字段开始，不含 HDLC 地址和控制字段
+type Message struct {
+	Control   bool
+	TunnelID  uint16
+	SessionID uint16
+	// Ns、Nr 控制报文的序号，RFC 2661 5.8，数据报文不使用
+	Ns      uint16
+	Nr      uint16
+	AVPs    []AVP
+	Payload []byte
+}
+
+// NewControl 创建 t 类型的控制报文，tunnelID、sessionID 为对端分配的 ID
+func NewControl(t MessageType, tunnelID uint16, sessionID uint16) *Message {
+	m := &Message{Control: true, TunnelID: tunnelID, SessionID: sessionID}
+	m.AddUint16(AVPMessageType, uint16(t))
+	return m
+}
+
+// Type 控制报文的类型，ZLB 为 0
+func (m *Message) Type() MessageType {
+	if len(m.AVPs) == 0 {
+		return 0
+	}
+	a := m.AVPs[0]
+	if a.VendorID != 0 || a.Type != AVPMessageType || len(a.Value) != 2 {
+		return 0
+	}
+	return MessageType(binary.BigEndian.Uint16(a.Value))
+}
+
+func (m *Message) Add(t AVPType, value []byte) {
+	m.AVPs = append(m.AVPs, AVP{Mandatory: t.mandatory(), Type: t, Value: value})
+}
+
+func (m *Message) AddString(t AVPType, value string) {
+	m.Add(t, []byte(value))
+}
+
+func (m *Message) AddUint16(t AVPType, value uint16) {
+	m.Add(t, binary.BigEndian.AppendUint16(nil, value))
+}
+
+func (m *Message) AddUint32(t AVPType, value uint32) {
+	m.Add(t, binary.BigEndian.AppendUint32(nil, value))
+}
+
+// Get 返回第一个类型为 t 且没有隐藏的 IETF AVP 的值
+func (m *Message) Get(t AVPType) (value []byte, ok bool) {
+	for _, a := range m.AVPs {
+		if a.VendorID == 0 && a.Type == t && !a.Hidden {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Message) GetString(t AVPType) string {
+	value, _ := m.Get(t)
+	return string(value)
+}
+
+func (m *Message) GetUint16(t AVPType) (uint16, bool) {
+	value, ok := m.Get(t)
+	if !ok || len(value) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(value), true
+}
+
+func (m *Message) GetUint32(t AVPType) (uint32, bool) {
+	value, ok := m.Get(t)
+	if !ok || len(value) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
+
+// Result StopCCN、CDN 中的 Result Code AVP：结果、可选的错误码和错误信息
+func (m *Message) Result() (err *ResultError) {
+	err = &ResultError{Type: m.Type()}
+	value, _ := m.Get(AVPResultCode)
+	if len(value) >= 2 {
+		err.Result = binary.BigEndian.Uint16(value)
+	}
+	if len(value) >= 4 {
+		err.ErrorCode = binary.BigEndian.Uint16(value[2:])
+		err.Message = string(value[4:])
+	}
+	return
+}
+
+// AppendEncode 将报文追加到 dst 后返回。控制报文带长度和序号，数据报文不带，并在 PPP 帧前补上地址和控制字段
+func (m *Message) AppendEncode(dst []byte) (bs []byte, err error) {
+	if !m.Control {
+		return AppendData(dst, m.TunnelID, m.SessionID, m.Payload), nil
+	}
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint16(dst, flagType|flagLength|flagSequence|version)
+	dst = binary.BigEndian.AppendUint16(dst, 0)
+	dst = binary.BigEndian.AppendUint16(dst, m.TunnelID)
+	dst = binary.BigEndian.AppendUint16(dst, m.SessionID)
+	dst = binary.BigEndian.AppendUint16(dst, m.Ns)
+	dst = binary.BigEndian.AppendUint16(dst, m.Nr)
+	for _, a := range m.AVPs {
+		length := AVPHeaderLen + len(a.Value)
+		if length > avpLength {
+			err = fmt.Errorf("l2tp avp %d too long: %d bytes", a.Type, length)
+			return
+		}
+		flags := uint16(length)
+		if a.Mandatory {
+			flags |= avpMandatory
+		}
+		if a.Hidden {
+			flags |= avpHidden
+		}
+		dst = binary.BigEndian.AppendUint16(dst, flags)
+		dst = binary.BigEndian.AppendUint16(dst, a.VendorID)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(a.Type))
+		dst = append(dst, a.Value...)
+	}
+	if len(dst)-start > 0xffff {
+		err = errors.New("l2tp control message too long")
+		return
+	}
+	binary.BigEndian.PutUint16(dst[start+2:], uint16(len(dst)-start))
+	bs = dst
+	return
+}
+
+// AppendData 将承载 frame（从协议字段开始）的数据报文追加到 dst 后返回，dst 容量足够时不分配内存
+func AppendData(dst []byte, tunnelID uint16, sessionID uint16, frame []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, version)
+	dst = binary.BigEndian.AppendUint16(dst, tunnelID)
+	dst = binary.BigEndian.AppendUint16(dst, sessionID)
+	dst = append(dst, pppAddressControl...)
+	return append(dst, frame...)
+}
+
+func Decode(bs []byte) (m Message, err error) {
+	err = DecodeInto(&m, bs)
+	return
+}
+
+// DecodeInto 解码到 m，m.AVPs 的底层数组会被复用。AVP 的值和 Payload 引用 bs。
+// 控制报文必须带长度和序号；数据报文的序号和偏移填充被忽略
+func DecodeInto(m *Message, bs []byte) (err error) {
+	avps := m.AVPs[:0]
+	*m = Message{}
+	if len(bs) < DataHeaderLen {
+		err = truncated(LayerL2TP, "header", 0, DataHeaderLen, len(bs))
+		return
+	}
+	flags := binary.BigEndian.Uint16(bs)
+	if flags&flagVersion != version {
+		err = &DecodeError{Layer: LayerL2TP, Field: "version", Offset: 1, Expected: version, Actual: int(flags & flagVersion), Err: ErrBadVersion}
+		return
+	}
+	m.Control = flags&flagType != 0
+	if m.Control && (flags&flagLength == 0 || flags&flagSequence == 0) {
+		err = &DecodeError{Layer: LayerL2TP, Field: "flags", Offset: 0, Expected: flagType | flagLength | flagSequence | version, Actual: int(flags), Err: ErrBadFlags}
+		return
+	}
+	// 各可选字段存在时报文头的长度
+	headerLen := DataHeaderLen
+	if flags&flagLength != 0 {
+		headerLen += 2
+	}
+	if flags&flagSequence != 0 {
+		headerLen += 4
+	}
+	if flags&flagOffset != 0 {
+		headerLen += 2
+	}
+	if len(bs) < headerLen {
+		err = truncated(LayerL2TP, "header", 0, headerLen, len(bs))
+		return
+	}
+	off := 2
+	if flags&flagLength != 0 {
+		length := int(binary.BigEndian.Uint16(bs[off:]))
+		if length < headerLen {
+			err = badLength(LayerL2TP, "length", off, -1, length)
+			return
+		}
+		if len(bs) < length {
+			err = truncated(LayerL2TP, "message", 0, length, len(bs))
+			return
+		}
+		bs = bs[:length]
+		off += 2
+	}
+	m.TunnelID = binary.BigEndian.Uint16(bs[off:])
+	m.SessionID = binary.BigEndian.Uint16(bs[off+2:])
+	off += 4
+	if flags&flagSequence != 0 {
+		m.Ns = binary.BigEndian.Uint16(bs[off:])
+		m.Nr = binary.BigEndian.Uint16(bs[off+2:])
+		off += 4
+	}
+	if flags&flagOffset != 0 {
+		pad := int(binary.BigEndian.Uint16(bs[off:]))
+		off += 2
+		if len(bs)-off < pad {
+			err = truncated(LayerL2TP, "offset pad", off, pad, len(bs)-off)
+			return
+		}
+		off += pad
+	}
+	if !m.Control {
+		m.Payload = bs[off:]
+		if len(m.Payload) >= 2 && m.Payload[0] == pppAddressControl[0] && m.Payload[1] == pppAddressControl[1] {
+			m.Payload = m.Payload[2:]
+		}
+		return
+	}
+	for off < len(bs) {
+		if len(bs)-off < AVPHeaderLen {
+			err = truncated(LayerAVP, "header", off, AVPHeaderLen, len(bs)-off)
+			return
+		}
+		head := binary.BigEndian.Uint16(bs[off:])
+		length := int(head & avpLength)
+		if length < AVPHeaderLen || length > len(bs)-off {
+			err = badLength(LayerAVP, "length", off, -1, length)
+			return
+		}
+		avps = append(avps, AVP{
+			Mandatory: head&avpMandatory != 0,
+			Hidden:    head&avpHidden != 0,
+			VendorID:  binary.BigEndian.Uint16(bs[off+2:]),
+			Type:      AVPType(binary.BigEndian.Uint16(bs[off+4:])),
+			Value:     bs[off+AVPHeaderLen : off+length],
+		})
+		off += length
+	}
+	if len(avps) > 0 {
+		m.AVPs = avps
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package l2tp
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMessage_ControlRoundTrip(t *testing.T) {
+	m := NewControl(MessageSCCRQ, 0, 0)
+	m.AddUint16(AVPProtocolVersion, protocolVersion)
+	m.AddString(AVPHostName, "lac")
+	m.AddUint32(AVPFramingCapabilities, FramingSync)
+	m.AddString(AVPProxyAuthenName, "user")
+	m.Ns, m.Nr = 3, 7
+	bs, err := m.AppendEncode(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xc8, 0x02, 0x00, byte(len(bs)), 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x07}, bs[:ControlHeaderLen])
+	// Message Type AVP：M 标志，长度 8
+	assert.Equal(t, []byte{0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, bs[ControlHeaderLen:ControlHeaderLen+8])
+
+	decoded, err := Decode(bs)
+	assert.Nil(t, err)
+	assert.True(t, decoded.Control)
+	assert.Equal(t, MessageSCCRQ, decoded.Type())
+	assert.Equal(t, uint16(3), decoded.Ns)
+	assert.Equal(t, uint16(7), decoded.Nr)
+	assert.Equal(t, "lac", decoded.GetString(AVPHostName))
+	version, _ := decoded.GetUint16(AVPProtocolVersion)
+	assert.Equal(t, uint16(protocolVersion), version)
+	framing, _ := decoded.GetUint32(AVPFramingCapabilities)
+	assert.Equal(t, FramingSync, framing)
+	assert.True(t, decoded.AVPs[2].Mandatory)
+	assert.False(t, decoded.AVPs[4].Mandatory)
+}
+
+func TestMessage_ZLB(t *testing.T) {
+	bs, err := (&Message{Control: true, TunnelID: 1, Ns: 2, Nr: 3}).AppendEncode(nil)
+	assert.Nil(t, err)
+	assert.Len(t, bs, ControlHeaderLen)
+	m, err := Decode(bs)
+	assert.Nil(t, err)
+	assert.True(t, m.Control)
+	assert.Equal(t, MessageType(0), m.Type())
+	assert.Nil(t, m.AVPs)
+}
+
+func TestMessage_Data(t *testing.T) {
+	frame := []byte{0xc0, 0x21, 0x09, 0x01, 0x00, 0x08, 0x01, 0x02, 0x03, 0x04}
+	bs := AppendData(nil, 0x1234, 0x5678, frame)
+	assert.Equal(t, []byte{0x00, 0x02, 0x12, 0x34, 0x56, 0x78, 0xff, 0x03}, bs[:8])
+	m, err := Decode(bs)
+	assert.Nil(t, err)
+	assert.False(t, m.Control)
+	assert.Equal(t, uint16(0x1234), m.TunnelID)
+	assert.Equal(t, uint16(0x5678), m.SessionID)
+	assert.Equal(t, frame, m.Payload)
+
+	// 带长度、序号和偏移填充的数据报文
+	bs = []byte{0x4a, 0x02, 0x00, 0x12, 0x12, 0x34, 0x56, 0x78, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0xaa, 0xbb, 0xc0, 0x21}
+	m, err = Decode(bs)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xc0, 0x21}, m.Payload)
+}
+
+func TestMessage_Result(t *testing.T) {
+	m := NewControl(MessageCDN, 0, 1)
+	m.Add(AVPResultCode, []byte{0x00, 0x02, 0x00, 0x06, 'b', 'y', 'e'})
+	err := m.Result()
+	assert.Equal(t, uint16(2), err.Result)
+	assert.Equal(t, uint16(6), err.ErrorCode)
+	assert.Equal(t, "l2tp peer sent CDN: result 2, error 6: bye", err.Error())
+}
+
+func TestDecode_Errors(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		data  []byte
+		field string
+		kind  error
+	}{
+		{"short header", []byte{0xc8, 0x02, 0x00}, "header", ErrTruncated},
+		{"version 3", []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x00}, "version", ErrBadVersion},
+		{"control without sequence", []byte{0xc0, 0x02, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00}, "flags", ErrBadFlags},
+		{"length beyond data", []byte{0xc8, 0x02, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, "message", ErrTruncated},
+		{"avp length too small", []byte{0xc8, 0x02, 0x00, 0x12, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x02, 0x00, 0x00, 0x00, 0x00}, "length", ErrBadLength},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Decode(c.data)
+			var de *DecodeError
+			assert.True(t, errors.As(err, &de), "%v", err)
+			assert.Equal(t, c.field, de.Field)
+			assert.ErrorIs(t, err, c.kind)
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package l2tp
+
+import (
+	"errors"
+	"pppoe-probe/ppp"
+	"sync"
+	"time"
+)
+
+// DefaultConnectSpeed ICCN 中默认的 (Tx) Connect Speed，单位 bps
+const DefaultConnectSpeed = 100000000
+
+// Proxy Authen Type 的取值，RFC 2661 4.4.5
+const (
+	ProxyAuthenCHAP uint16 = 2
+	ProxyAuthenPAP  uint16 = 3
+	ProxyAuthenNone uint16 = 4
+)
+
+// SessionConfig 入向呼叫的参数。代理 LCP 和代理认证让 LNS 沿用 LAC 与对端协商的结果，不必重新协商（RFC 2661 4.4.5）
+type SessionConfig struct {
+	// CallingNumber 对端标识，例如 PPPoE 对端的 MAC，为空时不携带
+	CallingNumber string
+	// ConnectSpeed 为 0 时使用 DefaultConnectSpeed
+	ConnectSpeed uint32
+	// InitialReceivedLCP、LastSentLCP、LastReceivedLCP 代理 LCP，只含配置项部分，见 ppp.Engine.ConfigRequests。
+	// LastSentLCP 或 LastReceivedLCP 为空时不携带代理 LCP
+	InitialReceivedLCP []byte
+	LastSentLCP        []byte
+	LastReceivedLCP    []byte
+	// ProxyAuth 代理认证，只支持 PAP 和 CHAP（MD5），为 nil 时不携带
+	ProxyAuth *ppp.AuthRequest
+	// OnFrame 收到 LNS 发来的 PPP 帧（从协议字段开始），frame 只在调用期间有效，在隧道的接收协程中调用
+	OnFrame func(frame []byte)
+	// OnClose LNS 发送 CDN 或隧道结束时调用一次，本端调用 Session.Close 时不调用
+	OnClose func(err error)
+}
+
+// Session 隧道中的一个会话
+type Session struct {
+	t       *Tunnel
+	cfg     SessionConfig
+	localID uint16
+	icrp    chan *Message
+	done    chan struct{}
+
+	// 以下字段由 Tunnel.mu 保护
+	peerID uint16
+	open   bool
+	closed bool
+	err    error
+
+	// sendMu 保护发送数据报文时复用的缓冲区
+	sendMu  sync.Mutex
+	sendBuf []byte
+}
+
+// OpenSession 发起入向呼叫：ICRQ、ICRP、ICCN。返回后即可收发 PPP 帧
+func (t *Tunnel) OpenSession(cfg SessionConfig) (s *Session, err error) {
+	if cfg.ConnectSpeed == 0 {
+		cfg.ConnectSpeed = DefaultConnectSpeed
+	}
+	s = &Session{t: t, cfg: cfg, icrp: make(chan *Message, 1), done: make(chan struct{})}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrClosed
+	}
+	t.newSession(s)
+	t.serial++
+	serial := t.serial
+	t.mu.Unlock()
+
+	icrq := NewControl(MessageICRQ, 0, 0)
+	icrq.AddUint16(AVPAssignedSessionID, s.localID)
+	icrq.AddUint32(AVPCallSerialNumber, serial)
+	if cfg.CallingNumber != "" {
+		icrq.AddString(AVPCallingNumber, cfg.CallingNumber)
+	}
+	if err = t.send(icrq); err != nil {
+		s.end(err)
+		return nil, err
+	}
+	var icrp *Message
+	select {
+	case icrp = <-s.icrp:
+	case <-s.done:
+		return nil, s.closeErr()
+	case <-time.After(t.giveUp()):
+		s.Close()
+		return nil, ErrTimeout
+	}
+	peerID, _ := icrp.GetUint16(AVPAssignedSessionID)
+	if peerID == 0 {
+		s.Close()
+		return nil, errors.New("missing assigned session id in ICRP")
+	}
+	t.mu.Lock()
+	s.peerID = peerID
+	t.mu.Unlock()
+
+	if err = t.send(s.iccn()); err != nil {
+		s.end(err)
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s.closed {
+		return nil, s.err
+	}
+	s.open = true
+	return
+}
+
+// iccn 带代理 LCP 和代理认证的 ICCN
+func (s *Session) iccn() *Message {
+	cfg := s.cfg
+	m := NewControl(MessageICCN, 0, s.peerID)
+	m.AddUint32(AVPTxConnectSpeed, cfg.ConnectSpeed)
+	m.AddUint32(AVPFramingType, FramingSync)
+	if len(cfg.LastSentLCP) > 0 && len(cfg.LastReceivedLCP) > 0 {
+		if len(cfg.InitialReceivedLCP) > 0 {
+			m.Add(AVPInitialReceivedLCPConfReq, cfg.InitialReceivedLCP)
+		}
+		m.Add(AVPLastSentLCPConfReq, cfg.LastSentLCP)
+		m.Add(AVPLastReceivedLCPConfReq, cfg.LastReceivedLCP)
+	}
+	auth := cfg.ProxyAuth
+	if auth == nil {
+		return m
+	}
+	switch auth.Protocol {
+	case ppp.AuthProtocolPassword:
+		m.AddUint16(AVPProxyAuthenType, ProxyAuthenPAP)
+		m.AddString(AVPProxyAuthenName, auth.Username)
+		m.AddUint16(AVPProxyAuthenID, uint16(auth.Identifier))
+		m.AddString(AVPProxyAuthenResponse, auth.Password)
+	case ppp.AuthProtocolChap:
+		m.AddUint16(AVPProxyAuthenType, ProxyAuthenCHAP)
+		m.AddString(AVPProxyAuthenName, auth.Username)
+		m.Add(AVPProxyAuthenChallenge, auth.Challenge)
+		m.AddUint16(AVPProxyAuthenID, uint16(auth.Identifier))
+		m.Add(AVPProxyAuthenResponse, auth.Response)
+	}
+	return m
+}
+
+// LocalID 本端分配的会话 ID
+func (s *Session) LocalID() uint16 {
+	return s.localID
+}
+
+// WriteFrame 向 LNS 发送一个 PPP 帧（从协议字段开始）
+func (s *Session) WriteFrame(frame []byte) (err error) {
+	t := s.t
+	t.mu.Lock()
+	closed := s.closed
+	tunnelID, sessionID := t.peerID, s.peerID
+	t.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.sendBuf = AppendData(s.sendBuf[:0], tunnelID, sessionID, frame)
+	return t.writeData(s.sendBuf)
+}
+
+// Close 发送 CDN 结束会话，不调用 OnClose
+func (s *Session) Close() {
+	t := s.t
+	t.mu.Lock()
+	if s.closed {
+		t.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.err = ErrClosed
+	delete(t.sessions, s.localID)
+	close(s.done)
+	peerID := s.peerID
+	t.mu.Unlock()
+
+	cdn := NewControl(MessageCDN, 0, peerID)
+	cdn.AddUint16(AVPResultCode, CDNAdmin)
+	cdn.AddUint16(AVPAssignedSessionID, s.localID)
+	_ = t.send(cdn)
+}
+
+func (s *Session) handleControl(m *Message) {
+	switch m.Type() {
+	case MessageICRP:
+		select {
+		case s.icrp <- m:
+		default:
+		}
+	case MessageCDN:
+		s.end(m.Result())
+	}
+}
+
+// end 对端或隧道结束了会话，建立之后才调用 OnClose
+func (s *Session) end(err error) {
+	t := s.t
+	t.mu.Lock()
+	if s.closed {
+		t.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.err = err
+	delete(t.sessions, s.localID)
+	close(s.done)
+	open := s.open
+	t.mu.Unlock()
+	if open && s.cfg.OnClose != nil {
+		s.cfg.OnClose(err)
+	}
+}
+
+func (s *Session) closeErr() error {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	return s.err
+}
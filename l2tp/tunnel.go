@@ -0,0 +1,520 @@
+package l2tp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	mrand "math/rand"
+	"net"
+	"pppoe-probe/ppp"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPort          = "1701"
+	DefaultHostName      = "pppoe-probe"
+	DefaultTimeout       = time.Second
+	DefaultRetries       = 5
+	DefaultHelloInterval = 60 * time.Second
+	// maxTimeout 重传间隔每次加倍，不超过该值，RFC 2661 5.8
+	maxTimeout = 8 * time.Second
+	// defaultWindow 对端没有携带 Receive Window Size 时的发送窗口
+	defaultWindow = 4
+	// tickInterval 检查重传和 HELLO 的间隔
+	tickInterval = 100 * time.Millisecond
+	// protocolVersion Protocol Version AVP：版本 1，修订 0
+	protocolVersion = 0x0100
+)
+
+// Framing Capabilities 和 Framing Type 的取值
+const (
+	FramingSync  uint32 = 1
+	FramingAsync uint32 = 2
+)
+
+// Result Code 的取值，RFC 2661 4.4.2
+const (
+	// StopCCNGeneralRequest 请求关闭隧道
+	StopCCNGeneralRequest uint16 = 1
+	// StopCCNNotAuthorized 对端没有通过隧道认证
+	StopCCNNotAuthorized uint16 = 4
+	// CDNLostCarrier 对端链路断开
+	CDNLostCarrier uint16 = 1
+	// CDNAdmin 管理原因结束会话
+	CDNAdmin uint16 = 3
+)
+
+// Config 控制连接配置
+type Config struct {
+	// Server LNS 地址，没有端口时使用 DefaultPort
+	Server string
+	// Secret 隧道认证的共享密钥（RFC 2661 5.1.1），为空时不认证，LNS 要求认证时无法建立隧道
+	Secret string
+	// HostName SCCRQ 中的 Host Name，为空时使用 DefaultHostName
+	HostName string
+	// Timeout 控制报文第一次重传前等待确认的时间，之后每次加倍，为 0 时使用 DefaultTimeout
+	Timeout time.Duration
+	// Retries 重传次数，之后仍未确认则关闭隧道，为 0 时使用 DefaultRetries
+	Retries int
+	// HelloInterval 没有收到对端报文多久后发送 HELLO，为 0 时使用 DefaultHelloInterval，小于 0 时不发送
+	HelloInterval time.Duration
+	// OnClose 隧道建立之后结束时调用一次：对端 StopCCN 时为 *ResultError，重传超时为 ErrTimeout，本端 Close 为 ErrClosed
+	OnClose func(err error)
+}
+
+// outgoing 等待确认的控制报文
+type outgoing struct {
+	m       *Message
+	sentAt  time.Time
+	timeout time.Duration
+	tries   int
+}
+
+// Tunnel LAC 侧的 L2TPv2 控制连接（RFC 2661），控制报文按 5.8 可靠传输，在同一个 UDP 端口上承载各会话的数据报文。
+// 只支持 LAC 主动发起的入向呼叫（ICRQ），不支持隐藏的 AVP。各方法可以并发调用
+type Tunnel struct {
+	cfg     Config
+	conn    *net.UDPConn
+	localID uint16
+	sccrp   chan *Message
+	// done 隧道结束后关闭
+	done chan struct{}
+
+	mu       sync.Mutex
+	remote   *net.UDPAddr
+	peerID   uint16
+	ns       uint16
+	nr       uint16
+	window   int
+	unacked  []*outgoing
+	queued   []*Message
+	sessions map[uint16]*Session
+	serial   uint32
+	lastRecv time.Time
+	onClose  func(err error)
+	closed   bool
+	err      error
+}
+
+// Dial 与 LNS 建立控制连接：SCCRQ、SCCRP、SCCCN，配置了 Secret 时双向校验 Challenge Response
+func Dial(cfg Config) (t *Tunnel, err error) {
+	host, port, err := net.SplitHostPort(cfg.Server)
+	if err != nil {
+		host, port, err = cfg.Server, DefaultPort, nil
+	}
+	if host == "" {
+		err = errors.New("missing l2tp server")
+		return
+	}
+	remote, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return
+	}
+	if cfg.HostName == "" {
+		cfg.HostName = DefaultHostName
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultRetries
+	}
+	if cfg.HelloInterval == 0 {
+		cfg.HelloInterval = DefaultHelloInterval
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return
+	}
+	t = &Tunnel{
+		cfg:      cfg,
+		conn:     conn,
+		localID:  randomID(),
+		sccrp:    make(chan *Message, 1),
+		done:     make(chan struct{}),
+		remote:   remote,
+		window:   defaultWindow,
+		sessions: make(map[uint16]*Session),
+		lastRecv: time.Now(),
+	}
+	go t.read()
+	go t.tick()
+
+	sccrq := NewControl(MessageSCCRQ, 0, 0)
+	sccrq.AddUint16(AVPProtocolVersion, protocolVersion)
+	sccrq.AddString(AVPHostName, cfg.HostName)
+	sccrq.AddUint32(AVPFramingCapabilities, FramingSync|FramingAsync)
+	sccrq.AddUint16(AVPAssignedTunnelID, t.localID)
+	var challenge []byte
+	if cfg.Secret != "" {
+		challenge = make([]byte, 16)
+		_, _ = rand.Read(challenge)
+		sccrq.Add(AVPChallenge, challenge)
+	}
+	if err = t.send(sccrq); err != nil {
+		return nil, err
+	}
+	var sccrp *Message
+	select {
+	case sccrp = <-t.sccrp:
+	case <-t.done:
+		return nil, t.closeErr()
+	case <-time.After(t.giveUp()):
+		t.fail(ErrTimeout)
+		return nil, ErrTimeout
+	}
+	peerID, _ := sccrp.GetUint16(AVPAssignedTunnelID)
+	if peerID == 0 {
+		err = errors.New("missing assigned tunnel id in SCCRP")
+		t.fail(err)
+		return nil, err
+	}
+	t.mu.Lock()
+	t.peerID = peerID
+	if window, ok := sccrp.GetUint16(AVPReceiveWindowSize); ok && window > 0 {
+		t.window = int(window)
+	}
+	t.mu.Unlock()
+	if challenge != nil {
+		response, _ := sccrp.Get(AVPChallengeResponse)
+		if !hmac.Equal(response, ppp.ChapMD5Response(byte(MessageSCCRP), cfg.Secret, challenge)) {
+			t.stop(StopCCNNotAuthorized, ErrAuthFailed)
+			return nil, ErrAuthFailed
+		}
+	}
+	scccn := NewControl(MessageSCCCN, 0, 0)
+	if peerChallenge, ok := sccrp.Get(AVPChallenge); ok {
+		if cfg.Secret == "" {
+			err = errors.New("lns requires tunnel authentication")
+			t.stop(StopCCNNotAuthorized, err)
+			return nil, err
+		}
+		scccn.Add(AVPChallengeResponse, ppp.ChapMD5Response(byte(MessageSCCCN), cfg.Secret, peerChallenge))
+	}
+	if err = t.send(scccn); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.onClose = cfg.OnClose
+	t.mu.Unlock()
+	return
+}
+
+// LocalID 本端分配的隧道 ID
+func (t *Tunnel) LocalID() uint16 {
+	return t.localID
+}
+
+// RemoteAddr LNS 的地址，SCCRP 之后为 LNS 实际回复的端口
+func (t *Tunnel) RemoteAddr() net.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remote
+}
+
+// Done 隧道结束后关闭
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Close 发送 StopCCN，等待对端确认后关闭隧道，仍然打开的会话的 OnClose 收到 ErrClosed
+func (t *Tunnel) Close() {
+	t.stop(StopCCNGeneralRequest, ErrClosed)
+}
+
+// stop 发送 StopCCN，对端确认或重传超时后以 err 结束隧道
+func (t *Tunnel) stop(result uint16, err error) {
+	m := NewControl(MessageStopCCN, 0, 0)
+	m.AddUint16(AVPAssignedTunnelID, t.localID)
+	m.AddUint16(AVPResultCode, result)
+	if t.send(m) != nil {
+		return
+	}
+	deadline := time.After(t.giveUp())
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for !t.idle() {
+		select {
+		case <-t.done:
+			return
+		case <-deadline:
+			t.fail(err)
+			return
+		case <-ticker.C:
+		}
+	}
+	t.fail(err)
+}
+
+func (t *Tunnel) idle() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.unacked) == 0 && len(t.queued) == 0
+}
+
+func (t *Tunnel) closeErr() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// giveUp 一个控制报文从第一次发送到重传超时的总时间
+func (t *Tunnel) giveUp() (d time.Duration) {
+	timeout := t.cfg.Timeout
+	for i := 0; i <= t.cfg.Retries; i++ {
+		d += timeout
+		timeout = min(timeout*2, maxTimeout)
+	}
+	return
+}
+
+// send 发送控制报文，发送窗口已满时排队，等待对端确认之前的报文后再发送
+func (t *Tunnel) send(m *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	t.sendLocked(m)
+	return nil
+}
+
+// sendLocked 同 send，调用方需持有 mu
+func (t *Tunnel) sendLocked(m *Message) {
+	m.TunnelID = t.peerID
+	m.Ns = t.ns
+	t.ns++
+	if len(t.unacked) >= t.window {
+		t.queued = append(t.queued, m)
+		return
+	}
+	t.transmit(m)
+}
+
+// transmit 发送并记录等待确认的控制报文，调用方需持有 mu
+func (t *Tunnel) transmit(m *Message) {
+	t.unacked = append(t.unacked, &outgoing{m: m, sentAt: time.Now(), timeout: t.cfg.Timeout})
+	t.write(m)
+}
+
+// write 以当前的 Nr 编码并发送，调用方需持有 mu
+func (t *Tunnel) write(m *Message) {
+	m.Nr = t.nr
+	bs, err := m.AppendEncode(nil)
+	if err != nil {
+		return
+	}
+	_, _ = t.conn.WriteToUDP(bs, t.remote)
+}
+
+// ack 发送 ZLB 确认收到的控制报文，调用方需持有 mu
+func (t *Tunnel) ack() {
+	t.write(&Message{Control: true, TunnelID: t.peerID, Ns: t.ns})
+}
+
+// acknowledge 移除对端已确认（Ns 在 nr 之前）的报文，并发送排队中的报文，调用方需持有 mu
+func (t *Tunnel) acknowledge(nr uint16) {
+	for len(t.unacked) > 0 && seqBefore(t.unacked[0].m.Ns, nr) {
+		t.unacked = t.unacked[1:]
+	}
+	for len(t.queued) > 0 && len(t.unacked) < t.window {
+		m := t.queued[0]
+		t.queued = t.queued[1:]
+		t.transmit(m)
+	}
+}
+
+// seqBefore 按 16 位序号回绕比较 a 是否在 b 之前
+func seqBefore(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// read 接收 LNS 的报文直到隧道结束
+func (t *Tunnel) read() {
+	buf := make([]byte, 0xffff)
+	var m Message
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			t.fail(err)
+			return
+		}
+		if !t.fromPeer(addr) {
+			continue
+		}
+		if err = DecodeInto(&m, buf[:n]); err != nil || m.TunnelID != t.localID {
+			continue
+		}
+		if m.Control {
+			t.handleControl(&m, addr)
+		} else {
+			t.handleData(&m)
+		}
+	}
+}
+
+// fromPeer 只接受 LNS 所在地址的报文，端口在 SCCRP 之后固定
+func (t *Tunnel) fromPeer(addr *net.UDPAddr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.peerID == 0 {
+		return addr.IP.Equal(t.remote.IP)
+	}
+	return addr.IP.Equal(t.remote.IP) && addr.Port == t.remote.Port
+}
+
+func (t *Tunnel) handleControl(m *Message, addr *net.UDPAddr) {
+	t.mu.Lock()
+	t.lastRecv = time.Now()
+	t.acknowledge(m.Nr)
+	if len(m.AVPs) == 0 {
+		t.mu.Unlock()
+		return
+	}
+	if m.Type() == MessageSCCRP && t.peerID == 0 {
+		// LNS 可以从另一个端口回复，之后的报文都发往该端口
+		t.remote = addr
+	}
+	if m.Ns != t.nr {
+		// 重复的报文说明对端没有收到确认，重新确认；乱序的报文丢弃，等待对端重传
+		t.ack()
+		t.mu.Unlock()
+		return
+	}
+	t.nr++
+	t.ack()
+	s := t.sessions[m.SessionID]
+	t.mu.Unlock()
+
+	// m 引用读缓冲区，交给其他协程之前需要复制
+	switch m.Type() {
+	case MessageSCCRP:
+		select {
+		case t.sccrp <- clone(m):
+		default:
+		}
+	case MessageStopCCN:
+		t.fail(m.Result())
+	case MessageICRP, MessageCDN:
+		if s != nil && m.SessionID != 0 {
+			s.handleControl(clone(m))
+		}
+	}
+}
+
+func (t *Tunnel) handleData(m *Message) {
+	t.mu.Lock()
+	s := t.sessions[m.SessionID]
+	t.mu.Unlock()
+	if s != nil && s.cfg.OnFrame != nil {
+		s.cfg.OnFrame(m.Payload)
+	}
+}
+
+// tick 重传超时的控制报文，空闲时发送 HELLO
+func (t *Tunnel) tick() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			if !t.retransmit(now) {
+				t.fail(ErrTimeout)
+				return
+			}
+		}
+	}
+}
+
+// retransmit 重传超时的报文，超过重传次数时返回 false
+func (t *Tunnel) retransmit(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, o := range t.unacked {
+		if now.Sub(o.sentAt) < o.timeout {
+			continue
+		}
+		if o.tries >= t.cfg.Retries {
+			return false
+		}
+		o.tries++
+		o.sentAt = now
+		o.timeout = min(o.timeout*2, maxTimeout)
+		t.write(o.m)
+	}
+	idle := len(t.unacked) == 0 && len(t.queued) == 0
+	if t.peerID != 0 && idle && t.cfg.HelloInterval > 0 && now.Sub(t.lastRecv) >= t.cfg.HelloInterval {
+		t.sendLocked(NewControl(MessageHello, 0, 0))
+	}
+	return true
+}
+
+// fail 结束隧道和其中所有会话，只执行一次
+func (t *Tunnel) fail(err error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	t.err = err
+	sessions := make([]*Session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	onClose := t.onClose
+	t.mu.Unlock()
+	close(t.done)
+	_ = t.conn.Close()
+	for _, s := range sessions {
+		s.end(err)
+	}
+	if onClose != nil {
+		onClose(err)
+	}
+}
+
+// writeData 发送数据报文，数据报文不可靠传输
+func (t *Tunnel) writeData(bs []byte) (err error) {
+	t.mu.Lock()
+	remote := t.remote
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	_, err = t.conn.WriteToUDP(bs, remote)
+	return
+}
+
+// newSession 分配本端的会话 ID 并登记会话，调用方需持有 mu
+func (t *Tunnel) newSession(s *Session) {
+	for {
+		id := randomID()
+		if _, ok := t.sessions[id]; !ok {
+			s.localID = id
+			t.sessions[id] = s
+			return
+		}
+	}
+}
+
+// randomID 1~0xffff 之间的随机 ID，0 为保留值
+func randomID() uint16 {
+	return uint16(mrand.Intn(0xffff)) + 1
+}
+
+// clone 深拷贝控制报文的 AVP
+func clone(m *Message) *Message {
+	c := *m
+	c.AVPs = make([]AVP, len(m.AVPs))
+	for i, a := range m.AVPs {
+		a.Value = append([]byte(nil), a.Value...)
+		c.AVPs[i] = a
+	}
+	c.Payload = nil
+	return &c
+}
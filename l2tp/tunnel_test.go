@@ -0,0 +1,267 @@
+package l2tp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"pppoe-probe/ppp"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testSecret       = "testing123"
+	standInTunnelID  = 0x1234
+	standInSessionID = 0x4321
+)
+
+// standIn 进程内的 LNS，应答隧道和会话的建立，记录收到的控制报文和数据报文
+type standIn struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	secret string
+
+	mu         sync.Mutex
+	peer       *net.UDPAddr
+	peerTunnel uint16
+	ns         uint16
+	nr         uint16
+	challenge  []byte
+
+	controls chan *Message
+	frames   chan []byte
+}
+
+func newStandIn(t *testing.T, secret string) *standIn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	s := &standIn{t: t, conn: conn, secret: secret, controls: make(chan *Message, 10), frames: make(chan []byte, 10)}
+	go s.serve()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return s
+}
+
+func (s *standIn) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *standIn) serve() {
+	buf := make([]byte, 0xffff)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		m, err := Decode(buf[:n])
+		if err != nil {
+			continue
+		}
+		if !m.Control {
+			s.frames <- append([]byte(nil), m.Payload...)
+			continue
+		}
+		if len(m.AVPs) == 0 {
+			continue
+		}
+		m = *clone(&m)
+		s.mu.Lock()
+		s.peer = addr
+		s.nr = m.Ns + 1
+		s.mu.Unlock()
+		switch m.Type() {
+		case MessageSCCRQ:
+			s.mu.Lock()
+			s.peerTunnel, _ = m.GetUint16(AVPAssignedTunnelID)
+			s.mu.Unlock()
+			reply := NewControl(MessageSCCRP, 0, 0)
+			reply.AddUint16(AVPAssignedTunnelID, standInTunnelID)
+			reply.AddUint16(AVPReceiveWindowSize, 8)
+			if challenge, ok := m.Get(AVPChallenge); ok {
+				reply.Add(AVPChallengeResponse, ppp.ChapMD5Response(byte(MessageSCCRP), s.secret, challenge))
+			}
+			if s.secret != "" {
+				s.challenge = []byte("lns-challenge")
+				reply.Add(AVPChallenge, s.challenge)
+			}
+			s.send(reply)
+		case MessageICRQ:
+			peerSession, _ := m.GetUint16(AVPAssignedSessionID)
+			reply := NewControl(MessageICRP, 0, peerSession)
+			reply.AddUint16(AVPAssignedSessionID, standInSessionID)
+			s.send(reply)
+		default:
+			s.ack()
+		}
+		s.controls <- &m
+	}
+}
+
+// send 调用方已设置 SessionID，其余头部字段在这里填写
+func (s *standIn) send(m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.TunnelID = s.peerTunnel
+	m.Ns = s.ns
+	m.Nr = s.nr
+	s.ns++
+	bs, err := m.AppendEncode(nil)
+	assert.Nil(s.t, err)
+	_, _ = s.conn.WriteToUDP(bs, s.peer)
+}
+
+func (s *standIn) ack() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bs, _ := (&Message{Control: true, TunnelID: s.peerTunnel, Ns: s.ns, Nr: s.nr}).AppendEncode(nil)
+	_, _ = s.conn.WriteToUDP(bs, s.peer)
+}
+
+func (s *standIn) sendData(sessionID uint16, frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = s.conn.WriteToUDP(AppendData(nil, s.peerTunnel, sessionID, frame), s.peer)
+}
+
+// expect 等待下一个类型为 t 的控制报文
+func (s *standIn) expect(t MessageType) *Message {
+	for {
+		select {
+		case m := <-s.controls:
+			if m.Type() == t {
+				return m
+			}
+		case <-time.After(2 * time.Second):
+			s.t.Fatalf("no %s received", t)
+			return nil
+		}
+	}
+}
+
+func TestTunnel_ProxySession(t *testing.T) {
+	lns := newStandIn(t, testSecret)
+	closed := make(chan error, 1)
+	tunnel, err := Dial(Config{Server: lns.addr(), Secret: testSecret, HostName: "lac", OnClose: func(err error) {
+		closed <- err
+	}})
+	assert.Nil(t, err)
+	sccrq := lns.expect(MessageSCCRQ)
+	assert.Equal(t, "lac", sccrq.GetString(AVPHostName))
+	scccn := lns.expect(MessageSCCCN)
+	response, _ := scccn.Get(AVPChallengeResponse)
+	assert.Equal(t, ppp.ChapMD5Response(byte(MessageSCCCN), testSecret, lns.challenge), response)
+
+	frames := make(chan []byte, 1)
+	sessionClosed := make(chan error, 1)
+	session, err := tunnel.OpenSession(SessionConfig{
+		CallingNumber:      "00:11:22:33:44:55",
+		InitialReceivedLCP: []byte{0x01, 0x04, 0x05, 0xd4},
+		LastSentLCP:        []byte{0x03, 0x04, 0xc0, 0x23},
+		LastReceivedLCP:    []byte{0x01, 0x04, 0x05, 0xc8},
+		ProxyAuth:          &ppp.AuthRequest{Protocol: ppp.AuthProtocolPassword, Identifier: 7, Username: "user", Password: "secret"},
+		OnFrame: func(frame []byte) {
+			frames <- append([]byte(nil), frame...)
+		},
+		OnClose: func(err error) {
+			sessionClosed <- err
+		},
+	})
+	assert.Nil(t, err)
+	icrq := lns.expect(MessageICRQ)
+	assert.Equal(t, "00:11:22:33:44:55", icrq.GetString(AVPCallingNumber))
+	iccn := lns.expect(MessageICCN)
+	assert.Equal(t, uint16(standInSessionID), iccn.SessionID)
+	assert.Equal(t, []byte{0x01, 0x04, 0x05, 0xc8}, mustGet(t, iccn, AVPLastReceivedLCPConfReq))
+	authType, _ := iccn.GetUint16(AVPProxyAuthenType)
+	assert.Equal(t, ProxyAuthenPAP, authType)
+	assert.Equal(t, "user", iccn.GetString(AVPProxyAuthenName))
+	assert.Equal(t, "secret", iccn.GetString(AVPProxyAuthenResponse))
+	assert.Equal(t, []byte{0x00, 0x07}, mustGet(t, iccn, AVPProxyAuthenID))
+
+	// 数据报文双向转发
+	ipcp := []byte{0x80, 0x21, 0x01, 0x01, 0x00, 0x04}
+	assert.Nil(t, session.WriteFrame(ipcp))
+	select {
+	case frame := <-lns.frames:
+		assert.Equal(t, ipcp, frame)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no data received by lns")
+	}
+	lns.sendData(session.LocalID(), ipcp)
+	select {
+	case frame := <-frames:
+		assert.True(t, bytes.Equal(ipcp, frame))
+	case <-time.After(2 * time.Second):
+		t.Fatal("no data received from lns")
+	}
+
+	// LNS 结束会话
+	cdn := NewControl(MessageCDN, 0, session.LocalID())
+	cdn.Add(AVPResultCode, []byte{0x00, 0x03})
+	lns.send(cdn)
+	select {
+	case err := <-sessionClosed:
+		assert.Equal(t, uint16(CDNAdmin), err.(*ResultError).Result)
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not closed")
+	}
+	assert.ErrorIs(t, session.WriteFrame(ipcp), ErrClosed)
+
+	tunnel.Close()
+	lns.expect(MessageStopCCN)
+	assert.ErrorIs(t, <-closed, ErrClosed)
+	_, err = tunnel.OpenSession(SessionConfig{})
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestTunnel_CloseSessions(t *testing.T) {
+	lns := newStandIn(t, "")
+	tunnel, err := Dial(Config{Server: lns.addr()})
+	assert.Nil(t, err)
+	sessionClosed := make(chan error, 1)
+	_, err = tunnel.OpenSession(SessionConfig{OnClose: func(err error) {
+		sessionClosed <- err
+	}})
+	assert.Nil(t, err)
+	iccn := lns.expect(MessageICCN)
+	_, ok := iccn.Get(AVPProxyAuthenType)
+	assert.False(t, ok)
+
+	// LNS 关闭隧道时会话随之结束
+	stop := NewControl(MessageStopCCN, 0, 0)
+	stop.AddUint16(AVPAssignedTunnelID, standInTunnelID)
+	stop.Add(AVPResultCode, []byte{0x00, 0x01})
+	lns.send(stop)
+	select {
+	case err := <-sessionClosed:
+		assert.Equal(t, MessageStopCCN, err.(*ResultError).Type)
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not closed")
+	}
+	<-tunnel.Done()
+}
+
+func TestDial_BadSecret(t *testing.T) {
+	lns := newStandIn(t, "other")
+	_, err := Dial(Config{Server: lns.addr(), Secret: testSecret, Timeout: 50 * time.Millisecond})
+	assert.ErrorIs(t, err, ErrAuthFailed)
+	stop := lns.expect(MessageStopCCN)
+	result, _ := stop.GetUint16(AVPResultCode)
+	assert.Equal(t, StopCCNNotAuthorized, result)
+}
+
+func TestDial_Timeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = Dial(Config{Server: conn.LocalAddr().String(), Timeout: 20 * time.Millisecond, Retries: 1})
+	assert.ErrorIs(t, err, ErrTimeout)
+}
+
+func mustGet(t *testing.T, m *Message, avp AVPType) []byte {
+	value, ok := m.Get(avp)
+	assert.True(t, ok, "missing avp %d", avp)
+	return value
+}
@@ -0,0 +1,203 @@
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// VlanTag 一层 802.1Q/802.1ad VLAN 标签
+type VlanTag struct {
+	TPID     layers.EthernetType
+	ID       uint16
+	Priority uint8
+	// DropEligible DEI 位（原 802.1Q 的 CFI），拥塞时优先丢弃
+	DropEligible bool
+}
+
+// AnyVlanID 作为筛选条件时匹配任意 ID 的一层标签，ParseVlanFilter 中写作 *
+const AnyVlanID = 0xffff
+
+// VlanStack 帧中的 VLAN 标签，外层在前。未打标签的帧为空。
+type VlanStack []VlanTag
+
+// ParseVlanStack 解析 "35" 或 "100.35"（外层.内层）形式的 VLAN 标签，"" 和 "0" 表示不打标签。
+// 单层标签使用 802.1Q（0x8100），双层标签的外层使用 802.1ad（0x88a8）。
+func ParseVlanStack(s string) (vlans VlanStack, err error) {
+	if s == "" || s == "0" {
+		return
+	}
+	fields := strings.Split(s, ".")
+	for i, field := range fields {
+		id, err := strconv.ParseUint(field, 10, 12)
+		if err != nil {
+			return nil, err
+		}
+		if id == 0 {
+			return nil, errors.New("invalid vlan id 0 in " + s)
+		}
+		tpid := layers.EthernetTypeDot1Q
+		if i == 0 && len(fields) > 1 {
+			tpid = layers.EthernetTypeQinQ
+		}
+		vlans = append(vlans, VlanTag{TPID: tpid, ID: uint16(id)})
+	}
+	return
+}
+
+// ParseVlanFilter 解析 "35"、"100.35"、"100.*" 形式的筛选条件，* 匹配该层任意 ID，用于 VlanStack.Match
+func ParseVlanFilter(s string) (filter VlanStack, err error) {
+	if s == "" || s == "0" {
+		return
+	}
+	fields := strings.Split(s, ".")
+	for _, field := range fields {
+		if field == "*" {
+			filter = append(filter, VlanTag{ID: AnyVlanID})
+			continue
+		}
+		id, err := strconv.ParseUint(field, 10, 12)
+		if err != nil {
+			return nil, err
+		}
+		if id == 0 {
+			return nil, errors.New("invalid vlan id 0 in " + s)
+		}
+		filter = append(filter, VlanTag{ID: uint16(id)})
+	}
+	return
+}
+
+// Match 层数与 filter 相同，且从外到内每层 ID 都相同（filter 中为 AnyVlanID 的层除外）时返回 true。
+// 不比较 TPID、优先级和 DEI
+func (s VlanStack) Match(filter VlanStack) bool {
+	if len(s) != len(filter) {
+		return false
+	}
+	for i, tag := range filter {
+		if tag.ID != AnyVlanID && tag.ID != s[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+// ID 返回最内层的 VLAN ID，未打标签时返回 0
+func (s VlanStack) ID() uint16 {
+	if len(s) == 0 {
+		return 0
+	}
+	return s[len(s)-1].ID
+}
+
+// String 形如 "35" 或 "100.35"（外层.内层），未打标签时为空
+func (s VlanStack) String() string {
+	var ids []string
+	for _, tag := range s {
+		ids = append(ids, strconv.Itoa(int(tag.ID)))
+	}
+	return strings.Join(ids, ".")
+}
+
+// Layers 生成以太网头和 VLAN 标签层，etherType 为最内层承载的协议
+func (s VlanStack) Layers(src net.HardwareAddr, dst net.HardwareAddr, etherType layers.EthernetType) []gopacket.SerializableLayer {
+	eth := &layers.Ethernet{
+		SrcMAC:       src,
+		DstMAC:       dst,
+		EthernetType: etherType,
+	}
+	if len(s) == 0 {
+		return []gopacket.SerializableLayer{eth}
+	}
+	eth.EthernetType = s[0].TPID
+	ls := []gopacket.SerializableLayer{eth}
+	for i, tag := range s {
+		next := etherType
+		if i+1 < len(s) {
+			next = s[i+1].TPID
+		}
+		ls = append(ls, &layers.Dot1Q{
+			Priority:       tag.Priority,
+			DropEligible:   tag.DropEligible,
+			VLANIdentifier: tag.ID,
+			Type:           next,
+		})
+	}
+	return ls
+}
+
+// Frame 剥离 VLAN 标签后的以太网帧
+type Frame struct {
+	SrcMac    net.HardwareAddr
+	DstMac    net.HardwareAddr
+	Vlans     VlanStack
+	EtherType layers.EthernetType
+	Payload   []byte
+}
+
+// MinFrameLen 不含 FCS 的以太网最小帧长，短帧补零到该长度
+const MinFrameLen = 60
+
+// Encode 按 VLAN 标签封装以太网帧
+func (f Frame) Encode() ([]byte, error) {
+	return f.AppendEncode(nil)
+}
+
+// AppendEncode 将封装后的帧追加到 dst 后返回，结果与 Encode 相同，dst 容量足够时不分配内存
+func (f Frame) AppendEncode(dst []byte) ([]byte, error) {
+	if len(f.DstMac) != 6 {
+		return dst, fmt.Errorf("invalid dst MAC: %v", f.DstMac)
+	}
+	if len(f.SrcMac) != 6 {
+		return dst, fmt.Errorf("invalid src MAC: %v", f.SrcMac)
+	}
+	start := len(dst)
+	dst = append(dst, f.DstMac...)
+	dst = append(dst, f.SrcMac...)
+	for _, tag := range f.Vlans {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(tag.TPID))
+		tci := uint16(tag.Priority)<<13 | tag.ID&0x0fff
+		if tag.DropEligible {
+			tci |= 1 << 12
+		}
+		dst = binary.BigEndian.AppendUint16(dst, tci)
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(f.EtherType))
+	dst = append(dst, f.Payload...)
+	for len(dst)-start < MinFrameLen {
+		dst = append(dst, 0)
+	}
+	return dst, nil
+}
+
+// DecodeFrame 解析以太网头和任意层 VLAN 标签
+func DecodeFrame(packet gopacket.Packet) (f Frame, ok bool) {
+	ethPack, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		return
+	}
+	f.SrcMac = ethPack.SrcMAC
+	f.DstMac = ethPack.DstMAC
+	f.EtherType = ethPack.EthernetType
+	f.Payload = ethPack.Payload
+	for _, l := range packet.Layers() {
+		dot1q, isDot1q := l.(*layers.Dot1Q)
+		if !isDot1q {
+			continue
+		}
+		f.Vlans = append(f.Vlans, VlanTag{
+			TPID:         f.EtherType,
+			ID:           dot1q.VLANIdentifier,
+			Priority:     dot1q.Priority,
+			DropEligible: dot1q.DropEligible,
+		})
+		f.EtherType = dot1q.Type
+		f.Payload = dot1q.Payload
+	}
+	return
+}
@@ -0,0 +1,142 @@
+package link
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFrame_Encode(t *testing.T) {
+	vlans, err := ParseVlanStack("100.35")
+	assert.Nil(t, err)
+	f := Frame{
+		SrcMac:    []byte{0x00, 0x0c, 0x29, 0x8b, 0x82, 0xc5},
+		DstMac:    []byte{0x00, 0xe0, 0x4c, 0x36, 0x17, 0xf8},
+		Vlans:     vlans,
+		EtherType: layers.EthernetTypePPPoEDiscovery,
+		Payload:   []byte{0x11, 0x09, 0x00, 0x00, 0x00, 0x00},
+	}
+	data, err := f.Encode()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x88, 0xa8, 0x00, 0x64, 0x81, 0x00, 0x00, 0x23, 0x88, 0x63}, data[12:22])
+
+	decoded, ok := DecodeFrame(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+	assert.True(t, ok)
+	assert.Equal(t, "100.35", decoded.Vlans.String())
+	assert.Equal(t, uint16(35), decoded.Vlans.ID())
+	assert.Equal(t, layers.EthernetTypePPPoEDiscovery, decoded.EtherType)
+	assert.Equal(t, f.Payload, decoded.Payload[:len(f.Payload)])
+}
+
+func TestParseVlanStack(t *testing.T) {
+	vlans, err := ParseVlanStack("")
+	assert.Nil(t, err)
+	assert.Empty(t, vlans)
+
+	vlans, err = ParseVlanStack("7")
+	assert.Nil(t, err)
+	assert.Equal(t, VlanStack{{TPID: layers.EthernetTypeDot1Q, ID: 7}}, vlans)
+
+	_, err = ParseVlanStack("4096")
+	assert.NotNil(t, err)
+}
+
+func TestParseVlanFilter(t *testing.T) {
+	filter, err := ParseVlanFilter("100.*")
+	assert.Nil(t, err)
+	assert.Equal(t, VlanStack{{ID: 100}, {ID: AnyVlanID}}, filter)
+	_, err = ParseVlanFilter("100.x")
+	assert.NotNil(t, err)
+	_, err = ParseVlanFilter("0.35")
+	assert.NotNil(t, err)
+}
+
+func TestVlanStack_Match(t *testing.T) {
+	qinq, _ := ParseVlanStack("100.35")
+	single, _ := ParseVlanStack("35")
+	tests := []struct {
+		filter string
+		vlans  VlanStack
+		want   bool
+	}{
+		{"100.35", qinq, true},
+		{"100.*", qinq, true},
+		{"*.35", qinq, true},
+		{"200.35", qinq, false},
+		{"100.36", qinq, false},
+		{"35", qinq, false},
+		{"35", single, true},
+		{"100.*", single, false},
+		{"*", single, true},
+		{"", nil, true},
+		{"", single, false},
+	}
+	for _, tt := range tests {
+		filter, err := ParseVlanFilter(tt.filter)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.want, tt.vlans.Match(filter), tt.filter+" "+tt.vlans.String())
+	}
+}
+
+func TestDecodeFrame_DropEligible(t *testing.T) {
+	vlans, _ := ParseVlanStack("100.35")
+	vlans[0].DropEligible = true
+	vlans[1].Priority = 7
+	data, err := Frame{
+		SrcMac:    []byte{0x00, 0x0c, 0x29, 0x8b, 0x82, 0xc5},
+		DstMac:    []byte{0x00, 0xe0, 0x4c, 0x36, 0x17, 0xf8},
+		Vlans:     vlans,
+		EtherType: layers.EthernetTypePPPoEDiscovery,
+	}.Encode()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x88, 0xa8, 0x10, 0x64, 0x81, 0x00, 0xe0, 0x23}, data[12:20])
+	decoded, ok := DecodeFrame(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+	assert.True(t, ok)
+	assert.Equal(t, vlans, decoded.Vlans)
+}
+
+func TestFrame_AppendEncode(t *testing.T) {
+	vlans, err := ParseVlanStack("100.35")
+	assert.Nil(t, err)
+	vlans[1].Priority = 5
+	vlans[1].DropEligible = true
+	for _, f := range []Frame{
+		{EtherType: layers.EthernetTypePPPoEDiscovery, Payload: []byte{0x11, 0x09, 0x00, 0x00, 0x00, 0x00}},
+		{Vlans: vlans, EtherType: layers.EthernetTypePPPoESession, Payload: make([]byte, 100)},
+	} {
+		f.SrcMac = []byte{0x00, 0x0c, 0x29, 0x8b, 0x82, 0xc5}
+		f.DstMac = []byte{0x00, 0xe0, 0x4c, 0x36, 0x17, 0xf8}
+		buffer := gopacket.NewSerializeBuffer()
+		ls := append(f.Vlans.Layers(f.SrcMac, f.DstMac, f.EtherType), gopacket.Payload(f.Payload))
+		assert.Nil(t, gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{}, ls...))
+		data, err := f.AppendEncode(nil)
+		assert.Nil(t, err)
+		assert.Equal(t, buffer.Bytes(), data)
+
+		buf := make([]byte, 0, 1518)
+		allocs := testing.AllocsPerRun(100, func() {
+			buf, _ = f.AppendEncode(buf[:0])
+		})
+		assert.Equal(t, float64(0), allocs)
+	}
+
+	_, err = Frame{SrcMac: []byte{0x00}}.AppendEncode(nil)
+	assert.NotNil(t, err)
+}
+
+func BenchmarkFrame_AppendEncode(b *testing.B) {
+	vlans, _ := ParseVlanStack("100.35")
+	f := Frame{
+		SrcMac:    []byte{0x00, 0x0c, 0x29, 0x8b, 0x82, 0xc5},
+		DstMac:    []byte{0x00, 0xe0, 0x4c, 0x36, 0x17, 0xf8},
+		Vlans:     vlans,
+		EtherType: layers.EthernetTypePPPoESession,
+		Payload:   make([]byte, 1400),
+	}
+	buf := make([]byte, 0, 1518)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, _ = f.AppendEncode(buf[:0])
+	}
+}
@@ -0,0 +1,298 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 解码错误所在的层
+const (
+	LayerPPPoED = "pppoed"
+	LayerPPPoES = "pppoes"
+	// LayerHDLC 串口链路上的 RFC 1662 成帧及其承载的 PPP 帧
+	LayerHDLC = "hdlc"
+)
+
+// 数据面报文方向：rx 为从对端收到，tx 为发给对端
+const (
+	DirectionRx = "rx"
+	DirectionTx = "tx"
+)
+
+// 数据面丢包原因
+const (
+	DropNoRoute  = "no_route"
+	DropTooBig   = "too_big"
+	DropNotReady = "not_ready"
+	DropSpoofed  = "spoofed"
+)
+
+// DefaultAuthBuckets 从 PADI 到收到认证请求耗时直方图的分桶，单位秒
+var DefaultAuthBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Collector 统计发现、LCP、认证各阶段的数据，并以 Prometheus 文本格式输出。
+// 所有方法都可以并发调用，nil Collector 的方法不做任何事，方便未开启统计时直接调用。
+type Collector struct {
+	padi         *counterVec
+	padr         *counterVec
+	lcpAck       *counterVec
+	credentials  *counterVec
+	authResults  *counterVec
+	decodeErrors *counterVec
+	padiToAuth   *histogramVec
+	dataPackets  *counterVec
+	dataBytes    *counterVec
+	dataDropped  *counterVec
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		padi:         newCounterVec("pppoe_padi_total", "PADI packets received.", "adapter"),
+		padr:         newCounterVec("pppoe_padr_total", "PADR packets received.", "adapter"),
+		lcpAck:       newCounterVec("pppoe_lcp_ack_total", "PPP sessions whose LCP negotiation completed.", "adapter"),
+		credentials:  newCounterVec("pppoe_credentials_total", "PAP and CHAP credentials captured.", "adapter"),
+		authResults:  newCounterVec("pppoe_auth_results_total", "Auth decisions made for peers.", "adapter", "method", "verdict"),
+		decodeErrors: newCounterVec("pppoe_decode_errors_total", "Frames that failed to decode.", "adapter", "layer"),
+		padiToAuth:   newHistogramVec("pppoe_padi_to_auth_seconds", "Time from first PADI to the PAP or CHAP auth request.", DefaultAuthBuckets, "adapter"),
+		dataPackets:  newCounterVec("pppoe_data_packets_total", "IP packets forwarded between PPPoE sessions and TUN devices.", "adapter", "direction"),
+		dataBytes:    newCounterVec("pppoe_data_bytes_total", "IP bytes forwarded between PPPoE sessions and TUN devices.", "adapter", "direction"),
+		dataDropped:  newCounterVec("pppoe_data_dropped_total", "IP packets dropped by the data plane.", "adapter", "reason"),
+	}
+}
+
+func (c *Collector) IncPADI(adapter string) {
+	if c != nil {
+		c.padi.inc(adapter)
+	}
+}
+
+func (c *Collector) IncPADR(adapter string) {
+	if c != nil {
+		c.padr.inc(adapter)
+	}
+}
+
+// IncLCPAck 统计一次完成的 LCP 协商（双方都已 Configure-Ack），每个会话只统计一次
+func (c *Collector) IncLCPAck(adapter string) {
+	if c != nil {
+		c.lcpAck.inc(adapter)
+	}
+}
+
+func (c *Collector) IncCredentials(adapter string) {
+	if c != nil {
+		c.credentials.inc(adapter)
+	}
+}
+
+// IncAuthResult 统计一次认证决定，method 为 pap 或 chap，verdict 为 accept、reject 或 ignore
+func (c *Collector) IncAuthResult(adapter string, method string, verdict string) {
+	if c != nil {
+		c.authResults.inc(adapter, method, verdict)
+	}
+}
+
+func (c *Collector) IncDecodeErrors(adapter string, layer string) {
+	if c != nil {
+		c.decodeErrors.inc(adapter, layer)
+	}
+}
+
+func (c *Collector) ObservePADIToAuth(adapter string, d time.Duration) {
+	if c != nil {
+		c.padiToAuth.observe(d.Seconds(), adapter)
+	}
+}
+
+// AddData 统计一个转发的数据报文，direction 为 DirectionRx 或 DirectionTx
+func (c *Collector) AddData(adapter string, direction string, bytes int) {
+	if c != nil {
+		c.dataPackets.inc(adapter, direction)
+		c.dataBytes.add(uint64(bytes), adapter, direction)
+	}
+}
+
+func (c *Collector) IncDataDropped(adapter string, reason string) {
+	if c != nil {
+		c.dataDropped.inc(adapter, reason)
+	}
+}
+
+// WriteTo 以 Prometheus 文本格式输出所有指标，nil Collector 不输出任何内容
+func (c *Collector) WriteTo(w io.Writer) (n int64, err error) {
+	if c == nil {
+		return
+	}
+	var sb strings.Builder
+	c.padi.write(&sb)
+	c.padr.write(&sb)
+	c.lcpAck.write(&sb)
+	c.credentials.write(&sb)
+	c.authResults.write(&sb)
+	c.decodeErrors.write(&sb)
+	c.padiToAuth.write(&sb)
+	c.dataPackets.write(&sb)
+	c.dataBytes.write(&sb)
+	c.dataDropped.write(&sb)
+	written, err := io.WriteString(w, sb.String())
+	return int64(written), err
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+}
+
+func (v *counterVec) inc(labelValues ...string) {
+	v.add(1, labelValues...)
+}
+
+func (v *counterVec) add(n uint64, labelValues ...string) {
+	key := labelKey(v.labels, labelValues)
+	v.mu.Lock()
+	v.values[key] += n
+	v.mu.Unlock()
+}
+
+func (v *counterVec) write(sb *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	writeHeader(sb, v.name, v.help, "counter")
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(sb, "%s%s %d\n", v.name, key, v.values[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (v *histogramVec) observe(value float64, labelValues ...string) {
+	key := labelKey(v.labels, labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.values[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.values[key] = h
+	}
+	for i, upper := range v.buckets {
+		if value <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (v *histogramVec) write(sb *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	writeHeader(sb, v.name, v.help, "histogram")
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := v.values[key]
+		for i, upper := range v.buckets {
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", v.name, withLabel(key, "le", formatFloat(upper)), h.counts[i])
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", v.name, withLabel(key, "le", "+Inf"), h.count)
+		fmt.Fprintf(sb, "%s_sum%s %s\n", v.name, key, formatFloat(h.sum))
+		fmt.Fprintf(sb, "%s_count%s %d\n", v.name, key, h.count)
+	}
+}
+
+func writeHeader(sb *strings.Builder, name string, help string, typ string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(sb, "# TYPE %s %s\n", name, typ)
+}
+
+// labelKey 生成 {a="x",b="y"} 形式的标签串，同时作为 map 的 key
+func labelKey(labels []string, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i, label := range labels {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, label+"="+strconv.Quote(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(key string, label string, value string) string {
+	pair := label + "=" + strconv.Quote(value)
+	if key == "" {
+		return "{" + pair + "}"
+	}
+	return key[:len(key)-1] + "," + pair + "}"
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
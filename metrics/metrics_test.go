@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollector_WriteTo(t *testing.T) {
+	c := NewCollector()
+	c.IncPADI("00:11:22:33:44:55")
+	c.IncPADI("00:11:22:33:44:55")
+	c.IncDecodeErrors("00:11:22:33:44:55", LayerPPPoES)
+	c.ObservePADIToAuth("00:11:22:33:44:55", 700*time.Millisecond)
+	c.IncAuthResult("00:11:22:33:44:55", "chap", "reject")
+
+	var sb strings.Builder
+	_, err := c.WriteTo(&sb)
+	assert.Nil(t, err)
+	out := sb.String()
+	assert.Contains(t, out, "# TYPE pppoe_padi_total counter\n")
+	assert.Contains(t, out, `pppoe_padi_total{adapter="00:11:22:33:44:55"} 2`+"\n")
+	assert.Contains(t, out, `pppoe_decode_errors_total{adapter="00:11:22:33:44:55",layer="pppoes"} 1`+"\n")
+	assert.Contains(t, out, `pppoe_auth_results_total{adapter="00:11:22:33:44:55",method="chap",verdict="reject"} 1`+"\n")
+	assert.Contains(t, out, "# TYPE pppoe_padi_to_auth_seconds histogram\n")
+	assert.Contains(t, out, `pppoe_padi_to_auth_seconds_bucket{adapter="00:11:22:33:44:55",le="0.5"} 0`+"\n")
+	assert.Contains(t, out, `pppoe_padi_to_auth_seconds_bucket{adapter="00:11:22:33:44:55",le="1"} 1`+"\n")
+	assert.Contains(t, out, `pppoe_padi_to_auth_seconds_bucket{adapter="00:11:22:33:44:55",le="+Inf"} 1`+"\n")
+	assert.Contains(t, out, `pppoe_padi_to_auth_seconds_count{adapter="00:11:22:33:44:55"} 1`+"\n")
+}
+
+func TestCollector_AddData(t *testing.T) {
+	c := NewCollector()
+	c.AddData("00:11:22:33:44:55", DirectionRx, 84)
+	c.AddData("00:11:22:33:44:55", DirectionRx, 1400)
+	c.IncDataDropped("00:11:22:33:44:55", DropTooBig)
+
+	var sb strings.Builder
+	_, err := c.WriteTo(&sb)
+	assert.Nil(t, err)
+	out := sb.String()
+	assert.Contains(t, out, `pppoe_data_packets_total{adapter="00:11:22:33:44:55",direction="rx"} 2`+"\n")
+	assert.Contains(t, out, `pppoe_data_bytes_total{adapter="00:11:22:33:44:55",direction="rx"} 1484`+"\n")
+	assert.Contains(t, out, `pppoe_data_dropped_total{adapter="00:11:22:33:44:55",reason="too_big"} 1`+"\n")
+}
+
+func TestCollector_Nil(t *testing.T) {
+	var c *Collector
+	c.IncPADI("00:11:22:33:44:55")
+	c.ObservePADIToAuth("00:11:22:33:44:55", time.Second)
+
+	var sb strings.Builder
+	n, err := c.WriteTo(&sb)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Body.String())
+}
@@ -0,0 +1,138 @@
+package ppp
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	ChapCodeChallenge byte = 0x1
+	ChapCodeResponse  byte = 0x2
+	ChapCodeSuccess   byte = 0x3
+	ChapCodeFailure   byte = 0x4
+)
+
+// ChapProtocol CHAP 报文，RFC 1994。
+// Challenge/Response 携带 Value 和 Name，Success/Failure 携带 Message。
+type ChapProtocol struct {
+	Code       byte
+	Identifier byte
+	Value      []byte
+	Name       string
+	Message    string
+}
+
+func (p ChapProtocol) GetShowCode() string {
+	switch p.Code {
+	case ChapCodeChallenge:
+		return "Challenge"
+	case ChapCodeResponse:
+		return "Response"
+	case ChapCodeSuccess:
+		return "Success"
+	case ChapCodeFailure:
+		return "Failure"
+	}
+	return "unknown"
+}
+
+// chapProtocol 没有 Format 等方法，用于打印脱敏后的副本，避免递归
+type chapProtocol ChapProtocol
+
+// redacted Response 的 Value 配合 Challenge 可以离线暴力破解密码，打印时去掉
+func (p ChapProtocol) redacted() chapProtocol {
+	r := chapProtocol(p)
+	if r.Code == ChapCodeResponse && r.Value != nil {
+		r.Value = []byte(RedactedMask)
+	}
+	return r
+}
+
+// String 打印时不包含 Response 的值
+func (p ChapProtocol) String() string {
+	return fmt.Sprintf("%+v", p.redacted())
+}
+
+// Format 使 %v、%+v 等格式化（包括作为 Frame 的字段被打印时）不输出 Response 的值
+func (p ChapProtocol) Format(f fmt.State, verb rune) {
+	_, _ = fmt.Fprintf(f, fmt.FormatString(f, verb), p.redacted())
+}
+
+// MarshalJSON 序列化时不包含 Response 的值
+func (p ChapProtocol) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.redacted())
+}
+
+// ChapMD5Response 计算 CHAP-MD5 的 Response：MD5(Identifier + secret + challenge)
+func ChapMD5Response(identifier byte, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{identifier})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+func (p ChapProtocol) encode() (pd []byte) {
+	return p.appendEncode(nil)
+}
+
+func (p ChapProtocol) appendEncode(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, p.Code, p.Identifier, 0, 0)
+	switch p.Code {
+	case ChapCodeChallenge, ChapCodeResponse:
+		dst = append(dst, byte(len(p.Value)))
+		dst = append(dst, p.Value...)
+		dst = append(dst, p.Name...)
+	default:
+		dst = append(dst, p.Message...)
+	}
+	putLength(dst, start)
+	return dst
+}
+
+func DecodeChapProtocol(payload []byte) (p ChapProtocol, err error) {
+	err = p.decode(payload)
+	return
+}
+
+// decode 解码到 p，内容与 p 中原有的字符串相同时不重新分配
+func (p *ChapProtocol) decode(payload []byte) (err error) {
+	old := *p
+	*p = ChapProtocol{}
+	if len(payload) < ControlHeaderLen {
+		err = truncated(LayerCHAP, "header", 0, ControlHeaderLen, len(payload))
+		return
+	}
+	p.Code = payload[0]
+	p.Identifier = payload[1]
+	chapLen := binary.BigEndian.Uint16(payload[2:4])
+	if chapLen < ControlHeaderLen {
+		err = badLength(LayerCHAP, "length", 2, ControlHeaderLen, int(chapLen))
+		return
+	}
+	if len(payload) < int(chapLen) {
+		err = truncated(LayerCHAP, "packet", 0, int(chapLen), len(payload))
+		return
+	}
+	payload = payload[ControlHeaderLen:chapLen]
+	switch p.Code {
+	case ChapCodeChallenge, ChapCodeResponse:
+		if len(payload) < 1 {
+			err = truncated(LayerCHAP, "value size", ControlHeaderLen, 1, 0)
+			return
+		}
+		valueLen := payload[0]
+		if len(payload) < int(valueLen)+1 {
+			err = truncated(LayerCHAP, "value", ControlHeaderLen, int(valueLen)+1, len(payload))
+			return
+		}
+		p.Value = payload[1 : valueLen+1]
+		p.Name = reuseString(old.Name, payload[valueLen+1:])
+	default:
+		p.Message = reuseString(old.Message, payload)
+	}
+	return
+}
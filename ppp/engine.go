@@ -0,0 +1,606 @@
+package ppp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+)
+
+// Role 本端在认证中的角色
+type Role int
+
+const (
+	// RoleAuthenticator 要求对端认证，例如 AC
+	RoleAuthenticator Role = iota
+	// RolePeer 向对端认证，例如拨号客户端
+	RolePeer
+)
+
+// Phase 链路阶段，RFC 1661 3.2
+type Phase int
+
+const (
+	PhaseDead Phase = iota
+	PhaseEstablish
+	PhaseAuthenticate
+	PhaseNetwork
+	PhaseTerminate
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseDead:
+		return "dead"
+	case PhaseEstablish:
+		return "establish"
+	case PhaseAuthenticate:
+		return "authenticate"
+	case PhaseNetwork:
+		return "network"
+	case PhaseTerminate:
+		return "terminate"
+	}
+	return "unknown"
+}
+
+// AuthRequest 认证方收到的认证请求。PAP 携带 Password，CHAP 携带 Challenge 和 Response
+type AuthRequest struct {
+	Protocol   AuthProtocol
+	Identifier byte
+	Username   string
+	Password   string
+	Challenge  []byte
+	Response   []byte
+}
+
+// Config 协商参数和回调。回调在 Engine 的锁之外调用，可以在其中调用 Engine 的方法
+type Config struct {
+	Role Role
+	// MRU 本端配置请求中的 MRU，为 0 时使用对端第一个 LCP 报文中的 MRU，对端也没有时不携带
+	MRU uint16
+	// MagicNumber 为 0 时不携带
+	MagicNumber uint32
+	// Async 链路为异步串口（RFC 1662）时接受对端的 ACCM 配置项，PPPoE 等链路上一律拒绝
+	Async bool
+	// AuthProtocol 认证方要求对端使用的认证协议，AuthProtocolPassword 或 AuthProtocolChap（CHAP-MD5），
+	// 对端拒绝 CHAP 时退回 PAP。被认证方使用对端要求的协议，忽略此项
+	AuthProtocol AuthProtocol
+	// Name 认证方在 CHAP Challenge 中的名字
+	Name string
+	// Username、Password 被认证方使用的账号
+	Username string
+	Password string
+
+	// Send 发送一个 PPP 帧，f 只在调用期间有效
+	Send func(f *Frame)
+	// OnPhase 进入新的阶段
+	OnPhase func(p Phase)
+	// OnAuthenticate 认证方收到认证请求，决定后调用 Engine.AuthDone，不调用时忽略对端之后的重传
+	OnAuthenticate func(req AuthRequest)
+	// OnAuthResult 被认证方收到认证结果
+	OnAuthResult func(accepted bool, message string)
+	// OnProtocolReject 对端拒绝了本端发送的协议，例如 IPCP
+	OnProtocolReject func(p Protocol)
+}
+
+type authState int
+
+const (
+	authNone authState = iota
+	authPending
+	authDone
+)
+
+// Engine LCP 协商和 PAP/CHAP 认证，与承载 PPP 的链路无关：链路收到的帧交给 Input，要发送的帧通过 Config.Send 发出。
+// 网络阶段的 IPCP/IPv6CP 和数据不由 Engine 处理。各方法可以并发调用
+type Engine struct {
+	cfg Config
+
+	mu           sync.Mutex
+	phase        Phase
+	identifier   byte
+	request      LinkCtrlProtocol
+	localOpen    bool
+	peerOpen     bool
+	peerMRU      uint16
+	peerACCM     uint32
+	authProtocol AuthProtocol
+	// 代理 LCP 用到的配置请求，只含配置项部分
+	initialReceived []byte
+	lastReceived    []byte
+	lastSent        []byte
+	// pending 等待应答的请求，Retransmit 时重发
+	pending *Frame
+
+	auth          authState
+	authReq       AuthRequest
+	authReply     Frame
+	chapID        byte
+	chapChallenge []byte
+
+	// actions 持有锁期间产生的发送和回调，释放锁后依次执行
+	actions []func()
+}
+
+func NewEngine(cfg Config) *Engine {
+	e := &Engine{cfg: cfg, peerACCM: DefaultACCM}
+	e.request = LinkCtrlProtocol{
+		Code:           LinkCodeConfigRequest,
+		MaxReceiveUint: cfg.MRU,
+		MagicNumber:    cfg.MagicNumber,
+	}
+	if cfg.Role == RoleAuthenticator {
+		e.authProtocol = cfg.AuthProtocol
+		if e.authProtocol == 0 {
+			e.authProtocol = AuthProtocolPassword
+		}
+	}
+	return e
+}
+
+// Phase 当前阶段
+func (e *Engine) Phase() Phase {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.phase
+}
+
+// PeerMRU 对端配置请求中的 MRU，未协商或对端没有携带时为 0
+func (e *Engine) PeerMRU() uint16 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.peerMRU
+}
+
+// PeerACCM 向对端发送时需要转义的控制字符，对端没有携带 ACCM 时为 DefaultACCM
+func (e *Engine) PeerACCM() uint32 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.peerACCM
+}
+
+// AuthProtocol 协商出的认证协议，被认证方在对端没有要求认证时为 0
+func (e *Engine) AuthProtocol() AuthProtocol {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.authProtocol
+}
+
+// ConfigRequests 收到的第一个和最后一个 LCP 配置请求，以及本端最后发送的配置请求，只含配置项部分，
+// 用于 L2TP LAC 的代理 LCP（RFC 2661 4.4.5）。还没有收到或发送时为 nil
+func (e *Engine) ConfigRequests() (initialReceived []byte, lastSent []byte, lastReceived []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.initialReceived, e.lastSent, e.lastReceived
+}
+
+// Open 主动发起 LCP 协商。不调用时收到对端第一个 LCP 报文后再发起
+func (e *Engine) Open() {
+	e.mu.Lock()
+	defer e.unlock()
+	if e.phase == PhaseDead {
+		e.setPhase(PhaseEstablish)
+		e.sendConfigRequest(e.nextIdentifier())
+	}
+}
+
+// Input 处理链路收到的帧，LCP、PAP 和 CHAP 以外的协议返回 false，由调用方处理
+func (e *Engine) Input(f *Frame) bool {
+	switch f.Protocol {
+	case ProtocolLCP, ProtocolPAP, ProtocolCHAP:
+	default:
+		return false
+	}
+	e.mu.Lock()
+	defer e.unlock()
+	switch f.Protocol {
+	case ProtocolLCP:
+		e.inputLCP(&f.LinkProtocol)
+	case ProtocolPAP:
+		e.inputPAP(&f.PwdAuthProtocol)
+	case ProtocolCHAP:
+		e.inputCHAP(&f.ChapProtocol)
+	}
+	return true
+}
+
+// Retransmit 重发尚未收到应答的配置请求、认证请求或 Terminate Request，没有时不做处理
+func (e *Engine) Retransmit() {
+	e.mu.Lock()
+	defer e.unlock()
+	if e.pending != nil {
+		e.send(*e.pending)
+	}
+}
+
+// AuthDone 认证方回复 OnAuthenticate 的认证请求，通过后进入网络阶段
+func (e *Engine) AuthDone(accept bool, message string) {
+	e.mu.Lock()
+	defer e.unlock()
+	if e.auth != authPending {
+		return
+	}
+	e.auth = authDone
+	if e.authReq.Protocol == AuthProtocolChap {
+		code := ChapCodeFailure
+		if accept {
+			code = ChapCodeSuccess
+		}
+		e.authReply = Frame{Protocol: ProtocolCHAP, ChapProtocol: ChapProtocol{Code: code, Identifier: e.authReq.Identifier, Message: message}}
+	} else {
+		code := PwdAuthCodeNak
+		if accept {
+			code = PwdAuthCodeAck
+		}
+		e.authReply = Frame{Protocol: ProtocolPAP, PwdAuthProtocol: PwdAuthProtocol{Code: code, Identifier: e.authReq.Identifier, Message: message}}
+	}
+	e.send(e.authReply)
+	if accept {
+		e.setPhase(PhaseNetwork)
+	}
+}
+
+// Close 发送 Terminate Request，收到 Terminate Ack 后进入 PhaseDead
+func (e *Engine) Close() {
+	e.mu.Lock()
+	defer e.unlock()
+	if e.phase == PhaseDead || e.phase == PhaseTerminate {
+		return
+	}
+	e.setPhase(PhaseTerminate)
+	e.retransmit(Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{
+		Code:       LinkCodeTerminateRequest,
+		Identifier: e.nextIdentifier(),
+	}})
+}
+
+// RejectProtocol 对不支持的协议回复 Protocol Reject，raw 为收到的 PPP 帧（从协议字段开始）。LCP 打开之前不回复
+func (e *Engine) RejectProtocol(raw []byte) {
+	e.mu.Lock()
+	defer e.unlock()
+	if e.phase != PhaseAuthenticate && e.phase != PhaseNetwork {
+		return
+	}
+	e.send(Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{
+		Code:       LinkCodeProtocolReject,
+		Identifier: e.nextIdentifier(),
+		Data:       raw,
+	}})
+}
+
+func (e *Engine) inputLCP(lcp *LinkCtrlProtocol) {
+	switch lcp.Code {
+	case LinkCodeEchoRequest:
+		// 只在 LCP 打开后应答（RFC 1661 5.8）
+		if e.phase != PhaseAuthenticate && e.phase != PhaseNetwork {
+			return
+		}
+		e.send(Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{
+			Code:        LinkCodeEchoReply,
+			Identifier:  lcp.Identifier,
+			MagicNumber: e.request.MagicNumber,
+			Data:        lcp.Data,
+		}})
+		return
+	case LinkCodeTerminateRequest:
+		e.send(Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{
+			Code:       LinkCodeTerminateAck,
+			Identifier: lcp.Identifier,
+		}})
+		e.pending = nil
+		e.setPhase(PhaseDead)
+		return
+	case LinkCodeTerminateAck:
+		if e.phase == PhaseTerminate {
+			e.pending = nil
+			e.setPhase(PhaseDead)
+		}
+		return
+	case LinkCodeProtocolReject:
+		if len(lcp.Data) >= ProtocolLen && e.cfg.OnProtocolReject != nil {
+			p := Protocol(binary.BigEndian.Uint16(lcp.Data))
+			e.actions = append(e.actions, func() { e.cfg.OnProtocolReject(p) })
+		}
+		return
+	}
+	if lcp.Code < LinkCodeConfigRequest || lcp.Code > LinkCodeDiscardRequest {
+		// RFC 1661 5.6：不认识的 Code 回复 Code-Reject，带上收到的整个 LCP 报文
+		if e.phase != PhaseDead {
+			e.send(Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{
+				Code:       LinkCodeCodeReject,
+				Identifier: e.nextIdentifier(),
+				Data:       lcp.encode(),
+			}})
+		}
+		return
+	}
+	if e.phase == PhaseTerminate {
+		return
+	}
+	if e.phase == PhaseDead {
+		// 对端先发起协商时以对端的 Identifier 加一发送本端的请求
+		if e.request.MaxReceiveUint == 0 {
+			e.request.MaxReceiveUint = lcp.MaxReceiveUint
+		}
+		e.setPhase(PhaseEstablish)
+		e.identifier = lcp.Identifier
+		e.sendConfigRequest(e.nextIdentifier())
+	}
+	switch lcp.Code {
+	case LinkCodeConfigRequest:
+		if e.phase == PhaseAuthenticate || e.phase == PhaseNetwork {
+			e.restart()
+		}
+		e.lastReceived = lcp.encode()[ControlHeaderLen:]
+		if e.initialReceived == nil {
+			e.initialReceived = e.lastReceived
+		}
+		e.inputConfigRequest(lcp)
+	case LinkCodeConfigAck:
+		if lcp.Identifier == e.request.Identifier {
+			e.localOpen = true
+		}
+	case LinkCodeConfigNak, LinkCodeConfigReject:
+		if lcp.Identifier == e.request.Identifier && e.adjustRequest(lcp) {
+			e.sendConfigRequest(e.nextIdentifier())
+		}
+	}
+	e.checkOpened()
+}
+
+// inputConfigRequest 只接受 MRU、magic number、PAP/CHAP-MD5 认证和异步链路上的 ACCM，其余配置项一律拒绝
+func (e *Engine) inputConfigRequest(lcp *LinkCtrlProtocol) {
+	rejectACCM := lcp.HasACCM && !e.cfg.Async
+	if lcp.ProtocolFieldCompression || lcp.AddressCtrlFieldCompression || lcp.CallbackOperation != 0 || len(lcp.UnknownOptions) > 0 || rejectACCM {
+		e.send(Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{
+			Code:                        LinkCodeConfigReject,
+			Identifier:                  lcp.Identifier,
+			ACCM:                        lcp.ACCM,
+			HasACCM:                     rejectACCM,
+			ProtocolFieldCompression:    lcp.ProtocolFieldCompression,
+			AddressCtrlFieldCompression: lcp.AddressCtrlFieldCompression,
+			CallbackOperation:           lcp.CallbackOperation,
+			UnknownOptions:              lcp.UnknownOptions,
+		}})
+		return
+	}
+	if e.cfg.Role == RolePeer {
+		chapMD5 := lcp.AuthProtocol == AuthProtocolChap && lcp.AuthAlgorithm == ChapAlgorithmMD5
+		if lcp.AuthProtocol != 0 && lcp.AuthProtocol != AuthProtocolPassword && !chapMD5 {
+			e.send(Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{
+				Code:         LinkCodeConfigNak,
+				Identifier:   lcp.Identifier,
+				AuthProtocol: AuthProtocolPassword,
+			}})
+			return
+		}
+		e.authProtocol = lcp.AuthProtocol
+	}
+	e.peerMRU = lcp.MaxReceiveUint
+	e.peerACCM = DefaultACCM
+	if lcp.HasACCM {
+		e.peerACCM = lcp.ACCM
+	}
+	ack := *lcp
+	ack.Code = LinkCodeConfigAck
+	e.send(Frame{Protocol: ProtocolLCP, LinkProtocol: ack})
+	e.peerOpen = true
+}
+
+// adjustRequest 按对端的 Nak/Reject 修改本端的配置请求，有修改时返回 true。
+// 认证方的 CHAP 只在对端 Nak 或 Reject 了认证协议选项时退回 PAP
+func (e *Engine) adjustRequest(lcp *LinkCtrlProtocol) (changed bool) {
+	if e.cfg.Role == RoleAuthenticator && e.authProtocol == AuthProtocolChap && lcp.AuthProtocol != 0 {
+		e.authProtocol = AuthProtocolPassword
+		changed = true
+	}
+	if lcp.Code == LinkCodeConfigNak {
+		if lcp.MaxReceiveUint > 0 && lcp.MaxReceiveUint != e.request.MaxReceiveUint {
+			e.request.MaxReceiveUint = lcp.MaxReceiveUint
+			changed = true
+		}
+		if lcp.MagicNumber > 0 && e.request.MagicNumber > 0 {
+			e.request.MagicNumber++
+			changed = true
+		}
+		return
+	}
+	if lcp.MaxReceiveUint > 0 && e.request.MaxReceiveUint > 0 {
+		e.request.MaxReceiveUint = 0
+		changed = true
+	}
+	if lcp.MagicNumber > 0 && e.request.MagicNumber > 0 {
+		e.request.MagicNumber = 0
+		changed = true
+	}
+	return
+}
+
+// restart 链路打开后收到对端的配置请求，对端已经重新开始协商（RFC 1661 状态 Opened 的 RCR 事件）：
+// 回到协商阶段并发送本端的配置请求，双向确认后重新认证
+func (e *Engine) restart() {
+	e.localOpen = false
+	e.peerOpen = false
+	e.auth = authNone
+	e.authReq = AuthRequest{}
+	e.authReply = Frame{}
+	e.chapChallenge = nil
+	e.setPhase(PhaseEstablish)
+	e.sendConfigRequest(e.nextIdentifier())
+}
+
+// checkOpened LCP 双向确认后进入认证阶段
+func (e *Engine) checkOpened() {
+	if e.phase != PhaseEstablish || !e.localOpen || !e.peerOpen {
+		return
+	}
+	e.pending = nil
+	e.setPhase(PhaseAuthenticate)
+	if e.cfg.Role == RoleAuthenticator {
+		if e.authProtocol == AuthProtocolChap && e.chapChallenge == nil {
+			challenge := make([]byte, 16)
+			_, _ = rand.Read(challenge)
+			e.chapID = challenge[0]
+			e.chapChallenge = challenge
+			e.retransmit(Frame{Protocol: ProtocolCHAP, ChapProtocol: ChapProtocol{
+				Code:       ChapCodeChallenge,
+				Identifier: e.chapID,
+				Value:      challenge,
+				Name:       e.cfg.Name,
+			}})
+		}
+		return
+	}
+	switch e.authProtocol {
+	case AuthProtocolPassword:
+		e.retransmit(Frame{Protocol: ProtocolPAP, PwdAuthProtocol: PwdAuthProtocol{
+			Code:       PwdAuthCodeRequest,
+			Identifier: e.nextIdentifier(),
+			PeerID:     e.cfg.Username,
+			Password:   e.cfg.Password,
+		}})
+	case AuthProtocolChap:
+		// 等待对端发送 Challenge
+	default:
+		e.setPhase(PhaseNetwork)
+	}
+}
+
+func (e *Engine) inputPAP(pap *PwdAuthProtocol) {
+	if e.cfg.Role == RoleAuthenticator {
+		// 认证阶段之外的请求丢弃，只有认证通过后对端重传的请求仍然重发回复
+		if pap.Code == PwdAuthCodeRequest && (e.phase == PhaseAuthenticate || (e.phase == PhaseNetwork && e.auth == authDone)) {
+			e.authenticate(AuthRequest{
+				Protocol:   AuthProtocolPassword,
+				Identifier: pap.Identifier,
+				Username:   pap.PeerID,
+				Password:   pap.Password,
+			})
+		}
+		return
+	}
+	if e.phase != PhaseAuthenticate || e.authProtocol != AuthProtocolPassword {
+		return
+	}
+	switch pap.Code {
+	case PwdAuthCodeAck:
+		e.authResult(true, pap.Message)
+	case PwdAuthCodeNak:
+		e.authResult(false, pap.Message)
+	}
+}
+
+func (e *Engine) inputCHAP(chap *ChapProtocol) {
+	if e.cfg.Role == RoleAuthenticator {
+		// 没有发过 Challenge 或者回复的不是最近一次 Challenge
+		if chap.Code != ChapCodeResponse || e.chapChallenge == nil || chap.Identifier != e.chapID {
+			return
+		}
+		e.authenticate(AuthRequest{
+			Protocol:   AuthProtocolChap,
+			Identifier: chap.Identifier,
+			Username:   chap.Name,
+			Challenge:  e.chapChallenge,
+			Response:   append([]byte(nil), chap.Value...),
+		})
+		return
+	}
+	if e.phase != PhaseAuthenticate || e.authProtocol != AuthProtocolChap {
+		return
+	}
+	switch chap.Code {
+	case ChapCodeChallenge:
+		// 对端未收到 Response 时会重发 Challenge，因此这里不需要重传
+		e.send(Frame{Protocol: ProtocolCHAP, ChapProtocol: ChapProtocol{
+			Code:       ChapCodeResponse,
+			Identifier: chap.Identifier,
+			Value:      ChapMD5Response(chap.Identifier, e.cfg.Password, chap.Value),
+			Name:       e.cfg.Username,
+		}})
+	case ChapCodeSuccess:
+		e.authResult(true, chap.Message)
+	case ChapCodeFailure:
+		e.authResult(false, chap.Message)
+	}
+}
+
+// authenticate 认证方把请求交给 OnAuthenticate。决定之前对端重传的请求直接忽略，之后重发同样的回复
+func (e *Engine) authenticate(req AuthRequest) {
+	switch e.auth {
+	case authPending:
+		return
+	case authDone:
+		reply := e.authReply
+		reply.PwdAuthProtocol.Identifier = req.Identifier
+		reply.ChapProtocol.Identifier = req.Identifier
+		e.send(reply)
+		return
+	}
+	e.auth = authPending
+	e.authReq = req
+	e.pending = nil
+	if e.cfg.OnAuthenticate != nil {
+		e.actions = append(e.actions, func() { e.cfg.OnAuthenticate(req) })
+	}
+}
+
+// authResult 被认证方收到认证结果，通过后进入网络阶段
+func (e *Engine) authResult(accepted bool, message string) {
+	e.pending = nil
+	if e.cfg.OnAuthResult != nil {
+		e.actions = append(e.actions, func() { e.cfg.OnAuthResult(accepted, message) })
+	}
+	if accepted {
+		e.setPhase(PhaseNetwork)
+	}
+}
+
+func (e *Engine) sendConfigRequest(identifier byte) {
+	e.request.Identifier = identifier
+	e.request.AuthProtocol = 0
+	e.request.AuthAlgorithm = 0
+	if e.cfg.Role == RoleAuthenticator {
+		e.request.AuthProtocol = e.authProtocol
+		if e.authProtocol == AuthProtocolChap {
+			e.request.AuthAlgorithm = ChapAlgorithmMD5
+		}
+	}
+	e.localOpen = false
+	e.lastSent = e.request.encode()[ControlHeaderLen:]
+	e.retransmit(Frame{Protocol: ProtocolLCP, LinkProtocol: e.request})
+}
+
+func (e *Engine) nextIdentifier() byte {
+	e.identifier++
+	return e.identifier
+}
+
+// retransmit 发送请求并记录下来，收到应答前可以用 Retransmit 重发
+func (e *Engine) retransmit(f Frame) {
+	e.pending = &f
+	e.send(f)
+}
+
+func (e *Engine) send(f Frame) {
+	e.actions = append(e.actions, func() { e.cfg.Send(&f) })
+}
+
+func (e *Engine) setPhase(p Phase) {
+	if e.phase == p {
+		return
+	}
+	e.phase = p
+	if e.cfg.OnPhase != nil {
+		e.actions = append(e.actions, func() { e.cfg.OnPhase(p) })
+	}
+}
+
+// unlock 释放锁后执行持有锁期间产生的发送和回调
+func (e *Engine) unlock() {
+	actions := e.actions
+	e.actions = nil
+	e.mu.Unlock()
+	for _, action := range actions {
+		action()
+	}
+}
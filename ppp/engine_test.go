@@ -0,0 +1,381 @@
+package ppp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// engineRecorder 记录 Engine 发出的帧和回调
+type engineRecorder struct {
+	sent     []Frame
+	phases   []Phase
+	requests []AuthRequest
+}
+
+func (r *engineRecorder) config(cfg Config) Config {
+	cfg.Send = func(f *Frame) {
+		decoded, _ := DecodeFrame(f.Encode())
+		r.sent = append(r.sent, decoded)
+	}
+	cfg.OnPhase = func(p Phase) {
+		r.phases = append(r.phases, p)
+	}
+	cfg.OnAuthenticate = func(req AuthRequest) {
+		r.requests = append(r.requests, req)
+	}
+	return cfg
+}
+
+func (r *engineRecorder) last() Frame {
+	return r.sent[len(r.sent)-1]
+}
+
+// enginePair 认证方和被认证方相连，帧经过编码和解码后按发送顺序交给对端
+type enginePair struct {
+	a, p  *Engine
+	queue []func()
+}
+
+func connectEngines(auth Config, peer Config) *enginePair {
+	pair := &enginePair{}
+	deliver := func(to **Engine) func(f *Frame) {
+		return func(f *Frame) {
+			decoded, err := DecodeFrame(f.Encode())
+			if err == nil {
+				pair.queue = append(pair.queue, func() { (*to).Input(&decoded) })
+			}
+		}
+	}
+	auth.Role = RoleAuthenticator
+	auth.Send = deliver(&pair.p)
+	peer.Role = RolePeer
+	peer.Send = deliver(&pair.a)
+	pair.a = NewEngine(auth)
+	pair.p = NewEngine(peer)
+	return pair
+}
+
+// run 投递所有在途的帧
+func (pair *enginePair) run() {
+	for len(pair.queue) > 0 {
+		next := pair.queue[0]
+		pair.queue = pair.queue[1:]
+		next()
+	}
+}
+
+func TestEngine_PAP(t *testing.T) {
+	var results []string
+	var pair *enginePair
+	pair = connectEngines(Config{
+		MRU:          1492,
+		MagicNumber:  0x01020304,
+		AuthProtocol: AuthProtocolPassword,
+		OnAuthenticate: func(req AuthRequest) {
+			assert.Equal(t, AuthProtocolPassword, req.Protocol)
+			assert.Equal(t, "user", req.Username)
+			pair.a.AuthDone(req.Password == "secret", "welcome")
+		},
+	}, Config{
+		MRU:         1480,
+		MagicNumber: 0x05060708,
+		Username:    "user",
+		Password:    "secret",
+		OnAuthResult: func(accepted bool, message string) {
+			assert.True(t, accepted)
+			results = append(results, message)
+		},
+	})
+	pair.p.Open()
+	pair.run()
+	assert.Equal(t, PhaseNetwork, pair.a.Phase())
+	assert.Equal(t, PhaseNetwork, pair.p.Phase())
+	assert.Equal(t, []string{"welcome"}, results)
+	assert.Equal(t, uint16(1480), pair.a.PeerMRU())
+	assert.Equal(t, uint16(1492), pair.p.PeerMRU())
+	assert.Equal(t, AuthProtocolPassword, pair.p.AuthProtocol())
+}
+
+func TestEngine_CHAP(t *testing.T) {
+	var pair *enginePair
+	var accepted bool
+	pair = connectEngines(Config{
+		AuthProtocol: AuthProtocolChap,
+		Name:         "bras",
+		OnAuthenticate: func(req AuthRequest) {
+			assert.Equal(t, AuthProtocolChap, req.Protocol)
+			pair.a.AuthDone(bytes.Equal(req.Response, ChapMD5Response(req.Identifier, "secret", req.Challenge)), "")
+		},
+	}, Config{
+		Username: "user",
+		Password: "secret",
+		OnAuthResult: func(ok bool, message string) {
+			accepted = ok
+		},
+	})
+	// 认证方先发起
+	pair.a.Open()
+	pair.run()
+	assert.True(t, accepted)
+	assert.Equal(t, PhaseNetwork, pair.a.Phase())
+	assert.Equal(t, AuthProtocolChap, pair.p.AuthProtocol())
+}
+
+func TestEngine_CHAPFailure(t *testing.T) {
+	var pair *enginePair
+	var results []bool
+	pair = connectEngines(Config{
+		AuthProtocol: AuthProtocolChap,
+		OnAuthenticate: func(req AuthRequest) {
+			pair.a.AuthDone(false, "bad password")
+		},
+	}, Config{
+		Username: "user",
+		Password: "wrong",
+		OnAuthResult: func(ok bool, message string) {
+			results = append(results, ok)
+			assert.Equal(t, "bad password", message)
+		},
+	})
+	pair.p.Open()
+	pair.run()
+	assert.Equal(t, []bool{false}, results)
+	assert.Equal(t, PhaseAuthenticate, pair.a.Phase())
+	assert.Equal(t, PhaseAuthenticate, pair.p.Phase())
+}
+
+func TestEngine_PassiveOpen(t *testing.T) {
+	r := &engineRecorder{}
+	e := NewEngine(r.config(Config{Role: RoleAuthenticator, AuthProtocol: AuthProtocolChap, MagicNumber: 0x01020304}))
+	request := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 5, MaxReceiveUint: 1480}}
+	assert.True(t, e.Input(&request))
+	assert.Equal(t, []Phase{PhaseEstablish}, r.phases)
+	// 先发送本端的请求，MRU 使用对端的值，再确认对端的请求
+	assert.Len(t, r.sent, 2)
+	assert.Equal(t, LinkCodeConfigRequest, r.sent[0].LinkProtocol.Code)
+	assert.Equal(t, byte(6), r.sent[0].LinkProtocol.Identifier)
+	assert.Equal(t, uint16(1480), r.sent[0].LinkProtocol.MaxReceiveUint)
+	assert.Equal(t, AuthProtocolChap, r.sent[0].LinkProtocol.AuthProtocol)
+	assert.Equal(t, ChapAlgorithmMD5, r.sent[0].LinkProtocol.AuthAlgorithm)
+	assert.Equal(t, LinkCodeConfigAck, r.sent[1].LinkProtocol.Code)
+
+	// 只 Nak 了 MRU 时保留 CHAP
+	nak := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigNak, Identifier: 6, MaxReceiveUint: 1400}}
+	e.Input(&nak)
+	assert.Equal(t, byte(7), r.last().LinkProtocol.Identifier)
+	assert.Equal(t, uint16(1400), r.last().LinkProtocol.MaxReceiveUint)
+	assert.Equal(t, AuthProtocolChap, r.last().LinkProtocol.AuthProtocol)
+	assert.Equal(t, AuthProtocolChap, e.AuthProtocol())
+
+	// 对端拒绝 CHAP 时退回 PAP
+	nak = Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigNak, Identifier: 7, AuthProtocol: AuthProtocolPassword}}
+	e.Input(&nak)
+	assert.Equal(t, LinkCodeConfigRequest, r.last().LinkProtocol.Code)
+	assert.Equal(t, byte(8), r.last().LinkProtocol.Identifier)
+	assert.Equal(t, AuthProtocolPassword, r.last().LinkProtocol.AuthProtocol)
+	assert.Equal(t, AuthProtocolPassword, e.AuthProtocol())
+
+	e.Retransmit()
+	assert.Equal(t, byte(8), r.last().LinkProtocol.Identifier)
+
+	// 认证阶段之前的认证请求丢弃
+	pap := Frame{Protocol: ProtocolPAP, PwdAuthProtocol: PwdAuthProtocol{Code: PwdAuthCodeRequest, Identifier: 1, PeerID: "user", Password: "secret"}}
+	e.Input(&pap)
+	assert.Empty(t, r.requests)
+
+	ack := Frame{Protocol: ProtocolLCP, LinkProtocol: r.last().LinkProtocol}
+	ack.LinkProtocol.Code = LinkCodeConfigAck
+	e.Input(&ack)
+	assert.Equal(t, PhaseAuthenticate, e.Phase())
+
+	// 认证请求在决定之前的重传被忽略，决定之后重发同样的回复
+	e.Input(&pap)
+	e.Input(&pap)
+	assert.Len(t, r.requests, 1)
+	assert.Equal(t, "secret", r.requests[0].Password)
+	sent := len(r.sent)
+	e.AuthDone(true, "welcome")
+	assert.Equal(t, PhaseNetwork, e.Phase())
+	assert.Equal(t, PwdAuthCodeAck, r.last().PwdAuthProtocol.Code)
+	pap.PwdAuthProtocol.Identifier = 2
+	e.Input(&pap)
+	assert.Len(t, r.sent, sent+2)
+	assert.Equal(t, byte(2), r.last().PwdAuthProtocol.Identifier)
+	assert.Equal(t, "welcome", r.last().PwdAuthProtocol.Message)
+	assert.Len(t, r.requests, 1)
+}
+
+func TestEngine_RejectOptions(t *testing.T) {
+	r := &engineRecorder{}
+	e := NewEngine(r.config(Config{Role: RolePeer}))
+	e.Open()
+	request := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 1,
+		ProtocolFieldCompression: true, UnknownOptions: []byte{0x11, 0x04, 0x05, 0xd4}}}
+	e.Input(&request)
+	reject := r.last().LinkProtocol
+	assert.Equal(t, LinkCodeConfigReject, reject.Code)
+	assert.True(t, reject.ProtocolFieldCompression)
+	assert.Equal(t, []byte{0x11, 0x04, 0x05, 0xd4}, reject.UnknownOptions)
+
+	// 被认证方只接受 PAP 和 CHAP-MD5
+	request.LinkProtocol = LinkCtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 2, AuthProtocol: AuthProtocolChap, AuthAlgorithm: 0x80}
+	e.Input(&request)
+	assert.Equal(t, LinkCodeConfigNak, r.last().LinkProtocol.Code)
+	assert.Equal(t, AuthProtocolPassword, r.last().LinkProtocol.AuthProtocol)
+
+	// 没有要求认证时 LCP 打开后直接进入网络阶段
+	request.LinkProtocol = LinkCtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 3}
+	e.Input(&request)
+	ack := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigAck, Identifier: 1}}
+	e.Input(&ack)
+	assert.Equal(t, []Phase{PhaseEstablish, PhaseAuthenticate, PhaseNetwork}, r.phases)
+
+	// LCP 打开后对不支持的协议回复 Protocol Reject
+	e.RejectProtocol([]byte{0x80, 0xfd, 0x01, 0x01, 0x00, 0x04})
+	assert.Equal(t, LinkCodeProtocolReject, r.last().LinkProtocol.Code)
+	assert.Equal(t, []byte{0x80, 0xfd, 0x01, 0x01, 0x00, 0x04}, r.last().LinkProtocol.Data)
+}
+
+func TestEngine_ACCM(t *testing.T) {
+	// PPPoE 等同步链路上拒绝 ACCM
+	r := &engineRecorder{}
+	e := NewEngine(r.config(Config{Role: RoleAuthenticator}))
+	request := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 1, HasACCM: true, MagicNumber: 0x01020304}}
+	e.Input(&request)
+	reject := r.last().LinkProtocol
+	assert.Equal(t, LinkCodeConfigReject, reject.Code)
+	assert.True(t, reject.HasACCM)
+	assert.Equal(t, uint32(0), reject.MagicNumber)
+
+	// 异步链路上接受对端的 ACCM，之后按其转义
+	r = &engineRecorder{}
+	e = NewEngine(r.config(Config{Role: RoleAuthenticator, Async: true}))
+	assert.Equal(t, DefaultACCM, e.PeerACCM())
+	e.Input(&request)
+	ack := r.last().LinkProtocol
+	assert.Equal(t, LinkCodeConfigAck, ack.Code)
+	assert.True(t, ack.HasACCM)
+	assert.Equal(t, uint32(0), e.PeerACCM())
+}
+
+func TestEngine_EchoAndTerminate(t *testing.T) {
+	r := &engineRecorder{}
+	e := NewEngine(r.config(Config{Role: RolePeer, MagicNumber: 0x01020304}))
+	e.Open()
+	// LCP 打开之前不应答 Echo Request
+	echo := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeEchoRequest, Identifier: 9, MagicNumber: 0x0a0b0c0d, Data: []byte{0x01}}}
+	e.Input(&echo)
+	assert.Len(t, r.sent, 1)
+	e.Input(&Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 1, MagicNumber: 0x0a0b0c0d}})
+	e.Input(&Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigAck, Identifier: r.sent[0].LinkProtocol.Identifier}})
+	assert.Equal(t, PhaseNetwork, e.Phase())
+
+	e.Input(&echo)
+	reply := r.last().LinkProtocol
+	assert.Equal(t, LinkCodeEchoReply, reply.Code)
+	assert.Equal(t, byte(9), reply.Identifier)
+	assert.Equal(t, uint32(0x01020304), reply.MagicNumber)
+	assert.Equal(t, []byte{0x01}, reply.Data)
+
+	var rejected []Protocol
+	e.cfg.OnProtocolReject = func(p Protocol) {
+		rejected = append(rejected, p)
+	}
+	protocolReject := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeProtocolReject, Identifier: 1, Data: []byte{0x80, 0x21, 0x01}}}
+	e.Input(&protocolReject)
+	assert.Equal(t, []Protocol{ProtocolIPCP}, rejected)
+
+	terminate := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeTerminateRequest, Identifier: 4}}
+	e.Input(&terminate)
+	assert.Equal(t, LinkCodeTerminateAck, r.last().LinkProtocol.Code)
+	assert.Equal(t, byte(4), r.last().LinkProtocol.Identifier)
+	assert.Equal(t, PhaseDead, e.Phase())
+
+	// 本端发起的结束在收到 Terminate Ack 后完成
+	e.Open()
+	e.Close()
+	assert.Equal(t, PhaseTerminate, e.Phase())
+	assert.Equal(t, LinkCodeTerminateRequest, r.last().LinkProtocol.Code)
+	e.Input(&Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeTerminateAck, Identifier: r.last().LinkProtocol.Identifier}})
+	assert.Equal(t, PhaseDead, e.Phase())
+
+	assert.False(t, e.Input(&Frame{Protocol: ProtocolIPCP}))
+}
+
+func TestEngine_ConfigRequests(t *testing.T) {
+	pair := connectEngines(Config{
+		MRU:          1492,
+		MagicNumber:  0x01020304,
+		AuthProtocol: AuthProtocolPassword,
+	}, Config{
+		MRU:         1480,
+		MagicNumber: 0x05060708,
+	})
+	initial, sent, received := pair.a.ConfigRequests()
+	assert.Nil(t, initial)
+	assert.Nil(t, sent)
+	assert.Nil(t, received)
+
+	pair.p.Open()
+	pair.run()
+	initial, sent, received = pair.a.ConfigRequests()
+	peerRequest := []byte{0x01, 0x04, 0x05, 0xc8, 0x05, 0x06, 0x05, 0x06, 0x07, 0x08}
+	assert.Equal(t, peerRequest, initial)
+	assert.Equal(t, peerRequest, received)
+	assert.Equal(t, []byte{0x01, 0x04, 0x05, 0xd4, 0x05, 0x06, 0x01, 0x02, 0x03, 0x04, 0x03, 0x04, 0xc0, 0x23}, sent)
+}
+
+func TestEngine_Renegotiate(t *testing.T) {
+	var pair *enginePair
+	var requests, results int
+	var phases []Phase
+	pair = connectEngines(Config{
+		AuthProtocol: AuthProtocolChap,
+		OnPhase: func(p Phase) {
+			phases = append(phases, p)
+		},
+		OnAuthenticate: func(req AuthRequest) {
+			requests++
+			pair.a.AuthDone(true, "")
+		},
+	}, Config{
+		Username: "user",
+		Password: "secret",
+		OnAuthResult: func(ok bool, message string) {
+			results++
+		},
+	})
+	pair.p.Open()
+	pair.run()
+	assert.Equal(t, PhaseNetwork, pair.a.Phase())
+	assert.Equal(t, 1, requests)
+
+	// 网络阶段对端重新发起 LCP 协商，双方回到协商阶段并重新认证
+	pair.p.mu.Lock()
+	pair.p.restart()
+	pair.p.unlock()
+	pair.run()
+	assert.Equal(t, []Phase{PhaseEstablish, PhaseAuthenticate, PhaseNetwork, PhaseEstablish, PhaseAuthenticate, PhaseNetwork}, phases)
+	assert.Equal(t, PhaseNetwork, pair.p.Phase())
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 2, results)
+}
+
+func TestEngine_CodeReject(t *testing.T) {
+	r := &engineRecorder{}
+	e := NewEngine(r.config(Config{Role: RoleAuthenticator}))
+	unknown := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: 0x0c, Identifier: 3, Data: []byte{0x01, 0x02}}}
+	// 链路未开始时不回复
+	e.Input(&unknown)
+	assert.Empty(t, r.sent)
+
+	e.Open()
+	sent := len(r.sent)
+	e.Input(&unknown)
+	assert.Len(t, r.sent, sent+1)
+	reject := r.last().LinkProtocol
+	assert.Equal(t, LinkCodeCodeReject, reject.Code)
+	assert.Equal(t, []byte{0x0c, 0x03, 0x00, 0x06, 0x01, 0x02}, reject.Data)
+	assert.Equal(t, PhaseEstablish, e.Phase())
+}
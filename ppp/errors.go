@@ -0,0 +1,80 @@
+package ppp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DecodeError.Layer 的取值
+const (
+	LayerPPP    = "ppp"
+	LayerLCP    = "lcp"
+	LayerPAP    = "pap"
+	LayerCHAP   = "chap"
+	LayerIPCP   = "ipcp"
+	LayerIPv6CP = "ipv6cp"
+	LayerHDLC   = "hdlc"
+)
+
+// 解码错误的类别，DecodeError 可以用 errors.Is 与之比较
+var (
+	// ErrTruncated 数据比需要的短，例如帧被截断或长度字段大于实际数据
+	ErrTruncated = errors.New("truncated")
+	// ErrBadLength 长度字段本身不合法，例如小于头部长度或配置项长度与类型不符
+	ErrBadLength = errors.New("invalid length")
+)
+
+// DecodeError 解码失败的位置和原因，可以用 errors.As 取出。
+// Offset 相对于传给解码函数的数据起点，例如 DecodeFrame 返回的 LCP 错误以 PPP 协议字段为起点，
+// 承载 PPP 的 PPPoE 等封装也使用此类型，并把偏移换算到各自的报文头。
+// Expected、Actual 对长度错误为期望和实际的字节数，对其他错误为期望和实际的值，期望值不唯一时 Expected 为 -1。
+type DecodeError struct {
+	Layer    string
+	Field    string
+	Offset   int
+	Expected int
+	Actual   int
+	// Err ErrTruncated、ErrBadLength 或封装层定义的错误类别
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	s := fmt.Sprintf("decode %s %s at offset %d: %s", e.Layer, e.Field, e.Offset, e.Err)
+	switch {
+	case e.Err == ErrTruncated || e.Err == ErrBadLength:
+		if e.Expected >= 0 {
+			s += fmt.Sprintf(" (expected %d bytes, got %d)", e.Expected, e.Actual)
+		} else {
+			s += fmt.Sprintf(" (got %d bytes)", e.Actual)
+		}
+	case e.Expected >= 0:
+		s += fmt.Sprintf(" (expected %#x, got %#x)", e.Expected, e.Actual)
+	default:
+		s += fmt.Sprintf(" (got %#x)", e.Actual)
+	}
+	return s
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func truncated(layer string, field string, offset int, expected int, actual int) error {
+	return &DecodeError{Layer: layer, Field: field, Offset: offset, Expected: expected, Actual: actual, Err: ErrTruncated}
+}
+
+func badLength(layer string, field string, offset int, expected int, actual int) error {
+	return &DecodeError{Layer: layer, Field: field, Offset: offset, Expected: expected, Actual: actual, Err: ErrBadLength}
+}
+
+// ShiftOffset 内层协议的错误加上内层数据在外层中的偏移
+func ShiftOffset(err error, n int) error {
+	if err == nil {
+		return nil
+	}
+	var de *DecodeError
+	if errors.As(err, &de) {
+		de.Offset += n
+	}
+	return err
+}
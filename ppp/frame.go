@@ -0,0 +1,137 @@
+package ppp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Protocol PPP 协议字段，RFC 1661
+type Protocol uint16
+
+const (
+	ProtocolLCP    Protocol = 0xc021
+	ProtocolPAP    Protocol = 0xc023
+	ProtocolCHAP   Protocol = 0xc223
+	ProtocolIPCP   Protocol = 0x8021
+	ProtocolIPv6CP Protocol = 0x8057
+	ProtocolIPv4   Protocol = 0x0021
+	ProtocolIPv6   Protocol = 0x0057
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolLCP:
+		return "LCP"
+	case ProtocolPAP:
+		return "PAP"
+	case ProtocolCHAP:
+		return "CHAP"
+	case ProtocolIPCP:
+		return "IPCP"
+	case ProtocolIPv6CP:
+		return "IPv6CP"
+	case ProtocolIPv4:
+		return "IPv4"
+	case ProtocolIPv6:
+		return "IPv6"
+	}
+	return fmt.Sprintf("%#04x", uint16(p))
+}
+
+// ProtocolLen PPP 协议字段的长度，不使用协议字段压缩
+const ProtocolLen = 2
+
+// ControlHeaderLen LCP 等控制协议报文头的长度：Code、Identifier 和 Length
+const ControlHeaderLen = 4
+
+// OptionHeaderLen 配置项头的长度：Type 和 Length
+const OptionHeaderLen = 2
+
+// Frame 一个 PPP 帧，不含 HDLC 地址和控制字段，由 PPPoE、L2TP 或串口等链路承载。
+// 按 Protocol 使用对应的字段，其他协议的报文放在 Data 中
+type Frame struct {
+	Protocol         Protocol
+	LinkProtocol     LinkCtrlProtocol
+	PwdAuthProtocol  PwdAuthProtocol
+	ChapProtocol     ChapProtocol
+	IPCtrlProtocol   IPCtrlProtocol
+	IPv6CtrlProtocol IPv6CtrlProtocol
+	// Data IPv4/IPv6 等非控制协议的报文，不含协议字段
+	Data []byte
+}
+
+func (f *Frame) Encode() []byte {
+	return f.AppendEncode(nil)
+}
+
+// AppendEncode 将协议字段和报文追加到 dst 后返回，dst 容量足够时不分配内存
+func (f *Frame) AppendEncode(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(f.Protocol))
+	switch f.Protocol {
+	case ProtocolLCP:
+		dst = f.LinkProtocol.appendEncode(dst)
+	case ProtocolPAP:
+		dst = f.PwdAuthProtocol.appendEncode(dst)
+	case ProtocolCHAP:
+		dst = f.ChapProtocol.appendEncode(dst)
+	case ProtocolIPCP:
+		dst = f.IPCtrlProtocol.appendEncode(dst)
+	case ProtocolIPv6CP:
+		dst = f.IPv6CtrlProtocol.appendEncode(dst)
+	default:
+		dst = append(dst, f.Data...)
+	}
+	return dst
+}
+
+func DecodeFrame(b []byte) (f Frame, err error) {
+	err = DecodeFrameInto(&f, b)
+	return
+}
+
+// DecodeFrameInto 解码到 f，用于循环解码时避免分配内存。
+// f 中原有的切片和字符串会被复用或覆盖，调用方不能再持有上一次解码的结果；解码结果中的切片可能引用 b
+func DecodeFrameInto(f *Frame, b []byte) (err error) {
+	old := *f
+	*f = Frame{}
+	if len(b) < ProtocolLen {
+		err = truncated(LayerPPP, "protocol", 0, ProtocolLen, len(b))
+		return
+	}
+	f.Protocol = Protocol(binary.BigEndian.Uint16(b))
+	payload := b[ProtocolLen:]
+	switch f.Protocol {
+	case ProtocolLCP:
+		f.LinkProtocol = old.LinkProtocol
+		err = f.LinkProtocol.decode(payload)
+	case ProtocolPAP:
+		f.PwdAuthProtocol = old.PwdAuthProtocol
+		err = f.PwdAuthProtocol.decode(payload)
+	case ProtocolCHAP:
+		f.ChapProtocol = old.ChapProtocol
+		err = f.ChapProtocol.decode(payload)
+	case ProtocolIPCP:
+		f.IPCtrlProtocol = old.IPCtrlProtocol
+		err = f.IPCtrlProtocol.decode(payload)
+	case ProtocolIPv6CP:
+		f.IPv6CtrlProtocol = old.IPv6CtrlProtocol
+		err = f.IPv6CtrlProtocol.decode(payload)
+	default:
+		f.Data = payload
+	}
+	err = ShiftOffset(err, ProtocolLen)
+	return
+}
+
+// putLength 写入控制协议报文头中的长度，start 为报文在 dst 中的起点
+func putLength(dst []byte, start int) {
+	binary.BigEndian.PutUint16(dst[start+2:], uint16(len(dst)-start))
+}
+
+// reuseString b 与 s 内容相同时返回 s，循环解码时避免重复分配
+func reuseString(s string, b []byte) string {
+	if s == string(b) {
+		return s
+	}
+	return string(b)
+}
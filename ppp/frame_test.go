@@ -0,0 +1,286 @@
+package ppp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestDecodeFrame(t *testing.T) {
+	// configuration request，末尾为以太网最小帧补齐的填充
+	data := []byte{0xc0, 0x21, 0x01, 0x00, 0x00, 0x15, 0x01, 0x04, 0x05, 0xc8, 0x05, 0x06, 0x07, 0x97, 0x52, 0x1d, 0x07, 0x02, 0x08, 0x02, 0x0d, 0x03, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	f, err := DecodeFrame(data)
+	assert.Nil(t, err)
+	assert.Equal(t, ProtocolLCP, f.Protocol)
+	assert.Equal(t, LinkCodeConfigRequest, f.LinkProtocol.Code)
+	assert.Equal(t, byte(0), f.LinkProtocol.Identifier)
+	assert.Equal(t, uint16(1480), f.LinkProtocol.MaxReceiveUint)
+	assert.Equal(t, uint32(127357469), f.LinkProtocol.MagicNumber)
+	assert.True(t, f.LinkProtocol.ProtocolFieldCompression)
+	assert.True(t, f.LinkProtocol.AddressCtrlFieldCompression)
+	assert.Equal(t, CallbackOperationCBCP, f.LinkProtocol.CallbackOperation)
+
+	// authenticate request
+	data = []byte{0xc0, 0x23, 0x01, 0x00, 0x00, 0x0f, 0x06, 0x31, 0x32, 0x33, 0x31, 0x32, 0x33, 0x03, 0x31, 0x32, 0x33, 0x00, 0x00, 0x00}
+	f, err = DecodeFrame(data)
+	assert.Nil(t, err)
+	assert.Equal(t, ProtocolPAP, f.Protocol)
+	assert.Equal(t, byte(1), f.PwdAuthProtocol.Code)
+	assert.Equal(t, byte(0), f.PwdAuthProtocol.Identifier)
+	assert.Equal(t, "123123", f.PwdAuthProtocol.PeerID)
+	assert.Equal(t, "123", f.PwdAuthProtocol.Password)
+}
+
+func TestFrame_EncodeChap(t *testing.T) {
+	f := Frame{
+		Protocol: ProtocolCHAP,
+		ChapProtocol: ChapProtocol{
+			Code:       ChapCodeResponse,
+			Identifier: 7,
+			Value:      ChapMD5Response(7, "123", []byte{0x01, 0x02, 0x03, 0x04}),
+			Name:       "123123",
+		},
+	}
+	decoded, err := DecodeFrame(f.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, ProtocolCHAP, decoded.Protocol)
+	assert.Equal(t, f.ChapProtocol, decoded.ChapProtocol)
+	assert.Len(t, decoded.ChapProtocol.Value, 16)
+}
+
+func TestFrame_EncodeIPCtrl(t *testing.T) {
+	f := Frame{
+		Protocol: ProtocolIPCP,
+		IPCtrlProtocol: IPCtrlProtocol{
+			Code:         LinkCodeConfigNak,
+			Identifier:   1,
+			IPAddress:    net.IPv4(10, 0, 0, 2).To4(),
+			PrimaryDNS:   net.IPv4(114, 114, 114, 114).To4(),
+			SecondaryDNS: net.IPv4(8, 8, 8, 8).To4(),
+		},
+	}
+	bs := f.Encode()
+	assert.Equal(t, []byte{0x80, 0x21, 0x03, 0x01, 0x00, 0x16, 0x03, 0x06, 0x0a, 0x00, 0x00, 0x02}, bs[:12])
+	decoded, err := DecodeFrame(bs)
+	assert.Nil(t, err)
+	assert.Equal(t, f.IPCtrlProtocol, decoded.IPCtrlProtocol)
+}
+
+func TestFrame_EncodeIPv6Ctrl(t *testing.T) {
+	f := Frame{
+		Protocol: ProtocolIPv6CP,
+		IPv6CtrlProtocol: IPv6CtrlProtocol{
+			Code:        LinkCodeConfigRequest,
+			Identifier:  1,
+			InterfaceID: []byte{0x02, 0x11, 0x22, 0xff, 0xfe, 0x33, 0x44, 0x55},
+		},
+	}
+	bs := f.Encode()
+	assert.Equal(t, []byte{0x80, 0x57, 0x01, 0x01, 0x00, 0x0e, 0x01, 0x0a, 0x02, 0x11}, bs[:10])
+	decoded, err := DecodeFrame(bs)
+	assert.Nil(t, err)
+	assert.Equal(t, f.IPv6CtrlProtocol, decoded.IPv6CtrlProtocol)
+}
+
+func TestFrame_EncodeIPv4Data(t *testing.T) {
+	packet := []byte{0x45, 0x00, 0x00, 0x14, 0x00, 0x00, 0x40, 0x00, 0x40, 0x01, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x02, 0x0a, 0x00, 0x00, 0x01}
+	f := Frame{Protocol: ProtocolIPv4, Data: packet}
+	bs := f.Encode()
+	assert.Equal(t, []byte{0x00, 0x21, 0x45}, bs[:3])
+	decoded, err := DecodeFrame(bs)
+	assert.Nil(t, err)
+	assert.Equal(t, ProtocolIPv4, decoded.Protocol)
+	assert.Equal(t, packet, decoded.Data)
+
+	// 未知协议也放在 Data 中，用于回复 Protocol Reject
+	decoded, err = DecodeFrame([]byte{0x80, 0xfd, 0x01})
+	assert.Nil(t, err)
+	assert.Equal(t, "0x80fd", decoded.Protocol.String())
+	assert.Equal(t, []byte{0x01}, decoded.Data)
+}
+
+func TestFrame_EncodeLinkCtrlEcho(t *testing.T) {
+	f := Frame{
+		Protocol: ProtocolLCP,
+		LinkProtocol: LinkCtrlProtocol{
+			Code:        LinkCodeEchoReply,
+			Identifier:  3,
+			MagicNumber: 0x0797521d,
+		},
+	}
+	bs := f.Encode()
+	assert.Equal(t, []byte{0xc0, 0x21, 0x0a, 0x03, 0x00, 0x08, 0x07, 0x97, 0x52, 0x1d}, bs)
+	decoded, err := DecodeFrame(bs)
+	assert.Nil(t, err)
+	assert.Equal(t, LinkCodeEchoReply, decoded.LinkProtocol.Code)
+	assert.Equal(t, uint32(0x0797521d), decoded.LinkProtocol.MagicNumber)
+}
+
+func TestFrame_EncodeLinkCtrlChapOption(t *testing.T) {
+	f := Frame{
+		Protocol: ProtocolLCP,
+		LinkProtocol: LinkCtrlProtocol{
+			Code:           LinkCodeConfigRequest,
+			Identifier:     1,
+			MaxReceiveUint: 1492,
+			MagicNumber:    0x01020304,
+			AuthProtocol:   AuthProtocolChap,
+			AuthAlgorithm:  ChapAlgorithmMD5,
+			UnknownOptions: []byte{0x11, 0x04, 0x05, 0xd4},
+		},
+	}
+	decoded, err := DecodeFrame(f.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, AuthProtocolChap, decoded.LinkProtocol.AuthProtocol)
+	assert.Equal(t, ChapAlgorithmMD5, decoded.LinkProtocol.AuthAlgorithm)
+	assert.Equal(t, uint16(1492), decoded.LinkProtocol.MaxReceiveUint)
+	assert.Equal(t, []byte{0x11, 0x04, 0x05, 0xd4}, decoded.LinkProtocol.UnknownOptions)
+}
+
+func TestFrame_EncodePwdAuth(t *testing.T) {
+	f := Frame{
+		Protocol:        ProtocolPAP,
+		PwdAuthProtocol: PwdAuthProtocol{Code: PwdAuthCodeRequest, Identifier: 1, PeerID: "123123", Password: "123"},
+	}
+	bs := f.Encode()
+	assert.Equal(t, []byte{0xc0, 0x23, 0x01, 0x01, 0x00, 0x0f, 0x06, 0x31, 0x32, 0x33, 0x31, 0x32, 0x33, 0x03, 0x31, 0x32, 0x33}, bs)
+
+	f.PwdAuthProtocol = PwdAuthProtocol{Code: PwdAuthCodeNak, Identifier: 1, Message: "bad password"}
+	decoded, err := DecodeFrame(f.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, f.PwdAuthProtocol, decoded.PwdAuthProtocol)
+}
+
+func TestFrame_FormatRedactsCredentials(t *testing.T) {
+	f := Frame{
+		Protocol:        ProtocolPAP,
+		PwdAuthProtocol: PwdAuthProtocol{Code: PwdAuthCodeRequest, Identifier: 1, PeerID: "user01", Password: "s3cr3t-pw"},
+		ChapProtocol:    ChapProtocol{Code: ChapCodeResponse, Identifier: 2, Value: []byte("s3cr3t-md5"), Name: "user01"},
+	}
+	for _, s := range []string{fmt.Sprint(f), fmt.Sprintf("%+v", f), fmt.Sprintf("%#v", f), f.PwdAuthProtocol.String(), f.ChapProtocol.String()} {
+		assert.NotContains(t, s, "s3cr3t")
+		assert.Contains(t, s, "user01")
+	}
+	bs, err := json.Marshal(f)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(bs), "s3cr3t")
+	assert.Contains(t, string(bs), RedactedMask)
+
+	// 脱敏不影响编码
+	decoded, err := DecodeFrame(f.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, "s3cr3t-pw", decoded.PwdAuthProtocol.Password)
+}
+
+func TestDecodeFrame_Errors(t *testing.T) {
+	var de *DecodeError
+	_, err := DecodeFrame([]byte{0xc0})
+	assert.ErrorIs(t, err, ErrTruncated)
+	assert.ErrorAs(t, err, &de)
+	assert.Equal(t, LayerPPP, de.Layer)
+
+	// LCP Configure-Request 中 MRU 配置项长度为 3
+	_, err = DecodeFrame([]byte{0xc0, 0x21, 0x01, 0x01, 0x00, 0x07, 0x01, 0x03, 0x05})
+	assert.ErrorIs(t, err, ErrBadLength)
+	assert.ErrorAs(t, err, &de)
+	assert.Equal(t, LayerLCP, de.Layer)
+	assert.Equal(t, "option max receive unit", de.Field)
+	assert.Equal(t, ProtocolLen+ControlHeaderLen, de.Offset)
+	assert.Equal(t, 4, de.Expected)
+	assert.Equal(t, 3, de.Actual)
+	assert.Equal(t, "decode lcp option max receive unit at offset 6: invalid length (expected 4 bytes, got 3)", err.Error())
+
+	// PAP 长度字段大于实际数据
+	_, err = DecodePwdAuthProtocol([]byte{0x01, 0x01, 0x00, 0x20, 0x01})
+	assert.ErrorIs(t, err, ErrTruncated)
+	assert.ErrorAs(t, err, &de)
+	assert.Equal(t, LayerPAP, de.Layer)
+	assert.Equal(t, 0, de.Offset)
+	// 长度字段小于协议头
+	_, err = DecodePwdAuthProtocol([]byte{0x01, 0x01, 0x00, 0x00})
+	assert.ErrorIs(t, err, ErrBadLength)
+	assert.ErrorAs(t, err, &de)
+	assert.Equal(t, "length", de.Field)
+	// 空的 Peer-ID 之后照常解码密码
+	pap, err := DecodePwdAuthProtocol([]byte{0x01, 0x01, 0x00, 0x0b, 0x00, 0x05, 's', 'e', 'c', 'r', 't'})
+	assert.Nil(t, err)
+	assert.Equal(t, PwdAuthProtocol{Code: PwdAuthCodeRequest, Identifier: 1, Password: "secrt"}, pap)
+	// 不足 4 字节的控制协议头
+	_, err = DecodeLinkCtrlProtocol([]byte{0x01})
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+// allocTestFrames 覆盖各个协议的帧，用于验证追加编码和解码到已有结构时不分配内存
+func allocTestFrames() []Frame {
+	return []Frame{
+		{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 1, MaxReceiveUint: 1492, MagicNumber: 0x01020304,
+			AuthProtocol: AuthProtocolChap, AuthAlgorithm: ChapAlgorithmMD5, ProtocolFieldCompression: true, AddressCtrlFieldCompression: true}},
+		{Protocol: ProtocolPAP, PwdAuthProtocol: PwdAuthProtocol{Code: PwdAuthCodeRequest, Identifier: 2, PeerID: "user", Password: "secret"}},
+		{Protocol: ProtocolCHAP, ChapProtocol: ChapProtocol{Code: ChapCodeResponse, Identifier: 3, Value: make([]byte, 16), Name: "user"}},
+		{Protocol: ProtocolIPCP, IPCtrlProtocol: IPCtrlProtocol{Code: LinkCodeConfigNak, Identifier: 4, IPAddress: net.IPv4(10, 0, 0, 2), PrimaryDNS: net.IPv4(8, 8, 8, 8)}},
+		{Protocol: ProtocolIPv6CP, IPv6CtrlProtocol: IPv6CtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 5, InterfaceID: []byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{Protocol: ProtocolIPv4, Data: make([]byte, 1400)},
+	}
+}
+
+func TestFrame_AppendEncode(t *testing.T) {
+	for _, f := range allocTestFrames() {
+		prefix := []byte{0xaa, 0xbb}
+		bs := f.AppendEncode(prefix)
+		assert.Equal(t, prefix, bs[:2])
+		assert.Equal(t, f.Encode(), bs[2:])
+
+		buf := make([]byte, 0, 2048)
+		allocs := testing.AllocsPerRun(100, func() {
+			buf = f.AppendEncode(buf[:0])
+		})
+		assert.Equal(t, float64(0), allocs, "protocol %s", f.Protocol)
+	}
+}
+
+func TestDecodeFrameInto(t *testing.T) {
+	var f Frame
+	for _, want := range allocTestFrames() {
+		data := want.Encode()
+		assert.Nil(t, DecodeFrameInto(&f, data))
+		decoded, err := DecodeFrame(data)
+		assert.Nil(t, err)
+		assert.Equal(t, decoded.Protocol, f.Protocol)
+		assert.Equal(t, decoded.Encode(), f.Encode())
+
+		allocs := testing.AllocsPerRun(100, func() {
+			_ = DecodeFrameInto(&f, data)
+		})
+		assert.Equal(t, float64(0), allocs, "protocol %s", f.Protocol)
+	}
+
+	// 上一次解码的字段不能残留
+	assert.Nil(t, DecodeFrameInto(&f, allocTestFrames()[1].Encode()))
+	assert.Nil(t, DecodeFrameInto(&f, allocTestFrames()[0].Encode()))
+	assert.Equal(t, PwdAuthProtocol{}, f.PwdAuthProtocol)
+	assert.Nil(t, DecodeFrameInto(&f, allocTestFrames()[3].Encode()))
+	ipcp := Frame{Protocol: ProtocolIPCP, IPCtrlProtocol: IPCtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 6, IPAddress: net.IPv4zero}}
+	assert.Nil(t, DecodeFrameInto(&f, ipcp.Encode()))
+	assert.Equal(t, net.IPv4zero.To4(), f.IPCtrlProtocol.IPAddress)
+	assert.Nil(t, f.IPCtrlProtocol.PrimaryDNS)
+}
+
+func BenchmarkFrame_AppendEncode(b *testing.B) {
+	f := allocTestFrames()[0]
+	buf := make([]byte, 0, 2048)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = f.AppendEncode(buf[:0])
+	}
+}
+
+func BenchmarkDecodeFrameInto(b *testing.B) {
+	data := allocTestFrames()[1].Encode()
+	var f Frame
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = DecodeFrameInto(&f, data)
+	}
+}
@@ -0,0 +1,78 @@
+package ppp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// 运行：go test ./ppp -fuzz FuzzDecodeFrame
+
+// checkDecodeError 解码失败时必须返回位置在数据范围内的 DecodeError
+func checkDecodeError(t *testing.T, data []byte, err error) {
+	if err == nil {
+		return
+	}
+	var de *DecodeError
+	if !errors.As(err, &de) {
+		t.Fatalf("error is not a DecodeError: %v", err)
+	}
+	if de.Offset < 0 || de.Offset > len(data) {
+		t.Fatalf("offset %d out of range [0, %d]: %v", de.Offset, len(data), err)
+	}
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	f.Add([]byte{0xc0, 0x21, 0x01, 0x00, 0x00, 0x15, 0x01, 0x04, 0x05, 0xc8, 0x05, 0x06, 0x07, 0x97, 0x52, 0x1d, 0x07, 0x02, 0x08, 0x02, 0x0d, 0x03, 0x06})
+	f.Add([]byte{0xc0, 0x23, 0x01, 0x00, 0x00, 0x0f, 0x06, 0x31, 0x32, 0x33, 0x31, 0x32, 0x33, 0x03, 0x31, 0x32, 0x33})
+	f.Add([]byte{0x80, 0x21, 0x03, 0x01, 0x00, 0x16, 0x03, 0x06, 0x0a, 0x00, 0x00, 0x02, 0x81, 0x06, 0x72, 0x72, 0x72, 0x72, 0x83, 0x06, 0x08, 0x08, 0x08, 0x08})
+	f.Add([]byte{0x00, 0x21})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := DecodeFrame(data)
+		checkDecodeError(t, data, err)
+		if err == nil && (frame.Protocol == ProtocolIPv4 || frame.Protocol == ProtocolIPv6) && len(frame.Data) != len(data)-ProtocolLen {
+			t.Fatalf("data length %d, frame length %d", len(frame.Data), len(data))
+		}
+	})
+}
+
+// FuzzDecodeControl 直接调用各个控制协议的解码函数，输入不经过 DecodeFrame
+func FuzzDecodeControl(f *testing.F) {
+	f.Add([]byte{0x01, 0x00, 0x00, 0x15, 0x01, 0x04, 0x05, 0xc8, 0x05, 0x06, 0x07, 0x97, 0x52, 0x1d, 0x07, 0x02, 0x08, 0x02, 0x0d, 0x03, 0x06})
+	f.Add([]byte{0x01, 0x00, 0x00, 0x0f, 0x06, 0x31, 0x32, 0x33, 0x31, 0x32, 0x33, 0x03, 0x31, 0x32, 0x33})
+	f.Add([]byte{0x03, 0x01, 0x00, 0x16, 0x03, 0x06, 0x0a, 0x00, 0x00, 0x02, 0x81, 0x06, 0x72, 0x72, 0x72, 0x72, 0x83, 0x06, 0x08, 0x08, 0x08, 0x08})
+	f.Add([]byte{0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, err := DecodeLinkCtrlProtocol(data)
+		checkDecodeError(t, data, err)
+		_, err = DecodePwdAuthProtocol(data)
+		checkDecodeError(t, data, err)
+		_, err = DecodeChapProtocol(data)
+		checkDecodeError(t, data, err)
+		_, err = DecodeIPCtrlProtocol(data)
+		checkDecodeError(t, data, err)
+		_, err = DecodeIPv6CtrlProtocol(data)
+		checkDecodeError(t, data, err)
+	})
+}
+
+// FuzzHDLCReader 任意字节流都只能读出 DecodeError 或 io.EOF
+func FuzzHDLCReader(f *testing.F) {
+	f.Add(AppendHDLC(nil, []byte{0xc0, 0x21, 0x09, 0x01, 0x00, 0x08, 0x01, 0x02, 0x03, 0x04}, DefaultACCM, false), false)
+	f.Add(AppendHDLC(nil, []byte{0xc0, 0x23, 0x01, 0x01, 0x00, 0x06, 0x00, 0x00}, 0, true), true)
+	f.Add([]byte{0x7e, 0x7d, 0x7e, 0x7e}, false)
+	f.Fuzz(func(t *testing.T, data []byte, fcs32 bool) {
+		r := NewHDLCReader(bytes.NewReader(data), fcs32)
+		for {
+			_, err := r.ReadFrame()
+			if err == io.EOF {
+				return
+			}
+			var de *DecodeError
+			if err != nil && !errors.As(err, &de) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	})
+}
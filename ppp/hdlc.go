@@ -0,0 +1,178 @@
+package ppp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// RFC 1662 异步 HDLC 成帧：帧以 0x7e 分隔，地址 0xff 和控制 0x03 之后是 PPP 协议字段，最后是 FCS
+const (
+	hdlcFlag    = 0x7e
+	hdlcEscape  = 0x7d
+	hdlcXor     = 0x20
+	hdlcAddress = 0xff
+	hdlcControl = 0x03
+	// hdlcMaxLen 去掉转义后一个帧的最大长度，超过时丢弃到下一个 0x7e，避免线路噪声导致缓冲区无限增长
+	hdlcMaxLen = 0xffff + 8
+)
+
+// DefaultACCM 协商之前的 ACCM，转义所有 0x00-0x1f 的控制字符
+const DefaultACCM uint32 = 0xffffffff
+
+// ErrBadFCS HDLC 帧的 FCS 校验失败，通常是线路噪声或两端的 FCS 长度不一致
+var ErrBadFCS = errors.New("bad fcs")
+
+var fcs16Table = func() (t [256]uint16) {
+	for b := range t {
+		v := uint16(b)
+		for i := 0; i < 8; i++ {
+			if v&1 != 0 {
+				v = v>>1 ^ 0x8408
+			} else {
+				v >>= 1
+			}
+		}
+		t[b] = v
+	}
+	return
+}()
+
+// FCS16 RFC 1662 附录 C.2 的 16 位 FCS，返回值已取反，按小端序追加在帧后
+func FCS16(b []byte) uint16 {
+	return ^fcs16(0xffff, b)
+}
+
+// FCS32 RFC 1662 附录 C.3 的 32 位 FCS，即 IEEE CRC-32，按小端序追加在帧后
+func FCS32(b []byte) uint32 {
+	return crc32.ChecksumIEEE(b)
+}
+
+// AppendHDLC 将 PPP 帧（从协议字段开始）按 RFC 1662 成帧后追加到 dst：补上地址和控制字段，计算 FCS，
+// 转义 0x7e、0x7d 和 accm 中的控制字符，首尾加上 0x7e。fcs32 为 true 时使用 32 位 FCS
+func AppendHDLC(dst []byte, frame []byte, accm uint32, fcs32 bool) []byte {
+	dst = append(dst, hdlcFlag)
+	dst = appendEscaped(dst, hdlcAddress, accm)
+	dst = appendEscaped(dst, hdlcControl, accm)
+	for _, c := range frame {
+		dst = appendEscaped(dst, c, accm)
+	}
+	header := [2]byte{hdlcAddress, hdlcControl}
+	var fcs [4]byte
+	n := 2
+	if fcs32 {
+		crc := crc32.Update(crc32.ChecksumIEEE(header[:]), crc32.IEEETable, frame)
+		binary.LittleEndian.PutUint32(fcs[:], crc)
+		n = 4
+	} else {
+		binary.LittleEndian.PutUint16(fcs[:], ^fcs16(fcs16(0xffff, header[:]), frame))
+	}
+	for _, c := range fcs[:n] {
+		dst = appendEscaped(dst, c, accm)
+	}
+	return append(dst, hdlcFlag)
+}
+
+// fcs16 在 fcs 的基础上继续计算，未取反
+func fcs16(fcs uint16, b []byte) uint16 {
+	for _, c := range b {
+		fcs = fcs>>8 ^ fcs16Table[byte(fcs)^c]
+	}
+	return fcs
+}
+
+func appendEscaped(dst []byte, c byte, accm uint32) []byte {
+	if c == hdlcFlag || c == hdlcEscape || c < 0x20 && accm&(1<<c) != 0 {
+		return append(dst, hdlcEscape, c^hdlcXor)
+	}
+	return append(dst, c)
+}
+
+// HDLCReader 从串口等字节流中读取 RFC 1662 成帧的 PPP 帧
+type HDLCReader struct {
+	r     *bufio.Reader
+	fcs32 bool
+	buf   []byte
+}
+
+// NewHDLCReader fcs32 为 true 时按 32 位 FCS 校验，需与对端一致
+func NewHDLCReader(r io.Reader, fcs32 bool) *HDLCReader {
+	return &HDLCReader{r: bufio.NewReader(r), fcs32: fcs32}
+}
+
+// ReadFrame 读取下一个帧，返回去掉地址、控制字段和 FCS 的 PPP 帧（从协议字段开始），只在下一次调用之前有效。
+// 帧太短、太长或 FCS 错误时返回 *DecodeError，可以继续读取下一个帧；读取字节流出错时返回该错误。
+// 收到的未转义控制字符按 RFC 1662 7.1 丢弃，本端不协商 ACCM，对端始终转义全部控制字符
+func (r *HDLCReader) ReadFrame() (frame []byte, err error) {
+	r.buf = r.buf[:0]
+	escaped := false
+	overflow := false
+	for {
+		var c byte
+		c, err = r.r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch {
+		case c == hdlcFlag:
+			if escaped || len(r.buf) == 0 && !overflow {
+				// 0x7d 0x7e 表示对端中止了当前帧，连续的 0x7e 之间没有帧
+				r.buf = r.buf[:0]
+				escaped = false
+				continue
+			}
+			if overflow {
+				err = badLength(LayerHDLC, "frame", 0, hdlcMaxLen, len(r.buf))
+				return
+			}
+			return r.check()
+		case c == hdlcEscape:
+			escaped = true
+		case c < 0x20 && !escaped:
+			// 线路上插入的 XON/XOFF 等字符
+		default:
+			if escaped {
+				c ^= hdlcXor
+				escaped = false
+			}
+			if len(r.buf) >= hdlcMaxLen {
+				overflow = true
+				continue
+			}
+			r.buf = append(r.buf, c)
+		}
+	}
+}
+
+// check 校验 FCS，去掉地址和控制字段。对端没有协商 ACFC 时也接受省略了地址和控制字段的帧
+func (r *HDLCReader) check() (frame []byte, err error) {
+	n := 2
+	if r.fcs32 {
+		n = 4
+	}
+	if len(r.buf) < n+ProtocolLen {
+		err = truncated(LayerHDLC, "frame", 0, n+ProtocolLen, len(r.buf))
+		return
+	}
+	data := r.buf[:len(r.buf)-n]
+	if r.fcs32 {
+		expected, actual := FCS32(data), binary.LittleEndian.Uint32(r.buf[len(data):])
+		if expected != actual {
+			err = &DecodeError{Layer: LayerHDLC, Field: "fcs", Offset: len(data), Expected: int(expected), Actual: int(actual), Err: ErrBadFCS}
+			return
+		}
+	} else {
+		expected, actual := FCS16(data), binary.LittleEndian.Uint16(r.buf[len(data):])
+		if expected != actual {
+			err = &DecodeError{Layer: LayerHDLC, Field: "fcs", Offset: len(data), Expected: int(expected), Actual: int(actual), Err: ErrBadFCS}
+			return
+		}
+	}
+	if len(data) >= 2 && data[0] == hdlcAddress && data[1] == hdlcControl {
+		data = data[2:]
+	}
+	frame = data
+	return
+}
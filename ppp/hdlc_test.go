@@ -0,0 +1,80 @@
+package ppp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestFCS(t *testing.T) {
+	// CRC-16/X-25 和 CRC-32 的标准校验值
+	assert.Equal(t, uint16(0x906e), FCS16([]byte("123456789")))
+	assert.Equal(t, uint32(0xcbf43926), FCS32([]byte("123456789")))
+}
+
+func TestHDLC_RoundTrip(t *testing.T) {
+	lcp := Frame{Protocol: ProtocolLCP, LinkProtocol: LinkCtrlProtocol{Code: LinkCodeConfigRequest, Identifier: 1, HasACCM: true, MagicNumber: 0x7e7d1101}}
+	frame := lcp.Encode()
+	for _, fcs32 := range []bool{false, true} {
+		bs := AppendHDLC(nil, frame, DefaultACCM, fcs32)
+		assert.Equal(t, byte(hdlcFlag), bs[0])
+		assert.Equal(t, byte(hdlcFlag), bs[len(bs)-1])
+		// 首尾之外没有 0x7e，也没有未转义的控制字符
+		for _, c := range bs[1 : len(bs)-1] {
+			assert.NotEqual(t, byte(hdlcFlag), c)
+			assert.False(t, c < 0x20)
+		}
+
+		// 帧之间的噪声和连续的 0x7e 不影响读取
+		stream := append([]byte{hdlcFlag, hdlcFlag, 0x11}, bs...)
+		stream = AppendHDLC(stream, []byte{0x80, 0x21, 0x01}, DefaultACCM, fcs32)
+		r := NewHDLCReader(bytes.NewReader(stream), fcs32)
+		decoded, err := r.ReadFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, frame, decoded)
+		decoded, err = r.ReadFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte{0x80, 0x21, 0x01}, decoded)
+		_, err = r.ReadFrame()
+		assert.Equal(t, io.EOF, err)
+	}
+
+	// ACCM 为 0 时控制字符不转义
+	bs := AppendHDLC(nil, []byte{0xc0, 0x21, 0x01}, 0, false)
+	assert.Equal(t, []byte{hdlcFlag, 0xff, 0x03, 0xc0, 0x21, 0x01}, bs[:6])
+}
+
+func TestHDLCReader_Errors(t *testing.T) {
+	good := AppendHDLC(nil, []byte{0xc0, 0x21, 0x09, 0x01}, DefaultACCM, false)
+	bad := append([]byte(nil), good...)
+	bad[len(bad)-3] ^= 0x01
+
+	// FCS 错误后可以继续读取
+	r := NewHDLCReader(bytes.NewReader(append(bad, good...)), false)
+	_, err := r.ReadFrame()
+	assert.True(t, errors.Is(err, ErrBadFCS))
+	var de *DecodeError
+	assert.True(t, errors.As(err, &de))
+	assert.Equal(t, LayerHDLC, de.Layer)
+	frame, err := r.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xc0, 0x21, 0x09, 0x01}, frame)
+
+	// 0x7d 0x7e 中止当前帧
+	aborted := append([]byte{hdlcFlag, 0xff, 0x7d, 0x23, 0xc0, hdlcEscape}, good...)
+	r = NewHDLCReader(bytes.NewReader(aborted), false)
+	frame, err = r.ReadFrame()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xc0, 0x21, 0x09, 0x01}, frame)
+
+	// 两端 FCS 长度不一致
+	r = NewHDLCReader(bytes.NewReader(good), true)
+	_, err = r.ReadFrame()
+	assert.True(t, errors.Is(err, ErrBadFCS))
+
+	r = NewHDLCReader(bytes.NewReader([]byte{hdlcFlag, 0xc0, 0x21, hdlcFlag}), false)
+	_, err = r.ReadFrame()
+	assert.True(t, errors.Is(err, ErrTruncated))
+}
@@ -0,0 +1,124 @@
+package ppp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+type IPCtrlOption byte
+
+const (
+	IPCtrlOptionIPAddress    IPCtrlOption = 0x3
+	IPCtrlOptionPrimaryDNS   IPCtrlOption = 0x81
+	IPCtrlOptionSecondaryDNS IPCtrlOption = 0x83
+)
+
+// IPCtrlProtocol IPCP 报文，RFC 1332/1877，报文类型与 LCP 相同。
+// 地址为 nil 时不携带该配置项，0.0.0.0 表示向对端请求分配。
+type IPCtrlProtocol struct {
+	Code         LinkCode
+	Identifier   byte
+	IPAddress    net.IP
+	PrimaryDNS   net.IP
+	SecondaryDNS net.IP
+	// UnknownOptions 无法识别的配置项原始数据，用于回复 Config Reject
+	UnknownOptions []byte
+}
+
+func (p IPCtrlProtocol) GetShowCode() string {
+	lcp := LinkCtrlProtocol{Code: p.Code}
+	return lcp.GetShowCode()
+}
+
+func (p IPCtrlProtocol) encode() (pd []byte) {
+	return p.appendEncode(nil)
+}
+
+func (p IPCtrlProtocol) appendEncode(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, byte(p.Code), p.Identifier, 0, 0)
+	dst = appendIPOption(dst, IPCtrlOptionIPAddress, p.IPAddress)
+	dst = appendIPOption(dst, IPCtrlOptionPrimaryDNS, p.PrimaryDNS)
+	dst = appendIPOption(dst, IPCtrlOptionSecondaryDNS, p.SecondaryDNS)
+	dst = append(dst, p.UnknownOptions...)
+	putLength(dst, start)
+	return dst
+}
+
+func appendIPOption(dst []byte, option IPCtrlOption, ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		dst = append(dst, byte(option), 0x6)
+		dst = append(dst, ip4...)
+	}
+	return dst
+}
+
+func DecodeIPCtrlProtocol(payload []byte) (p IPCtrlProtocol, err error) {
+	err = p.decode(payload)
+	return
+}
+
+// decode 解码到 p，复用 p 中地址和 UnknownOptions 的空间
+func (p *IPCtrlProtocol) decode(payload []byte) (err error) {
+	old := *p
+	*p = IPCtrlProtocol{UnknownOptions: old.UnknownOptions[:0]}
+	if len(payload) < ControlHeaderLen {
+		err = truncated(LayerIPCP, "header", 0, ControlHeaderLen, len(payload))
+		return
+	}
+	p.Code = LinkCode(payload[0])
+	p.Identifier = payload[1]
+	ipcpLen := binary.BigEndian.Uint16(payload[2:4])
+	if ipcpLen < ControlHeaderLen {
+		err = badLength(LayerIPCP, "length", 2, ControlHeaderLen, int(ipcpLen))
+		return
+	}
+	if len(payload) < int(ipcpLen) {
+		err = truncated(LayerIPCP, "packet", 0, int(ipcpLen), len(payload))
+		return
+	}
+	payload = payload[ControlHeaderLen:ipcpLen]
+	offset := ControlHeaderLen
+	if p.Code < LinkCodeConfigRequest || p.Code > LinkCodeConfigReject {
+		return
+	}
+	for len(payload) > 0 {
+		if len(payload) < OptionHeaderLen {
+			err = truncated(LayerIPCP, "option header", offset, OptionHeaderLen, len(payload))
+			return
+		}
+		oType := IPCtrlOption(payload[0])
+		oLen := payload[1]
+		if oLen < OptionHeaderLen {
+			err = badLength(LayerIPCP, fmt.Sprintf("option %d", oType), offset, OptionHeaderLen, int(oLen))
+			return
+		}
+		if len(payload) < int(oLen) {
+			err = truncated(LayerIPCP, fmt.Sprintf("option %d", oType), offset, int(oLen), len(payload))
+			return
+		}
+		var ip *net.IP
+		var buf net.IP
+		switch oType {
+		case IPCtrlOptionIPAddress:
+			ip, buf = &p.IPAddress, old.IPAddress
+		case IPCtrlOptionPrimaryDNS:
+			ip, buf = &p.PrimaryDNS, old.PrimaryDNS
+		case IPCtrlOptionSecondaryDNS:
+			ip, buf = &p.SecondaryDNS, old.SecondaryDNS
+		}
+		if ip != nil {
+			if oLen != 6 {
+				err = badLength(LayerIPCP, fmt.Sprintf("option %d", oType), offset, 6, int(oLen))
+				return
+			}
+			*ip = append(buf[:0], payload[2:6]...)
+		} else {
+			p.UnknownOptions = append(p.UnknownOptions, payload[:oLen]...)
+		}
+		payload = payload[oLen:]
+		offset += int(oLen)
+	}
+	return
+}
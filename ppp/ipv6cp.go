@@ -0,0 +1,99 @@
+package ppp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type IPv6CtrlOption byte
+
+const IPv6CtrlOptionInterfaceID IPv6CtrlOption = 0x1
+
+// IPv6CtrlProtocol IPv6CP 报文，RFC 5072，报文类型与 LCP 相同。
+// InterfaceID 为 8 字节的接口标识，为 nil 时不携带该配置项。
+type IPv6CtrlProtocol struct {
+	Code        LinkCode
+	Identifier  byte
+	InterfaceID []byte
+	// UnknownOptions 无法识别的配置项原始数据，用于回复 Config Reject
+	UnknownOptions []byte
+}
+
+func (p IPv6CtrlProtocol) GetShowCode() string {
+	lcp := LinkCtrlProtocol{Code: p.Code}
+	return lcp.GetShowCode()
+}
+
+func (p IPv6CtrlProtocol) encode() (pd []byte) {
+	return p.appendEncode(nil)
+}
+
+func (p IPv6CtrlProtocol) appendEncode(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, byte(p.Code), p.Identifier, 0, 0)
+	if len(p.InterfaceID) == 8 {
+		dst = append(dst, byte(IPv6CtrlOptionInterfaceID), 0xa)
+		dst = append(dst, p.InterfaceID...)
+	}
+	dst = append(dst, p.UnknownOptions...)
+	putLength(dst, start)
+	return dst
+}
+
+func DecodeIPv6CtrlProtocol(payload []byte) (p IPv6CtrlProtocol, err error) {
+	err = p.decode(payload)
+	return
+}
+
+// decode 解码到 p，复用 p 中 UnknownOptions 的空间
+func (p *IPv6CtrlProtocol) decode(payload []byte) (err error) {
+	*p = IPv6CtrlProtocol{UnknownOptions: p.UnknownOptions[:0]}
+	if len(payload) < ControlHeaderLen {
+		err = truncated(LayerIPv6CP, "header", 0, ControlHeaderLen, len(payload))
+		return
+	}
+	p.Code = LinkCode(payload[0])
+	p.Identifier = payload[1]
+	ipv6cpLen := binary.BigEndian.Uint16(payload[2:4])
+	if ipv6cpLen < ControlHeaderLen {
+		err = badLength(LayerIPv6CP, "length", 2, ControlHeaderLen, int(ipv6cpLen))
+		return
+	}
+	if len(payload) < int(ipv6cpLen) {
+		err = truncated(LayerIPv6CP, "packet", 0, int(ipv6cpLen), len(payload))
+		return
+	}
+	payload = payload[ControlHeaderLen:ipv6cpLen]
+	offset := ControlHeaderLen
+	if p.Code < LinkCodeConfigRequest || p.Code > LinkCodeConfigReject {
+		return
+	}
+	for len(payload) > 0 {
+		if len(payload) < OptionHeaderLen {
+			err = truncated(LayerIPv6CP, "option header", offset, OptionHeaderLen, len(payload))
+			return
+		}
+		oType := IPv6CtrlOption(payload[0])
+		oLen := payload[1]
+		if oLen < OptionHeaderLen {
+			err = badLength(LayerIPv6CP, fmt.Sprintf("option %d", oType), offset, OptionHeaderLen, int(oLen))
+			return
+		}
+		if len(payload) < int(oLen) {
+			err = truncated(LayerIPv6CP, fmt.Sprintf("option %d", oType), offset, int(oLen), len(payload))
+			return
+		}
+		if oType == IPv6CtrlOptionInterfaceID {
+			if oLen != 10 {
+				err = badLength(LayerIPv6CP, "option interface identifier", offset, 10, int(oLen))
+				return
+			}
+			p.InterfaceID = payload[2:10]
+		} else {
+			p.UnknownOptions = append(p.UnknownOptions, payload[:oLen]...)
+		}
+		payload = payload[oLen:]
+		offset += int(oLen)
+	}
+	return
+}
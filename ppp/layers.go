@@ -0,0 +1,215 @@
+package ppp
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// 本项目在 gopacket 中注册的层类型编号，全部集中在这里分配，避免包之间重复。
+// gopacket 保留 0-999，1000-1999 留给应用自定义的常用类型。编号被其他包占用时 gopacket.RegisterLayerType
+// 会在包初始化时 panic，不会静默覆盖，出现冲突时整体平移这组编号即可
+const (
+	LayerNumberPPPoETags = 1516 + iota
+	LayerNumberLCP
+	LayerNumberPAP
+	LayerNumberCHAP
+	LayerNumberIPCP
+	LayerNumberIPv6CP
+)
+
+// gopacket 中的层类型。
+// 导入本包后 gopacket.NewPacket 会在 layers.PPP 之后解析出 LCP、PAP 等控制协议，也可以在 gopacket.DecodingLayerParser 中使用
+var (
+	LayerTypeLCP    = gopacket.RegisterLayerType(LayerNumberLCP, gopacket.LayerTypeMetadata{Name: "LCP", Decoder: gopacket.DecodeFunc(decodeLCP)})
+	LayerTypePAP    = gopacket.RegisterLayerType(LayerNumberPAP, gopacket.LayerTypeMetadata{Name: "PAP", Decoder: gopacket.DecodeFunc(decodePAP)})
+	LayerTypeCHAP   = gopacket.RegisterLayerType(LayerNumberCHAP, gopacket.LayerTypeMetadata{Name: "CHAP", Decoder: gopacket.DecodeFunc(decodeCHAP)})
+	LayerTypeIPCP   = gopacket.RegisterLayerType(LayerNumberIPCP, gopacket.LayerTypeMetadata{Name: "IPCP", Decoder: gopacket.DecodeFunc(decodeIPCP)})
+	LayerTypeIPv6CP = gopacket.RegisterLayerType(LayerNumberIPv6CP, gopacket.LayerTypeMetadata{Name: "IPv6CP", Decoder: gopacket.DecodeFunc(decodeIPv6CP)})
+)
+
+// init 修改的是 gopacket 的全局表，对进程内所有使用 layers.PPP 的代码生效。
+// gopacket 默认只为 IPv4、IPv6 和 MPLS 填写了解码器，这里填写的协议号原本没有解码器，不会替换 gopacket 自带的解析
+func init() {
+	layers.PPPTypeMetadata[ProtocolLCP] = layers.EnumMetadata{DecodeWith: LayerTypeLCP, Name: "LCP", LayerType: LayerTypeLCP}
+	layers.PPPTypeMetadata[ProtocolPAP] = layers.EnumMetadata{DecodeWith: LayerTypePAP, Name: "PAP", LayerType: LayerTypePAP}
+	layers.PPPTypeMetadata[ProtocolCHAP] = layers.EnumMetadata{DecodeWith: LayerTypeCHAP, Name: "CHAP", LayerType: LayerTypeCHAP}
+	layers.PPPTypeMetadata[ProtocolIPCP] = layers.EnumMetadata{DecodeWith: LayerTypeIPCP, Name: "IPCP", LayerType: LayerTypeIPCP}
+	layers.PPPTypeMetadata[ProtocolIPv6CP] = layers.EnumMetadata{DecodeWith: LayerTypeIPv6CP, Name: "IPv6CP", LayerType: LayerTypeIPv6CP}
+}
+
+// NextLayerType PPP 帧中协议字段之后的层，可以用于承载 PPP 的封装层实现 gopacket.DecodingLayer
+func (p Protocol) NextLayerType() gopacket.LayerType {
+	switch p {
+	case ProtocolIPv4:
+		return layers.LayerTypeIPv4
+	case ProtocolIPv6:
+		return layers.LayerTypeIPv6
+	}
+	return layers.PPPTypeMetadata[p].LayerType
+}
+
+// LCP 链路控制协议报文，即 PPP 协议号为 0xc021 的 layers.PPP 的 Payload
+type LCP struct {
+	layers.BaseLayer
+	LinkCtrlProtocol
+}
+
+func (l *LCP) LayerType() gopacket.LayerType     { return LayerTypeLCP }
+func (l *LCP) CanDecode() gopacket.LayerClass    { return LayerTypeLCP }
+func (l *LCP) NextLayerType() gopacket.LayerType { return gopacket.LayerTypeZero }
+func (l *LCP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) (err error) {
+	if l.LinkCtrlProtocol, err = DecodeLinkCtrlProtocol(data); err != nil {
+		return DecodeFailed(df, err)
+	}
+	l.BaseLayer = controlBaseLayer(data)
+	return
+}
+
+func (l *LCP) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	return Prepend(b, l.LinkCtrlProtocol.encode())
+}
+
+// PAP 密码认证协议报文。打印时与 PwdAuthProtocol 一样隐藏密码，但 Contents 中仍是原始数据
+type PAP struct {
+	layers.BaseLayer
+	PwdAuthProtocol
+}
+
+func (l *PAP) LayerType() gopacket.LayerType     { return LayerTypePAP }
+func (l *PAP) CanDecode() gopacket.LayerClass    { return LayerTypePAP }
+func (l *PAP) NextLayerType() gopacket.LayerType { return gopacket.LayerTypeZero }
+func (l *PAP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) (err error) {
+	if l.PwdAuthProtocol, err = DecodePwdAuthProtocol(data); err != nil {
+		return DecodeFailed(df, err)
+	}
+	l.BaseLayer = controlBaseLayer(data)
+	return
+}
+
+func (l *PAP) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	return Prepend(b, l.PwdAuthProtocol.encode())
+}
+
+// CHAP 挑战握手认证协议报文，打印时隐藏 Response 中的 Value
+type CHAP struct {
+	layers.BaseLayer
+	ChapProtocol
+}
+
+func (l *CHAP) LayerType() gopacket.LayerType     { return LayerTypeCHAP }
+func (l *CHAP) CanDecode() gopacket.LayerClass    { return LayerTypeCHAP }
+func (l *CHAP) NextLayerType() gopacket.LayerType { return gopacket.LayerTypeZero }
+func (l *CHAP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) (err error) {
+	if l.ChapProtocol, err = DecodeChapProtocol(data); err != nil {
+		return DecodeFailed(df, err)
+	}
+	l.BaseLayer = controlBaseLayer(data)
+	return
+}
+
+func (l *CHAP) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	return Prepend(b, l.ChapProtocol.encode())
+}
+
+// IPCP IP 控制协议报文
+type IPCP struct {
+	layers.BaseLayer
+	IPCtrlProtocol
+}
+
+func (l *IPCP) LayerType() gopacket.LayerType     { return LayerTypeIPCP }
+func (l *IPCP) CanDecode() gopacket.LayerClass    { return LayerTypeIPCP }
+func (l *IPCP) NextLayerType() gopacket.LayerType { return gopacket.LayerTypeZero }
+func (l *IPCP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) (err error) {
+	if l.IPCtrlProtocol, err = DecodeIPCtrlProtocol(data); err != nil {
+		return DecodeFailed(df, err)
+	}
+	l.BaseLayer = controlBaseLayer(data)
+	return
+}
+
+func (l *IPCP) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	return Prepend(b, l.IPCtrlProtocol.encode())
+}
+
+// IPv6CP IPv6 控制协议报文
+type IPv6CP struct {
+	layers.BaseLayer
+	IPv6CtrlProtocol
+}
+
+func (l *IPv6CP) LayerType() gopacket.LayerType     { return LayerTypeIPv6CP }
+func (l *IPv6CP) CanDecode() gopacket.LayerClass    { return LayerTypeIPv6CP }
+func (l *IPv6CP) NextLayerType() gopacket.LayerType { return gopacket.LayerTypeZero }
+func (l *IPv6CP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) (err error) {
+	if l.IPv6CtrlProtocol, err = DecodeIPv6CtrlProtocol(data); err != nil {
+		return DecodeFailed(df, err)
+	}
+	l.BaseLayer = controlBaseLayer(data)
+	return
+}
+
+func (l *IPv6CP) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	return Prepend(b, l.IPv6CtrlProtocol.encode())
+}
+
+// controlBaseLayer 按报文头中的长度划分 Contents 和 Payload，长度之后的数据（例如以太网补齐）放在 Payload 中
+func controlBaseLayer(data []byte) layers.BaseLayer {
+	n := len(data)
+	if n >= ControlHeaderLen {
+		if l := int(binary.BigEndian.Uint16(data[2:4])); l >= ControlHeaderLen && l <= n {
+			n = l
+		}
+	}
+	return layers.BaseLayer{Contents: data[:n], Payload: data[n:]}
+}
+
+// DecodeFailed 截断的报文通知 gopacket 设置 Truncated，供各协议包实现 gopacket.DecodingLayer 时使用
+func DecodeFailed(df gopacket.DecodeFeedback, err error) error {
+	if errors.Is(err, ErrTruncated) {
+		df.SetTruncated()
+	}
+	return err
+}
+
+// Prepend 把编码后的报文写到 b 的开头，用于实现 gopacket.SerializableLayer
+func Prepend(b gopacket.SerializeBuffer, bs []byte) error {
+	buf, err := b.PrependBytes(len(bs))
+	if err != nil {
+		return err
+	}
+	copy(buf, bs)
+	return nil
+}
+
+func decodeLCP(data []byte, p gopacket.PacketBuilder) error {
+	return DecodeLayer(&LCP{}, data, p)
+}
+
+func decodePAP(data []byte, p gopacket.PacketBuilder) error {
+	return DecodeLayer(&PAP{}, data, p)
+}
+
+func decodeCHAP(data []byte, p gopacket.PacketBuilder) error {
+	return DecodeLayer(&CHAP{}, data, p)
+}
+
+func decodeIPCP(data []byte, p gopacket.PacketBuilder) error {
+	return DecodeLayer(&IPCP{}, data, p)
+}
+
+func decodeIPv6CP(data []byte, p gopacket.PacketBuilder) error {
+	return DecodeLayer(&IPv6CP{}, data, p)
+}
+
+// DecodeLayer 用 l 解码 data 并加入 p，用于实现 gopacket.Decoder
+func DecodeLayer(l gopacket.DecodingLayer, data []byte, p gopacket.PacketBuilder) error {
+	if err := l.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(l.(gopacket.Layer))
+	return nil
+}
@@ -0,0 +1,32 @@
+package ppp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayers_SerializeAndTruncated(t *testing.T) {
+	l := &LCP{LinkCtrlProtocol: LinkCtrlProtocol{Code: LinkCodeEchoRequest, Identifier: 7, MagicNumber: 0x01020304}}
+	buf := gopacket.NewSerializeBuffer()
+	assert.Nil(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, l))
+	assert.Equal(t, l.LinkCtrlProtocol.encode(), buf.Bytes())
+
+	var decoded LCP
+	df := gopacket.NilDecodeFeedback
+	assert.Nil(t, decoded.DecodeFromBytes(buf.Bytes(), df))
+	assert.Equal(t, uint32(0x01020304), decoded.MagicNumber)
+
+	packet := gopacket.NewPacket(buf.Bytes()[:6], LayerTypeLCP, gopacket.Default)
+	assert.True(t, packet.Metadata().Truncated)
+	var de *DecodeError
+	assert.True(t, errors.As(packet.ErrorLayer().Error(), &de))
+	assert.Equal(t, LayerLCP, de.Layer)
+}
+
+func TestProtocol_NextLayerType(t *testing.T) {
+	assert.Equal(t, LayerTypeIPCP, ProtocolIPCP.NextLayerType())
+	assert.Equal(t, gopacket.LayerTypeZero, Protocol(0x80fd).NextLayerType())
+}
@@ -0,0 +1,265 @@
+package ppp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type LinkCode byte
+
+const LinkCodeConfigRequest LinkCode = 0x01
+const LinkCodeConfigAck LinkCode = 0x02
+const LinkCodeConfigNak LinkCode = 0x03
+const LinkCodeConfigReject LinkCode = 0x04
+const LinkCodeTerminateRequest LinkCode = 0x05
+const LinkCodeTerminateAck LinkCode = 0x06
+const LinkCodeCodeReject LinkCode = 0x07
+const LinkCodeProtocolReject LinkCode = 0x08
+const LinkCodeEchoRequest LinkCode = 0x09
+const LinkCodeEchoReply LinkCode = 0x0a
+const LinkCodeDiscardRequest LinkCode = 0x0b
+
+type Option byte
+
+const (
+	OptionMaxReceiveUint                    Option = 0x1
+	OptionAsyncControlCharacterMap          Option = 0x2
+	OptionAuthProtocol                      Option = 0x3
+	OptionMagicNumber                       Option = 0x5
+	OptionProtocolFieldCompression          Option = 0x7
+	OptionAddressAndControlFieldCompression Option = 0x8
+	OptionCallback                          Option = 0xd
+)
+
+type CallbackOperation byte
+
+const CallbackOperationCBCP CallbackOperation = 0x6
+
+type AuthProtocol uint16
+
+const AuthProtocolPassword AuthProtocol = 0xc023
+const AuthProtocolChap AuthProtocol = 0xc223
+
+// ChapAlgorithmMD5 CHAP 认证协议选项中的算法，RFC 1994
+const ChapAlgorithmMD5 byte = 0x5
+
+type LinkCtrlProtocol struct {
+	Code           LinkCode
+	Identifier     byte
+	MaxReceiveUint uint16
+	// ACCM 异步链路上要求对端转义的控制字符（RFC 1662 7.1），HasACCM 为 false 时不携带此项
+	ACCM                        uint32
+	HasACCM                     bool
+	AuthProtocol                AuthProtocol
+	AuthAlgorithm               byte
+	MagicNumber                 uint32
+	ProtocolFieldCompression    bool
+	AddressCtrlFieldCompression bool
+	CallbackOperation           CallbackOperation
+	// UnknownOptions 无法识别的配置项原始数据，用于回复 Config Reject
+	UnknownOptions []byte
+	// Data Echo/Discard 中 magic number 之后的数据，或 Terminate/Code Reject/Protocol Reject 的数据
+	Data []byte
+}
+
+func (p *LinkCtrlProtocol) GetShowCode() string {
+	switch p.Code {
+	case LinkCodeConfigAck:
+		return "Config ACK"
+	case LinkCodeConfigRequest:
+		return "Config Request"
+	case LinkCodeConfigNak:
+		return "Config Nak"
+	case LinkCodeConfigReject:
+		return "Config Reject"
+	case LinkCodeTerminateRequest:
+		return "Terminate Request"
+	case LinkCodeTerminateAck:
+		return "Terminate Ack"
+	case LinkCodeCodeReject:
+		return "Code Reject"
+	case LinkCodeProtocolReject:
+		return "Protocol Reject"
+	case LinkCodeEchoRequest:
+		return "Echo Request"
+	case LinkCodeEchoReply:
+		return "Echo Reply"
+	case LinkCodeDiscardRequest:
+		return "Discard Request"
+	}
+	return "Unknown"
+}
+
+// hasOptions 该类型的报文是否携带配置项
+func (p *LinkCtrlProtocol) hasOptions() bool {
+	return p.Code >= LinkCodeConfigRequest && p.Code <= LinkCodeConfigReject
+}
+
+// hasMagicNumber 该类型的报文是否以 magic number 开头
+func (p *LinkCtrlProtocol) hasMagicNumber() bool {
+	return p.Code >= LinkCodeEchoRequest && p.Code <= LinkCodeDiscardRequest
+}
+
+func (p LinkCtrlProtocol) encode() (pd []byte) {
+	return p.appendEncode(nil)
+}
+
+func (p LinkCtrlProtocol) appendEncode(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, byte(p.Code), p.Identifier, 0, 0)
+	switch {
+	case p.hasMagicNumber():
+		dst = binary.BigEndian.AppendUint32(dst, p.MagicNumber)
+		dst = append(dst, p.Data...)
+	case !p.hasOptions():
+		dst = append(dst, p.Data...)
+	default:
+		if p.MaxReceiveUint > 0 {
+			dst = append(dst, byte(OptionMaxReceiveUint), 0x4)
+			dst = binary.BigEndian.AppendUint16(dst, p.MaxReceiveUint)
+		}
+		if p.HasACCM {
+			dst = append(dst, byte(OptionAsyncControlCharacterMap), 0x6)
+			dst = binary.BigEndian.AppendUint32(dst, p.ACCM)
+		}
+		if p.MagicNumber > 0 {
+			dst = append(dst, byte(OptionMagicNumber), 0x6)
+			dst = binary.BigEndian.AppendUint32(dst, p.MagicNumber)
+		}
+		if p.AuthProtocol > 0 {
+			if p.AuthAlgorithm > 0 {
+				dst = append(dst, byte(OptionAuthProtocol), 0x5)
+				dst = binary.BigEndian.AppendUint16(dst, uint16(p.AuthProtocol))
+				dst = append(dst, p.AuthAlgorithm)
+			} else {
+				dst = append(dst, byte(OptionAuthProtocol), 0x4)
+				dst = binary.BigEndian.AppendUint16(dst, uint16(p.AuthProtocol))
+			}
+		}
+		if p.ProtocolFieldCompression {
+			dst = append(dst, byte(OptionProtocolFieldCompression), 0x2)
+		}
+		if p.AddressCtrlFieldCompression {
+			dst = append(dst, byte(OptionAddressAndControlFieldCompression), 0x2)
+		}
+		if p.CallbackOperation > 0 {
+			dst = append(dst, byte(OptionCallback), 0x3, byte(p.CallbackOperation))
+		}
+		dst = append(dst, p.UnknownOptions...)
+	}
+	putLength(dst, start)
+	return dst
+}
+
+func DecodeLinkCtrlProtocol(payload []byte) (p LinkCtrlProtocol, err error) {
+	err = p.decode(payload)
+	return
+}
+
+// decode 解码到 p，复用 p 中 UnknownOptions 的空间
+func (p *LinkCtrlProtocol) decode(payload []byte) (err error) {
+	*p = LinkCtrlProtocol{UnknownOptions: p.UnknownOptions[:0]}
+	if len(payload) < ControlHeaderLen {
+		err = truncated(LayerLCP, "header", 0, ControlHeaderLen, len(payload))
+		return
+	}
+	p.Code = LinkCode(payload[0])
+	p.Identifier = payload[1]
+	optionLen := binary.BigEndian.Uint16(payload[2:4])
+	if optionLen == 0 {
+		return
+	}
+	if optionLen < ControlHeaderLen {
+		err = badLength(LayerLCP, "length", 2, ControlHeaderLen, int(optionLen))
+		return
+	}
+	// link control options
+	if len(payload) < int(optionLen) {
+		err = truncated(LayerLCP, "packet", 0, int(optionLen), len(payload))
+		return
+	}
+	payload = payload[ControlHeaderLen:optionLen]
+	offset := ControlHeaderLen
+	if p.hasMagicNumber() {
+		if len(payload) < 4 {
+			err = truncated(LayerLCP, "magic number", offset, 4, len(payload))
+			return
+		}
+		p.MagicNumber = binary.BigEndian.Uint32(payload[:4])
+		p.Data = payload[4:]
+		return
+	}
+	if !p.hasOptions() {
+		p.Data = payload
+		return
+	}
+	for {
+		if len(payload) < 1 {
+			break
+		}
+		if len(payload) < OptionHeaderLen {
+			if payload[0] == 0 {
+				return
+			}
+			err = truncated(LayerLCP, "option header", offset, OptionHeaderLen, len(payload))
+			return
+		}
+		lType := Option(payload[0])
+		lLen := payload[1]
+		if lLen == 0 {
+			payload = payload[OptionHeaderLen:]
+			offset += OptionHeaderLen
+			continue
+		}
+		if len(payload) < int(lLen) {
+			err = truncated(LayerLCP, fmt.Sprintf("option %d", lType), offset, int(lLen), len(payload))
+			return
+		}
+
+		switch lType {
+		case OptionAddressAndControlFieldCompression:
+			p.AddressCtrlFieldCompression = true
+		case OptionProtocolFieldCompression:
+			p.ProtocolFieldCompression = true
+		case OptionMaxReceiveUint:
+			if lLen != 4 {
+				err = badLength(LayerLCP, "option max receive unit", offset, 4, int(lLen))
+				return
+			}
+			p.MaxReceiveUint = binary.BigEndian.Uint16(payload[2:lLen])
+		case OptionAsyncControlCharacterMap:
+			if lLen != 6 {
+				err = badLength(LayerLCP, "option accm", offset, 6, int(lLen))
+				return
+			}
+			p.ACCM = binary.BigEndian.Uint32(payload[2:lLen])
+			p.HasACCM = true
+		case OptionMagicNumber:
+			if lLen != 6 {
+				err = badLength(LayerLCP, "option magic number", offset, 6, int(lLen))
+				return
+			}
+			p.MagicNumber = binary.BigEndian.Uint32(payload[2:lLen])
+		case OptionCallback:
+			if lLen != 3 {
+				err = badLength(LayerLCP, "option callback", offset, 3, int(lLen))
+				return
+			}
+			p.CallbackOperation = CallbackOperation(payload[2])
+		case OptionAuthProtocol:
+			if lLen != 4 && lLen != 5 {
+				err = badLength(LayerLCP, "option auth protocol", offset, -1, int(lLen))
+				return
+			}
+			p.AuthProtocol = AuthProtocol(binary.BigEndian.Uint16(payload[2:4]))
+			if lLen == 5 {
+				p.AuthAlgorithm = payload[4]
+			}
+		default:
+			p.UnknownOptions = append(p.UnknownOptions, payload[:lLen]...)
+		}
+		payload = payload[lLen:]
+		offset += int(lLen)
+	}
+	return
+}
@@ -0,0 +1,147 @@
+package ppp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// RedactedMask 打印报文时代替密码等敏感数据
+const RedactedMask = "******"
+
+const (
+	PwdAuthCodeRequest byte = 0x1
+	PwdAuthCodeAck     byte = 0x2
+	PwdAuthCodeNak     byte = 0x3
+)
+
+type PwdAuthProtocol struct {
+	Code       byte
+	Identifier byte
+	PeerID     string
+	Password   string
+	// Message Auth ack/nak 中的消息
+	Message string
+}
+
+func (p PwdAuthProtocol) GetShowCode() string {
+	switch p.Code {
+	case PwdAuthCodeRequest:
+		return "Auth request"
+	case PwdAuthCodeAck:
+		return "Auth ack"
+	case PwdAuthCodeNak:
+		return "Auth nak"
+	}
+	return "unknown"
+}
+
+// pwdAuthProtocol 没有 Format 等方法，用于打印脱敏后的副本，避免递归
+type pwdAuthProtocol PwdAuthProtocol
+
+func (p PwdAuthProtocol) redacted() pwdAuthProtocol {
+	r := pwdAuthProtocol(p)
+	if r.Password != "" {
+		r.Password = RedactedMask
+	}
+	return r
+}
+
+// String 打印时不包含明文密码
+func (p PwdAuthProtocol) String() string {
+	return fmt.Sprintf("%+v", p.redacted())
+}
+
+// Format 使 %v、%+v 等格式化（包括作为 Frame 的字段被打印时）不输出明文密码
+func (p PwdAuthProtocol) Format(f fmt.State, verb rune) {
+	_, _ = fmt.Fprintf(f, fmt.FormatString(f, verb), p.redacted())
+}
+
+// MarshalJSON 序列化时不包含明文密码
+func (p PwdAuthProtocol) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.redacted())
+}
+
+func (p PwdAuthProtocol) encode() (pd []byte) {
+	return p.appendEncode(nil)
+}
+
+func (p PwdAuthProtocol) appendEncode(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, p.Code, p.Identifier, 0, 0)
+	switch p.Code {
+	case PwdAuthCodeAck, PwdAuthCodeNak:
+		dst = append(dst, byte(len(p.Message)))
+		dst = append(dst, p.Message...)
+	default:
+		dst = append(dst, byte(len(p.PeerID)))
+		dst = append(dst, p.PeerID...)
+		dst = append(dst, byte(len(p.Password)))
+		dst = append(dst, p.Password...)
+	}
+	putLength(dst, start)
+	return dst
+}
+
+func DecodePwdAuthProtocol(payload []byte) (p PwdAuthProtocol, err error) {
+	err = p.decode(payload)
+	return
+}
+
+// decode 解码到 p，内容与 p 中原有的字符串相同时不重新分配
+func (p *PwdAuthProtocol) decode(payload []byte) (err error) {
+	old := *p
+	*p = PwdAuthProtocol{}
+	if len(payload) < ControlHeaderLen {
+		err = truncated(LayerPAP, "header", 0, ControlHeaderLen, len(payload))
+		return
+	}
+	p.Code = payload[0]
+	p.Identifier = payload[1]
+	authLen := binary.BigEndian.Uint16(payload[2:4])
+	if authLen < ControlHeaderLen {
+		err = badLength(LayerPAP, "length", 2, ControlHeaderLen, int(authLen))
+		return
+	}
+	if len(payload) < int(authLen) {
+		err = truncated(LayerPAP, "packet", 0, int(authLen), len(payload))
+		return
+	}
+	payload = payload[ControlHeaderLen:authLen]
+	if len(payload) < 1 {
+		return
+	}
+	if p.Code == PwdAuthCodeAck || p.Code == PwdAuthCodeNak {
+		msgLen := payload[0]
+		if len(payload) < int(msgLen)+1 {
+			err = truncated(LayerPAP, "message", ControlHeaderLen, int(msgLen)+1, len(payload))
+			return
+		}
+		p.Message = reuseString(old.Message, payload[1:msgLen+1])
+		return
+	}
+	// Peer-ID 可以为空，之后仍有 Passwd-Length 和 Password
+	peerIDLen := payload[0]
+	if len(payload) < int(peerIDLen)+1 {
+		err = truncated(LayerPAP, "peer id", ControlHeaderLen, int(peerIDLen)+1, len(payload))
+		return
+	}
+	p.PeerID = reuseString(old.PeerID, payload[1:peerIDLen+1])
+
+	if len(payload) < int(peerIDLen)+2 {
+		return
+	}
+	payload = payload[peerIDLen+1:]
+
+	pwdLen := payload[0]
+	if pwdLen < 1 {
+		return
+	}
+	if len(payload) < int(pwdLen)+1 {
+		err = truncated(LayerPAP, "password", ControlHeaderLen+int(peerIDLen)+1, int(pwdLen)+1, len(payload))
+		return
+	}
+	p.Password = reuseString(old.Password, payload[1:pwdLen+1])
+
+	return
+}
@@ -0,0 +1,36 @@
+package pppoe
+
+import (
+	"errors"
+
+	"pppoe-probe/ppp"
+)
+
+// DecodeError.Layer 的取值，PPP 各协议的取值见 ppp 包
+const (
+	LayerPPPoED = "pppoed"
+	LayerPPPoES = "pppoes"
+)
+
+// DecodeError 与 ppp.DecodeError 相同，PPPoE 头和其中 PPP 报文的解码错误可以统一处理
+type DecodeError = ppp.DecodeError
+
+// 解码错误的类别，DecodeError 可以用 errors.Is 与之比较
+var (
+	// ErrTruncated 同 ppp.ErrTruncated
+	ErrTruncated = ppp.ErrTruncated
+	// ErrBadLength 同 ppp.ErrBadLength
+	ErrBadLength = ppp.ErrBadLength
+	// ErrBadVersion PPPoE 头中的版本和类型不是 0x11
+	ErrBadVersion = errors.New("bad version")
+	// ErrUnknownCode PPPoE 头中的 Code 不是已知的取值
+	ErrUnknownCode = errors.New("unknown code")
+)
+
+func truncated(layer string, field string, offset int, expected int, actual int) error {
+	return &DecodeError{Layer: layer, Field: field, Offset: offset, Expected: expected, Actual: actual, Err: ErrTruncated}
+}
+
+func badLength(layer string, field string, offset int, expected int, actual int) error {
+	return &DecodeError{Layer: layer, Field: field, Offset: offset, Expected: expected, Actual: actual, Err: ErrBadLength}
+}
@@ -0,0 +1,66 @@
+package pppoe
+
+import (
+	"encoding/binary"
+	"errors"
+	"pppoe-probe/ppp"
+	"testing"
+)
+
+// 种子语料在 testdata/fuzz 下，取自实际抓包中去掉以太网头后的 PPPoE 报文。
+// 运行：go test ./pppoe -fuzz FuzzDecodePPPoES，PPP 各协议的解码见 ppp 包的 FuzzDecodeFrame
+
+// checkDecodeError 解码失败时必须返回位置在数据范围内的 DecodeError
+func checkDecodeError(t *testing.T, data []byte, err error) {
+	if err == nil {
+		return
+	}
+	var de *DecodeError
+	if !errors.As(err, &de) {
+		t.Fatalf("error is not a DecodeError: %v", err)
+	}
+	if de.Offset < 0 || de.Offset > len(data) {
+		t.Fatalf("offset %d out of range [0, %d]: %v", de.Offset, len(data), err)
+	}
+}
+
+func FuzzDecodePPPoED(f *testing.F) {
+	f.Add([]byte{0x11, 0x09, 0x00, 0x00, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := DecodePPPoED(data)
+		checkDecodeError(t, data, err)
+		if err == nil && p.VersionAndType != VersionAndType {
+			t.Fatalf("accepted version %#x", p.VersionAndType)
+		}
+	})
+}
+
+func FuzzDecodeRawPPPoED(f *testing.F) {
+	f.Add([]byte{0x11, 0x09, 0x00, 0x00, 0x00, 0x04, 0x01, 0x10, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := DecodeRawPPPoED(data)
+		checkDecodeError(t, data, err)
+		if err != nil {
+			return
+		}
+		if encoded := p.AppendEncode(nil); len(encoded) > len(data) {
+			t.Fatalf("re-encoded %d bytes from %d", len(encoded), len(data))
+		}
+	})
+}
+
+func FuzzDecodePPPoES(f *testing.F) {
+	f.Add([]byte{0x11, 0x00, 0x00, 0x01, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p PPPoES
+		var frame ppp.Frame
+		err := DecodeSessionFrameInto(&p, &frame, data)
+		checkDecodeError(t, data, err)
+		if err != nil || len(data) < PPPoESBasicLen {
+			return
+		}
+		if pLen := int(binary.BigEndian.Uint16(data[4:6])); len(p.Payload) != pLen {
+			t.Fatalf("payload length %d, length field %d", len(p.Payload), pLen)
+		}
+	})
+}
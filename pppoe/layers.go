@@ -0,0 +1,125 @@
+package pppoe
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"pppoe-probe/ppp"
+)
+
+// LayerTypePPPoETags gopacket 中的层类型，编号见 ppp.LayerNumberPPPoETags。
+// 导入本包后 gopacket.NewPacket 会在 layers.PPPoE 之后解析出 PPPoETags，在 layers.PPP 之后解析出 ppp 包中的 LCP、PAP 等控制协议，
+// 也可以在 gopacket.DecodingLayerParser 中使用
+var LayerTypePPPoETags = gopacket.RegisterLayerType(ppp.LayerNumberPPPoETags, gopacket.LayerTypeMetadata{Name: "PPPoETags", Decoder: gopacket.DecodeFunc(decodePPPoETags)})
+
+// init 同 ppp 包，修改的是 gopacket 的全局表。gopacket 默认只为会话报文填写了解码器，discovery 报文原本没有
+func init() {
+	for _, code := range []DCode{CodePADI, CodePADO, CodePADR, CodePADS, CodePADT} {
+		layers.PPPoECodeMetadata[code] = layers.EnumMetadata{DecodeWith: LayerTypePPPoETags, Name: code.String(), LayerType: LayerTypePPPoETags}
+	}
+}
+
+// PPPoEHeader PPPoE 头，session 报文还包含其后的 PPP 协议号。
+// layers.PPPoE 和 layers.PPP 没有实现 gopacket.DecodingLayer，在 DecodingLayerParser 中用它代替二者，
+// 之后的层为 PPPoETags、LCP 等控制协议或 IPv4/IPv6
+type PPPoEHeader struct {
+	layers.BaseLayer
+	VersionAndType byte
+	Code           byte
+	SessionID      uint16
+	Length         uint16
+	// Protocol 承载的 PPP 协议，discovery 报文为 0
+	Protocol ppp.Protocol
+}
+
+func (l *PPPoEHeader) LayerType() gopacket.LayerType  { return layers.LayerTypePPPoE }
+func (l *PPPoEHeader) CanDecode() gopacket.LayerClass { return layers.LayerTypePPPoE }
+func (l *PPPoEHeader) NextLayerType() gopacket.LayerType {
+	if l.Code != byte(SCodeSessionData) {
+		return LayerTypePPPoETags
+	}
+	return l.Protocol.NextLayerType()
+}
+
+func (l *PPPoEHeader) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	layer := LayerPPPoED
+	if len(data) > 1 && data[1] == byte(SCodeSessionData) {
+		layer = LayerPPPoES
+	}
+	if len(data) < PPPoESBasicLen {
+		return ppp.DecodeFailed(df, truncated(layer, "header", 0, PPPoESBasicLen, len(data)))
+	}
+	l.VersionAndType = data[0]
+	l.Code = data[1]
+	l.SessionID = binary.BigEndian.Uint16(data[2:4])
+	l.Length = binary.BigEndian.Uint16(data[4:6])
+	l.Protocol = 0
+	if l.VersionAndType != VersionAndType {
+		return &DecodeError{Layer: layer, Field: "version", Expected: int(VersionAndType), Actual: int(l.VersionAndType), Err: ErrBadVersion}
+	}
+	payload := data[PPPoESBasicLen:]
+	if len(payload) < int(l.Length) {
+		return ppp.DecodeFailed(df, truncated(layer, "payload", PPPoESBasicLen, int(l.Length), len(payload)))
+	}
+	payload = payload[:l.Length]
+	if layer == LayerPPPoED {
+		l.BaseLayer = layers.BaseLayer{Contents: data[:PPPoEDBasicLen], Payload: payload}
+		return nil
+	}
+	if len(payload) < ppp.ProtocolLen {
+		return badLength(layer, "length", 4, ppp.ProtocolLen, int(l.Length))
+	}
+	l.Protocol = ppp.Protocol(binary.BigEndian.Uint16(payload))
+	l.BaseLayer = layers.BaseLayer{Contents: data[:PPPoESBasicLen+ppp.ProtocolLen], Payload: payload[ppp.ProtocolLen:]}
+	return nil
+}
+
+func (l *PPPoEHeader) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	n := PPPoESBasicLen
+	if l.Code == byte(SCodeSessionData) {
+		n += ppp.ProtocolLen
+	}
+	length := len(b.Bytes()) + n - PPPoESBasicLen
+	bs, err := b.PrependBytes(n)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		l.Length = uint16(length)
+	}
+	bs[0] = l.VersionAndType
+	bs[1] = l.Code
+	binary.BigEndian.PutUint16(bs[2:4], l.SessionID)
+	binary.BigEndian.PutUint16(bs[4:6], l.Length)
+	if n > PPPoESBasicLen {
+		binary.BigEndian.PutUint16(bs[6:8], uint16(l.Protocol))
+	}
+	return nil
+}
+
+// PPPoETags PPPoE discovery 报文头之后的标签，即 layers.PPPoE 的 Payload
+type PPPoETags struct {
+	layers.BaseLayer
+	DiscoveryTags
+}
+
+func (l *PPPoETags) LayerType() gopacket.LayerType     { return LayerTypePPPoETags }
+func (l *PPPoETags) CanDecode() gopacket.LayerClass    { return LayerTypePPPoETags }
+func (l *PPPoETags) NextLayerType() gopacket.LayerType { return gopacket.LayerTypeZero }
+func (l *PPPoETags) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	l.DiscoveryTags = DiscoveryTags{}
+	if err := l.DiscoveryTags.decode(data, 0); err != nil {
+		return ppp.DecodeFailed(df, err)
+	}
+	l.BaseLayer = layers.BaseLayer{Contents: data}
+	return nil
+}
+
+func (l *PPPoETags) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	return ppp.Prepend(b, l.DiscoveryTags.encode())
+}
+
+func decodePPPoETags(data []byte, p gopacket.PacketBuilder) error {
+	return ppp.DecodeLayer(&PPPoETags{}, data, p)
+}
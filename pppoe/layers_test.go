@@ -0,0 +1,92 @@
+package pppoe
+
+import (
+	"net"
+	"pppoe-probe/ppp"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+var layerTestMac = net.HardwareAddr{0x00, 0xe0, 0x4c, 0x36, 0x17, 0xf8}
+
+func ethernetFrame(ethType layers.EthernetType, payload []byte) []byte {
+	frame := append([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, layerTestMac...)
+	frame = append(frame, byte(ethType>>8), byte(ethType))
+	return append(frame, payload...)
+}
+
+func TestLayers_NewPacketDiscovery(t *testing.T) {
+	pppoed := NewPPPoEDPacket(CodePADO, 0, "ubuntu", []byte{0x01, 0x02}, []byte{0x03, 0x04})
+	pppoed.ServiceNames = []string{"internet"}
+	packet := gopacket.NewPacket(ethernetFrame(layers.EthernetTypePPPoEDiscovery, pppoed.Encode()), layers.LayerTypeEthernet, gopacket.Default)
+	assert.Nil(t, packet.ErrorLayer())
+	tags, ok := packet.Layer(LayerTypePPPoETags).(*PPPoETags)
+	assert.True(t, ok)
+	assert.Equal(t, "ubuntu", tags.AcName)
+	assert.Equal(t, []string{"internet"}, tags.ServiceNames)
+	assert.Equal(t, []byte{0x01, 0x02}, tags.HostUniq)
+	assert.Equal(t, []byte{0x03, 0x04}, tags.AcCookie)
+}
+
+func TestLayers_NewPacketSession(t *testing.T) {
+	lcp := ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1,
+		MaxReceiveUint: 1492, MagicNumber: 0x12345678, AuthProtocol: ppp.AuthProtocolPassword}}
+	pap := ppp.Frame{Protocol: ppp.ProtocolPAP, PwdAuthProtocol: ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeRequest, Identifier: 2, PeerID: "user", Password: "secret"}}
+	ipcp := ppp.Frame{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 3, IPAddress: net.IPv4(10, 0, 0, 2).To4()}}
+	// 以太网最小帧补齐
+	data := append(AppendSessionFrame(nil, 1, &lcp), make([]byte, 20)...)
+
+	packet := gopacket.NewPacket(ethernetFrame(layers.EthernetTypePPPoESession, data), layers.LayerTypeEthernet, gopacket.Default)
+	assert.Nil(t, packet.ErrorLayer())
+	l, ok := packet.Layer(ppp.LayerTypeLCP).(*ppp.LCP)
+	assert.True(t, ok)
+	assert.Equal(t, ppp.LinkCodeConfigRequest, l.Code)
+	assert.Equal(t, uint16(1492), l.MaxReceiveUint)
+	assert.Equal(t, uint32(0x12345678), l.MagicNumber)
+	assert.Equal(t, lcp.Encode()[ppp.ProtocolLen:], l.LayerContents())
+
+	packet = gopacket.NewPacket(ethernetFrame(layers.EthernetTypePPPoESession, AppendSessionFrame(nil, 1, &pap)), layers.LayerTypeEthernet, gopacket.Default)
+	p, ok := packet.Layer(ppp.LayerTypePAP).(*ppp.PAP)
+	assert.True(t, ok)
+	assert.Equal(t, "user", p.PeerID)
+	assert.Equal(t, "secret", p.Password)
+	assert.NotContains(t, packet.String(), "secret")
+
+	packet = gopacket.NewPacket(ethernetFrame(layers.EthernetTypePPPoESession, AppendSessionFrame(nil, 1, &ipcp)), layers.LayerTypeEthernet, gopacket.Default)
+	i, ok := packet.Layer(ppp.LayerTypeIPCP).(*ppp.IPCP)
+	assert.True(t, ok)
+	assert.Equal(t, net.IPv4(10, 0, 0, 2).To4(), i.IPAddress)
+}
+
+func TestLayers_DecodingLayerParser(t *testing.T) {
+	chap := ppp.Frame{Protocol: ppp.ProtocolCHAP, ChapProtocol: ppp.ChapProtocol{Code: ppp.ChapCodeChallenge, Identifier: 1, Value: []byte{0x01, 0x02, 0x03, 0x04}, Name: "bras"}}
+	var (
+		eth   layers.Ethernet
+		pppoe PPPoEHeader
+		lcp   ppp.LCP
+		c     ppp.CHAP
+	)
+	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &pppoe, &lcp, &c)
+	var decoded []gopacket.LayerType
+	err := parser.DecodeLayers(ethernetFrame(layers.EthernetTypePPPoESession, AppendSessionFrame(nil, 1, &chap)), &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, []gopacket.LayerType{layers.LayerTypeEthernet, layers.LayerTypePPPoE, ppp.LayerTypeCHAP}, decoded)
+	assert.Equal(t, ppp.ChapCodeChallenge, c.Code)
+	assert.Equal(t, "bras", c.Name)
+}
+
+func TestLayers_SerializeSession(t *testing.T) {
+	f := ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1,
+		MaxReceiveUint: 1492, MagicNumber: 0x01020304, AuthProtocol: ppp.AuthProtocolChap}}
+	buf := gopacket.NewSerializeBuffer()
+	header := &PPPoEHeader{VersionAndType: VersionAndType, Code: byte(SCodeSessionData), SessionID: 1, Protocol: ppp.ProtocolLCP}
+	assert.Nil(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, header, &ppp.LCP{LinkCtrlProtocol: f.LinkProtocol}))
+	assert.Equal(t, AppendSessionFrame(nil, 1, &f), buf.Bytes())
+
+	var decoded PPPoEHeader
+	assert.Nil(t, decoded.DecodeFromBytes(NewPPPoEDPacket(CodePADI, 0, "", nil, nil).Encode(), gopacket.NilDecodeFeedback))
+	assert.Equal(t, LayerTypePPPoETags, decoded.NextLayerType())
+}
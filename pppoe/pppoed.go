@@ -2,7 +2,7 @@ package pppoe
 
 import (
 	"encoding/binary"
-	"errors"
+	"fmt"
 )
 
 type DCode byte
@@ -11,114 +11,230 @@ const CodePADI DCode = 0x09
 const CodePADO DCode = 0x07
 const CodePADR DCode = 0x19
 const CodePADS DCode = 0x65
+const CodePADT DCode = 0xa7
+
+func (c DCode) String() string {
+	switch c {
+	case CodePADI:
+		return "PADI"
+	case CodePADO:
+		return "PADO"
+	case CodePADR:
+		return "PADR"
+	case CodePADS:
+		return "PADS"
+	case CodePADT:
+		return "PADT"
+	}
+	return "Unknown"
+}
 
 type TagType uint16
 
 const TagTypeBasic = 0x0101
+const TagTypeServiceName = TagTypeBasic
 const TagTypeAcName = 0x0102
 const TagTypeHostUniq = 0x0103
 const TagTypeAcCookie = 0x0104
+const TagTypeVendorSpecific = 0x0105
+const TagTypeRelaySessionID = 0x0110
+
+// VendorTag Vendor-Specific 标签，前 4 字节为 vendor id
+type VendorTag struct {
+	VendorID uint32
+	Value    []byte
+}
 
 const PPPoEDBasicLen = 6
 
+// VersionAndType RFC 2516 规定 PPPoE 头中的版本和类型都为 1
+const VersionAndType byte = 0x11
+
+// DiscoveryTags PPPoE discovery 报文中的标签
+type DiscoveryTags struct {
+	AcName       string
+	AcCookie     []byte
+	HostUniq     []byte
+	ServiceNames []string
+	VendorTags   []VendorTag
+}
+
 // Packet ethernet pppoe discovery packet
 type PPPoED struct {
 	VersionAndType byte
 	Code           DCode
 	SessionID      uint16
-	AcName         string
-	AcCookie       []byte
-	HostUniq       []byte
+	DiscoveryTags
 }
 
 func NewPPPoEDPacket(code DCode, sessionID uint16, acName string, hostUniq []byte, acCookie []byte) PPPoED {
 	return PPPoED{
-		VersionAndType: 0x11,
+		VersionAndType: VersionAndType,
 		Code:           code,
 		SessionID:      sessionID,
-		AcName:         acName,
-		HostUniq:       hostUniq,
-		AcCookie:       acCookie,
+		DiscoveryTags: DiscoveryTags{
+			AcName:   acName,
+			HostUniq: hostUniq,
+			AcCookie: acCookie,
+		},
 	}
 }
 
 func (p PPPoED) Encode() (bs []byte) {
-	var tags []byte
+	return p.AppendEncode(nil)
+}
+
+// AppendEncode 将报文追加到 dst 后返回，dst 容量足够时不分配内存
+func (p PPPoED) AppendEncode(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, p.VersionAndType, byte(p.Code))
+	dst = binary.BigEndian.AppendUint16(dst, p.SessionID)
+	dst = append(dst, 0, 0)
+	dst = p.DiscoveryTags.appendEncode(dst)
+	binary.BigEndian.PutUint16(dst[start+4:], uint16(len(dst)-start-PPPoEDBasicLen))
+	return dst
+}
+
+func (p DiscoveryTags) encode() (tags []byte) {
+	return p.appendEncode(nil)
+}
+
+func (p DiscoveryTags) appendEncode(dst []byte) []byte {
 	if len(p.AcName) > 0 {
-		tags = append(tags, divideUint16IntoByteArray(TagTypeAcName)...)
-		tags = append(tags, divideUint16IntoByteArray(uint16(len(p.AcName)))...)
-		tags = append(tags, []byte(p.AcName)...)
+		dst = appendTag(dst, TagTypeAcName, len(p.AcName))
+		dst = append(dst, p.AcName...)
+	}
+	if len(p.ServiceNames) == 0 {
+		dst = appendTag(dst, TagTypeBasic, 0)
+	}
+	for _, serviceName := range p.ServiceNames {
+		dst = appendTag(dst, TagTypeServiceName, len(serviceName))
+		dst = append(dst, serviceName...)
 	}
-	tags = append(tags, divideUint16IntoByteArray(TagTypeBasic)...)
-	tags = append(tags, divideUint16IntoByteArray(uint16(0))...)
 	if len(p.AcCookie) > 0 {
-		tags = append(tags, divideUint16IntoByteArray(TagTypeAcCookie)...)
-		tags = append(tags, divideUint16IntoByteArray(uint16(len(p.AcCookie)))...)
-		tags = append(tags, p.AcCookie...)
+		dst = appendTag(dst, TagTypeAcCookie, len(p.AcCookie))
+		dst = append(dst, p.AcCookie...)
 	}
 	if len(p.HostUniq) > 0 {
-		tags = append(tags, divideUint16IntoByteArray(TagTypeHostUniq)...)
-		tags = append(tags, divideUint16IntoByteArray(uint16(len(p.HostUniq)))...)
-		tags = append(tags, p.HostUniq...)
+		dst = appendTag(dst, TagTypeHostUniq, len(p.HostUniq))
+		dst = append(dst, p.HostUniq...)
 	}
-
-	bs = append(bs, p.VersionAndType, byte(p.Code))
-	bs = append(bs, divideUint16IntoByteArray(p.SessionID)...)
-	bs = append(bs, divideUint16IntoByteArray(uint16(len(tags)))...)
-	bs = append(bs, tags...)
-	return
+	for _, vendor := range p.VendorTags {
+		dst = appendTag(dst, TagTypeVendorSpecific, len(vendor.Value)+4)
+		dst = binary.BigEndian.AppendUint32(dst, vendor.VendorID)
+		dst = append(dst, vendor.Value...)
+	}
+	return dst
 }
 
-func divideUint16IntoByteArray(u uint16) []byte {
-	return []byte{byte(u >> 8), byte(u)}
+// appendTag 追加标签类型和长度
+func appendTag(dst []byte, tagType TagType, length int) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(tagType))
+	return binary.BigEndian.AppendUint16(dst, uint16(length))
 }
-func divideUint32IntoByteArray(u uint32) []byte {
-	return []byte{byte(u >> 24), byte(u >> 16), byte(u >> 8), byte(u)}
+
+// reuseString b 与 s 内容相同时返回 s，循环解码时避免重复分配
+func reuseString(s string, b []byte) string {
+	if s == string(b) {
+		return s
+	}
+	return string(b)
 }
 
 func DecodePPPoED(content []byte) (p PPPoED, err error) {
+	err = DecodePPPoEDInto(&p, content)
+	return
+}
+
+// DecodePPPoEDInto 解码到 p，用于循环解码时避免分配内存。
+// p 中原有的切片和字符串会被复用或覆盖，调用方不能再持有上一次解码的结果；解码结果中的切片引用 content
+func DecodePPPoEDInto(p *PPPoED, content []byte) (err error) {
+	tags := p.DiscoveryTags
+	*p = PPPoED{}
+	payload, err := decodeHeader(p, content)
+	if err != nil || len(payload) == 0 {
+		return
+	}
+	p.DiscoveryTags = tags
+	err = p.DiscoveryTags.decode(payload, PPPoEDBasicLen)
+	return
+}
+
+// decodeHeader 解码 PPPoE 头到 p 的 VersionAndType、Code、SessionID，返回长度字段范围内的标签部分。
+// 短帧会被补齐到以太网最小长度，补齐的字节不在返回值中
+func decodeHeader(p *PPPoED, content []byte) (payload []byte, err error) {
 	if len(content) < PPPoEDBasicLen {
-		err = errors.New("invalid content length")
+		err = truncated(LayerPPPoED, "header", 0, PPPoEDBasicLen, len(content))
 		return
 	}
 	p.VersionAndType = content[0]
 	p.Code = DCode(content[1])
 	p.SessionID = binary.BigEndian.Uint16(content[2:4])
-	pLen := binary.BigEndian.Uint16(content[4:6])
-	if pLen == 0 {
+	if p.VersionAndType != VersionAndType {
+		err = &DecodeError{Layer: LayerPPPoED, Field: "version", Expected: int(VersionAndType), Actual: int(p.VersionAndType), Err: ErrBadVersion}
+		return
+	}
+	switch p.Code {
+	case CodePADI, CodePADO, CodePADR, CodePADS, CodePADT:
+	default:
+		err = &DecodeError{Layer: LayerPPPoED, Field: "code", Offset: 1, Expected: -1, Actual: int(p.Code), Err: ErrUnknownCode}
 		return
 	}
-	if len(content) < int(pLen)+PPPoEDBasicLen {
-		err = errors.New("invalid payload length")
+	pLen := int(binary.BigEndian.Uint16(content[4:6]))
+	if len(content) < pLen+PPPoEDBasicLen {
+		err = truncated(LayerPPPoED, "payload", PPPoEDBasicLen, pLen, len(content)-PPPoEDBasicLen)
 		return
 	}
-	payload := content[PPPoEDBasicLen:]
+	payload = content[PPPoEDBasicLen : PPPoEDBasicLen+pLen]
+	return
+}
+
+// decode 解析标签，offset 为 payload 在报文中的偏移，用于错误信息。复用 p 中 ServiceNames、VendorTags 的空间
+func (p *DiscoveryTags) decode(payload []byte, offset int) (err error) {
+	old := *p
+	*p = DiscoveryTags{ServiceNames: old.ServiceNames[:0], VendorTags: old.VendorTags[:0]}
 	for {
 		if len(payload) == 0 {
 			break
 		}
 		if len(payload) < 4 {
-			err = errors.New("invalid tag length")
+			err = truncated(LayerPPPoED, "tag header", offset, 4, len(payload))
 			return
 		}
 		tagType := binary.BigEndian.Uint16(payload[0:2])
 		tLen := binary.BigEndian.Uint16(payload[2:4])
 		if len(payload) < int(tLen)+4 {
-			err = errors.New("invalid tag paload length")
+			err = truncated(LayerPPPoED, fmt.Sprintf("tag %#04x", tagType), offset, int(tLen)+4, len(payload))
 			return
 		}
 		if tLen > 0 {
 			tagPayload := payload[4 : 4+tLen]
 			switch tagType {
 			case TagTypeAcName:
-				p.AcName = string(tagPayload)
+				p.AcName = reuseString(old.AcName, tagPayload)
+			case TagTypeServiceName:
+				var name string
+				if n := len(p.ServiceNames); n < len(old.ServiceNames) {
+					name = old.ServiceNames[n]
+				}
+				p.ServiceNames = append(p.ServiceNames, reuseString(name, tagPayload))
 			case TagTypeHostUniq:
 				p.HostUniq = tagPayload
 			case TagTypeAcCookie:
 				p.AcCookie = tagPayload
+			case TagTypeVendorSpecific:
+				// 不足 4 字节放不下 Vendor-Id，部分 AC 会发出这样的标签，忽略而不是整个报文解码失败
+				if tLen < 4 {
+					break
+				}
+				p.VendorTags = append(p.VendorTags, VendorTag{
+					VendorID: binary.BigEndian.Uint32(tagPayload[:4]),
+					Value:    tagPayload[4:],
+				})
 			}
 		}
 		payload = payload[4+tLen:]
+		offset += 4 + int(tLen)
 	}
 	return
 }
@@ -28,3 +28,127 @@ func TestPPPoED_Encode(t *testing.T) {
 	pppoed := NewPPPoEDPacket(CodePADO, 0, "ubuntu", hostUniq, acCookie)
 	assert.Equal(t, data, pppoed.Encode())
 }
+
+func TestDecodePPPoED_ServiceNames(t *testing.T) {
+	pppoed := NewPPPoEDPacket(CodePADO, 0, "ubuntu", nil, nil)
+	pppoed.ServiceNames = []string{"internet", "iptv"}
+	decoded, err := DecodePPPoED(pppoed.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, CodePADO, decoded.Code)
+	assert.Equal(t, "ubuntu", decoded.AcName)
+	assert.Equal(t, []string{"internet", "iptv"}, decoded.ServiceNames)
+}
+
+func TestDecodePPPoED_VendorTags(t *testing.T) {
+	pppoed := NewPPPoEDPacket(CodePADO, 0, "ubuntu", nil, nil)
+	pppoed.VendorTags = []VendorTag{{VendorID: 3561, Value: []byte{0x01, 0x03, 0x65, 0x74, 0x68}}}
+	decoded, err := DecodePPPoED(pppoed.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, pppoed.VendorTags, decoded.VendorTags)
+}
+
+func TestDecodePPPoED_ShortVendorTag(t *testing.T) {
+	data := []byte{
+		0x11, 0x07, 0x00, 0x00, 0x00, 0x16,
+		0x01, 0x02, 0x00, 0x04, 'b', 'r', 'a', 's',
+		// Vendor-Specific 只有 2 字节，放不下 Vendor-Id
+		0x01, 0x05, 0x00, 0x02, 0xab, 0xcd,
+		0x01, 0x04, 0x00, 0x04, 0x01, 0x02, 0x03, 0x04,
+	}
+	decoded, err := DecodePPPoED(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "bras", decoded.AcName)
+	assert.Empty(t, decoded.VendorTags)
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, decoded.AcCookie)
+}
+
+func TestDecodePPPoED_Padding(t *testing.T) {
+	pppoed := NewPPPoEDPacket(CodePADS, 0x1234, "ubuntu", []byte{0x01, 0x02}, nil)
+	data := append(pppoed.Encode(), 0x00, 0x00, 0x00)
+	decoded, err := DecodePPPoED(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0x1234), decoded.SessionID)
+	assert.Equal(t, []byte{0x01, 0x02}, decoded.HostUniq)
+}
+
+func TestDecodePPPoED_Errors(t *testing.T) {
+	var de *DecodeError
+	_, err := DecodePPPoED([]byte{0x11, 0x09, 0x00})
+	assert.ErrorIs(t, err, ErrTruncated)
+	assert.ErrorAs(t, err, &de)
+	assert.Equal(t, LayerPPPoED, de.Layer)
+	assert.Equal(t, PPPoEDBasicLen, de.Expected)
+	assert.Equal(t, 3, de.Actual)
+
+	_, err = DecodePPPoED([]byte{0x12, 0x09, 0x00, 0x00, 0x00, 0x00})
+	assert.ErrorIs(t, err, ErrBadVersion)
+
+	_, err = DecodePPPoED([]byte{0x11, 0x42, 0x00, 0x00, 0x00, 0x00})
+	assert.ErrorIs(t, err, ErrUnknownCode)
+
+	// Host-Uniq 标签长度 8，实际只有 2 字节
+	_, err = DecodePPPoED([]byte{0x11, 0x09, 0x00, 0x00, 0x00, 0x06, 0x01, 0x03, 0x00, 0x08, 0x01, 0x02})
+	assert.ErrorIs(t, err, ErrTruncated)
+	assert.ErrorAs(t, err, &de)
+	assert.Equal(t, "tag 0x0103", de.Field)
+	assert.Equal(t, 6, de.Offset)
+	assert.Equal(t, 12, de.Expected)
+	assert.Equal(t, 6, de.Actual)
+}
+
+func allocTestPPPoED() PPPoED {
+	p := NewPPPoEDPacket(CodePADO, 0, "ubuntu", []byte{0x01, 0x02, 0x03, 0x04}, make([]byte, 20))
+	p.ServiceNames = []string{"internet", "iptv"}
+	p.VendorTags = []VendorTag{{VendorID: 3561, Value: []byte{0x01, 0x03, 0x65, 0x74, 0x68}}}
+	return p
+}
+
+func TestPPPoED_AppendEncode(t *testing.T) {
+	p := allocTestPPPoED()
+	bs := p.AppendEncode([]byte{0xaa})
+	assert.Equal(t, p.Encode(), bs[1:])
+
+	buf := make([]byte, 0, 1500)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = p.AppendEncode(buf[:0])
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func TestDecodePPPoEDInto(t *testing.T) {
+	data := allocTestPPPoED().Encode()
+	var p PPPoED
+	assert.Nil(t, DecodePPPoEDInto(&p, data))
+	decoded, err := DecodePPPoED(data)
+	assert.Nil(t, err)
+	assert.Equal(t, decoded, p)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = DecodePPPoEDInto(&p, data)
+	})
+	assert.Equal(t, float64(0), allocs)
+
+	assert.Nil(t, DecodePPPoEDInto(&p, NewPPPoEDPacket(CodePADT, 1, "", nil, nil).Encode()))
+	assert.Equal(t, CodePADT, p.Code)
+	assert.Empty(t, p.AcName)
+	assert.Empty(t, p.VendorTags)
+	assert.Empty(t, p.ServiceNames)
+}
+
+func BenchmarkPPPoED_AppendEncode(b *testing.B) {
+	p := allocTestPPPoED()
+	buf := make([]byte, 0, 1500)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = p.AppendEncode(buf[:0])
+	}
+}
+
+func BenchmarkDecodePPPoEDInto(b *testing.B) {
+	data := allocTestPPPoED().Encode()
+	var p PPPoED
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = DecodePPPoEDInto(&p, data)
+	}
+}
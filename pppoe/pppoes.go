@@ -2,136 +2,87 @@ package pppoe
 
 import (
 	"encoding/binary"
-	"errors"
+
+	"pppoe-probe/ppp"
 )
 
 type SCode byte
 
 const SCodeSessionData SCode = 0x00
 
-type P2PProtocol uint16
-
-const (
-	P2PLinkCtrlProtocol P2PProtocol = 0xc021
-	P2PAuthProtocol     P2PProtocol = 0xc023
-)
-
 const PPPoESBasicLen = 6
-const P2PProtocolBasicLen = 4
-const LinkCtrlOptionBasicLen = 2
 
+// PPPoES PPPoE 会话报文，Payload 为承载的 PPP 帧（从协议字段开始），用 ppp.DecodeFrame 解码
 type PPPoES struct {
-	VersionAndType  byte
-	Code            SCode
-	SessionID       uint16
-	P2PProtocol     P2PProtocol
-	LinkProtocol    LinkCtrlProtocol
-	PwdAuthProtocol PwdAuthProtocol
+	VersionAndType byte
+	Code           SCode
+	SessionID      uint16
+	Payload        []byte
 }
 
-func NewPPPoESLinkProtocolPacket(sessionID uint16, auth AuthProtocol, linkCode LinkCode, identifier byte, maxReceiveUint uint16, magicNumber uint32, pfc bool, acfc bool, cb CallbackOperation) PPPoES {
-	return PPPoES{
-		VersionAndType: 0x11,
-		Code:           SCodeSessionData,
-		P2PProtocol:    P2PLinkCtrlProtocol,
-		SessionID:      sessionID,
-		LinkProtocol: LinkCtrlProtocol{
-			Code:                        linkCode,
-			Identifier:                  identifier,
-			AuthProtocol:                auth,
-			MaxReceiveUint:              maxReceiveUint,
-			MagicNumber:                 magicNumber,
-			ProtocolFieldCompression:    pfc,
-			AddressCtrlFieldCompression: acfc,
-			CallbackOperation:           cb,
-		},
-	}
+func (p PPPoES) Encode() (bs []byte) {
+	return p.AppendEncode(nil)
 }
 
-func (p PPPoES) Encode() (bs []byte) {
-	var pd []byte
-	pd = append(pd, divideUint16IntoByteArray(uint16(p.P2PProtocol))...)
-	switch p.P2PProtocol {
-	case P2PLinkCtrlProtocol:
-		pd = append(pd,
-			byte(p.LinkProtocol.Code),
-			p.LinkProtocol.Identifier)
-		var options []byte
-		if p.LinkProtocol.MaxReceiveUint > 0 {
-			options = append(options, byte(OptionMaxReceiveUint), 0x4)
-			options = append(options, divideUint16IntoByteArray(p.LinkProtocol.MaxReceiveUint)...)
-		}
-		if p.LinkProtocol.MagicNumber > 0 {
-			options = append(options, byte(OptionMagicNumber), 0x6)
-			options = append(options, divideUint32IntoByteArray(p.LinkProtocol.MagicNumber)...)
-		}
-		if p.LinkProtocol.AuthProtocol > 0 {
-			options = append(options, byte(OptionAuthProtocol), 0x4)
-			options = append(options, divideUint16IntoByteArray(uint16(p.LinkProtocol.AuthProtocol))...)
-		}
-		if p.LinkProtocol.ProtocolFieldCompression {
-			options = append(options, byte(OptionProtocolFieldCompression), 0x2)
-		}
-		if p.LinkProtocol.AddressCtrlFieldCompression {
-			options = append(options, byte(OptionAddressAndControlFieldCompression), 0x2)
-		}
-		if p.LinkProtocol.CallbackOperation > 0 {
-			options = append(options, byte(OptionCallback), 0x3, byte(p.LinkProtocol.CallbackOperation))
-		}
-		pd = append(pd, divideUint16IntoByteArray(uint16(len(options)+4))...)
-		pd = append(pd, options...)
-	case P2PAuthProtocol:
-		pd = append(pd,
-			p.PwdAuthProtocol.Code,
-			p.PwdAuthProtocol.Identifier)
-		var data []byte
-		if len(p.PwdAuthProtocol.PeerID) > 0 {
-			data = append(data, byte(len(p.PwdAuthProtocol.PeerID)))
-			data = append(data, []byte(p.PwdAuthProtocol.PeerID)...)
-		}
-		if len(p.PwdAuthProtocol.Password) > 0 {
-			data = append(data, byte(len(p.PwdAuthProtocol.Password)))
-			data = append(data, []byte(p.PwdAuthProtocol.Password)...)
-		}
-		pd = append(pd, data...)
-	}
+// AppendEncode 将报文追加到 dst 后返回，dst 容量足够时不分配内存
+func (p PPPoES) AppendEncode(dst []byte) []byte {
+	dst = appendSessionHeader(dst, p.VersionAndType, p.Code, p.SessionID, len(p.Payload))
+	return append(dst, p.Payload...)
+}
 
-	bs = append(bs, p.VersionAndType, byte(p.Code))
-	bs = append(bs, divideUint16IntoByteArray(p.SessionID)...)
-	bs = append(bs, divideUint16IntoByteArray(uint16(len(pd)))...)
-	bs = append(bs, pd...)
-	return
+// AppendSessionFrame 将承载 f 的会话报文追加到 dst 后返回，PPP 帧直接编码到 dst 中，不经过中间缓冲区
+func AppendSessionFrame(dst []byte, sessionID uint16, f *ppp.Frame) []byte {
+	start := len(dst)
+	dst = appendSessionHeader(dst, VersionAndType, SCodeSessionData, sessionID, 0)
+	dst = f.AppendEncode(dst)
+	binary.BigEndian.PutUint16(dst[start+4:], uint16(len(dst)-start-PPPoESBasicLen))
+	return dst
+}
+
+func appendSessionHeader(dst []byte, versionAndType byte, code SCode, sessionID uint16, length int) []byte {
+	dst = append(dst, versionAndType, byte(code))
+	dst = binary.BigEndian.AppendUint16(dst, sessionID)
+	return binary.BigEndian.AppendUint16(dst, uint16(length))
 }
 
 func DecodePPPoES(bs []byte) (p PPPoES, err error) {
+	err = DecodePPPoESInto(&p, bs)
+	return
+}
+
+// DecodePPPoESInto 解码到 p，Payload 引用 bs 中长度字段范围内的数据
+func DecodePPPoESInto(p *PPPoES, bs []byte) (err error) {
+	*p = PPPoES{}
 	if len(bs) < PPPoESBasicLen {
-		err = errors.New("invalid pppoes content length")
+		err = truncated(LayerPPPoES, "header", 0, PPPoESBasicLen, len(bs))
 		return
 	}
 	p.VersionAndType = bs[0]
 	p.Code = SCode(bs[1])
 	p.SessionID = binary.BigEndian.Uint16(bs[2:4])
-	pLen := binary.BigEndian.Uint16(bs[4:PPPoESBasicLen])
-	if pLen == 0 {
+	if p.VersionAndType != VersionAndType {
+		err = &DecodeError{Layer: LayerPPPoES, Field: "version", Expected: int(VersionAndType), Actual: int(p.VersionAndType), Err: ErrBadVersion}
+		return
+	}
+	if p.Code != SCodeSessionData {
+		err = &DecodeError{Layer: LayerPPPoES, Field: "code", Offset: 1, Expected: int(SCodeSessionData), Actual: int(p.Code), Err: ErrUnknownCode}
 		return
 	}
-	// p2p protocol
+	pLen := binary.BigEndian.Uint16(bs[4:PPPoESBasicLen])
 	payload := bs[PPPoESBasicLen:]
 	if len(payload) < int(pLen) {
-		err = errors.New("invalid pppoes payload length")
+		err = truncated(LayerPPPoES, "payload", PPPoESBasicLen, int(pLen), len(payload))
 		return
 	}
-	p.P2PProtocol = P2PProtocol(binary.BigEndian.Uint16(payload[:2]))
-	payload = payload[2:]
-	if len(payload) < P2PProtocolBasicLen {
-		err = errors.New("invalid protocol length")
+	// 短帧会被补齐到以太网最小长度，只取长度字段范围内的数据
+	p.Payload = payload[:pLen]
+	return
+}
+
+// DecodeSessionFrameInto 解码会话报文及其承载的 PPP 帧，PPP 帧解码错误的偏移以 PPPoE 头为起点
+func DecodeSessionFrameInto(p *PPPoES, f *ppp.Frame, bs []byte) (err error) {
+	if err = DecodePPPoESInto(p, bs); err != nil {
 		return
 	}
-	switch p.P2PProtocol {
-	case P2PLinkCtrlProtocol:
-		p.LinkProtocol, err = DecodeLinkCtrlProtocol(payload)
-	case P2PAuthProtocol:
-		p.PwdAuthProtocol, err = DecodePwdAuthProtocol(payload)
-	}
-	return
+	return ppp.ShiftOffset(ppp.DecodeFrameInto(f, p.Payload), PPPoESBasicLen)
 }
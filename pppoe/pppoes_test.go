@@ -4,6 +4,8 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/stretchr/testify/assert"
+	"net"
+	"pppoe-probe/ppp"
 	"testing"
 )
 
@@ -16,28 +18,118 @@ func TestDecodePPPoES(t *testing.T) {
 	assert.Equal(t, byte(0x11), p.VersionAndType)
 	assert.Equal(t, SCodeSessionData, p.Code)
 	assert.Equal(t, uint16(1), p.SessionID)
-	assert.Equal(t, P2PLinkCtrlProtocol, p.P2PProtocol)
+	// 以太网最小帧补齐的填充不属于报文
+	assert.Equal(t, data[20:43], p.Payload)
 
-	assert.Equal(t, LinkCodeConfigRequest, p.LinkProtocol.Code)
-	assert.Equal(t, byte(0), p.LinkProtocol.Identifier)
-	assert.Equal(t, uint16(1480), p.LinkProtocol.MaxReceiveUint)
-	assert.Equal(t, uint32(127357469), p.LinkProtocol.MagicNumber)
-	assert.True(t, p.LinkProtocol.ProtocolFieldCompression)
-	assert.True(t, p.LinkProtocol.AddressCtrlFieldCompression)
-	assert.Equal(t, CallbackOperationCBCP, p.LinkProtocol.CallbackOperation)
+	f, err := ppp.DecodeFrame(p.Payload)
+	assert.Nil(t, err)
+	assert.Equal(t, ppp.ProtocolLCP, f.Protocol)
+	assert.Equal(t, ppp.LinkCodeConfigRequest, f.LinkProtocol.Code)
+	assert.Equal(t, uint16(1480), f.LinkProtocol.MaxReceiveUint)
 
 	// authenticate request
 	data = []byte{0x00, 0x0c, 0x29, 0x8b, 0x82, 0xc5, 0x00, 0xe0, 0x4c, 0x36, 0x17, 0xf8, 0x88, 0x64, 0x11, 0x00, 0x00, 0x01, 0x00, 0x11, 0xc0, 0x23, 0x01, 0x00, 0x00, 0x0f, 0x06, 0x31, 0x32, 0x33, 0x31, 0x32, 0x33, 0x03, 0x31, 0x32, 0x33, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 	packet = gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
-	p, err = DecodePPPoES(packet.Layer(layers.LayerTypeEthernet).LayerPayload())
-	assert.Nil(t, err)
-	assert.Equal(t, byte(0x11), p.VersionAndType)
-	assert.Equal(t, SCodeSessionData, p.Code)
+	assert.Nil(t, DecodeSessionFrameInto(&p, &f, packet.Layer(layers.LayerTypeEthernet).LayerPayload()))
 	assert.Equal(t, uint16(1), p.SessionID)
-	assert.Equal(t, P2PAuthProtocol, p.P2PProtocol)
+	assert.Equal(t, ppp.ProtocolPAP, f.Protocol)
+	assert.Equal(t, "123123", f.PwdAuthProtocol.PeerID)
+	assert.Equal(t, "123", f.PwdAuthProtocol.Password)
+}
+
+func TestPPPoES_Encode(t *testing.T) {
+	p := PPPoES{VersionAndType: VersionAndType, Code: SCodeSessionData, SessionID: 0x1234, Payload: []byte{0x00, 0x21, 0x45}}
+	bs := p.Encode()
+	assert.Equal(t, []byte{0x11, 0x00, 0x12, 0x34, 0x00, 0x03, 0x00, 0x21, 0x45}, bs)
+	decoded, err := DecodePPPoES(append(bs, 0x00, 0x00))
+	assert.Nil(t, err)
+	assert.Equal(t, p, decoded)
+}
+
+func TestAppendSessionFrame(t *testing.T) {
+	f := ppp.Frame{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeEchoReply, Identifier: 3, MagicNumber: 0x0797521d}}
+	bs := AppendSessionFrame([]byte{0xaa}, 1, &f)
+	assert.Equal(t, []byte{0xaa, 0x11, 0x00, 0x00, 0x01, 0x00, 0x0a, 0xc0, 0x21, 0x0a, 0x03, 0x00, 0x08, 0x07, 0x97, 0x52, 0x1d}, bs)
+	assert.Equal(t, PPPoES{VersionAndType: VersionAndType, SessionID: 1, Payload: f.Encode()}.Encode(), bs[1:])
+}
+
+func TestDecodePPPoES_Errors(t *testing.T) {
+	var de *DecodeError
+	_, err := DecodePPPoES([]byte{0x11, 0x01, 0x00, 0x01, 0x00, 0x00})
+	assert.ErrorIs(t, err, ErrUnknownCode)
+	_, err = DecodePPPoES([]byte{0x11, 0x00, 0x00, 0x01, 0x00, 0x04, 0xc0})
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	// LCP Configure-Request 中 MRU 配置项长度为 3，偏移以 PPPoE 头为起点
+	var p PPPoES
+	var f ppp.Frame
+	err = DecodeSessionFrameInto(&p, &f, []byte{0x11, 0x00, 0x00, 0x01, 0x00, 0x09, 0xc0, 0x21, 0x01, 0x01, 0x00, 0x07, 0x01, 0x03, 0x05})
+	assert.ErrorIs(t, err, ErrBadLength)
+	assert.ErrorAs(t, err, &de)
+	assert.Equal(t, ppp.LayerLCP, de.Layer)
+	assert.Equal(t, PPPoESBasicLen+ppp.ProtocolLen+ppp.ControlHeaderLen, de.Offset)
+	assert.Equal(t, "decode lcp option max receive unit at offset 12: invalid length (expected 4 bytes, got 3)", err.Error())
+
+	// 长度字段只有 1 的会话帧放不下 PPP 协议字段
+	err = DecodeSessionFrameInto(&p, &f, []byte{0x11, 0x00, 0x00, 0x01, 0x00, 0x01, 0xc0})
+	assert.ErrorIs(t, err, ErrTruncated)
+	assert.ErrorAs(t, err, &de)
+	assert.Equal(t, ppp.LayerPPP, de.Layer)
+	assert.Equal(t, PPPoESBasicLen, de.Offset)
+}
+
+// allocTestFrames 覆盖各个协议的 PPP 帧，用于验证追加编码和解码到已有结构时不分配内存
+func allocTestFrames() []ppp.Frame {
+	return []ppp.Frame{
+		{Protocol: ppp.ProtocolLCP, LinkProtocol: ppp.LinkCtrlProtocol{Code: ppp.LinkCodeConfigRequest, Identifier: 1, MaxReceiveUint: 1492, MagicNumber: 0x01020304,
+			AuthProtocol: ppp.AuthProtocolChap, AuthAlgorithm: ppp.ChapAlgorithmMD5}},
+		{Protocol: ppp.ProtocolPAP, PwdAuthProtocol: ppp.PwdAuthProtocol{Code: ppp.PwdAuthCodeRequest, Identifier: 2, PeerID: "user", Password: "secret"}},
+		{Protocol: ppp.ProtocolIPCP, IPCtrlProtocol: ppp.IPCtrlProtocol{Code: ppp.LinkCodeConfigNak, Identifier: 4, IPAddress: net.IPv4(10, 0, 0, 2)}},
+		{Protocol: ppp.ProtocolIPv4, Data: make([]byte, 1400)},
+	}
+}
+
+func TestAppendSessionFrame_Allocs(t *testing.T) {
+	for _, f := range allocTestFrames() {
+		buf := make([]byte, 0, 2048)
+		allocs := testing.AllocsPerRun(100, func() {
+			buf = AppendSessionFrame(buf[:0], 1, &f)
+		})
+		assert.Equal(t, float64(0), allocs, "protocol %s", f.Protocol)
+	}
+}
+
+func TestDecodeSessionFrameInto(t *testing.T) {
+	var p PPPoES
+	var f ppp.Frame
+	for _, want := range allocTestFrames() {
+		data := AppendSessionFrame(nil, 1, &want)
+		assert.Nil(t, DecodeSessionFrameInto(&p, &f, data))
+		assert.Equal(t, uint16(1), p.SessionID)
+		assert.Equal(t, want.Encode(), f.Encode())
+
+		allocs := testing.AllocsPerRun(100, func() {
+			_ = DecodeSessionFrameInto(&p, &f, data)
+		})
+		assert.Equal(t, float64(0), allocs, "protocol %s", f.Protocol)
+	}
+}
+
+func BenchmarkAppendSessionFrame(b *testing.B) {
+	f := allocTestFrames()[0]
+	buf := make([]byte, 0, 2048)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = AppendSessionFrame(buf[:0], 1, &f)
+	}
+}
 
-	assert.Equal(t, byte(1), p.PwdAuthProtocol.Code)
-	assert.Equal(t, byte(0), p.PwdAuthProtocol.Identifier)
-	assert.Equal(t, "123123", p.PwdAuthProtocol.PeerID)
-	assert.Equal(t, "123", p.PwdAuthProtocol.Password)
+func BenchmarkDecodeSessionFrameInto(b *testing.B) {
+	f := allocTestFrames()[1]
+	data := AppendSessionFrame(nil, 1, &f)
+	var p PPPoES
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = DecodeSessionFrameInto(&p, &f, data)
+	}
 }
@@ -0,0 +1,108 @@
+package pppoe
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BroadbandForumVendorID TR-101 线路标识所在 Vendor-Specific 标签的 vendor id（ADSL Forum，3561）
+const BroadbandForumVendorID = 0x00000de9
+
+// TR-101 线路标识的子选项类型
+const (
+	SubOptionAgentCircuitID = 0x01
+	SubOptionAgentRemoteID  = 0x02
+)
+
+// MaxAgentIDLen Agent-Circuit-ID、Agent-Remote-ID 的最大长度
+const MaxAgentIDLen = 63
+
+// Tag 原始的 discovery 标签
+type Tag struct {
+	Type  TagType
+	Value []byte
+}
+
+// VendorID Vendor-Specific 标签的 vendor id，其他标签返回 false
+func (t Tag) VendorID() (id uint32, ok bool) {
+	if t.Type != TagTypeVendorSpecific || len(t.Value) < 4 {
+		return
+	}
+	return binary.BigEndian.Uint32(t.Value), true
+}
+
+// RawPPPoED 按原始顺序保留所有标签的 discovery 报文，包括 DiscoveryTags 不认识的标签。
+// 用于中继等需要原样转发报文、只增删个别标签的场景
+type RawPPPoED struct {
+	Code      DCode
+	SessionID uint16
+	Tags      []Tag
+}
+
+// DecodeRawPPPoED 解码 discovery 报文，Tags 中的值引用 content
+func DecodeRawPPPoED(content []byte) (p RawPPPoED, err error) {
+	var header PPPoED
+	payload, err := decodeHeader(&header, content)
+	if err != nil {
+		return
+	}
+	p.Code, p.SessionID = header.Code, header.SessionID
+	offset := PPPoEDBasicLen
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			err = truncated(LayerPPPoED, "tag header", offset, 4, len(payload))
+			return
+		}
+		tagType := binary.BigEndian.Uint16(payload[0:2])
+		tLen := int(binary.BigEndian.Uint16(payload[2:4]))
+		if len(payload) < tLen+4 {
+			err = truncated(LayerPPPoED, fmt.Sprintf("tag %#04x", tagType), offset, tLen+4, len(payload))
+			return
+		}
+		p.Tags = append(p.Tags, Tag{Type: TagType(tagType), Value: payload[4 : 4+tLen]})
+		payload = payload[4+tLen:]
+		offset += 4 + tLen
+	}
+	return
+}
+
+// Tag 返回第一个类型为 tagType 的标签的值
+func (p RawPPPoED) Tag(tagType TagType) (value []byte, ok bool) {
+	for _, tag := range p.Tags {
+		if tag.Type == tagType {
+			return tag.Value, true
+		}
+	}
+	return
+}
+
+// AppendEncode 将报文追加到 dst 后返回
+func (p RawPPPoED) AppendEncode(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, VersionAndType, byte(p.Code))
+	dst = binary.BigEndian.AppendUint16(dst, p.SessionID)
+	dst = append(dst, 0, 0)
+	for _, tag := range p.Tags {
+		dst = appendTag(dst, tag.Type, len(tag.Value))
+		dst = append(dst, tag.Value...)
+	}
+	binary.BigEndian.PutUint16(dst[start+4:], uint16(len(dst)-start-PPPoEDBasicLen))
+	return dst
+}
+
+// NewAgentTag 生成 TR-101 线路标识标签，circuitID、remoteID 为空时不携带对应子选项，超过 MaxAgentIDLen 的部分截断
+func NewAgentTag(circuitID string, remoteID string) Tag {
+	value := binary.BigEndian.AppendUint32(nil, BroadbandForumVendorID)
+	for _, sub := range []struct {
+		t  byte
+		id string
+	}{{SubOptionAgentCircuitID, circuitID}, {SubOptionAgentRemoteID, remoteID}} {
+		if sub.id == "" {
+			continue
+		}
+		id := sub.id[:min(len(sub.id), MaxAgentIDLen)]
+		value = append(value, sub.t, byte(len(id)))
+		value = append(value, id...)
+	}
+	return Tag{Type: TagTypeVendorSpecific, Value: value}
+}
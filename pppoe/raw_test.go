@@ -0,0 +1,61 @@
+package pppoe
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRawPPPoED_RoundTrip(t *testing.T) {
+	pppoed := NewPPPoEDPacket(CodePADR, 0, "ubuntu", []byte{0x01, 0x02}, []byte{0x03})
+	data := pppoed.Encode()
+	// PPP-Max-Payload 不在 DiscoveryTags 中，原样保留
+	data = append(data, 0x01, 0x20, 0x00, 0x02, 0x05, 0xdc)
+	data[5] += 6
+	raw, err := DecodeRawPPPoED(append(data, 0x00, 0x00))
+	assert.Nil(t, err)
+	assert.Equal(t, CodePADR, raw.Code)
+	assert.Len(t, raw.Tags, 5)
+	maxPayload, ok := raw.Tag(0x0120)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x05, 0xdc}, maxPayload)
+	assert.Equal(t, data, raw.AppendEncode(nil))
+
+	raw.Tags = append(raw.Tags, Tag{Type: TagTypeRelaySessionID, Value: []byte{0x00, 0x01}})
+	decoded, err := DecodeRawPPPoED(raw.AppendEncode(nil))
+	assert.Nil(t, err)
+	relayID, ok := decoded.Tag(TagTypeRelaySessionID)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x00, 0x01}, relayID)
+	_, ok = decoded.Tag(TagTypeAcCookie + 0x10)
+	assert.False(t, ok)
+}
+
+func TestNewAgentTag(t *testing.T) {
+	tag := NewAgentTag("eth 0/1:35", "cpe")
+	id, ok := tag.VendorID()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(BroadbandForumVendorID), id)
+	assert.Equal(t, []byte{0x00, 0x00, 0x0d, 0xe9, 0x01, 0x0a, 'e', 't', 'h', ' ', '0', '/', '1', ':', '3', '5', 0x02, 0x03, 'c', 'p', 'e'}, tag.Value)
+
+	// 经 DiscoveryTags 解码为 VendorTag
+	pppoed, err := DecodePPPoED(RawPPPoED{Code: CodePADI, Tags: []Tag{NewAgentTag("", "remote")}}.AppendEncode(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, []VendorTag{{VendorID: BroadbandForumVendorID, Value: []byte{0x02, 0x06, 'r', 'e', 'm', 'o', 't', 'e'}}}, pppoed.VendorTags)
+
+	long := NewAgentTag(string(make([]byte, 100)), "")
+	assert.Len(t, long.Value, 4+2+MaxAgentIDLen)
+}
+
+func TestDecodeRawPPPoED_Errors(t *testing.T) {
+	_, err := DecodeRawPPPoED([]byte{0x11, 0x09, 0x00, 0x00, 0x00, 0x03, 0x01, 0x01, 0x00})
+	assert.ErrorIs(t, err, ErrTruncated)
+	var de *DecodeError
+	assert.ErrorAs(t, err, &de)
+	assert.Equal(t, "tag header", de.Field)
+
+	_, err = DecodeRawPPPoED([]byte{0x11, 0x09, 0x00, 0x00, 0x00, 0x06, 0x01, 0x10, 0x00, 0x04, 0x00, 0x01})
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	_, err = DecodeRawPPPoED([]byte{0x11, 0x42, 0x00, 0x00, 0x00, 0x00})
+	assert.ErrorIs(t, err, ErrUnknownCode)
+}
@@ -0,0 +1,10 @@
+// Package pppox 通过 Linux 内核的 PPPoE（AF_PPPOX/PX_PROTO_OE）承载已完成发现阶段的会话。
+//
+// 会话连接后，内核负责该会话的 PPPoE 封装，PPP 控制报文（LCP、认证、IPCP 等）
+// 通过 /dev/ppp 通道交给用户态处理；创建 ppp 网卡后 IP 报文直接在内核中转发。
+package pppox
+
+import "errors"
+
+// ErrUnsupported 当前平台不支持内核 PPPoE
+var ErrUnsupported = errors.New("kernel pppoe is only supported on linux")
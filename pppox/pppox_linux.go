@@ -0,0 +1,206 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+package pppox
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl 编号按通用的 _IOC 编码计算，mips/ppc/sparc 的编码不同，不在支持范围内
+const (
+	afPPPoX   = 24
+	pxProtoOE = 0
+
+	pppIOCGCHAN    = 0x80047437
+	pppIOCATTCHAN  = 0x40047438
+	pppIOCCONNECT  = 0x4004743a
+	pppIOCNEWUNIT  = 0xc004743e
+	pppIOCSNPMODE  = 0x4008744b
+	pppIOCSMRU     = 0x40047452
+	npModePass     = 0
+	sockaddrLength = 30
+)
+
+// 内核转发的网络层协议
+var networkProtocols = []uint16{0x0021, 0x0057}
+
+// Session 一个内核 PPPoE 会话
+type Session struct {
+	sock    int
+	channel *os.File
+	unit    *os.File
+	unitNum int
+
+	frames    chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// sockaddr 生成 struct sockaddr_pppox（packed）：
+// sa_family(u16) sa_protocol(u32) sid(be16) remote[6] dev[IFNAMSIZ]
+func sockaddr(ifName string, sessionID uint16, remote net.HardwareAddr) (sa [sockaddrLength]byte, err error) {
+	if len(ifName) >= syscall.IFNAMSIZ {
+		err = errors.New("invalid interface name " + ifName)
+		return
+	}
+	if len(remote) != 6 {
+		err = errors.New("invalid remote mac " + remote.String())
+		return
+	}
+	binary.NativeEndian.PutUint16(sa[0:2], afPPPoX)
+	binary.NativeEndian.PutUint32(sa[2:6], pxProtoOE)
+	binary.BigEndian.PutUint16(sa[6:8], sessionID)
+	copy(sa[8:14], remote)
+	copy(sa[14:], ifName)
+	return
+}
+
+// Connect 在网卡 ifName 上连接对端 remote 的会话 sessionID，并打开对应的 /dev/ppp 通道。
+// 需要 CAP_NET_ADMIN 权限和 pppoe 内核模块。
+func Connect(ifName string, sessionID uint16, remote net.HardwareAddr) (s *Session, err error) {
+	sa, err := sockaddr(ifName, sessionID, remote)
+	if err != nil {
+		return
+	}
+	sock, err := syscall.Socket(afPPPoX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, pxProtoOE)
+	if err != nil {
+		return
+	}
+	s = &Session{
+		sock:    sock,
+		unitNum: -1,
+		frames:  make(chan []byte, 16),
+		closed:  make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			s.Close()
+			s = nil
+		}
+	}()
+	_, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(sock), uintptr(unsafe.Pointer(&sa[0])), sockaddrLength)
+	if errno != 0 {
+		err = errno
+		return
+	}
+	var channelIndex int32
+	if err = ioctl(sock, pppIOCGCHAN, unsafe.Pointer(&channelIndex)); err != nil {
+		return
+	}
+	if s.channel, err = openPPP(); err != nil {
+		return
+	}
+	if err = ioctl(int(s.channel.Fd()), pppIOCATTCHAN, unsafe.Pointer(&channelIndex)); err != nil {
+		return
+	}
+	go s.read(s.channel)
+	return
+}
+
+// ConnectUnit 创建 ppp 网卡并连接到会话，之后 IPv4/IPv6 报文由内核转发。
+// 返回网卡名，形如 ppp0。
+func (s *Session) ConnectUnit(mru int) (name string, err error) {
+	if s.unit, err = openPPP(); err != nil {
+		return
+	}
+	unitNum := int32(-1)
+	if err = ioctl(int(s.unit.Fd()), pppIOCNEWUNIT, unsafe.Pointer(&unitNum)); err != nil {
+		return
+	}
+	s.unitNum = int(unitNum)
+	if err = ioctl(int(s.channel.Fd()), pppIOCCONNECT, unsafe.Pointer(&unitNum)); err != nil {
+		return
+	}
+	if mru > 0 {
+		value := int32(mru)
+		if err = ioctl(int(s.unit.Fd()), pppIOCSMRU, unsafe.Pointer(&value)); err != nil {
+			return
+		}
+	}
+	for _, protocol := range networkProtocols {
+		npi := [2]int32{int32(protocol), npModePass}
+		if err = ioctl(int(s.unit.Fd()), pppIOCSNPMODE, unsafe.Pointer(&npi)); err != nil {
+			return
+		}
+	}
+	// 网卡连接后，非网络层的控制报文从网卡的文件描述符读出
+	go s.read(s.unit)
+	name = s.UnitName()
+	return
+}
+
+// UnitName ppp 网卡名，未创建时为空
+func (s *Session) UnitName() string {
+	if s.unitNum < 0 {
+		return ""
+	}
+	return "ppp" + strconv.Itoa(s.unitNum)
+}
+
+// ReadFrame 读取一个 PPP 控制报文（两字节协议号加数据），会话关闭后返回错误
+func (s *Session) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-s.frames:
+		return frame, nil
+	case <-s.closed:
+		return nil, os.ErrClosed
+	}
+}
+
+// WriteFrame 发送一个 PPP 报文（两字节协议号加数据）
+func (s *Session) WriteFrame(frame []byte) (err error) {
+	_, err = s.channel.Write(frame)
+	return
+}
+
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if s.unit != nil {
+			_ = s.unit.Close()
+		}
+		if s.channel != nil {
+			_ = s.channel.Close()
+		}
+		_ = syscall.Close(s.sock)
+	})
+}
+
+func (s *Session) read(f *os.File) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case s.frames <- append([]byte(nil), buf[:n]...):
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// openPPP 以非阻塞方式打开 /dev/ppp，交给 runtime poller 管理，Close 时才能唤醒阻塞中的 Read
+func openPPP() (*os.File, error) {
+	fd, err := syscall.Open("/dev/ppp", syscall.O_RDWR|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/ppp"), nil
+}
+
+func ioctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+package pppox
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestSockaddr(t *testing.T) {
+	remote := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	sa, err := sockaddr("eth0", 0x1234, remote)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x12, 0x34}, sa[6:8])
+	assert.Equal(t, []byte(remote), sa[8:14])
+	assert.Equal(t, []byte("eth0\x00"), sa[14:19])
+
+	_, err = sockaddr("a-very-long-interface-name", 1, remote)
+	assert.NotNil(t, err)
+	_, err = sockaddr("eth0", 1, remote[:4])
+	assert.NotNil(t, err)
+}
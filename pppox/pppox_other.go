@@ -0,0 +1,31 @@
+//go:build !(linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x))
+
+package pppox
+
+import "net"
+
+// Session 当前平台不支持内核 PPPoE，Connect 总是返回 ErrUnsupported
+type Session struct{}
+
+func Connect(ifName string, sessionID uint16, remote net.HardwareAddr) (*Session, error) {
+	return nil, ErrUnsupported
+}
+
+func (s *Session) ConnectUnit(mru int) (string, error) {
+	return "", ErrUnsupported
+}
+
+func (s *Session) UnitName() string {
+	return ""
+}
+
+func (s *Session) ReadFrame() ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+func (s *Session) WriteFrame(frame []byte) error {
+	return ErrUnsupported
+}
+
+func (s *Session) Close() {
+}
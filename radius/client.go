@@ -0,0 +1,256 @@
+package radius
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"pppoe-probe/auth"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAuthPort = "1812"
+	DefaultAcctPort = "1813"
+	DefaultTimeout  = 3 * time.Second
+	DefaultRetries  = 2
+)
+
+// ErrTimeout 重试之后仍然没有收到服务器的合法回复
+var ErrTimeout = errors.New("radius request timeout")
+
+// Config RADIUS 客户端配置
+type Config struct {
+	// Server 认证服务器地址，没有端口时使用 DefaultAuthPort
+	Server string
+	// AcctServer 计费服务器地址，为空时使用 Server 的主机和 DefaultAcctPort
+	AcctServer string
+	Secret     string
+	// Timeout 每次发送后等待回复的时间，为 0 时使用 DefaultTimeout
+	Timeout time.Duration
+	// Retries 超时后的重发次数，为 0 时使用 DefaultRetries，小于 0 时不重发
+	Retries       int
+	NASIdentifier string
+	NASIPAddress  net.IP
+}
+
+// Client RADIUS 客户端，实现 auth.Authenticator 和 auth.Accounter，可以并发调用
+type Client struct {
+	cfg Config
+
+	mu sync.Mutex
+	id byte
+}
+
+func NewClient(cfg Config) (c *Client, err error) {
+	if cfg.Secret == "" {
+		err = errors.New("missing radius secret")
+		return
+	}
+	host, port, err := net.SplitHostPort(cfg.Server)
+	if err != nil {
+		host, port, err = cfg.Server, DefaultAuthPort, nil
+	}
+	if host == "" {
+		err = errors.New("missing radius server")
+		return
+	}
+	cfg.Server = net.JoinHostPort(host, port)
+	if cfg.AcctServer == "" {
+		cfg.AcctServer = net.JoinHostPort(host, DefaultAcctPort)
+	} else if _, _, e := net.SplitHostPort(cfg.AcctServer); e != nil {
+		cfg.AcctServer = net.JoinHostPort(cfg.AcctServer, DefaultAcctPort)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultRetries
+	}
+	c = &Client{cfg: cfg}
+	return
+}
+
+func (c *Client) nextID() byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.id++
+	return c.id
+}
+
+// Authenticate 发送 Access-Request，Access-Accept 为通过，Access-Reject 和 Access-Challenge 为拒绝。
+// 回复中的 Reply-Message 作为 Decision.Message，Framed-IP-Address、Class 等属性放入 Decision.Attributes。
+func (c *Client) Authenticate(req auth.Request) (d auth.Decision, err error) {
+	p := &Packet{Code: CodeAccessRequest, Identifier: c.nextID()}
+	if _, err = rand.Read(p.Authenticator[:]); err != nil {
+		return
+	}
+	p.AddString(AttrUserName, req.Username)
+	switch req.Method {
+	case auth.MethodPAP:
+		p.Add(AttrUserPassword, EncryptPassword([]byte(req.Password), c.cfg.Secret, p.Authenticator))
+	case auth.MethodCHAP:
+		p.Add(AttrCHAPPassword, append([]byte{req.ChapID}, req.Response...))
+		p.Add(AttrCHAPChallenge, req.Challenge)
+	default:
+		err = errors.New("unsupported auth method " + req.Method)
+		return
+	}
+	p.AddUint32(AttrServiceType, ServiceTypeFramed)
+	p.AddUint32(AttrFramedProtocol, FramedProtocolPPP)
+	c.addSessionAttributes(p, req.Adapter, req.PeerMac, req.Vlan, req.SessionID)
+
+	resp, err := c.Exchange(p, c.cfg.Server)
+	if err != nil {
+		return
+	}
+	d.Message = resp.GetString(AttrReplyMessage)
+	switch resp.Code {
+	case CodeAccessAccept:
+		d.Verdict = auth.Accept
+		d.Attributes = replyAttributes(resp)
+	case CodeAccessReject, CodeAccessChallenge:
+		d.Verdict = auth.Reject
+	default:
+		err = fmt.Errorf("unexpected radius reply %s", resp.Code)
+	}
+	return
+}
+
+// replyAttributes 取出 Access-Accept 中会话要用到的属性
+func replyAttributes(resp *Packet) (attrs map[string]string) {
+	attrs = make(map[string]string)
+	if ip, ok := resp.Get(AttrFramedIPAddress); ok && len(ip) == 4 {
+		attrs[auth.AttrFramedIPAddress] = net.IP(ip).String()
+	}
+	if interval, ok := resp.GetUint32(AttrAcctInterimInterval); ok {
+		attrs[auth.AttrAcctInterimInterval] = strconv.FormatUint(uint64(interval), 10)
+	}
+	if timeout, ok := resp.GetUint32(AttrSessionTimeout); ok {
+		attrs[auth.AttrSessionTimeout] = strconv.FormatUint(uint64(timeout), 10)
+	}
+	if class, ok := resp.Get(AttrClass); ok {
+		attrs[auth.AttrClass] = string(class)
+	}
+	return
+}
+
+// Account 发送 Accounting-Request，收到 Accounting-Response 即为成功
+func (c *Client) Account(rec auth.AccountingRecord) (err error) {
+	p := &Packet{Code: CodeAccountingRequest, Identifier: c.nextID()}
+	switch rec.Status {
+	case auth.AcctStart:
+		p.AddUint32(AttrAcctStatusType, AcctStatusStart)
+	case auth.AcctStop:
+		p.AddUint32(AttrAcctStatusType, AcctStatusStop)
+	case auth.AcctInterim:
+		p.AddUint32(AttrAcctStatusType, AcctStatusInterim)
+	default:
+		return errors.New("unknown accounting status " + rec.Status)
+	}
+	p.AddString(AttrAcctSessionID, rec.SessionID)
+	p.AddString(AttrUserName, rec.Username)
+	p.AddUint32(AttrAcctAuthentic, AcctAuthenticRADIUS)
+	c.addSessionAttributes(p, rec.Adapter, rec.PeerMac, rec.Vlan, rec.PPPoESessionID)
+	if ip := net.ParseIP(rec.IP).To4(); ip != nil {
+		p.AddIP(AttrFramedIPAddress, ip)
+	}
+	if class, ok := rec.Attributes[auth.AttrClass]; ok {
+		p.AddString(AttrClass, class)
+	}
+	if rec.Status != auth.AcctStart {
+		p.AddUint32(AttrAcctSessionTime, uint32(rec.Duration/time.Second))
+		// Octets 只有 32 位，高 32 位放在 Gigawords 中（RFC 2869 5.1、5.2）
+		p.AddUint32(AttrAcctInputOctets, uint32(rec.RxBytes))
+		p.AddUint32(AttrAcctOutputOctets, uint32(rec.TxBytes))
+		p.AddUint32(AttrAcctInputGigawords, uint32(rec.RxBytes>>32))
+		p.AddUint32(AttrAcctOutputGigawords, uint32(rec.TxBytes>>32))
+		p.AddUint32(AttrAcctInputPackets, uint32(rec.RxPackets))
+		p.AddUint32(AttrAcctOutputPackets, uint32(rec.TxPackets))
+	}
+	if rec.Status == auth.AcctStop {
+		p.AddUint32(AttrAcctTerminateCause, terminateCause(rec.TerminateCause))
+	}
+	resp, err := c.Exchange(p, c.cfg.AcctServer)
+	if err != nil {
+		return
+	}
+	if resp.Code != CodeAccountingResponse {
+		err = fmt.Errorf("unexpected radius reply %s", resp.Code)
+	}
+	return
+}
+
+func terminateCause(cause string) uint32 {
+	switch cause {
+	case auth.TerminateUserRequest:
+		return TerminateUserRequest
+	case auth.TerminateAdminReset:
+		return TerminateAdminReset
+	}
+	return TerminateNASRequest
+}
+
+// addSessionAttributes 添加 NAS 和对端的标识：Calling-Station-Id 为对端 MAC，
+// NAS-Port-Id 为网卡名，有 VLAN 时加上 ":VLAN"，例如 eth0:100.35
+func (c *Client) addSessionAttributes(p *Packet, adapter string, peerMac string, vlan string, sessionID uint16) {
+	if c.cfg.NASIdentifier != "" {
+		p.AddString(AttrNASIdentifier, c.cfg.NASIdentifier)
+	}
+	if c.cfg.NASIPAddress.To4() != nil {
+		p.AddIP(AttrNASIPAddress, c.cfg.NASIPAddress)
+	}
+	p.AddUint32(AttrNASPort, uint32(sessionID))
+	p.AddUint32(AttrNASPortType, NASPortTypeEthernet)
+	portID := adapter
+	if vlan != "" {
+		portID += ":" + vlan
+	}
+	if portID != "" {
+		p.AddString(AttrNASPortID, portID)
+	}
+	p.AddString(AttrCallingStationID, peerMac)
+}
+
+// Exchange 发送请求并等待校验通过的回复，超时后按配置重发
+func (c *Client) Exchange(p *Packet, server string) (resp *Packet, err error) {
+	bs, err := p.EncodeRequest(c.cfg.Secret)
+	if err != nil {
+		return
+	}
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, MaxPacketLen)
+	for try := 0; try <= c.cfg.Retries || try == 0; try++ {
+		if _, err = conn.Write(bs); err != nil {
+			return
+		}
+		deadline := time.Now().Add(c.cfg.Timeout)
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return
+		}
+		for {
+			n, e := conn.Read(buf)
+			if e != nil {
+				var netErr net.Error
+				if errors.As(e, &netErr) && netErr.Timeout() {
+					break
+				}
+				err = e
+				return
+			}
+			// 丢弃标识不符或校验失败的回复，继续等待
+			if !VerifyResponse(buf[:n], p, c.cfg.Secret) {
+				continue
+			}
+			return Decode(buf[:n])
+		}
+	}
+	err = ErrTimeout
+	return
+}
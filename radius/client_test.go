@@ -0,0 +1,212 @@
+package radius
+
+import (
+	"bytes"
+	"crypto/md5"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"pppoe-probe/auth"
+	"pppoe-probe/ppp"
+	"testing"
+	"time"
+)
+
+const testSecret = "testing123"
+
+// standIn 进程内的 RADIUS 服务器，只认 alice/secret，记录收到的计费请求
+type standIn struct {
+	conn     net.PacketConn
+	secret   string
+	accounts chan *Packet
+}
+
+func newStandIn(t *testing.T, secret string) *standIn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &standIn{conn: conn, secret: secret, accounts: make(chan *Packet, 10)}
+	go s.serve()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return s
+}
+
+func (s *standIn) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *standIn) serve() {
+	buf := make([]byte, MaxPacketLen)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !VerifyRequest(buf[:n], s.secret) {
+			continue
+		}
+		req, err := Decode(buf[:n])
+		if err != nil {
+			continue
+		}
+		resp := &Packet{Code: CodeAccessReject}
+		switch req.Code {
+		case CodeAccessRequest:
+			if s.check(req) {
+				resp.Code = CodeAccessAccept
+				resp.AddIP(AttrFramedIPAddress, net.IPv4(10, 64, 0, 9))
+				resp.AddUint32(AttrAcctInterimInterval, 300)
+				resp.AddString(AttrClass, "group-a")
+				resp.AddString(AttrReplyMessage, "welcome")
+			} else {
+				resp.AddString(AttrReplyMessage, "bad password")
+			}
+		case CodeAccountingRequest:
+			s.accounts <- req
+			resp.Code = CodeAccountingResponse
+		}
+		bs, err := resp.EncodeResponse(s.secret, req)
+		if err != nil {
+			continue
+		}
+		_, _ = s.conn.WriteTo(bs, addr)
+	}
+}
+
+func (s *standIn) check(req *Packet) bool {
+	if req.GetString(AttrUserName) != "alice" {
+		return false
+	}
+	if hidden, ok := req.Get(AttrUserPassword); ok {
+		return string(DecryptPassword(hidden, s.secret, req.Authenticator)) == "secret"
+	}
+	chapPassword, ok := req.Get(AttrCHAPPassword)
+	challenge, _ := req.Get(AttrCHAPChallenge)
+	if !ok || len(chapPassword) != 1+md5.Size {
+		return false
+	}
+	return bytes.Equal(chapPassword[1:], ppp.ChapMD5Response(chapPassword[0], "secret", challenge))
+}
+
+func TestClient_Authenticate(t *testing.T) {
+	s := newStandIn(t, testSecret)
+	c, err := NewClient(Config{Server: s.addr(), Secret: testSecret, NASIdentifier: "lab-bras"})
+	assert.Nil(t, err)
+
+	d, err := c.Authenticate(auth.Request{
+		Adapter:  "eth0",
+		PeerMac:  "00:0c:29:8b:82:c5",
+		Vlan:     "100.35",
+		Method:   auth.MethodPAP,
+		Username: "alice",
+		Password: "secret",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, auth.Accept, d.Verdict)
+	assert.Equal(t, "welcome", d.Message)
+	assert.Equal(t, "10.64.0.9", d.Attributes[auth.AttrFramedIPAddress])
+	assert.Equal(t, "300", d.Attributes[auth.AttrAcctInterimInterval])
+	assert.Equal(t, "group-a", d.Attributes[auth.AttrClass])
+
+	d, err = c.Authenticate(auth.Request{Method: auth.MethodPAP, Username: "alice", Password: "wrong"})
+	assert.Nil(t, err)
+	assert.Equal(t, auth.Reject, d.Verdict)
+	assert.Equal(t, "bad password", d.Message)
+
+	challenge := []byte{0x10, 0x20, 0x30, 0x40, 0x50, 0x60, 0x70, 0x80}
+	d, err = c.Authenticate(auth.Request{
+		Method:    auth.MethodCHAP,
+		Username:  "alice",
+		ChapID:    3,
+		Challenge: challenge,
+		Response:  ppp.ChapMD5Response(3, "secret", challenge),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, auth.Accept, d.Verdict)
+}
+
+func TestClient_Account(t *testing.T) {
+	s := newStandIn(t, testSecret)
+	c, err := NewClient(Config{Server: "127.0.0.1", AcctServer: s.addr(), Secret: testSecret})
+	assert.Nil(t, err)
+
+	err = c.Account(auth.AccountingRecord{
+		Status:         auth.AcctStop,
+		SessionID:      "abc-0001",
+		Adapter:        "eth0",
+		PeerMac:        "00:0c:29:8b:82:c5",
+		Vlan:           "35",
+		PPPoESessionID: 1,
+		Username:       "alice",
+		IP:             "10.64.0.9",
+		Attributes:     map[string]string{auth.AttrClass: "group-a"},
+		Duration:       90 * time.Second,
+		RxBytes:        1484,
+		TxBytes:        84,
+		TerminateCause: auth.TerminateUserRequest,
+	})
+	assert.Nil(t, err)
+	req := <-s.accounts
+	status, _ := req.GetUint32(AttrAcctStatusType)
+	assert.Equal(t, AcctStatusStop, status)
+	assert.Equal(t, "abc-0001", req.GetString(AttrAcctSessionID))
+	assert.Equal(t, "eth0:35", req.GetString(AttrNASPortID))
+	assert.Equal(t, "00:0c:29:8b:82:c5", req.GetString(AttrCallingStationID))
+	assert.Equal(t, "group-a", req.GetString(AttrClass))
+	sessionTime, _ := req.GetUint32(AttrAcctSessionTime)
+	assert.Equal(t, uint32(90), sessionTime)
+	input, _ := req.GetUint32(AttrAcctInputOctets)
+	assert.Equal(t, uint32(1484), input)
+	cause, _ := req.GetUint32(AttrAcctTerminateCause)
+	assert.Equal(t, TerminateUserRequest, cause)
+}
+
+func TestClient_AccountGigawords(t *testing.T) {
+	s := newStandIn(t, testSecret)
+	c, err := NewClient(Config{Server: "127.0.0.1", AcctServer: s.addr(), Secret: testSecret})
+	assert.Nil(t, err)
+
+	err = c.Account(auth.AccountingRecord{
+		Status:    auth.AcctInterim,
+		SessionID: "abc-0002",
+		Adapter:   "eth0",
+		PeerMac:   "00:0c:29:8b:82:c5",
+		Username:  "alice",
+		RxBytes:   5<<32 + 1484,
+		TxBytes:   84,
+	})
+	assert.Nil(t, err)
+	req := <-s.accounts
+	tests := []struct {
+		attr AttributeType
+		want uint32
+	}{
+		{AttrAcctInputOctets, 1484},
+		{AttrAcctInputGigawords, 5},
+		{AttrAcctOutputOctets, 84},
+		{AttrAcctOutputGigawords, 0},
+	}
+	for _, tt := range tests {
+		v, ok := req.GetUint32(tt.attr)
+		assert.True(t, ok, tt.attr)
+		assert.Equal(t, tt.want, v, tt.attr)
+	}
+}
+
+func TestClient_WrongSecret(t *testing.T) {
+	s := newStandIn(t, "other-secret")
+	c, err := NewClient(Config{Server: s.addr(), Secret: testSecret, Timeout: 50 * time.Millisecond, Retries: -1})
+	assert.Nil(t, err)
+	_, err = c.Authenticate(auth.Request{Method: auth.MethodPAP, Username: "alice", Password: "secret"})
+	assert.Equal(t, ErrTimeout, err)
+}
+
+func TestEncryptPassword(t *testing.T) {
+	var authenticator [16]byte
+	copy(authenticator[:], "0123456789abcdef")
+	for _, password := range []string{"", "secret", "a-password-longer-than-16-bytes"} {
+		hidden := EncryptPassword([]byte(password), testSecret, authenticator)
+		assert.Equal(t, 0, len(hidden)%16)
+		assert.Equal(t, password, string(DecryptPassword(hidden, testSecret, authenticator)))
+	}
+}
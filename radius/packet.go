@@ -0,0 +1,344 @@
+package radius
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+type Code byte
+
+const (
+	CodeAccessRequest      Code = 1
+	CodeAccessAccept       Code = 2
+	CodeAccessReject       Code = 3
+	CodeAccountingRequest  Code = 4
+	CodeAccountingResponse Code = 5
+	CodeAccessChallenge    Code = 11
+)
+
+func (c Code) String() string {
+	switch c {
+	case CodeAccessRequest:
+		return "Access-Request"
+	case CodeAccessAccept:
+		return "Access-Accept"
+	case CodeAccessReject:
+		return "Access-Reject"
+	case CodeAccountingRequest:
+		return "Accounting-Request"
+	case CodeAccountingResponse:
+		return "Accounting-Response"
+	case CodeAccessChallenge:
+		return "Access-Challenge"
+	}
+	return "unknown"
+}
+
+type AttributeType byte
+
+// 属性类型，RFC 2865、RFC 2866、RFC 2869
+const (
+	AttrUserName             AttributeType = 1
+	AttrUserPassword         AttributeType = 2
+	AttrCHAPPassword         AttributeType = 3
+	AttrNASIPAddress         AttributeType = 4
+	AttrNASPort              AttributeType = 5
+	AttrServiceType          AttributeType = 6
+	AttrFramedProtocol       AttributeType = 7
+	AttrFramedIPAddress      AttributeType = 8
+	AttrReplyMessage         AttributeType = 18
+	AttrClass                AttributeType = 25
+	AttrSessionTimeout       AttributeType = 27
+	AttrIdleTimeout          AttributeType = 28
+	AttrCalledStationID      AttributeType = 30
+	AttrCallingStationID     AttributeType = 31
+	AttrNASIdentifier        AttributeType = 32
+	AttrAcctStatusType       AttributeType = 40
+	AttrAcctDelayTime        AttributeType = 41
+	AttrAcctInputOctets      AttributeType = 42
+	AttrAcctOutputOctets     AttributeType = 43
+	AttrAcctSessionID        AttributeType = 44
+	AttrAcctAuthentic        AttributeType = 45
+	AttrAcctSessionTime      AttributeType = 46
+	AttrAcctInputPackets     AttributeType = 47
+	AttrAcctOutputPackets    AttributeType = 48
+	AttrAcctTerminateCause   AttributeType = 49
+	AttrAcctInputGigawords   AttributeType = 52
+	AttrAcctOutputGigawords  AttributeType = 53
+	AttrCHAPChallenge        AttributeType = 60
+	AttrNASPortType          AttributeType = 61
+	AttrMessageAuthenticator AttributeType = 80
+	AttrAcctInterimInterval  AttributeType = 85
+	AttrNASPortID            AttributeType = 87
+)
+
+// 属性取值
+const (
+	ServiceTypeFramed     uint32 = 2
+	FramedProtocolPPP     uint32 = 1
+	NASPortTypeEthernet   uint32 = 15
+	AcctStatusStart       uint32 = 1
+	AcctStatusStop        uint32 = 2
+	AcctStatusInterim     uint32 = 3
+	AcctAuthenticRADIUS   uint32 = 1
+	AcctAuthenticLocal    uint32 = 2
+	TerminateUserRequest  uint32 = 1
+	TerminateLostCarrier  uint32 = 2
+	TerminateIdleTimeout  uint32 = 4
+	TerminateSessionLimit uint32 = 5
+	TerminateAdminReset   uint32 = 6
+	TerminateNASRequest   uint32 = 10
+)
+
+const (
+	// HeaderLen Code、Identifier、Length 和 16 字节 Authenticator
+	HeaderLen = 20
+	// MaxPacketLen RFC 2865 3 规定的最大报文长度
+	MaxPacketLen = 4096
+)
+
+type Attribute struct {
+	Type  AttributeType
+	Value []byte
+}
+
+// Packet RADIUS 报文，RFC 2865
+type Packet struct {
+	Code          Code
+	Identifier    byte
+	Authenticator [16]byte
+	Attributes    []Attribute
+}
+
+func (p *Packet) Add(t AttributeType, value []byte) {
+	p.Attributes = append(p.Attributes, Attribute{Type: t, Value: value})
+}
+
+func (p *Packet) AddString(t AttributeType, value string) {
+	p.Add(t, []byte(value))
+}
+
+func (p *Packet) AddUint32(t AttributeType, value uint32) {
+	p.Add(t, binary.BigEndian.AppendUint32(nil, value))
+}
+
+func (p *Packet) AddIP(t AttributeType, ip net.IP) {
+	p.Add(t, ip.To4())
+}
+
+// Get 返回第一个类型为 t 的属性值
+func (p *Packet) Get(t AttributeType) (value []byte, ok bool) {
+	for _, a := range p.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (p *Packet) GetString(t AttributeType) string {
+	value, _ := p.Get(t)
+	return string(value)
+}
+
+func (p *Packet) GetUint32(t AttributeType) (uint32, bool) {
+	value, ok := p.Get(t)
+	if !ok || len(value) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
+
+func (p *Packet) encode() (bs []byte, err error) {
+	bs = append(bs, byte(p.Code), p.Identifier, 0, 0)
+	bs = append(bs, p.Authenticator[:]...)
+	for _, a := range p.Attributes {
+		if len(a.Value) > 253 {
+			err = errors.New("radius attribute too long")
+			return
+		}
+		bs = append(bs, byte(a.Type), byte(len(a.Value)+2))
+		bs = append(bs, a.Value...)
+	}
+	if len(bs) > MaxPacketLen {
+		err = errors.New("radius packet too long")
+		return
+	}
+	binary.BigEndian.PutUint16(bs[2:4], uint16(len(bs)))
+	return
+}
+
+// EncodeRequest 编码请求报文。
+// Access-Request 的 Authenticator 由调用方随机生成，并在报文末尾加上 Message-Authenticator（RFC 3579）；
+// Accounting-Request 的 Authenticator 按 RFC 2866 3 计算后写回 p。
+func (p *Packet) EncodeRequest(secret string) (bs []byte, err error) {
+	if p.Code == CodeAccessRequest {
+		p.setMessageAuthenticator(secret)
+		return p.encode()
+	}
+	p.Authenticator = [16]byte{}
+	if bs, err = p.encode(); err != nil {
+		return
+	}
+	copy(p.Authenticator[:], packetHash(bs, secret))
+	copy(bs[4:HeaderLen], p.Authenticator[:])
+	return
+}
+
+// EncodeResponse 编码对 request 的回复，Response Authenticator 按 RFC 2865 3 计算
+func (p *Packet) EncodeResponse(secret string, request *Packet) (bs []byte, err error) {
+	p.Identifier = request.Identifier
+	p.Authenticator = request.Authenticator
+	if _, ok := p.Get(AttrMessageAuthenticator); ok || p.Code != CodeAccountingResponse {
+		p.setMessageAuthenticator(secret)
+	}
+	if bs, err = p.encode(); err != nil {
+		return
+	}
+	copy(p.Authenticator[:], packetHash(bs, secret))
+	copy(bs[4:HeaderLen], p.Authenticator[:])
+	return
+}
+
+// setMessageAuthenticator 计算 HMAC-MD5 时 Authenticator 为请求的 Authenticator，属性值先置零
+func (p *Packet) setMessageAuthenticator(secret string) {
+	attrs := p.Attributes[:0:0]
+	for _, a := range p.Attributes {
+		if a.Type != AttrMessageAuthenticator {
+			attrs = append(attrs, a)
+		}
+	}
+	p.Attributes = append(attrs, Attribute{Type: AttrMessageAuthenticator, Value: make([]byte, 16)})
+	bs, err := p.encode()
+	if err != nil {
+		return
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(bs)
+	copy(p.Attributes[len(p.Attributes)-1].Value, mac.Sum(nil))
+}
+
+func packetHash(bs []byte, secret string) []byte {
+	h := md5.New()
+	h.Write(bs)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+// Decode 解析报文，不校验 Authenticator
+func Decode(bs []byte) (p *Packet, err error) {
+	if len(bs) < HeaderLen {
+		err = errors.New("invalid radius packet length")
+		return
+	}
+	length := int(binary.BigEndian.Uint16(bs[2:4]))
+	if length < HeaderLen || length > MaxPacketLen || len(bs) < length {
+		err = errors.New("invalid radius length field")
+		return
+	}
+	p = &Packet{Code: Code(bs[0]), Identifier: bs[1]}
+	copy(p.Authenticator[:], bs[4:HeaderLen])
+	attrs := bs[HeaderLen:length]
+	for len(attrs) > 0 {
+		if len(attrs) < 2 || attrs[1] < 2 || int(attrs[1]) > len(attrs) {
+			return nil, errors.New("invalid radius attribute length")
+		}
+		p.Add(AttributeType(attrs[0]), append([]byte(nil), attrs[2:attrs[1]]...))
+		attrs = attrs[attrs[1]:]
+	}
+	return
+}
+
+// VerifyResponse 校验 bs 是否为对 request 的合法回复，有 Message-Authenticator 时一并校验
+func VerifyResponse(bs []byte, request *Packet, secret string) bool {
+	if len(bs) < HeaderLen || bs[1] != request.Identifier {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(bs[2:4]))
+	if length < HeaderLen || len(bs) < length {
+		return false
+	}
+	bs = append([]byte(nil), bs[:length]...)
+	expected := append([]byte(nil), bs[4:HeaderLen]...)
+	copy(bs[4:HeaderLen], request.Authenticator[:])
+	if !hmac.Equal(expected, packetHash(bs, secret)) {
+		return false
+	}
+	return verifyMessageAuthenticator(bs, secret)
+}
+
+// VerifyRequest 校验收到的请求：Accounting-Request 校验 Authenticator，Access-Request 校验 Message-Authenticator
+func VerifyRequest(bs []byte, secret string) bool {
+	if len(bs) < HeaderLen {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(bs[2:4]))
+	if length < HeaderLen || len(bs) < length {
+		return false
+	}
+	bs = append([]byte(nil), bs[:length]...)
+	if Code(bs[0]) == CodeAccessRequest {
+		return verifyMessageAuthenticator(bs, secret)
+	}
+	expected := append([]byte(nil), bs[4:HeaderLen]...)
+	copy(bs[4:HeaderLen], make([]byte, 16))
+	return hmac.Equal(expected, packetHash(bs, secret))
+}
+
+// verifyMessageAuthenticator bs 中的 Authenticator 需已替换为请求的 Authenticator，没有该属性时视为通过
+func verifyMessageAuthenticator(bs []byte, secret string) bool {
+	for i := HeaderLen; i+2 <= len(bs) && bs[i+1] >= 2; i += int(bs[i+1]) {
+		if AttributeType(bs[i]) != AttrMessageAuthenticator {
+			continue
+		}
+		if bs[i+1] != 18 || i+18 > len(bs) {
+			return false
+		}
+		expected := append([]byte(nil), bs[i+2:i+18]...)
+		zeroed := append([]byte(nil), bs...)
+		copy(zeroed[i+2:i+18], make([]byte, 16))
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(zeroed)
+		return hmac.Equal(expected, mac.Sum(nil))
+	}
+	return true
+}
+
+// EncryptPassword 按 RFC 2865 5.2 隐藏 User-Password
+func EncryptPassword(password []byte, secret string, authenticator [16]byte) []byte {
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+	last := authenticator[:]
+	for i := 0; i < len(padded); i += 16 {
+		h := md5.Sum(append([]byte(secret), last...))
+		for j := 0; j < 16; j++ {
+			padded[i+j] ^= h[j]
+		}
+		last = padded[i : i+16]
+	}
+	return padded
+}
+
+// DecryptPassword EncryptPassword 的逆运算，去掉末尾的填充
+func DecryptPassword(hidden []byte, secret string, authenticator [16]byte) []byte {
+	if len(hidden) == 0 || len(hidden)%16 != 0 {
+		return nil
+	}
+	password := make([]byte, len(hidden))
+	last := authenticator[:]
+	for i := 0; i < len(hidden); i += 16 {
+		h := md5.Sum(append([]byte(secret), last...))
+		for j := 0; j < 16; j++ {
+			password[i+j] = hidden[i+j] ^ h[j]
+		}
+		last = hidden[i : i+16]
+	}
+	return bytes.TrimRight(password, "\x00")
+}
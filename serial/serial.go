@@ -0,0 +1,13 @@
+// Package serial 打开串口或 pty 并设置为 raw 模式，用于在异步链路上承载 PPP（RFC 1662）。
+//
+// 成帧由 ppp.AppendHDLC 和 ppp.HDLCReader 处理，本包只负责设备本身。
+package serial
+
+import "io"
+
+// Device 串口或 pty 主设备，Close 后阻塞中的 Read 返回错误
+type Device interface {
+	io.ReadWriteCloser
+	// Name 设备路径，pty 为对端需要打开的从设备路径
+	Name() string
+}
@@ -0,0 +1,157 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+package serial
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ptmx = "/dev/ptmx"
+	// cbaud、crtscts 波特率掩码和硬件流控，syscall 中没有定义，mips/ppc/sparc 的取值不同，不在支持范围内
+	cbaud   = 0x100f
+	crtscts = 0x80000000
+)
+
+// 支持的波特率
+var speeds = map[int]uint32{
+	9600:    syscall.B9600,
+	19200:   syscall.B19200,
+	38400:   syscall.B38400,
+	57600:   syscall.B57600,
+	115200:  syscall.B115200,
+	230400:  syscall.B230400,
+	460800:  syscall.B460800,
+	921600:  syscall.B921600,
+	1000000: syscall.B1000000,
+}
+
+// Port Linux 串口或 pty
+type Port struct {
+	name string
+	file *os.File
+	// slave pty 的从设备，本端一直打开，对端关闭后主设备的 Read 不会返回 EIO
+	slave *os.File
+}
+
+// Open 打开串口设备并设置为 raw 模式（8N1，无流控，忽略调制解调器控制线），baud 为 0 时不修改波特率
+func Open(path string, baud int) (p *Port, err error) {
+	speed, ok := speeds[baud]
+	if baud != 0 && !ok {
+		err = fmt.Errorf("unsupported baud rate %d", baud)
+		return
+	}
+	// O_NONBLOCK 避免打开时等待载波，同时让 runtime poller 管理文件描述符，Close 时才能唤醒阻塞中的 Read
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	if err = makeRaw(fd, speed); err != nil {
+		_ = syscall.Close(fd)
+		return
+	}
+	p = &Port{name: path, file: os.NewFile(uintptr(fd), path)}
+	return
+}
+
+// OpenPty 创建一对 pty 并返回主设备，对端（例如 pppd）打开 Name 返回的从设备
+func OpenPty() (p *Port, err error) {
+	fd, err := syscall.Open(ptmx, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	var unlock int32
+	var n uint32
+	if err = ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err == nil {
+		err = ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err == nil {
+		err = makeRaw(fd, 0)
+	}
+	if err != nil {
+		_ = syscall.Close(fd)
+		return
+	}
+	name := "/dev/pts/" + strconv.Itoa(int(n))
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err == nil {
+		// 对端打开之前写入的数据不能被从设备的行规程回显
+		err = makeRawFile(slave)
+	}
+	if err != nil {
+		if slave != nil {
+			_ = slave.Close()
+		}
+		_ = syscall.Close(fd)
+		return
+	}
+	p = &Port{name: name, file: os.NewFile(uintptr(fd), ptmx), slave: slave}
+	return
+}
+
+func (p *Port) Name() string {
+	return p.name
+}
+
+func (p *Port) Read(b []byte) (int, error) {
+	return p.file.Read(b)
+}
+
+func (p *Port) Write(b []byte) (int, error) {
+	return p.file.Write(b)
+}
+
+func (p *Port) Close() error {
+	if p.slave != nil {
+		_ = p.slave.Close()
+	}
+	return p.file.Close()
+}
+
+// makeRaw 同 cfmakeraw，并打开 CLOCAL 和 CREAD，speed 不为 0 时设置波特率
+func makeRaw(fd int, speed uint32) error {
+	var t syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB | crtscts
+	t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if speed != 0 {
+		t.Cflag &^= cbaud
+		t.Cflag |= speed
+		t.Ispeed = speed
+		t.Ospeed = speed
+	}
+	return ioctl(fd, syscall.TCSETS, unsafe.Pointer(&t))
+}
+
+func makeRawFile(f *os.File) error {
+	c, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var rawErr error
+	if err = c.Control(func(fd uintptr) {
+		rawErr = makeRaw(int(fd), 0)
+	}); err != nil {
+		return err
+	}
+	return rawErr
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
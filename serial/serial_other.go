@@ -0,0 +1,34 @@
+//go:build !(linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x))
+
+package serial
+
+import "errors"
+
+var errUnsupported = errors.New("serial ports are not supported on this platform")
+
+// Port 当前平台不支持串口，Open 和 OpenPty 总是返回错误
+type Port struct{}
+
+func Open(path string, baud int) (*Port, error) {
+	return nil, errUnsupported
+}
+
+func OpenPty() (*Port, error) {
+	return nil, errUnsupported
+}
+
+func (p *Port) Name() string {
+	return ""
+}
+
+func (p *Port) Read(b []byte) (int, error) {
+	return 0, errUnsupported
+}
+
+func (p *Port) Write(b []byte) (int, error) {
+	return 0, errUnsupported
+}
+
+func (p *Port) Close() error {
+	return nil
+}
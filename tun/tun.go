@@ -0,0 +1,17 @@
+package tun
+
+import "net"
+
+// Device 三层 TUN 设备，每次 Read/Write 一个不带包信息头的 IPv4/IPv6 报文。
+// Close 后阻塞中的 Read 返回错误。
+type Device interface {
+	Name() string
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	Close() error
+}
+
+// PointToPoint 可以设置点对点地址的设备
+type PointToPoint interface {
+	SetPointToPoint(local net.IP, peer net.IP) error
+}
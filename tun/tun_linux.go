@@ -0,0 +1,161 @@
+//go:build linux
+
+package tun
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const cloneDevice = "/dev/net/tun"
+
+type ifreqFlags struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+type ifreqMTU struct {
+	Name [syscall.IFNAMSIZ]byte
+	MTU  int32
+	_    [20]byte
+}
+
+type ifreqAddr struct {
+	Name [syscall.IFNAMSIZ]byte
+	Addr syscall.RawSockaddrInet4
+	_    [8]byte
+}
+
+// Tun Linux TUN 设备
+type Tun struct {
+	name string
+	file *os.File
+}
+
+// Open 创建或打开名为 name 的 TUN 设备并启用，name 为空时由内核分配（tun0、tun1…）。
+// mtu 大于 0 时设置设备 MTU。需要 CAP_NET_ADMIN 权限。
+func Open(name string, mtu int) (t *Tun, err error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		err = errors.New("invalid tun name " + name)
+		return
+	}
+	fd, err := syscall.Open(cloneDevice, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	var req ifreqFlags
+	copy(req.Name[:], name)
+	req.Flags = syscall.IFF_TUN | syscall.IFF_NO_PI
+	if err = ioctl(fd, syscall.TUNSETIFF, unsafe.Pointer(&req)); err != nil {
+		_ = syscall.Close(fd)
+		return
+	}
+	// 非阻塞的文件描述符交给 runtime poller 管理，Close 时才能唤醒阻塞中的 Read
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return
+	}
+	t = &Tun{
+		name: string(bytes.TrimRight(req.Name[:], "\x00")),
+		file: os.NewFile(uintptr(fd), cloneDevice),
+	}
+	if mtu > 0 {
+		err = t.setMTU(mtu)
+	}
+	if err == nil {
+		err = t.setUp()
+	}
+	if err != nil {
+		_ = t.Close()
+		t = nil
+	}
+	return
+}
+
+func (t *Tun) Name() string {
+	return t.name
+}
+
+func (t *Tun) Read(p []byte) (int, error) {
+	return t.file.Read(p)
+}
+
+func (t *Tun) Write(p []byte) (int, error) {
+	return t.file.Write(p)
+}
+
+func (t *Tun) Close() error {
+	return t.file.Close()
+}
+
+// SetPointToPoint 设置本端和对端 IPv4 地址，内核会自动添加到对端的主机路由
+func (t *Tun) SetPointToPoint(local net.IP, peer net.IP) error {
+	return ConfigurePointToPoint(t.name, local, peer)
+}
+
+func (t *Tun) setMTU(mtu int) error {
+	var req ifreqMTU
+	copy(req.Name[:], t.name)
+	req.MTU = int32(mtu)
+	return ctl(syscall.SIOCSIFMTU, unsafe.Pointer(&req))
+}
+
+func (t *Tun) setUp() error {
+	return setUp(t.name)
+}
+
+// ConfigurePointToPoint 为任意点对点网卡（如 ppp0）设置本端和对端 IPv4 地址并启用
+func ConfigurePointToPoint(name string, local net.IP, peer net.IP) (err error) {
+	if err = setAddr(name, syscall.SIOCSIFADDR, local); err != nil {
+		return
+	}
+	if err = setAddr(name, syscall.SIOCSIFDSTADDR, peer); err != nil {
+		return
+	}
+	return setUp(name)
+}
+
+func setUp(name string) (err error) {
+	var req ifreqFlags
+	copy(req.Name[:], name)
+	if err = ctl(syscall.SIOCGIFFLAGS, unsafe.Pointer(&req)); err != nil {
+		return
+	}
+	req.Flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	return ctl(syscall.SIOCSIFFLAGS, unsafe.Pointer(&req))
+}
+
+func setAddr(name string, request uintptr, ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return errors.New("invalid ipv4 address " + ip.String())
+	}
+	var req ifreqAddr
+	copy(req.Name[:], name)
+	req.Addr.Family = syscall.AF_INET
+	copy(req.Addr.Addr[:], ip4)
+	return ctl(request, unsafe.Pointer(&req))
+}
+
+// ctl 接口配置类的 ioctl 需要在任意一个 socket 上调用
+func ctl(request uintptr, arg unsafe.Pointer) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return ioctl(fd, request, arg)
+}
+
+func ioctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
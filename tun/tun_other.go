@@ -0,0 +1,41 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"net"
+)
+
+var errUnsupported = errors.New("tun devices are only supported on linux")
+
+// Tun 非 Linux 平台不支持 TUN 设备，Open 总是返回错误
+type Tun struct{}
+
+func Open(name string, mtu int) (*Tun, error) {
+	return nil, errUnsupported
+}
+
+func (t *Tun) Name() string {
+	return ""
+}
+
+func (t *Tun) Read(p []byte) (int, error) {
+	return 0, errUnsupported
+}
+
+func (t *Tun) Write(p []byte) (int, error) {
+	return 0, errUnsupported
+}
+
+func (t *Tun) Close() error {
+	return nil
+}
+
+func (t *Tun) SetPointToPoint(local net.IP, peer net.IP) error {
+	return errUnsupported
+}
+
+func ConfigurePointToPoint(name string, local net.IP, peer net.IP) error {
+	return errUnsupported
+}
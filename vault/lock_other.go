@@ -0,0 +1,31 @@
+//go:build !windows
+
+package vault
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile 以 flock 独占锁住 path 旁边的 .lock 文件，阻塞到拿到锁
+func lockFile(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return
+	}
+	unlock = func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}
+	return
+}
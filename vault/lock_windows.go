@@ -0,0 +1,38 @@
+//go:build windows
+
+package vault
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// lockTimeout 等待其他进程释放锁的最长时间
+const lockTimeout = 10 * time.Second
+
+// errorSharingViolation ERROR_SHARING_VIOLATION，syscall 包中没有定义
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile 以不共享的方式打开 path 旁边的 .lock 文件作为独占锁，其他进程打开时共享冲突，重试到 lockTimeout
+func lockFile(path string) (unlock func(), err error) {
+	name, err := syscall.UTF16PtrFromString(path + ".lock")
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		var h syscall.Handle
+		h, err = syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+		if err == nil {
+			unlock = func() {
+				_ = syscall.CloseHandle(h)
+			}
+			return
+		}
+		if !errors.Is(err, errorSharingViolation) || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,338 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FileVersion 加密文件格式的版本号
+const FileVersion = 1
+
+// DefaultIterations 新建文件时 PBKDF2-HMAC-SHA256 的迭代次数
+const DefaultIterations = 600000
+
+// 读取文件时允许的迭代次数。过小时口令容易被穷举，过大时篡改过的文件会让 Open 长时间占用 CPU
+const (
+	MinIterations = 100000
+	MaxIterations = 10000000
+)
+
+// 导出格式
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+var (
+	// ErrBadPassphrase 口令错误或文件被篡改
+	ErrBadPassphrase = errors.New("vault: wrong passphrase or corrupted file")
+	ErrNotFound      = errors.New("vault: credential not found")
+)
+
+// Credential 一次捕获到的凭据
+type Credential struct {
+	ID         string    `json:"id"`
+	CapturedAt time.Time `json:"captured_at"`
+	// Adapter 捕获凭据的本地网卡 MAC
+	Adapter string `json:"adapter"`
+	PeerMac string `json:"peer_mac"`
+	Vlan    string `json:"vlan,omitempty"`
+	// Method 认证方式 pap 或 chap。CHAP 没有明文密码，捕获时不保存
+	Method   string `json:"method"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	// Fingerprint 认证方式、账号和密码的摘要，同一凭据文件中同一账号多次捕获时相同，可以在不导出密码的情况下去重
+	Fingerprint string `json:"fingerprint"`
+}
+
+// file 磁盘上的文件格式，Data 为凭据列表 JSON 经 AES-256-GCM 加密后的密文
+type file struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// Vault 加密保存凭据的文件，密钥由口令经 PBKDF2 派生。每次修改都整体重写文件，可以并发调用。
+// 修改时持有文件锁（同目录下的 .lock 文件）并重新读取文件，多个进程同时写入同一文件不会丢失凭据。
+type Vault struct {
+	path string
+
+	mu          sync.Mutex
+	key         []byte
+	fpKey       []byte
+	salt        []byte
+	iterations  int
+	credentials []Credential
+}
+
+// Open 打开凭据文件，文件不存在时创建一个空的。口令错误时返回 ErrBadPassphrase。
+func Open(path string, passphrase string) (v *Vault, err error) {
+	if passphrase == "" {
+		err = errors.New("vault: empty passphrase")
+		return
+	}
+	v = &Vault{path: path}
+	// 持有文件锁，避免两个进程同时创建文件
+	unlock, err := lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	f, err := readFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		v.salt = make([]byte, 16)
+		if _, err = rand.Read(v.salt); err != nil {
+			return nil, err
+		}
+		v.iterations = DefaultIterations
+		if err = v.setKey(passphrase); err != nil {
+			return nil, err
+		}
+		if err = v.save(nil); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.salt = f.Salt
+	v.iterations = f.Iterations
+	if err = v.setKey(passphrase); err != nil {
+		return nil, err
+	}
+	if v.credentials, err = v.decrypt(f); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// setKey 由口令、salt 和迭代次数派生加密密钥，指纹使用由加密密钥派生的另一个密钥
+func (v *Vault) setKey(passphrase string) (err error) {
+	if v.key, err = deriveKey(passphrase, v.salt, v.iterations); err != nil {
+		return
+	}
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte("pppoe-probe vault fingerprint"))
+	v.fpKey = mac.Sum(nil)
+	return
+}
+
+// Fingerprint 计算凭据摘要：以凭据文件密钥派生的密钥计算 HMAC-SHA256(method \0 username \0 password)，取前 8 字节。
+// 没有口令时无法由摘要穷举密码，不同凭据文件中同一凭据的摘要不同
+func (v *Vault) Fingerprint(method string, username string, password string) string {
+	mac := hmac.New(sha256.New, v.fpKey)
+	mac.Write([]byte(method + "\x00" + username + "\x00" + password))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Add 保存一条凭据，ID、CapturedAt 为空时自动填充，Fingerprint 总是重新计算，返回保存后的凭据
+func (v *Vault) Add(c Credential) (Credential, error) {
+	if c.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return c, err
+		}
+		c.ID = hex.EncodeToString(id)
+	}
+	if c.CapturedAt.IsZero() {
+		c.CapturedAt = time.Now()
+	}
+	c.Fingerprint = v.Fingerprint(c.Method, c.Username, c.Password)
+	err := v.update(func(credentials []Credential) ([]Credential, error) {
+		return append(credentials, c), nil
+	})
+	return c, err
+}
+
+// List 按捕获时间返回所有凭据，为打开文件或本进程上次修改时从文件中读到的内容
+func (v *Vault) List() []Credential {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]Credential(nil), v.credentials...)
+}
+
+// Delete 删除指定 ID 的凭据
+func (v *Vault) Delete(id string) error {
+	return v.update(func(credentials []Credential) ([]Credential, error) {
+		for i, c := range credentials {
+			if c.ID == id {
+				return append(credentials[:i:i], credentials[i+1:]...), nil
+			}
+		}
+		return nil, ErrNotFound
+	})
+}
+
+// update 持有文件锁，重新读取文件得到最新的凭据，经 f 修改后写回。f 返回错误时不写入
+func (v *Vault) update(f func(credentials []Credential) ([]Credential, error)) (err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	unlock, err := lockFile(v.path)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	credentials := v.credentials
+	// 文件被删除时以本进程的凭据重建
+	if vf, readErr := readFile(v.path); readErr == nil {
+		if credentials, err = v.decrypt(vf); err != nil {
+			return
+		}
+	} else if !errors.Is(readErr, os.ErrNotExist) {
+		return readErr
+	}
+	credentials, err = f(append([]Credential(nil), credentials...))
+	if err != nil {
+		return
+	}
+	if err = v.save(credentials); err != nil {
+		return
+	}
+	v.credentials = credentials
+	return
+}
+
+// readFile 读取并检查文件格式，不解密
+func readFile(path string) (f file, err error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(bs, &f); err != nil {
+		err = fmt.Errorf("vault: invalid file: %w", err)
+		return
+	}
+	if f.Version != FileVersion || f.KDF != "pbkdf2-sha256" {
+		err = fmt.Errorf("vault: unsupported file version %d kdf %s", f.Version, f.KDF)
+		return
+	}
+	if f.Iterations < MinIterations || f.Iterations > MaxIterations {
+		err = fmt.Errorf("vault: iterations %d out of range [%d, %d]", f.Iterations, MinIterations, MaxIterations)
+	}
+	return
+}
+
+// decrypt 解密文件中的凭据列表，密钥不匹配时返回 ErrBadPassphrase
+func (v *Vault) decrypt(f file) (credentials []Credential, err error) {
+	gcm, err := newGCM(v.key)
+	if err != nil {
+		return
+	}
+	plain, err := gcm.Open(nil, f.Nonce, f.Data, f.Salt)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	if err = json.Unmarshal(plain, &credentials); err != nil {
+		return nil, fmt.Errorf("vault: invalid credentials: %w", err)
+	}
+	// 旧版本保存的是不带密钥的摘要，读取时一律重新计算
+	for i := range credentials {
+		c := &credentials[i]
+		c.Fingerprint = v.Fingerprint(c.Method, c.Username, c.Password)
+	}
+	return
+}
+
+// Export 以明文导出所有凭据：json 为每行一个 Credential，csv 带表头
+func (v *Vault) Export(w io.Writer, format string) error {
+	credentials := v.List()
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		for _, c := range credentials {
+			if err := enc.Encode(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"id", "captured_at", "adapter", "peer_mac", "vlan", "method", "username", "password", "fingerprint"})
+		for _, c := range credentials {
+			_ = cw.Write([]string{c.ID, c.CapturedAt.Format(time.RFC3339), c.Adapter, c.PeerMac, c.Vlan, c.Method, c.Username, c.Password, c.Fingerprint})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return errors.New("vault: unknown export format " + format)
+}
+
+// save 加密后写入临时文件再改名，避免写到一半时损坏原文件。调用方需持有文件锁
+func (v *Vault) save(credentials []Credential) (err error) {
+	plain, err := json.Marshal(credentials)
+	if err != nil {
+		return
+	}
+	gcm, err := newGCM(v.key)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	bs, err := json.Marshal(file{
+		Version:    FileVersion,
+		KDF:        "pbkdf2-sha256",
+		Iterations: v.iterations,
+		Salt:       v.salt,
+		Nonce:      nonce,
+		Data:       gcm.Seal(nil, nonce, plain, v.salt),
+	})
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), filepath.Base(v.path)+".tmp*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(bs); err != nil {
+		_ = tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp.Name(), 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), v.path)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey PBKDF2-HMAC-SHA256（RFC 8018），输出 32 字节的 AES-256 密钥
+func deriveKey(passphrase string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+}
+
+// String 便于日志输出，不包含密码
+func (c Credential) String() string {
+	return c.ID + " " + c.CapturedAt.Format(time.RFC3339) + " " + c.PeerMac + " " + c.Method + " " + strconv.Quote(c.Username) + " " + c.Fingerprint
+}
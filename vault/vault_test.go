@@ -0,0 +1,144 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	// RFC 7914 11 中 PBKDF2-HMAC-SHA256 的测试向量，取前 32 字节
+	key, err := deriveKey("passwd", []byte("salt"), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc", hex.EncodeToString(key))
+	key, err = deriveKey("Password", []byte("NaCl"), 80000)
+	assert.Nil(t, err)
+	assert.Equal(t, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56", hex.EncodeToString(key))
+}
+
+func TestVault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "captures.vault")
+	v, err := Open(path, "correct horse")
+	assert.Nil(t, err)
+	alice, err := v.Add(Credential{Adapter: "00:11:22:33:44:55", PeerMac: "00:0c:29:8b:82:c5", Method: "pap", Username: "alice", Password: "secret"})
+	assert.Nil(t, err)
+	assert.Equal(t, v.Fingerprint("pap", "alice", "secret"), alice.Fingerprint)
+	bob, err := v.Add(Credential{PeerMac: "00:0c:29:8b:82:c6", Method: "chap", Username: "bob"})
+	assert.Nil(t, err)
+
+	bs, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(string(bs), "secret"))
+	assert.False(t, strings.Contains(string(bs), "alice"))
+
+	_, err = Open(path, "wrong")
+	assert.Equal(t, ErrBadPassphrase, err)
+
+	v, err = Open(path, "correct horse")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(v.List()))
+	assert.Nil(t, v.Delete(bob.ID))
+	assert.Equal(t, ErrNotFound, v.Delete(bob.ID))
+
+	v, err = Open(path, "correct horse")
+	assert.Nil(t, err)
+	credentials := v.List()
+	assert.Equal(t, 1, len(credentials))
+	assert.Equal(t, "secret", credentials[0].Password)
+
+	var sb strings.Builder
+	assert.Nil(t, v.Export(&sb, FormatCSV))
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, strings.HasPrefix(lines[1], alice.ID+","))
+	assert.True(t, strings.Contains(lines[1], ",alice,secret,"))
+}
+
+func TestVault_Iterations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "captures.vault")
+	_, err := Open(path, "correct horse")
+	assert.Nil(t, err)
+	bs, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	var f file
+	assert.Nil(t, json.Unmarshal(bs, &f))
+	assert.Equal(t, DefaultIterations, f.Iterations)
+
+	// 文件中的迭代次数超出范围时拒绝打开，不派生密钥
+	for _, iterations := range []int{0, MinIterations - 1, MaxIterations + 1} {
+		f.Iterations = iterations
+		bs, err = json.Marshal(f)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(path, bs, 0600))
+		_, err = Open(path, "correct horse")
+		assert.NotNil(t, err, iterations)
+		assert.NotEqual(t, ErrBadPassphrase, err)
+	}
+}
+
+func TestVault_Fingerprint(t *testing.T) {
+	dir := t.TempDir()
+	v1, err := Open(filepath.Join(dir, "a.vault"), "correct horse")
+	assert.Nil(t, err)
+	v2, err := Open(filepath.Join(dir, "b.vault"), "correct horse")
+	assert.Nil(t, err)
+
+	// 同一文件中同一凭据的摘要相同，不同文件（不同盐）不同，也不是无密钥的 SHA-256
+	fp := v1.Fingerprint("pap", "alice", "secret")
+	assert.Len(t, fp, 16)
+	assert.Equal(t, fp, v1.Fingerprint("pap", "alice", "secret"))
+	assert.NotEqual(t, fp, v1.Fingerprint("pap", "alice", "secret2"))
+	assert.NotEqual(t, fp, v2.Fingerprint("pap", "alice", "secret"))
+	sum := sha256.Sum256([]byte("pap\x00alice\x00secret"))
+	assert.NotEqual(t, hex.EncodeToString(sum[:8]), fp)
+
+	// 传入的摘要不可信，总是重新计算；重新打开后不变
+	c, err := v1.Add(Credential{Method: "pap", Username: "alice", Password: "secret", Fingerprint: "0000000000000000"})
+	assert.Nil(t, err)
+	assert.Equal(t, fp, c.Fingerprint)
+	v1, err = Open(filepath.Join(dir, "a.vault"), "correct horse")
+	assert.Nil(t, err)
+	assert.Equal(t, fp, v1.List()[0].Fingerprint)
+}
+
+// 两个进程打开同一文件分别写入，各自的凭据都不会丢失
+func TestVault_ConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "captures.vault")
+	a, err := Open(path, "correct horse")
+	assert.Nil(t, err)
+	b, err := Open(path, "correct horse")
+	assert.Nil(t, err)
+
+	const n = 10
+	var wg sync.WaitGroup
+	for _, v := range []*Vault{a, b} {
+		wg.Add(1)
+		go func(v *Vault) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				_, err := v.Add(Credential{Method: "pap", Username: "user" + strconv.Itoa(i), Password: "secret"})
+				assert.Nil(t, err)
+			}
+		}(v)
+	}
+	wg.Wait()
+
+	c, err := Open(path, "correct horse")
+	assert.Nil(t, err)
+	credentials := c.List()
+	assert.Len(t, credentials, 2*n)
+
+	// 删除时同样基于文件中的最新内容
+	assert.Nil(t, a.Delete(credentials[len(credentials)-1].ID))
+	c, err = Open(path, "correct horse")
+	assert.Nil(t, err)
+	assert.Len(t, c.List(), 2*n-1)
+	assert.Equal(t, ErrNotFound, b.Delete(credentials[len(credentials)-1].ID))
+}